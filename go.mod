@@ -3,24 +3,27 @@ module github.com/Apiara/ApiaraCDN
 go 1.19
 
 require (
-	github.com/BurntSushi/toml v1.2.1 // indirect
+	github.com/BurntSushi/toml v1.2.1
+	github.com/etherlabsio/go-m3u8 v1.0.0
+	github.com/go-redis/redis/v8 v8.11.5
+	github.com/google/go-cmp v0.5.9
+	github.com/gorilla/websocket v1.5.0
+	github.com/influxdata/influxdb-client-go/v2 v2.12.0
+	github.com/lib/pq v1.10.7
+	github.com/oschwald/geoip2-golang v1.8.0
+	github.com/stretchr/testify v1.8.1
+)
+
+require (
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/deepmap/oapi-codegen v1.8.2 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/etherlabsio/go-m3u8 v1.0.0 // indirect
-	github.com/go-redis/redis/v8 v8.11.5 // indirect
-	github.com/google/go-cmp v0.5.9 // indirect
-	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/influxdata/influxdb v1.10.0 // indirect
-	github.com/influxdata/influxdb-client-go/v2 v2.12.0 // indirect
 	github.com/influxdata/line-protocol v0.0.0-20200327222509-2487e7298839 // indirect
-	github.com/lib/pq v1.10.7 // indirect
-	github.com/oschwald/geoip2-golang v1.8.0 // indirect
 	github.com/oschwald/maxminddb-golang v1.10.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.8.1 // indirect
 	golang.org/x/net v0.0.0-20220127200216-cd36cc0744dd // indirect
 	golang.org/x/sys v0.0.0-20220804214406-8e32c043e418 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
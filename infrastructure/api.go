@@ -5,17 +5,24 @@ const (
 
 	CrowServiceAPIPublishResource = "/publish"
 	CrowServiceAPIPurgeResource   = "/purge"
+
+	CrowServiceAPICoverageResource  = "/coverage"
+	CrowServiceAPIReconcileResource = "/reconcile"
 )
 
 const (
 	CyprusServiceAPIProcessResource = "/process"
 	CyprusServiceAPIStatusResource  = "/status"
 	CyprusServiceAPIDeleteResource  = "/delete"
+	CyprusServiceAPIJobsResource    = "/jobs"
+	CyprusServiceAPICancelResource  = "/cancel"
 
 	CyprusStorageAPIKeyResource              = "/key"
 	CyprusStorageAPIDataResource             = "/crypdata"
 	CyprusStorageAPIPartialMetadataResource  = "/metadata/partial"
 	CyprusStorageAPICompleteMetadataResource = "/metadata/complete"
+	CyprusStorageAPIProofResource            = "/proof"
+	CyprusStorageAPIPlaylistResource         = "/playlist"
 )
 
 const (
@@ -43,6 +50,8 @@ const (
 	DeusServiceAPIStaleReportResource = "/content/stale"
 	DeusServiceAPIPushResource        = "/content/push"
 	DeusServiceAPIPurgeResource       = "/content/purge"
+
+	DeusServiceAPIProcessCallbackResource = "/process/complete"
 )
 
 const (
@@ -87,6 +96,11 @@ const (
 	StateAPIGetContentSizeResource      = "/content/size/get"
 	StateAPICreateContentEntryResource  = "/content/create"
 	StateAPIDeleteContentEntryResource  = "/content/delete"
+	StateAPIGetContentListResource      = "/content/list"
+
+	// Shared resource reference counting
+	StateAPIAddResourceReferenceResource    = "/resource/reference/add"
+	StateAPIRemoveResourceReferenceResource = "/resource/reference/remove"
 
 	// Edge network server entry resources
 	StateAPICreateServerEntryResource       = "/server/create"
@@ -10,9 +10,29 @@ const (
 	ContentFunctionalIDParam = "functional_id"
 	ContentByteSizeParam     = "bytes"
 
+	EndpointIdentityParam  = "identity"
+	EndpointUptimeParam    = "uptime"
+	EndpointBandwidthParam = "bandwidth"
+
 	MMDBFileNameParam = "mmdb"
 
 	ContentRuleParam = "content_rule"
+
+	ProcessingCallbackParam = "callback"
+	LiveIngestParam         = "live"
+	UpdateIngestParam       = "update"
+
+	AccessTokenParam = "token"
+)
+
+// Header names used between services
+const (
+	PayloadSignatureHeader = "X-Apiara-Signature"
+	PayloadTimestampHeader = "X-Apiara-Timestamp"
+
+	CryptIVOffsetHeader   = "X-Apiara-IV-Offset"
+	CryptIVLengthHeader   = "X-Apiara-IV-Length"
+	CryptDataOffsetHeader = "X-Apiara-Data-Offset"
 )
 
 // Query names for services in Debugging/Testing mode
@@ -24,9 +44,19 @@ const (
 type ProcessingStatus string
 
 const (
-	RunningProcessing  ProcessingStatus = "running"
-	FailedProcessing   ProcessingStatus = "failed"
-	FinishedProcessing ProcessingStatus = "finished"
+	RunningProcessing   ProcessingStatus = "running"
+	FailedProcessing    ProcessingStatus = "failed"
+	FinishedProcessing  ProcessingStatus = "finished"
+	CancelledProcessing ProcessingStatus = "cancelled"
+)
+
+// Phase of a running cyprus data processing job
+type ProcessingPhase string
+
+const (
+	IngestPhase  ProcessingPhase = "ingest"
+	DigestPhase  ProcessingPhase = "digest"
+	PublishPhase ProcessingPhase = "publish"
 )
 
 // Directory subpaths for cyprus data storage
@@ -35,4 +65,6 @@ const (
 	CryptDataStorageDir = "/cryptdata/"
 	PartialMapDir       = "/mediamap/partial/"
 	CompleteMediaMapDir = "/mediamap/complete/"
+	IntegrityProofDir   = "/proof/"
+	PlaylistDir         = "/playlist/"
 )
@@ -13,6 +13,8 @@ type LocationAwareDataAllocator interface {
 	NewEntry(loc string, cid string, size int64) error
 	DelEntry(loc string, cid string) error
 	AllocateSpace(loc string, availableSpace int64) ([]string, error)
+	AllocateSpaceByQuality(loc string, availableSpace int64, score float64) ([]string, error)
+	Entries() map[string][]string
 }
 
 type DataAllocatorConstructor func(region string) (DataAllocator, error)
@@ -26,6 +28,7 @@ type CompoundLocationDataAllocator struct {
 	mutex           *sync.Mutex
 	locations       map[string]DataAllocator
 	entryCount      map[string]int
+	entries         map[string]map[string]struct{}
 }
 
 /*
@@ -38,52 +41,97 @@ func NewCompoundLocationDataAllocator(sizeClasses []int64, createAllocator DataA
 		mutex:           &sync.Mutex{},
 		locations:       make(map[string]DataAllocator),
 		entryCount:      make(map[string]int),
+		entries:         make(map[string]map[string]struct{}),
+	}
+}
+
+// releaseLocation drops a location once it no longer has entries. Caller must hold mutex
+func (c *CompoundLocationDataAllocator) releaseLocation(loc string) {
+	if c.entryCount[loc] == 0 {
+		delete(c.locations, loc)
+		delete(c.entryCount, loc)
+		delete(c.entries, loc)
 	}
 }
 
 // NewEntry creates a new (content, size) entry at a location
 func (c *CompoundLocationDataAllocator) NewEntry(loc string, cid string, size int64) error {
 	c.mutex.Lock()
-	var err error
-	var allocator DataAllocator
-	if subAlloc, ok := c.locations[loc]; ok {
-		allocator = subAlloc
-	} else {
-		c.locations[loc], err = c.createAllocator(loc)
-		if err != nil {
-			c.mutex.Unlock()
+	defer c.mutex.Unlock()
+
+	allocator, ok := c.locations[loc]
+	if !ok {
+		var err error
+		if allocator, err = c.createAllocator(loc); err != nil {
 			return err
 		}
+		c.locations[loc] = allocator
 		c.entryCount[loc] = 0
-		allocator = c.locations[loc]
+		c.entries[loc] = make(map[string]struct{})
 	}
-	c.entryCount[loc]++
-	c.mutex.Unlock()
 
-	return allocator.NewEntry(cid, size)
+	if err := allocator.NewEntry(cid, size); err != nil {
+		c.releaseLocation(loc)
+		return err
+	}
+	c.entryCount[loc]++
+	c.entries[loc][cid] = struct{}{}
+	return nil
 }
 
 // DelEntry removes a (content, size) entry from a location
 func (c *CompoundLocationDataAllocator) DelEntry(loc string, cid string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	allocator, ok := c.locations[loc]
+	if !ok {
+		return fmt.Errorf("failed to delete content entry at location(%s) since location non-existant", loc)
+	}
+	if err := allocator.DelEntry(cid); err != nil {
+		return err
+	}
+	c.entryCount[loc]--
+	delete(c.entries[loc], cid)
+	c.releaseLocation(loc)
+	return nil
+}
+
+// Entries returns a snapshot of the content entries at every location
+func (c *CompoundLocationDataAllocator) Entries() map[string][]string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	snapshot := make(map[string][]string)
+	for loc, entries := range c.entries {
+		snapshot[loc] = setToList(entries)
+	}
+	return snapshot
+}
+
+// AllocateSpace allocates content to an endpoint based on (location, available space)
+func (c *CompoundLocationDataAllocator) AllocateSpace(loc string, availableSpace int64) ([]string, error) {
 	c.mutex.Lock()
 	if allocator, ok := c.locations[loc]; ok {
-		c.entryCount[loc]--
-		if c.entryCount[loc] == 0 {
-			delete(c.locations, loc)
-			delete(c.entryCount, loc)
-		}
 		c.mutex.Unlock()
-		return allocator.DelEntry(cid)
+		return allocator.AllocateSpace(availableSpace)
 	}
 	c.mutex.Unlock()
-	return fmt.Errorf("failed to delete content entry at location(%s) since location non-existant", loc)
+	return nil, fmt.Errorf("failed to allocate space for content at location(%s) since location non-existant", loc)
 }
 
-// AllocateSpace allocates content to an endpoint based on (location, available space)
-func (c *CompoundLocationDataAllocator) AllocateSpace(loc string, availableSpace int64) ([]string, error) {
+/*
+AllocateSpaceByQuality allocates content to an endpoint based on (location, available space)
+weighted by the endpoints quality score. Falls back to AllocateSpace if the location's
+DataAllocator isn't quality aware
+*/
+func (c *CompoundLocationDataAllocator) AllocateSpaceByQuality(loc string, availableSpace int64, score float64) ([]string, error) {
 	c.mutex.Lock()
 	if allocator, ok := c.locations[loc]; ok {
 		c.mutex.Unlock()
+		if qualityAllocator, ok := allocator.(QualityAwareDataAllocator); ok {
+			return qualityAllocator.AllocateSpaceByQuality(availableSpace, score)
+		}
 		return allocator.AllocateSpace(availableSpace)
 	}
 	c.mutex.Unlock()
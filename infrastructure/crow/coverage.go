@@ -0,0 +1,211 @@
+package crow
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+)
+
+const (
+	// Number of time buckets allocation counts are spread across in a window
+	coverageWindowBuckets = 60
+)
+
+// AllocationRecorder represents an object that is informed of every allocation handed out
+type AllocationRecorder interface {
+	RecordAllocation(region string, fids []string)
+}
+
+// CoverageReporter represents an object that can report regional endpoint coverage
+type CoverageReporter interface {
+	Report() ([]RegionCoverage, error)
+}
+
+// CoverageState represents the network state needed to estimate regional coverage
+type CoverageState interface {
+	ServerList() ([]string, error)
+	GetServerPrivateAddress(sid string) (string, error)
+}
+
+/*
+UnderservedContent is content whose demand exceeds the endpoints holding it.
+Demand counts requests both served by holders and still unmet
+*/
+type UnderservedContent struct {
+	FunctionalID string `json:"fid"`
+	Demand       int64  `json:"demand"`
+	Holders      int64  `json:"holders"`
+}
+
+/*
+RegionCoverage estimates how much of a regions demand can be served by
+endpoints instead of the origin. Coverage is the fraction of demand that
+is matched by endpoints holding the requested content. Error is set instead
+when the demand of the region couldn't be retrieved
+*/
+type RegionCoverage struct {
+	Region      string               `json:"region"`
+	Coverage    float64              `json:"coverage"`
+	Demand      int64                `json:"demand"`
+	Allocations int64                `json:"allocations"`
+	Underserved []UnderservedContent `json:"underserved"`
+	Error       string               `json:"error,omitempty"`
+}
+
+/*
+CoverageEstimator implements AllocationRecorder by counting allocations per
+region over a sliding window and combines them with damocles demand to
+create per region coverage reports
+*/
+type CoverageEstimator struct {
+	state      CoverageState
+	client     *http.Client
+	bucketSize time.Duration
+
+	mutex   *sync.Mutex
+	buckets map[int64]map[string]map[string]int64
+}
+
+/*
+NewCoverageEstimator creates a new CoverageEstimator where endpoints are
+assumed to hold allocations for 'window' after receiving them
+*/
+func NewCoverageEstimator(state CoverageState, window time.Duration) *CoverageEstimator {
+	bucketSize := window / coverageWindowBuckets
+	if bucketSize <= 0 {
+		bucketSize = time.Second
+	}
+	return &CoverageEstimator{
+		state:      state,
+		client:     http.DefaultClient,
+		bucketSize: bucketSize,
+		mutex:      &sync.Mutex{},
+		buckets:    make(map[int64]map[string]map[string]int64),
+	}
+}
+
+// prune removes buckets that have left the window. Caller must hold mutex
+func (c *CoverageEstimator) prune(current int64) {
+	for bucket := range c.buckets {
+		if current-bucket >= coverageWindowBuckets {
+			delete(c.buckets, bucket)
+		}
+	}
+}
+
+// RecordAllocation counts an allocation of 'fids' to an endpoint in 'region'
+func (c *CoverageEstimator) RecordAllocation(region string, fids []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	current := time.Now().UnixNano() / int64(c.bucketSize)
+	c.prune(current)
+	if _, ok := c.buckets[current]; !ok {
+		c.buckets[current] = make(map[string]map[string]int64)
+	}
+	if _, ok := c.buckets[current][region]; !ok {
+		c.buckets[current][region] = make(map[string]int64)
+	}
+	for _, fid := range fids {
+		c.buckets[current][region][fid]++
+	}
+}
+
+// holders returns the allocation counts per functional ID for 'region' within the window
+func (c *CoverageEstimator) holders(region string) map[string]int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.prune(time.Now().UnixNano() / int64(c.bucketSize))
+	counts := make(map[string]int64)
+	for _, regions := range c.buckets {
+		for fid, count := range regions[region] {
+			counts[fid] += count
+		}
+	}
+	return counts
+}
+
+// regionCoverage creates the coverage report of a single region
+func (c *CoverageEstimator) regionCoverage(region string) (RegionCoverage, error) {
+	// Retrieve demand from region edge server
+	edgeServerAddr, err := c.state.GetServerPrivateAddress(region)
+	if err != nil {
+		return RegionCoverage{}, err
+	}
+	priorityAPI, err := url.JoinPath(edgeServerAddr, infra.DamoclesServiceAPIPriorityListResource)
+	if err != nil {
+		return RegionCoverage{}, err
+	}
+	demand := make(map[string]int64)
+	err = infra.MakeHTTPRequest(priorityAPI, url.Values{}, nil, c.client, infra.GOBBodyDecoder, &demand)
+	if err != nil {
+		return RegionCoverage{}, err
+	}
+
+	/* Priority scores are requests already net of allocations, so they are
+	the unmet demand of content and every holder serves demand on top of it */
+	holders := c.holders(region)
+	coverage := RegionCoverage{Region: region, Coverage: 1, Underserved: []UnderservedContent{}}
+	for fid, count := range holders {
+		coverage.Allocations += count
+		if demand[fid] <= 0 {
+			coverage.Demand += count
+		}
+	}
+	for fid, need := range demand {
+		if need <= 0 {
+			continue
+		}
+		coverage.Demand += need + holders[fid]
+		coverage.Underserved = append(coverage.Underserved, UnderservedContent{
+			FunctionalID: fid,
+			Demand:       need + holders[fid],
+			Holders:      holders[fid],
+		})
+	}
+	if coverage.Demand > 0 {
+		coverage.Coverage = float64(coverage.Allocations) / float64(coverage.Demand)
+	}
+
+	// Order underserved content by how far it is from being covered
+	sort.Slice(coverage.Underserved, func(i, j int) bool {
+		a, b := coverage.Underserved[i], coverage.Underserved[j]
+		if a.Demand-a.Holders != b.Demand-b.Holders {
+			return a.Demand-a.Holders > b.Demand-b.Holders
+		}
+		return a.FunctionalID < b.FunctionalID
+	})
+	return coverage, nil
+}
+
+/*
+Report creates a coverage report for every region on the network. A region
+whose demand can't be retrieved is reported with its error instead of
+failing the whole report
+*/
+func (c *CoverageEstimator) Report() ([]RegionCoverage, error) {
+	regions, err := c.state.ServerList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create coverage report: %w", err)
+	}
+	sort.Strings(regions)
+
+	report := make([]RegionCoverage, 0, len(regions))
+	for _, region := range regions {
+		coverage, err := c.regionCoverage(region)
+		if err != nil {
+			err = fmt.Errorf("failed to create coverage report for region(%s): %w", region, err)
+			log.Println(err)
+			coverage = RegionCoverage{Region: region, Underserved: []UnderservedContent{}, Error: err.Error()}
+		}
+		report = append(report, coverage)
+	}
+	return report, nil
+}
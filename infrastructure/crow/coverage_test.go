@@ -0,0 +1,76 @@
+package crow
+
+import (
+	"encoding/gob"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+	"github.com/Apiara/ApiaraCDN/infrastructure/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoverageEstimator(t *testing.T) {
+	// Start test edge server reporting demand
+	api := http.NewServeMux()
+	api.HandleFunc(infra.DamoclesServiceAPIPriorityListResource,
+		func(resp http.ResponseWriter, req *http.Request) {
+			demand := map[string]int64{"fid1": 4, "fid2": 2, "fid3": 0, "fid4": -3}
+			if err := gob.NewEncoder(resp).Encode(demand); err != nil {
+				resp.WriteHeader(http.StatusInternalServerError)
+			}
+		})
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	metadata := &mockStateMetadata{state.NewMockMicroserviceState(), map[string][]string{
+		"region1": {},
+		"region2": {},
+		"region3": {},
+	}}
+	metadata.CreateServerEntry("region1", server.URL, server.URL)
+	metadata.CreateServerEntry("region2", server.URL, server.URL)
+	metadata.CreateServerEntry("region3", unreachable.URL, unreachable.URL)
+
+	// Record allocations
+	estimator := NewCoverageEstimator(metadata, time.Minute)
+	estimator.RecordAllocation("region1", []string{"fid1", "fid2"})
+	estimator.RecordAllocation("region1", []string{"fid2", "fid3"})
+	estimator.RecordAllocation("region2", []string{"fid1"})
+
+	report, err := estimator.Report()
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, 3, len(report), "expected report for every region")
+
+	// region1: priority scores are unmet demand on top of the demand served by holders
+	assert.Equal(t, "region1", report[0].Region, "wrong region order")
+	assert.Equal(t, int64(10), report[0].Demand, "wrong demand")
+	assert.Equal(t, int64(4), report[0].Allocations, "wrong allocation count")
+	assert.Equal(t, 0.4, report[0].Coverage, "wrong coverage")
+	assert.Equal(t, []UnderservedContent{
+		{FunctionalID: "fid1", Demand: 5, Holders: 1},
+		{FunctionalID: "fid2", Demand: 4, Holders: 2},
+	}, report[0].Underserved, "wrong underserved list")
+	assert.Empty(t, report[0].Error, "expected no region error")
+
+	// region2: fid2 has no holders
+	assert.Equal(t, []UnderservedContent{
+		{FunctionalID: "fid1", Demand: 5, Holders: 1},
+		{FunctionalID: "fid2", Demand: 2, Holders: 0},
+	}, report[1].Underserved, "wrong underserved list")
+
+	// region3: an unreachable edge server doesn't fail the other regions
+	assert.Equal(t, "region3", report[2].Region, "wrong region order")
+	assert.NotEmpty(t, report[2].Error, "expected region error")
+
+	// Allocations leave the window
+	estimator = NewCoverageEstimator(metadata, coverageWindowBuckets*time.Millisecond)
+	estimator.RecordAllocation("region1", []string{"fid1"})
+	time.Sleep(coverageWindowBuckets * time.Millisecond * 2)
+	assert.Equal(t, 0, len(estimator.holders("region1")), "expected allocations to expire")
+}
@@ -0,0 +1,197 @@
+package crow
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+	"github.com/Apiara/ApiaraCDN/infrastructure/state"
+)
+
+const (
+	// Bounds the number of descriptors kept by a CyprusContentDescriber
+	descriptorCacheSize = 4096
+
+	// How long descriptors are reused when no TTL is configured
+	defaultDescriptorCacheTTL = 10 * time.Second
+)
+
+// DataObjectDescriptor describes a single downloadable piece of encrypted content
+type DataObjectDescriptor struct {
+	FunctionalID string `json:"fid"`
+	URL          string `json:"url"`
+	Checksum     string `json:"checksum"`
+}
+
+/*
+ContentDescriptor describes everything an endpoint needs to download
+and verify a piece of allocated content
+*/
+type ContentDescriptor struct {
+	FunctionalID string                 `json:"fid"`
+	ByteSize     int64                  `json:"bytes"`
+	MetadataURL  string                 `json:"metadata"`
+	Objects      []DataObjectDescriptor `json:"objects"`
+}
+
+/*
+ContentDescriber represents an object that can resolve a functional ID
+to the download descriptor of the content it identifies
+*/
+type ContentDescriber interface {
+	Describe(fid string) (ContentDescriptor, error)
+}
+
+/*
+partialMetadata covers both partial metadata formats published by cyprus.
+Raw media has a single checksum while VOD manifests list their segments
+*/
+type partialMetadata struct {
+	FunctionalID string `json:"fid"`
+	Checksum     string `json:"checksum"`
+	Segments     []struct {
+		FunctionalID string `json:"fid"`
+		Checksum     string `json:"checksum"`
+	} `json:"segments"`
+}
+
+// cachedDescriptor is a descriptor along with when it has to be described again
+type cachedDescriptor struct {
+	descriptor ContentDescriptor
+	expires    time.Time
+}
+
+/*
+CyprusContentDescriber implements ContentDescriber by combining content
+sizes from state with partial metadata published by the cyprus storage API.
+Descriptors are cached for a bounded time since live content keeps its
+functional ID while its partial metadata changes
+*/
+type CyprusContentDescriber struct {
+	metadata        state.ContentMetadataStateReader
+	client          *http.Client
+	metadataBaseURL string
+	dataBaseURL     string
+	cacheTTL        time.Duration
+
+	mutex *sync.RWMutex
+	cache map[string]cachedDescriptor
+}
+
+/*
+NewCyprusContentDescriber creates a new CyprusContentDescriber that
+resolves download locations against the storage API at storageAddr,
+reusing descriptors for cacheTTL
+*/
+func NewCyprusContentDescriber(storageAddr string, metadata state.ContentMetadataStateReader,
+	cacheTTL time.Duration) (*CyprusContentDescriber, error) {
+	metadataBaseURL, err := url.JoinPath(storageAddr, infra.CyprusStorageAPIPartialMetadataResource)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create partial metadata base URL: %w", err)
+	}
+	dataBaseURL, err := url.JoinPath(storageAddr, infra.CyprusStorageAPIDataResource)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create data base URL: %w", err)
+	}
+
+	if cacheTTL <= 0 {
+		cacheTTL = defaultDescriptorCacheTTL
+	}
+	return &CyprusContentDescriber{
+		metadata:        metadata,
+		client:          http.DefaultClient,
+		metadataBaseURL: metadataBaseURL,
+		dataBaseURL:     dataBaseURL,
+		cacheTTL:        cacheTTL,
+		mutex:           &sync.RWMutex{},
+		cache:           make(map[string]cachedDescriptor),
+	}, nil
+}
+
+/*
+cacheDescriptor caches descriptor, making room by dropping expired descriptors
+and then the oldest one once the cache is full. Caller must hold mutex
+*/
+func (c *CyprusContentDescriber) cacheDescriptor(descriptor ContentDescriptor, now time.Time) {
+	if len(c.cache) >= descriptorCacheSize {
+		oldest := ""
+		for fid, cached := range c.cache {
+			if !now.Before(cached.expires) {
+				delete(c.cache, fid)
+			} else if oldest == "" || cached.expires.Before(c.cache[oldest].expires) {
+				oldest = fid
+			}
+		}
+		if len(c.cache) >= descriptorCacheSize {
+			delete(c.cache, oldest)
+		}
+	}
+	c.cache[descriptor.FunctionalID] = cachedDescriptor{descriptor: descriptor, expires: now.Add(c.cacheTTL)}
+}
+
+// fetchPartialMetadata downloads and decodes the partial metadata at metadataURL
+func (c *CyprusContentDescriber) fetchPartialMetadata(metadataURL string) (partialMetadata, error) {
+	var mdata partialMetadata
+	err := infra.MakeHTTPRequest(metadataURL, url.Values{}, nil, c.client, infra.JSONBodyDecoder, &mdata)
+	return mdata, err
+}
+
+// Describe returns the download descriptor for 'fid'
+func (c *CyprusContentDescriber) Describe(fid string) (ContentDescriptor, error) {
+	now := time.Now()
+	c.mutex.RLock()
+	cached, ok := c.cache[fid]
+	c.mutex.RUnlock()
+	if ok && now.Before(cached.expires) {
+		return cached.descriptor, nil
+	}
+
+	// Lookup content size
+	errMsg := "failed to describe content(%s): %w"
+	cid, err := c.metadata.GetContentID(fid)
+	if err != nil {
+		return ContentDescriptor{}, fmt.Errorf(errMsg, fid, err)
+	}
+	size, err := c.metadata.GetContentSize(cid)
+	if err != nil {
+		return ContentDescriptor{}, fmt.Errorf(errMsg, fid, err)
+	}
+
+	// Lookup data objects through partial metadata
+	metadataURL, err := url.JoinPath(c.metadataBaseURL, fid)
+	if err != nil {
+		return ContentDescriptor{}, fmt.Errorf(errMsg, fid, err)
+	}
+	mdata, err := c.fetchPartialMetadata(metadataURL)
+	if err != nil {
+		return ContentDescriptor{}, fmt.Errorf(errMsg, fid, err)
+	}
+
+	objects := make([]DataObjectDescriptor, 0, len(mdata.Segments))
+	if len(mdata.Segments) == 0 {
+		objects = append(objects, DataObjectDescriptor{FunctionalID: mdata.FunctionalID, Checksum: mdata.Checksum})
+	}
+	for _, segment := range mdata.Segments {
+		objects = append(objects, DataObjectDescriptor{FunctionalID: segment.FunctionalID, Checksum: segment.Checksum})
+	}
+	for i := range objects {
+		objects[i].URL, err = url.JoinPath(c.dataBaseURL, objects[i].FunctionalID)
+		if err != nil {
+			return ContentDescriptor{}, fmt.Errorf(errMsg, fid, err)
+		}
+	}
+
+	descriptor := ContentDescriptor{
+		FunctionalID: fid,
+		ByteSize:     size,
+		MetadataURL:  metadataURL,
+		Objects:      objects,
+	}
+	c.mutex.Lock()
+	c.cacheDescriptor(descriptor, now)
+	c.mutex.Unlock()
+	return descriptor, nil
+}
@@ -0,0 +1,89 @@
+package crow
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+	"github.com/Apiara/ApiaraCDN/infrastructure/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCyprusContentDescriber(t *testing.T) {
+	// Create test state
+	metadata := state.NewMockMicroserviceState()
+	metadata.CreateContentEntry("http://site.com/video.mp4", "rawfid", 1024, nil)
+	metadata.CreateContentEntry("http://site.com/video.m3u8", "vodfid", 4096, nil)
+
+	// Start test storage API
+	api := http.NewServeMux()
+	api.HandleFunc(infra.CyprusStorageAPIPartialMetadataResource+"/rawfid",
+		func(resp http.ResponseWriter, req *http.Request) {
+			resp.Write([]byte(`{"fid":"rawfid","checksum":"rawsum"}`))
+		})
+	vodPartial := &atomic.Value{}
+	vodPartial.Store(`{"fid":"vodfid","segments":[{"fid":"seg1","checksum":"sum1"},{"fid":"seg2","checksum":"sum2"}]}`)
+	api.HandleFunc(infra.CyprusStorageAPIPartialMetadataResource+"/vodfid",
+		func(resp http.ResponseWriter, req *http.Request) {
+			resp.Write([]byte(vodPartial.Load().(string)))
+		})
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	describer, err := NewCyprusContentDescriber(server.URL, metadata, time.Minute)
+	assert.Nil(t, err, "should not return error")
+
+	// Test raw media description
+	descriptor, err := describer.Describe("rawfid")
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, int64(1024), descriptor.ByteSize, "wrong byte size")
+	assert.Equal(t, server.URL+infra.CyprusStorageAPIPartialMetadataResource+"/rawfid", descriptor.MetadataURL, "wrong metadata URL")
+	assert.Equal(t, []DataObjectDescriptor{
+		{FunctionalID: "rawfid", URL: server.URL + infra.CyprusStorageAPIDataResource + "/rawfid", Checksum: "rawsum"},
+	}, descriptor.Objects, "wrong data objects")
+
+	// Test VOD media description
+	descriptor, err = describer.Describe("vodfid")
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, int64(4096), descriptor.ByteSize, "wrong byte size")
+	assert.Equal(t, []DataObjectDescriptor{
+		{FunctionalID: "seg1", URL: server.URL + infra.CyprusStorageAPIDataResource + "/seg1", Checksum: "sum1"},
+		{FunctionalID: "seg2", URL: server.URL + infra.CyprusStorageAPIDataResource + "/seg2", Checksum: "sum2"},
+	}, descriptor.Objects, "wrong data objects")
+
+	// Test cached descriptors expire, e.g. when the window of live content moves
+	vodPartial.Store(`{"fid":"vodfid","segments":[{"fid":"seg2","checksum":"sum2"},{"fid":"seg3","checksum":"sum3"}]}`)
+	descriptor, err = describer.Describe("vodfid")
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, "seg1", descriptor.Objects[0].FunctionalID, "expected cached descriptor")
+	describer.cacheTTL = time.Millisecond
+	describer.mutex.Lock()
+	describer.cache = make(map[string]cachedDescriptor)
+	describer.mutex.Unlock()
+	describer.Describe("vodfid")
+	time.Sleep(2 * time.Millisecond)
+	descriptor, err = describer.Describe("vodfid")
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, "seg3", descriptor.Objects[1].FunctionalID, "expected expired descriptor to be described again")
+
+	// Test the cache is bounded
+	for i := 0; i < descriptorCacheSize+10; i++ {
+		describer.mutex.Lock()
+		describer.cacheDescriptor(ContentDescriptor{FunctionalID: strconv.Itoa(i)}, time.Now())
+		describer.mutex.Unlock()
+	}
+	assert.LessOrEqual(t, len(describer.cache), descriptorCacheSize, "expected bounded cache")
+
+	// Test unknown content
+	_, err = describer.Describe("unknown")
+	assert.NotNil(t, err, "should fail to describe unknown content")
+
+	// Test allocation response filtering
+	response := describeAllocations([]string{"rawfid", "unknown", "vodfid"}, describer)
+	assert.Equal(t, []string{"rawfid", "vodfid"}, response.ServeList, "wrong serve list")
+	assert.Equal(t, 2, len(response.Content), "wrong amount of descriptors")
+}
@@ -4,20 +4,67 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 
 	infra "github.com/Apiara/ApiaraCDN/infrastructure"
 )
 
 type allocationResponse struct {
-	ServeList []string `json:"serve"`
+	ServeList []string            `json:"serve"`
+	Content   []ContentDescriptor `json:"content"`
+}
+
+/*
+describeAllocations resolves a download descriptor for every allocated
+functional ID. Content that can't be described is dropped from the
+allocation since the endpoint would have no way of retrieving it
+*/
+func describeAllocations(serveList []string, describer ContentDescriber) allocationResponse {
+	response := allocationResponse{
+		ServeList: make([]string, 0, len(serveList)),
+		Content:   make([]ContentDescriptor, 0, len(serveList)),
+	}
+	for _, fid := range serveList {
+		descriptor, err := describer.Describe(fid)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		response.ServeList = append(response.ServeList, fid)
+		response.Content = append(response.Content, descriptor)
+	}
+	return response
+}
+
+/*
+parseEndpointQuality reads self-reported endpoint quality from an allocation
+request. Returns false if the endpoint didn't report any quality information
+*/
+func parseEndpointQuality(query url.Values) (EndpointQuality, bool, error) {
+	quality := EndpointQuality{Identity: query.Get(infra.EndpointIdentityParam)}
+	uptimeStr := query.Get(infra.EndpointUptimeParam)
+	bandwidthStr := query.Get(infra.EndpointBandwidthParam)
+	if uptimeStr == "" || bandwidthStr == "" {
+		return quality, false, nil
+	}
+
+	var err error
+	if quality.Uptime, err = strconv.ParseFloat(uptimeStr, 64); err != nil {
+		return quality, false, err
+	}
+	if quality.Bandwidth, err = strconv.ParseInt(bandwidthStr, 10, 64); err != nil {
+		return quality, false, err
+	}
+	return quality, true, nil
 }
 
 /*
 StartDataAllocatorAPI starts the API service for endpoints to
 be allocated data to serve on the network
 */
-func StartDataAllocatorAPI(listenAddr string, allocator LocationAwareDataAllocator) {
+func StartDataAllocatorAPI(listenAddr string, allocator LocationAwareDataAllocator,
+	describer ContentDescriber, scorer EndpointScorer, recorder AllocationRecorder) {
 	allocateAPI := http.NewServeMux()
 	allocateAPI.HandleFunc(infra.CrowAllocateAPIResource, func(resp http.ResponseWriter, req *http.Request) {
 		regionID := req.URL.Query().Get(infra.RegionServerIDParam)
@@ -29,14 +76,27 @@ func StartDataAllocatorAPI(listenAddr string, allocator LocationAwareDataAllocat
 			return
 		}
 
-		serveList, err := allocator.AllocateSpace(regionID, availableSpace)
+		quality, reported, err := parseEndpointQuality(req.URL.Query())
+		if err != nil {
+			log.Println(err)
+			resp.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var serveList []string
+		if reported {
+			serveList, err = allocator.AllocateSpaceByQuality(regionID, availableSpace, scorer.Score(quality))
+		} else {
+			serveList, err = allocator.AllocateSpace(regionID, availableSpace)
+		}
 		if err != nil {
 			log.Println(err)
 			resp.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		response := allocationResponse{serveList}
+		response := describeAllocations(serveList, describer)
+		recorder.RecordAllocation(regionID, response.ServeList)
 		if err = json.NewEncoder(resp).Encode(&response); err != nil {
 			log.Println(err)
 			resp.WriteHeader(http.StatusInternalServerError)
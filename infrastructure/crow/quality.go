@@ -0,0 +1,184 @@
+package crow
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+	"github.com/Apiara/ApiaraCDN/infrastructure/dominique"
+)
+
+const (
+	// Bounds how long an allocation waits on the session history of an endpoint
+	historyRequestTimeout = 2 * time.Second
+
+	// How long delivery history is reused when no TTL is configured
+	defaultHistoryTTL = time.Minute
+)
+
+// EndpointQuality is the self-reported quality of an endpoint requesting an allocation
+type EndpointQuality struct {
+	Identity  string
+	Uptime    float64 // fraction of time the endpoint is online in [0, 1]
+	Bandwidth int64   // upload bandwidth in bytes per second
+}
+
+// EndpointScorer represents an object that can turn endpoint quality into a score in [0, 1]
+type EndpointScorer interface {
+	Score(quality EndpointQuality) float64
+}
+
+/*
+EndpointHistory represents an object that can look up how many bytes an
+endpoint delivered to clients and how many it failed to deliver over a time range
+*/
+type EndpointHistory interface {
+	DeliveryHistory(identity string, start time.Time, end time.Time) (delivered int64, missed int64, err error)
+}
+
+// deliveryResponse mirrors the dominique data API sum query response
+type deliveryResponse struct {
+	DomesticBytesServed int64 `json:"domestic"`
+	ForeignBytesServed  int64 `json:"foreign"`
+}
+
+// DominiqueEndpointHistory implements EndpointHistory using the dominique data API
+type DominiqueEndpointHistory struct {
+	client   *http.Client
+	fetchAPI string
+}
+
+// NewDominiqueEndpointHistory creates a new DominiqueEndpointHistory using the data API at dataAPIAddr
+func NewDominiqueEndpointHistory(dataAPIAddr string) (*DominiqueEndpointHistory, error) {
+	fetchAPI, err := url.JoinPath(dataAPIAddr, infra.DominiqueDataAPIFetchResource)
+	if err != nil {
+		return nil, err
+	}
+	return &DominiqueEndpointHistory{
+		client:   &http.Client{Timeout: historyRequestTimeout},
+		fetchAPI: fetchAPI,
+	}, nil
+}
+
+// DeliveryHistory sums the sessions served by 'identity' between start and end
+func (d *DominiqueEndpointHistory) DeliveryHistory(identity string, start time.Time, end time.Time) (int64, int64, error) {
+	query := url.Values{}
+	query.Add(dominique.QueryKeyParam, identity)
+	query.Add(dominique.QueryKeyTypeParam, dominique.UIDSearchKey)
+	query.Add(dominique.QueryAccumulationTypeParam, dominique.SumQuery)
+	query.Add(dominique.QueryStartTimeParam, start.Format(dominique.QueryTimeFormat))
+	query.Add(dominique.QueryEndTimeParam, end.Format(dominique.QueryTimeFormat))
+
+	var response deliveryResponse
+	err := infra.MakeHTTPRequest(d.fetchAPI, query, nil, d.client, infra.JSONBodyDecoder, &response)
+	if err != nil {
+		return -1, -1, fmt.Errorf("failed to retrieve session history for %s: %w", identity, err)
+	}
+	return response.DomesticBytesServed, response.ForeignBytesServed, nil
+}
+
+// deliveryRatio is the cached fraction of bytes an endpoint delivered
+type deliveryRatio struct {
+	ratio   float64
+	expires time.Time
+}
+
+/*
+ReportedQualityScorer implements EndpointScorer by scoring endpoints on
+self-reported uptime and bandwidth. If an EndpointHistory is provided the
+score is scaled by the fraction of bytes the endpoint actually delivered
+to clients over the history window. Delivery history is cached per endpoint
+and, when it can't be retrieved, the self-reported score is used unscaled
+*/
+type ReportedQualityScorer struct {
+	targetBandwidth int64
+	history         EndpointHistory
+	historyWindow   time.Duration
+	historyTTL      time.Duration
+
+	mutex  *sync.Mutex
+	ratios map[string]deliveryRatio
+}
+
+/*
+NewReportedQualityScorer creates a new ReportedQualityScorer where endpoints
+with 'targetBandwidth' or more upload bandwidth receive the full bandwidth
+score. 'history' may be nil to trust self-reported values as-is, otherwise
+the delivery history of an endpoint is reused for 'historyTTL'
+*/
+func NewReportedQualityScorer(targetBandwidth int64, history EndpointHistory,
+	historyWindow time.Duration, historyTTL time.Duration) *ReportedQualityScorer {
+	if historyTTL <= 0 {
+		historyTTL = defaultHistoryTTL
+	}
+	return &ReportedQualityScorer{
+		targetBandwidth: targetBandwidth,
+		history:         history,
+		historyWindow:   historyWindow,
+		historyTTL:      historyTTL,
+		mutex:           &sync.Mutex{},
+		ratios:          make(map[string]deliveryRatio),
+	}
+}
+
+/*
+deliveryRatio returns the fraction of bytes 'identity' delivered over the
+history window. Failures to retrieve history are cached as a neutral ratio
+so an unreachable history service isn't waited on for every allocation
+*/
+func (r *ReportedQualityScorer) deliveryRatio(identity string) float64 {
+	now := time.Now()
+	r.mutex.Lock()
+	cached, ok := r.ratios[identity]
+	r.mutex.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.ratio
+	}
+
+	ratio := 1.0
+	delivered, missed, err := r.history.DeliveryHistory(identity, now.Add(-r.historyWindow), now)
+	if err != nil {
+		log.Println(err)
+	} else if delivered+missed > 0 {
+		ratio = float64(delivered) / float64(delivered+missed)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for id, entry := range r.ratios {
+		if !now.Before(entry.expires) {
+			delete(r.ratios, id)
+		}
+	}
+	r.ratios[identity] = deliveryRatio{ratio: ratio, expires: now.Add(r.historyTTL)}
+	return ratio
+}
+
+// Score returns the endpoints quality score in [0, 1]
+func (r *ReportedQualityScorer) Score(quality EndpointQuality) float64 {
+	// Score self-reported values
+	uptime := quality.Uptime
+	if uptime < 0 {
+		uptime = 0
+	} else if uptime > 1 {
+		uptime = 1
+	}
+	bandwidth := 1.0
+	if r.targetBandwidth > 0 && quality.Bandwidth < r.targetBandwidth {
+		bandwidth = float64(quality.Bandwidth) / float64(r.targetBandwidth)
+	}
+	if bandwidth < 0 {
+		bandwidth = 0
+	}
+	score := uptime * bandwidth
+
+	// Cross-check against delivered session history
+	if r.history == nil || quality.Identity == "" {
+		return score
+	}
+	return score * r.deliveryRatio(quality.Identity)
+}
@@ -0,0 +1,164 @@
+package crow
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+)
+
+var (
+	// Score used for endpoints that don't report any quality information
+	DefaultEndpointScore = 0.5
+)
+
+/*
+QualityAwareDataAllocator represents a DataAllocator that can weight
+allocations by an endpoint quality score in the range [0, 1]
+*/
+type QualityAwareDataAllocator interface {
+	DataAllocator
+	AllocateSpaceByQuality(availableSpace int64, score float64) ([]string, error)
+}
+
+/*
+QualityWeightedDataAllocator implements QualityAwareDataAllocator by ordering
+content by need and handing high quality endpoints the most needed content
+while lower quality endpoints are allocated progressively further down the
+long tail
+*/
+type QualityWeightedDataAllocator struct {
+	mutex *sync.RWMutex
+
+	contentMap map[string]int64
+	priorities map[string]int64
+	ordered    []string
+}
+
+/*
+NewQualityWeightedDataAllocator creates a new QualityWeightedDataAllocator that
+refreshes content need every 'updateFrequency' using priorities fetched from 'edgeServerAddr'
+*/
+func NewQualityWeightedDataAllocator(edgeServerAddr string, updateFrequency time.Duration) (*QualityWeightedDataAllocator, error) {
+	edgeKeyAPI, err := url.JoinPath(edgeServerAddr, infra.DamoclesServiceAPIPriorityListResource)
+	if err != nil {
+		return nil, err
+	}
+
+	allocator := &QualityWeightedDataAllocator{
+		mutex:      &sync.RWMutex{},
+		contentMap: make(map[string]int64),
+		priorities: make(map[string]int64),
+		ordered:    []string{},
+	}
+	go startNeedUpdater(edgeKeyAPI, updateFrequency, http.DefaultClient, allocator)
+	return allocator, nil
+}
+
+// startNeedUpdater periodically refreshes allocator content need from the edge server
+func startNeedUpdater(edgePriorityAddress string, frequency time.Duration,
+	client *http.Client, allocator *QualityWeightedDataAllocator) {
+
+	for {
+		time.Sleep(frequency)
+
+		priorities := make(map[string]int64)
+		err := infra.MakeHTTPRequest(edgePriorityAddress, url.Values{}, nil, client, infra.GOBBodyDecoder, &priorities)
+		if err != nil {
+			log.Printf("failed to update content allocation priorities: %s", err.Error())
+			continue
+		}
+
+		allocator.mutex.Lock()
+		allocator.priorities = priorities
+		allocator.reorder()
+		allocator.mutex.Unlock()
+	}
+}
+
+// reorder sorts content from most to least needed. Caller must hold the write lock
+func (q *QualityWeightedDataAllocator) reorder() {
+	ordered := make([]string, 0, len(q.contentMap))
+	for id := range q.contentMap {
+		ordered = append(ordered, id)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		if q.priorities[ordered[i]] != q.priorities[ordered[j]] {
+			return q.priorities[ordered[i]] > q.priorities[ordered[j]]
+		}
+		return ordered[i] < ordered[j]
+	})
+	q.ordered = ordered
+}
+
+// NewEntry creates a new id entry for the allocator
+func (q *QualityWeightedDataAllocator) NewEntry(id string, size int64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, ok := q.contentMap[id]; ok {
+		return fmt.Errorf("failed to add content(%s) to QualityWeightedDataAllocator: already exists", id)
+	}
+	q.contentMap[id] = size
+	q.reorder()
+	return nil
+}
+
+// DelEntry removes a content ID from the allocator
+func (q *QualityWeightedDataAllocator) DelEntry(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, ok := q.contentMap[id]; !ok {
+		return fmt.Errorf("failed to delete content(%s) from QualityWeightedDataAllocator: doesn't exists", id)
+	}
+	delete(q.contentMap, id)
+	q.reorder()
+	return nil
+}
+
+// AllocateSpace allocates space for an endpoint with an unknown quality
+func (q *QualityWeightedDataAllocator) AllocateSpace(availableSpace int64) ([]string, error) {
+	return q.AllocateSpaceByQuality(availableSpace, DefaultEndpointScore)
+}
+
+/*
+AllocateSpaceByQuality starts filling 'availableSpace' at a point in the
+need ordered content list proportional to how poor 'score' is, wrapping
+around so that any remaining space is still filled
+*/
+func (q *QualityWeightedDataAllocator) AllocateSpaceByQuality(availableSpace int64, score float64) ([]string, error) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	allocations := make([]string, 0)
+	n := len(q.ordered)
+	if n == 0 {
+		return allocations, nil
+	}
+
+	// Clamp score and find starting point in need ordering
+	if score < 0 {
+		score = 0
+	} else if score > 1 {
+		score = 1
+	}
+	start := int((1 - score) * float64(n))
+	if start >= n {
+		start = n - 1
+	}
+
+	for i := 0; i < n && availableSpace > 0; i++ {
+		id := q.ordered[(start+i)%n]
+		if size := q.contentMap[id]; size <= availableSpace {
+			availableSpace -= size
+			allocations = append(allocations, id)
+		}
+	}
+	return allocations, nil
+}
@@ -0,0 +1,115 @@
+package crow
+
+import (
+	"encoding/gob"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockEndpointHistory struct {
+	delivered int64
+	missed    int64
+	err       error
+	calls     int
+}
+
+func (m *mockEndpointHistory) DeliveryHistory(string, time.Time, time.Time) (int64, int64, error) {
+	m.calls++
+	return m.delivered, m.missed, m.err
+}
+
+func TestQualityWeightedDataAllocator(t *testing.T) {
+	content := []string{"cid1", "cid2", "cid3", "cid4"}
+	needs := []int64{40, 30, 20, 10}
+	updateFreq := time.Second / 4
+
+	// Start test priority server
+	api := http.NewServeMux()
+	api.HandleFunc(infra.DamoclesServiceAPIPriorityListResource,
+		func(resp http.ResponseWriter, req *http.Request) {
+			returnMap := make(map[string]int64)
+			for i, id := range content {
+				returnMap[id] = needs[i]
+			}
+			if err := gob.NewEncoder(resp).Encode(returnMap); err != nil {
+				resp.WriteHeader(http.StatusInternalServerError)
+			}
+		})
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	// Create resources
+	allocator, err := NewQualityWeightedDataAllocator(server.URL, updateFreq)
+	assert.Nil(t, err, "should not return error")
+	for _, id := range content {
+		assert.Nil(t, allocator.NewEntry(id, 100), "should not return error")
+	}
+	assert.NotNil(t, allocator.NewEntry("cid1", 100), "should fail to create duplicate entry")
+	time.Sleep(updateFreq * 2)
+
+	// High quality endpoints receive the most needed content
+	ids, err := allocator.AllocateSpaceByQuality(200, 1)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, []string{"cid1", "cid2"}, ids, "wrong allocations for high quality endpoint")
+
+	// Low quality endpoints receive the long tail
+	ids, err = allocator.AllocateSpaceByQuality(100, 0)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, []string{"cid4"}, ids, "wrong allocations for low quality endpoint")
+
+	// Remaining space wraps around to more needed content
+	ids, err = allocator.AllocateSpaceByQuality(200, 0.5)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, []string{"cid3", "cid4"}, ids, "wrong allocations for average quality endpoint")
+	ids, err = allocator.AllocateSpaceByQuality(300, 0.25)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, []string{"cid4", "cid1", "cid2"}, ids, "wrong wrapped allocations")
+
+	// Test remove entry
+	assert.Nil(t, allocator.DelEntry("cid4"), "should not return error")
+	assert.NotNil(t, allocator.DelEntry("cid4"), "should fail to delete missing entry")
+	ids, err = allocator.AllocateSpaceByQuality(100, 0)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, []string{"cid3"}, ids, "wrong allocations after removal")
+}
+
+func TestReportedQualityScorer(t *testing.T) {
+	// Self-reported quality only
+	scorer := NewReportedQualityScorer(1000, nil, time.Hour, time.Minute)
+	assert.Equal(t, 0.9, scorer.Score(EndpointQuality{Uptime: 0.9, Bandwidth: 2000}), "wrong saturated score")
+	assert.Equal(t, 0.45, scorer.Score(EndpointQuality{Uptime: 0.9, Bandwidth: 500}), "wrong bandwidth scaled score")
+	assert.Equal(t, 0.0, scorer.Score(EndpointQuality{Uptime: -1, Bandwidth: 500}), "wrong clamped score")
+
+	// Cross-checked against session history
+	history := &mockEndpointHistory{delivered: 300, missed: 100}
+	scorer = NewReportedQualityScorer(1000, history, time.Hour, time.Minute)
+	assert.Equal(t, 0.75, scorer.Score(EndpointQuality{Identity: "e1", Uptime: 1, Bandwidth: 1000}), "wrong history scaled score")
+	assert.Equal(t, 1.0, scorer.Score(EndpointQuality{Uptime: 1, Bandwidth: 1000}), "anonymous endpoints should skip history")
+
+	history.delivered, history.missed = 0, 0
+	assert.Equal(t, 1.0, scorer.Score(EndpointQuality{Identity: "e2", Uptime: 1, Bandwidth: 1000}), "no history should not penalize")
+
+	// History is cached per endpoint
+	assert.Equal(t, 0.75, scorer.Score(EndpointQuality{Identity: "e1", Uptime: 1, Bandwidth: 1000}), "expected cached history")
+	assert.Equal(t, 2, history.calls, "expected cached history to not be requested again")
+
+	// Unreachable history gives a neutral score, which is cached too
+	history.err = errors.New("unreachable")
+	scorer = NewReportedQualityScorer(1000, history, time.Hour, time.Minute)
+	assert.Equal(t, 0.9, scorer.Score(EndpointQuality{Identity: "e1", Uptime: 0.9, Bandwidth: 1000}), "expected neutral history score")
+	scorer.Score(EndpointQuality{Identity: "e1", Uptime: 0.9, Bandwidth: 1000})
+	assert.Equal(t, 3, history.calls, "expected failed history lookup to be cached")
+
+	// Cached history expires
+	scorer = NewReportedQualityScorer(1000, history, time.Hour, time.Millisecond)
+	scorer.Score(EndpointQuality{Identity: "e1", Uptime: 1, Bandwidth: 1000})
+	time.Sleep(2 * time.Millisecond)
+	scorer.Score(EndpointQuality{Identity: "e1", Uptime: 1, Bandwidth: 1000})
+	assert.Equal(t, 5, history.calls, "expected expired history to be requested again")
+}
@@ -1,6 +1,7 @@
 package crow
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -13,7 +14,8 @@ import (
 StartServiceAPI starts the API that informs the service of what content
 to start or stop allocating to endpoints
 */
-func StartServiceAPI(listenAddr string, allocator LocationAwareDataAllocator) {
+func StartServiceAPI(listenAddr string, allocator LocationAwareDataAllocator, coverage CoverageReporter,
+	reconciler ReconcileReporter) {
 	serviceAPI := http.NewServeMux()
 
 	serviceAPI.HandleFunc(infra.CrowServiceAPIPublishResource, func(resp http.ResponseWriter, req *http.Request) {
@@ -42,6 +44,25 @@ func StartServiceAPI(listenAddr string, allocator LocationAwareDataAllocator) {
 			resp.WriteHeader(http.StatusInternalServerError)
 		}
 	})
+	serviceAPI.HandleFunc(infra.CrowServiceAPICoverageResource, func(resp http.ResponseWriter, req *http.Request) {
+		report, err := coverage.Report()
+		if err != nil {
+			log.Println(err)
+			resp.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if err = json.NewEncoder(resp).Encode(report); err != nil {
+			log.Println(err)
+			resp.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	serviceAPI.HandleFunc(infra.CrowServiceAPIReconcileResource, func(resp http.ResponseWriter, req *http.Request) {
+		if err := json.NewEncoder(resp).Encode(reconciler.Stats()); err != nil {
+			log.Println(err)
+			resp.WriteHeader(http.StatusInternalServerError)
+		}
+	})
 	fmt.Println("Listening on " + listenAddr)
 	http.ListenAndServe(listenAddr, serviceAPI)
 }
@@ -2,6 +2,9 @@ package crow
 
 import (
 	"fmt"
+	"log"
+	"sync"
+	"time"
 
 	"github.com/Apiara/ApiaraCDN/infrastructure/state"
 )
@@ -16,44 +19,213 @@ type StateMetadata interface {
 	ServerContentList(serverID string) ([]string, error)
 }
 
-// LoadContent makes allocator consistent with what content is expected to be allocated on the network
-func LoadContent(metadata StateMetadata, allocator LocationAwareDataAllocator) error {
+// ContentDrift describes the allocator changes made to match network state for a region
+type ContentDrift struct {
+	Region  string   `json:"region"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+/*
+ReconcileContent makes allocator consistent with what content is expected to be
+allocated on the network, adding missing entries and removing extra ones. Entries
+published or purged while state is being read are left alone. Returns the drift
+that was corrected for every region that didn't match
+*/
+func ReconcileContent(metadata StateMetadata, allocator LocationAwareDataAllocator) ([]ContentDrift, error) {
+	/* Snapshot allocator both before and after reading state. An entry published
+	or purged in between may or may not be reflected by the state read, so only
+	entries that are stable across both snapshots are acted on */
+	before := allocator.Entries()
+
 	// Get list of all servers
-	errMsg := "failed to load content allocation state: %w"
+	errMsg := "failed to reconcile content allocation state: %w"
 	servers, err := metadata.ServerList()
 	if err != nil {
-		return fmt.Errorf(errMsg, err)
+		return nil, fmt.Errorf(errMsg, err)
 	}
 
-	// Update allocator based on what content is served where
+	// Build expected (functional id, size) entries per server
 	type cinfo struct {
 		fid  string
 		size int64
 	}
 	contentInfo := make(map[string]*cinfo)
+	expected := make(map[string]map[string]int64)
 	for _, server := range servers {
 		serving, err := metadata.ServerContentList(server)
 		if err != nil {
-			return fmt.Errorf(errMsg, err)
+			return nil, fmt.Errorf(errMsg, err)
 		}
 
+		expected[server] = make(map[string]int64)
 		for _, cid := range serving {
 			if _, ok := contentInfo[cid]; !ok {
-				contentInfo[cid] = &cinfo{}
-				contentInfo[cid].size, err = metadata.GetContentSize(cid)
+				info := &cinfo{}
+				info.size, err = metadata.GetContentSize(cid)
 				if err != nil {
-					return fmt.Errorf(errMsg, err)
+					return nil, fmt.Errorf(errMsg, err)
 				}
-				contentInfo[cid].fid, err = metadata.GetContentFunctionalID(cid)
+				info.fid, err = metadata.GetContentFunctionalID(cid)
 				if err != nil {
-					return fmt.Errorf(errMsg, err)
+					return nil, fmt.Errorf(errMsg, err)
+				}
+				contentInfo[cid] = info
+			}
+			expected[server][contentInfo[cid].fid] = contentInfo[cid].size
+		}
+	}
+
+	// Diff against allocator entries stable across the state read
+	current := allocator.Entries()
+	regions := make(map[string]struct{})
+	for region := range expected {
+		regions[region] = struct{}{}
+	}
+	for region := range current {
+		regions[region] = struct{}{}
+	}
+
+	drift := make([]ContentDrift, 0)
+	failures := 0
+	var firstErr error
+	for region := range regions {
+		regionDrift := ContentDrift{Region: region, Added: []string{}, Removed: []string{}}
+		allocated := make(map[string]struct{})
+		existed := make(map[string]struct{})
+		for _, fid := range before[region] {
+			existed[fid] = struct{}{}
+		}
+		for _, fid := range current[region] {
+			allocated[fid] = struct{}{}
+			if _, ok := expected[region][fid]; ok {
+				continue
+			}
+			if _, ok := existed[fid]; !ok {
+				continue
+			}
+			if err = allocator.DelEntry(region, fid); err != nil {
+				failures++
+				if firstErr == nil {
+					firstErr = err
 				}
+				continue
+			}
+			regionDrift.Removed = append(regionDrift.Removed, fid)
+		}
+		for fid, size := range expected[region] {
+			if _, ok := allocated[fid]; ok {
+				continue
+			}
+			if _, ok := existed[fid]; ok {
+				continue
 			}
-			err = allocator.NewEntry(server, contentInfo[cid].fid, contentInfo[cid].size)
-			if err != nil {
-				return fmt.Errorf(errMsg, err)
+			if err = allocator.NewEntry(region, fid, size); err != nil {
+				failures++
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
 			}
+			regionDrift.Added = append(regionDrift.Added, fid)
+		}
+
+		if len(regionDrift.Added) > 0 || len(regionDrift.Removed) > 0 {
+			drift = append(drift, regionDrift)
+		}
+	}
+
+	if failures > 0 {
+		return drift, fmt.Errorf(errMsg, fmt.Errorf("%d allocator updates failed, first failure: %w", failures, firstErr))
+	}
+	return drift, nil
+}
+
+// LoadContent makes allocator consistent with what content is expected to be allocated on the network
+func LoadContent(metadata StateMetadata, allocator LocationAwareDataAllocator) error {
+	_, err := ReconcileContent(metadata, allocator)
+	return err
+}
+
+// ReconcileStats counts the reconciliations of a ContentReconciler and the drift they corrected
+type ReconcileStats struct {
+	Runs      int64          `json:"runs"`
+	Failures  int64          `json:"failures"`
+	Added     int64          `json:"added"`
+	Removed   int64          `json:"removed"`
+	LastDrift []ContentDrift `json:"last_drift"`
+}
+
+// ReconcileReporter represents an object that can report the drift corrected by reconciliation
+type ReconcileReporter interface {
+	Stats() ReconcileStats
+}
+
+/*
+ContentReconciler implements ReconcileReporter by reconciling allocator with
+network state and counting the drift every reconciliation corrected
+*/
+type ContentReconciler struct {
+	metadata  StateMetadata
+	allocator LocationAwareDataAllocator
+
+	mutex *sync.Mutex
+	stats ReconcileStats
+}
+
+// NewContentReconciler creates a new ContentReconciler
+func NewContentReconciler(metadata StateMetadata, allocator LocationAwareDataAllocator) *ContentReconciler {
+	return &ContentReconciler{
+		metadata:  metadata,
+		allocator: allocator,
+		mutex:     &sync.Mutex{},
+		stats:     ReconcileStats{LastDrift: []ContentDrift{}},
+	}
+}
+
+// Reconcile runs ReconcileContent once and records its drift
+func (r *ContentReconciler) Reconcile() ([]ContentDrift, error) {
+	drift, err := ReconcileContent(r.metadata, r.allocator)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stats.Runs++
+	if err != nil {
+		r.stats.Failures++
+	}
+	for _, regionDrift := range drift {
+		r.stats.Added += int64(len(regionDrift.Added))
+		r.stats.Removed += int64(len(regionDrift.Removed))
+	}
+	r.stats.LastDrift = drift
+	return drift, err
+}
+
+// Stats returns the reconciliation counts so far
+func (r *ContentReconciler) Stats() ReconcileStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stats := r.stats
+	stats.LastDrift = append([]ContentDrift{}, r.stats.LastDrift...)
+	return stats
+}
+
+/*
+StartContentReconciler reconciles with reconciler every 'frequency',
+logging any drift that had to be corrected
+*/
+func StartContentReconciler(reconciler *ContentReconciler, frequency time.Duration) {
+	for {
+		time.Sleep(frequency)
+
+		drift, err := reconciler.Reconcile()
+		if err != nil {
+			log.Println(err)
+		}
+		for _, regionDrift := range drift {
+			log.Printf("corrected allocator drift in region(%s): added %v, removed %v\n",
+				regionDrift.Region, regionDrift.Added, regionDrift.Removed)
 		}
 	}
-	return nil
 }
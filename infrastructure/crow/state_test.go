@@ -0,0 +1,133 @@
+package crow
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/Apiara/ApiaraCDN/infrastructure/state"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockStateMetadata extends the state mock with server content listings
+type mockStateMetadata struct {
+	*state.MockMicroserviceState
+	serving map[string][]string
+}
+
+func (m *mockStateMetadata) ServerList() ([]string, error) {
+	servers := make([]string, 0, len(m.serving))
+	for server := range m.serving {
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+func (m *mockStateMetadata) ServerContentList(server string) ([]string, error) {
+	return m.serving[server], nil
+}
+
+// racingStateMetadata runs update while its server list is read
+type racingStateMetadata struct {
+	*mockStateMetadata
+	update func()
+}
+
+func (m *racingStateMetadata) ServerList() ([]string, error) {
+	m.update()
+	return m.mockStateMetadata.ServerList()
+}
+
+func TestReconcileContent(t *testing.T) {
+	classes := []int64{1024, 4096}
+	allocator := NewCompoundLocationDataAllocator(classes, func(string) (DataAllocator, error) {
+		return NewEvenDataAllocator(classes), nil
+	})
+
+	metadata := &mockStateMetadata{state.NewMockMicroserviceState(), map[string][]string{
+		"region1": {"cid1", "cid2"},
+		"region2": {"cid2"},
+	}}
+	metadata.CreateContentEntry("cid1", "fid1", 100, nil)
+	metadata.CreateContentEntry("cid2", "fid2", 200, nil)
+
+	// Initial load adds everything
+	assert.Nil(t, LoadContent(metadata, allocator), "should not return error")
+	entries := allocator.Entries()
+	sort.Strings(entries["region1"])
+	assert.Equal(t, []string{"fid1", "fid2"}, entries["region1"], "wrong region1 entries")
+	assert.Equal(t, []string{"fid2"}, entries["region2"], "wrong region2 entries")
+
+	// Nothing to correct when consistent
+	drift, err := ReconcileContent(metadata, allocator)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, 0, len(drift), "should not have drift")
+
+	// Simulate missed publish and purge calls
+	assert.Nil(t, allocator.NewEntry("region3", "fid1", 100), "should not return error")
+	metadata.serving["region1"] = []string{"cid1"}
+	metadata.serving["region2"] = []string{"cid1", "cid2"}
+
+	drift, err = ReconcileContent(metadata, allocator)
+	assert.Nil(t, err, "should not return error")
+	sort.Slice(drift, func(i, j int) bool { return drift[i].Region < drift[j].Region })
+	assert.Equal(t, []ContentDrift{
+		{Region: "region1", Added: []string{}, Removed: []string{"fid2"}},
+		{Region: "region2", Added: []string{"fid1"}, Removed: []string{}},
+		{Region: "region3", Added: []string{}, Removed: []string{"fid1"}},
+	}, drift, "wrong drift")
+
+	entries = allocator.Entries()
+	_, ok := entries["region3"]
+	assert.False(t, ok, "expected empty region to be released")
+	assert.Equal(t, []string{"fid1"}, entries["region1"], "wrong region1 entries")
+
+	// Entries published while state is read are not removed as extra
+	racing := &racingStateMetadata{metadata, func() {
+		allocator.NewEntry("region1", "fid3", 300)
+	}}
+	drift, err = ReconcileContent(racing, allocator)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, 0, len(drift), "should not have drift")
+	entries = allocator.Entries()
+	sort.Strings(entries["region1"])
+	assert.Equal(t, []string{"fid1", "fid3"}, entries["region1"], "expected published entry to be kept")
+
+	// Entries purged while state is read are not added back as missing
+	metadata.CreateContentEntry("cid3", "fid3", 300, nil)
+	metadata.serving["region1"] = []string{"cid1", "cid3"}
+	racing.update = func() {
+		allocator.DelEntry("region1", "fid1")
+	}
+	drift, err = ReconcileContent(racing, allocator)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, 0, len(drift), "should not have drift")
+	assert.Equal(t, []string{"fid3"}, allocator.Entries()["region1"], "expected purged entry to stay purged")
+}
+
+func TestContentReconciler(t *testing.T) {
+	classes := []int64{1024, 4096}
+	allocator := NewCompoundLocationDataAllocator(classes, func(string) (DataAllocator, error) {
+		return NewEvenDataAllocator(classes), nil
+	})
+	metadata := &mockStateMetadata{state.NewMockMicroserviceState(), map[string][]string{
+		"region1": {"cid1", "cid2"},
+	}}
+	metadata.CreateContentEntry("cid1", "fid1", 100, nil)
+	metadata.CreateContentEntry("cid2", "fid2", 200, nil)
+
+	reconciler := NewContentReconciler(metadata, allocator)
+	_, err := reconciler.Reconcile()
+	assert.Nil(t, err, "should not return error")
+	metadata.serving["region1"] = []string{"cid1"}
+	_, err = reconciler.Reconcile()
+	assert.Nil(t, err, "should not return error")
+
+	// Drift is counted across reconciliations
+	stats := reconciler.Stats()
+	assert.Equal(t, int64(2), stats.Runs, "wrong run count")
+	assert.Zero(t, stats.Failures, "should not have failures")
+	assert.Equal(t, int64(2), stats.Added, "wrong added count")
+	assert.Equal(t, int64(1), stats.Removed, "wrong removed count")
+	assert.Equal(t, []ContentDrift{{Region: "region1", Added: []string{}, Removed: []string{"fid2"}}},
+		stats.LastDrift, "wrong last drift")
+}
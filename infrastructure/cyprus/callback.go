@@ -0,0 +1,84 @@
+package cyprus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+)
+
+/*
+callbackNotifier POSTs the final status of processing jobs to the callback URL
+provided on submission. Payloads are signed with a shared secret along with
+when they are sent so receivers can verify they came from cyprus and are fresh
+*/
+type callbackNotifier struct {
+	client      *http.Client
+	secret      []byte
+	maxAttempts int
+	backoff     time.Duration
+}
+
+func newCallbackNotifier(secret []byte, maxAttempts int, backoff time.Duration) *callbackNotifier {
+	if maxAttempts <= 0 {
+		maxAttempts = 1
+	}
+	return &callbackNotifier{
+		client:      &http.Client{Timeout: time.Minute},
+		secret:      secret,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+	}
+}
+
+// deliver makes a single attempt at sending 'status' to callbackURL
+func (c *callbackNotifier) deliver(callbackURL string, status infra.JobResponse) error {
+	payload, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("failed to encode callback payload: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create callback request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	timestamp, signature := infra.SignTimestampedPayload(c.secret, payload, time.Now())
+	req.Header.Set(infra.PayloadTimestampHeader, timestamp)
+	req.Header.Set(infra.PayloadSignatureHeader, signature)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback responded with bad HTTP status: %s", resp.Status)
+	}
+	return nil
+}
+
+/*
+notify delivers 'status' to callbackURL, retrying with exponential backoff.
+'delivered' is called once the receiver has accepted the payload
+*/
+func (c *callbackNotifier) notify(callbackURL string, status infra.JobResponse, delivered func()) {
+	for attempt := 1; ; attempt++ {
+		err := c.deliver(callbackURL, status)
+		if err == nil {
+			delivered()
+			return
+		}
+		if attempt >= c.maxAttempts {
+			log.Printf("Giving up on callback for %s to %s after %d attempts: %v\n",
+				status.ContentID, callbackURL, attempt, err)
+			return
+		}
+		backoff := c.backoff << (attempt - 1)
+		log.Printf("Callback attempt %d for %s failed, retrying in %s: %v\n", attempt, status.ContentID, backoff, err)
+		time.Sleep(backoff)
+	}
+}
@@ -0,0 +1,117 @@
+package cyprus
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+ChunkingPreprocessor implements DataPreprocessor by splitting the raw media
+ingested by another DataPreprocessor into fixed size chunks. The result is a
+single stream manifest so every chunk is encrypted, checksummed and assigned
+a functional ID like a VOD segment, letting endpoints serve chunks independently.
+Manifest based media is passed through untouched
+*/
+type ChunkingPreprocessor struct {
+	preprocessor DataPreprocessor
+	chunkSize    int64
+	outputDir    string
+}
+
+// NewChunkingPreprocessor creates a ChunkingPreprocessor splitting raw media into chunkSize byte chunks
+func NewChunkingPreprocessor(preprocessor DataPreprocessor, chunkSize int64, workingDir string) (*ChunkingPreprocessor, error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("failed to create ChunkingPreprocessor. invalid chunk size %d", chunkSize)
+	}
+	return &ChunkingPreprocessor{
+		preprocessor: preprocessor,
+		chunkSize:    chunkSize,
+		outputDir:    workingDir,
+	}, nil
+}
+
+// chunkURL returns the URL functional IDs of the chunk at index are generated from
+func chunkURL(mediaURL string, index int) string {
+	return fmt.Sprintf("%s#chunk-%d", mediaURL, index)
+}
+
+/*
+splitRawMedia splits the ingest file of media into chunks and removes it. On
+failure all chunk files created so far and the ingest file are removed
+*/
+func (c *ChunkingPreprocessor) splitRawMedia(media RawMedia) (VODManifest, error) {
+	defer os.Remove(media.File)
+	chunks := make([]VODSegment, 0)
+	fail := func(err error) (VODManifest, error) {
+		RemoveIngestArtifacts(MediaIngest{Type: VODMediaType, Result: VODManifest{
+			Streams: []VODStream{{Segments: chunks}},
+		}})
+		return VODManifest{}, err
+	}
+
+	mediaFile, err := os.Open(media.File)
+	if err != nil {
+		return fail(fmt.Errorf("failed to open ingest file %s: %w", media.File, err))
+	}
+	defer mediaFile.Close()
+
+	// Empty media still produces a single empty chunk
+	for index := 0; ; index++ {
+		chunkFile, err := os.CreateTemp(c.outputDir, ingestFilePattern)
+		if err != nil {
+			return fail(fmt.Errorf("failed to create chunk file: %w", err))
+		}
+		chunks = append(chunks, VODSegment{
+			Index:        index,
+			URL:          chunkURL(media.URL, index),
+			FunctionalID: "",
+			File:         chunkFile.Name(),
+		})
+
+		written, err := io.CopyN(chunkFile, mediaFile, c.chunkSize)
+		chunkFile.Close()
+		if err != nil && err != io.EOF {
+			return fail(fmt.Errorf("failed to write chunk %d of %s: %w", index, media.URL, err))
+		}
+
+		// Don't leave an empty trailing chunk when the size is a multiple of chunkSize
+		if written == 0 && index > 0 {
+			os.Remove(chunkFile.Name())
+			chunks = chunks[:len(chunks)-1]
+			break
+		}
+		if written < c.chunkSize {
+			break
+		}
+	}
+
+	return VODManifest{
+		URL:          media.URL,
+		FunctionalID: "",
+		Streams: []VODStream{{
+			URL:          DefaultStreamName,
+			FunctionalID: "",
+			Segments:     chunks,
+		}},
+	}, nil
+}
+
+// IngestMedia ingests url with the wrapped preprocessor and chunks any raw media result
+func (c *ChunkingPreprocessor) IngestMedia(url string) (MediaIngest, error) {
+	return c.IngestMediaObserved(url, nopProgressObserver{})
+}
+
+// IngestMediaObserved is IngestMedia reporting download progress to observer
+func (c *ChunkingPreprocessor) IngestMediaObserved(url string, observer ProgressObserver) (MediaIngest, error) {
+	ingest, err := ingestObserved(c.preprocessor, url, observer)
+	if err != nil || ingest.Type != RawMediaType {
+		return ingest, err
+	}
+
+	manifest, err := c.splitRawMedia(ingest.Result.(RawMedia))
+	if err != nil {
+		return MediaIngest{}, fmt.Errorf("failed to chunk %s: %w", url, err)
+	}
+	return MediaIngest{Type: VODMediaType, Result: manifest}, nil
+}
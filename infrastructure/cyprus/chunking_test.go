@@ -0,0 +1,87 @@
+package cyprus
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkingPreprocessor(t *testing.T) {
+	workingDir := t.TempDir()
+	raw := &RawPreprocessor{outputDir: workingDir, retrieveFile: CopyFromDisk}
+	chunker, err := NewChunkingPreprocessor(raw, 10, workingDir)
+	assert.Nil(t, err, "should not return error")
+
+	tests := []struct {
+		size       int
+		chunkSizes []int
+	}{
+		{25, []int{10, 10, 5}},
+		{20, []int{10, 10}},
+		{0, []int{0}},
+	}
+	for _, test := range tests {
+		content := []byte(strings.Repeat("x", test.size))
+		mediaFile := filepath.Join(t.TempDir(), "media.mp4")
+		assert.Nil(t, os.WriteFile(mediaFile, content, 0644), "failed to write test media")
+
+		ingest, err := chunker.IngestMedia(mediaFile)
+		assert.Nil(t, err, "should not return error")
+		assert.Equal(t, VODMediaType, ingest.Type, "chunked media should be a manifest")
+		manifest := ingest.Result.(VODManifest)
+		assert.Equal(t, mediaFile, manifest.URL, "wrong manifest url")
+		assert.Len(t, manifest.Streams, 1, "expected single chunk stream")
+
+		// Chunks reassemble to the original media
+		chunks := manifest.Streams[0].Segments
+		assert.Len(t, chunks, len(test.chunkSizes), "wrong number of chunks for %d bytes", test.size)
+		reassembled := &bytes.Buffer{}
+		for i, chunk := range chunks {
+			data, err := os.ReadFile(chunk.File)
+			assert.Nil(t, err, "should not return error")
+			assert.Equal(t, i, chunk.Index, "wrong chunk index")
+			assert.Equal(t, chunkURL(mediaFile, i), chunk.URL, "wrong chunk url")
+			assert.Len(t, data, test.chunkSizes[i], "wrong chunk size")
+			reassembled.Write(data)
+		}
+		assert.Equal(t, string(content), reassembled.String(), "chunks don't match original media")
+
+		// Only chunk files are left behind
+		files, _ := filepath.Glob(filepath.Join(workingDir, ingestFilePattern))
+		assert.Len(t, files, len(chunks), "unchunked ingest file not removed")
+		RemoveIngestArtifacts(ingest)
+	}
+}
+
+func TestChunkedMediaDigest(t *testing.T) {
+	workingDir := t.TempDir()
+	raw := &RawPreprocessor{outputDir: workingDir, retrieveFile: CopyFromDisk}
+	chunker, err := NewChunkingPreprocessor(raw, 4, workingDir)
+	assert.Nil(t, err, "should not return error")
+	processor, err := NewAESDataProcessor(DefaultAESKeySize, workingDir)
+	assert.Nil(t, err, "should not return error")
+
+	ingest, err := chunker.IngestMedia("./test_resources/hls/index_1_1.ts")
+	assert.Nil(t, err, "should not return error")
+	digest, err := processor.DigestMedia(ingest)
+	assert.Nil(t, err, "should not return error")
+	defer RemoveIngestArtifacts(MediaIngest{Type: digest.Type, Result: digest.Result})
+
+	// Every chunk is encrypted and checksummed under its own functional ID
+	partial := completeToPartialManifest(digest.Result.(VODManifest))
+	assert.Equal(t, digest.FunctionalID, partial.FunctionalID, "wrong manifest functional id")
+	assert.Len(t, partial.Segments, 3, "wrong number of chunks")
+	seen := make(map[string]bool)
+	for _, chunk := range partial.Segments {
+		assert.NotEmpty(t, chunk.Checksum, "chunk missing checksum")
+		assert.False(t, seen[chunk.FunctionalID], "chunk functional ids should be unique")
+		seen[chunk.FunctionalID] = true
+	}
+
+	_, err = NewChunkingPreprocessor(raw, 0, workingDir)
+	assert.NotNil(t, err, "expected invalid chunk size to fail")
+}
@@ -0,0 +1,149 @@
+package cyprus
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+In convergent mode every manifest segment is encrypted with a key derived from
+a keyed hash of its plaintext, so identical segments across titles encrypt to
+the same object under the same functional ID and are stored once. The segment
+key is published wrapped by the content key so clients still only need the key
+of the content they play. Keying the hash with a secret stops anyone without
+it from confirming a guessed plaintext by its functional ID
+*/
+const (
+	convergenceMinSecretSize = 16
+	segmentKeyNonceSize      = 12
+)
+
+// convergentSegment is what convergent mode derives from a segment plaintext
+type convergentSegment struct {
+	key          []byte
+	nonces       io.Reader
+	functionalID string
+}
+
+/*
+EnableConvergentSegments switches the processor to convergent encryption of
+manifest segments keyed by secret. Every cyprus instance publishing to the same
+storage must use the same secret for segments to be shared
+*/
+func (a *AESDataProcessor) EnableConvergentSegments(secret []byte) error {
+	if len(secret) < convergenceMinSecretSize {
+		return fmt.Errorf("convergence secret must be at least %d bytes, got %d", convergenceMinSecretSize, len(secret))
+	}
+	a.convergenceSecret = secret
+	return nil
+}
+
+/*
+deriveConvergentSegment derives the key, nonces and functional ID of the
+segment plaintext in fname. The output format is part of the derivation so
+segments digested with different settings never collide
+*/
+func (a *AESDataProcessor) deriveConvergentSegment(fname string) (convergentSegment, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return convergentSegment{}, fmt.Errorf("failed to open ingest file %s: %w", fname, err)
+	}
+	defer file.Close()
+
+	mac := hmac.New(sha256.New, a.convergenceSecret)
+	fmt.Fprintf(mac, "%s\n%d\n", a.sealMode, a.keySize)
+	if _, err = io.Copy(mac, file); err != nil {
+		return convergentSegment{}, fmt.Errorf("failed to hash ingest file %s: %w", fname, err)
+	}
+	material := mac.Sum(nil)
+
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, material)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	return convergentSegment{
+		key:          derive("key")[:a.keySize],
+		nonces:       bytes.NewReader(derive("nonce")),
+		functionalID: hex.EncodeToString(derive("fid")),
+	}, nil
+}
+
+// wrapSegmentKey seals segmentKey with the content cipher, bound to the segment fid
+func wrapSegmentKey(contentBlock cipher.Block, segmentKey []byte, fid string) (string, error) {
+	aead, err := cipher.NewGCM(contentBlock)
+	if err != nil {
+		return "", fmt.Errorf("failed to create key wrapping cipher: %w", err)
+	}
+	nonce, err := generateRandomBytes(segmentKeyNonceSize)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, segmentKey, []byte(fid))), nil
+}
+
+/*
+UnwrapSegmentKey returns the key the segment stored under fid was encrypted
+with. Segments without a wrapped key are encrypted with the content key
+*/
+func UnwrapSegmentKey(contentKey []byte, wrappedKey string, fid string) ([]byte, error) {
+	if wrappedKey == "" {
+		return contentKey, nil
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode wrapped key of segment %s: %w", fid, err)
+	}
+	if len(wrapped) < segmentKeyNonceSize {
+		return nil, fmt.Errorf("malformed wrapped key of segment %s", fid)
+	}
+
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key unwrapping cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key unwrapping cipher: %w", err)
+	}
+	key, err := aead.Open(nil, wrapped[:segmentKeyNonceSize], wrapped[segmentKeyNonceSize:], []byte(fid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap key of segment %s: %w", fid, err)
+	}
+	return key, nil
+}
+
+/*
+digestSegment assigns the segment its functional ID and digests it, encrypting
+it with the content cipher or, in convergent mode, its own derived key
+*/
+func (a *AESDataProcessor) digestSegment(block cipher.Block, fidCipher cipher.Stream, segment *VODSegment,
+	observer ProgressObserver) (digestedFile, error) {
+	if a.convergenceSecret == nil {
+		segment.FunctionalID = generateFunctionalID(segment.URL, fidCipher)
+		return a.digestFile(block, rand.Reader, segment.File, newSegmentFingerprint(block), observer)
+	}
+
+	convergent, err := a.deriveConvergentSegment(segment.File)
+	if err != nil {
+		return digestedFile{}, err
+	}
+	segmentBlock, err := aes.NewCipher(convergent.key)
+	if err != nil {
+		return digestedFile{}, fmt.Errorf("failed to generate segment cipher block: %w", err)
+	}
+	if segment.WrappedKey, err = wrapSegmentKey(block, convergent.key, convergent.functionalID); err != nil {
+		return digestedFile{}, err
+	}
+	segment.FunctionalID = convergent.functionalID
+	return a.digestFile(segmentBlock, convergent.nonces, segment.File, newSegmentFingerprint(block), observer)
+}
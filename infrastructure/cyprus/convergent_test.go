@@ -0,0 +1,68 @@
+package cyprus
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvergentSegments(t *testing.T) {
+	workingDir := t.TempDir()
+	processor, err := NewAESDataProcessor(DefaultAESKeySize, workingDir)
+	assert.Nil(t, err, "should not return error")
+	assert.NotNil(t, processor.EnableConvergentSegments([]byte("short")), "expected short secret to be rejected")
+	assert.Nil(t, processor.EnableConvergentSegments([]byte("0123456789abcdef")), "should not return error")
+
+	digestTitle := func(url string) (MediaDigest, VODSegment) {
+		ingestFile := filepath.Join(workingDir, "ingest_"+url)
+		os.WriteFile(ingestFile, []byte("shared segment"), 0644)
+		digest, err := processor.DigestMedia(MediaIngest{
+			Type: VODMediaType,
+			Result: VODManifest{
+				URL: url,
+				Streams: []VODStream{{
+					URL:      url + "/stream",
+					Segments: []VODSegment{{Index: 1, URL: url + "/segment.ts", File: ingestFile}},
+				}},
+			},
+		})
+		assert.Nil(t, err, "should not return error")
+		return digest, digest.Result.(VODManifest).Streams[0].Segments[0]
+	}
+
+	// Identical segments of different titles map to the same object
+	digest1, segment1 := digestTitle("title1")
+	digest2, segment2 := digestTitle("title2")
+	assert.NotEqual(t, digest1.CryptKey, digest2.CryptKey, "expected titles to keep their own keys")
+	assert.Equal(t, segment1.FunctionalID, segment2.FunctionalID, "expected identical segments to share a functional ID")
+	assert.Equal(t, segment1.Checksum, segment2.Checksum, "expected identical segments to encrypt identically")
+	data1, _ := os.ReadFile(segment1.File)
+	data2, _ := os.ReadFile(segment2.File)
+	assert.Equal(t, data1, data2, "expected identical segments to encrypt identically")
+
+	// Each title's key unwraps the segment key
+	segmentKey1, err := UnwrapSegmentKey(digest1.CryptKey, segment1.WrappedKey, segment1.FunctionalID)
+	assert.Nil(t, err, "should not return error")
+	segmentKey2, err := UnwrapSegmentKey(digest2.CryptKey, segment2.WrappedKey, segment2.FunctionalID)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, segmentKey1, segmentKey2, "expected titles to unwrap the same segment key")
+	_, err = UnwrapSegmentKey(digest1.CryptKey, segment2.WrappedKey, segment2.FunctionalID)
+	assert.NotNil(t, err, "expected key of another title to fail unwrapping")
+	_, err = UnwrapSegmentKey(digest1.CryptKey, segment1.WrappedKey, "otherfid")
+	assert.NotNil(t, err, "expected wrapped key to be bound to its functional ID")
+
+	block, err := aes.NewCipher(segmentKey1)
+	assert.Nil(t, err, "should not return error")
+	plaintext := make([]byte, len(data1)-aes.BlockSize)
+	cipher.NewCTR(block, data1[:aes.BlockSize]).XORKeyStream(plaintext, data1[aes.BlockSize:])
+	assert.Equal(t, "shared segment", string(plaintext), "wrong decrypted segment")
+
+	// Segments without a wrapped key use the content key
+	key, err := UnwrapSegmentKey(digest1.CryptKey, "", "fid")
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, digest1.CryptKey, key, "expected content key")
+}
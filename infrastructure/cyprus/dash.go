@@ -0,0 +1,477 @@
+package cyprus
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MPD manifest XML model. Only the elements needed to locate segments are parsed
+type (
+	mpdManifest struct {
+		MediaPresentationDuration string      `xml:"mediaPresentationDuration,attr"`
+		BaseURL                   string      `xml:"BaseURL"`
+		Periods                   []mpdPeriod `xml:"Period"`
+	}
+
+	mpdPeriod struct {
+		ID              string              `xml:"id,attr"`
+		Duration        string              `xml:"duration,attr"`
+		BaseURL         string              `xml:"BaseURL"`
+		SegmentBase     *mpdSegmentBase     `xml:"SegmentBase"`
+		SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+		SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+		AdaptationSets  []mpdAdaptationSet  `xml:"AdaptationSet"`
+	}
+
+	mpdAdaptationSet struct {
+		ID              string              `xml:"id,attr"`
+		BaseURL         string              `xml:"BaseURL"`
+		SegmentBase     *mpdSegmentBase     `xml:"SegmentBase"`
+		SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+		SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+		Representations []mpdRepresentation `xml:"Representation"`
+	}
+
+	mpdRepresentation struct {
+		ID              string              `xml:"id,attr"`
+		Bandwidth       int64               `xml:"bandwidth,attr"`
+		BaseURL         string              `xml:"BaseURL"`
+		SegmentBase     *mpdSegmentBase     `xml:"SegmentBase"`
+		SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+		SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	}
+
+	mpdURL struct {
+		SourceURL string `xml:"sourceURL,attr"`
+	}
+
+	mpdSegmentBase struct {
+		Initialization *mpdURL `xml:"Initialization"`
+	}
+
+	mpdSegmentURL struct {
+		Media string `xml:"media,attr"`
+	}
+
+	mpdSegmentList struct {
+		Initialization *mpdURL         `xml:"Initialization"`
+		SegmentURLs    []mpdSegmentURL `xml:"SegmentURL"`
+	}
+
+	mpdTimelineEntry struct {
+		Time     *uint64 `xml:"t,attr"`
+		Duration uint64  `xml:"d,attr"`
+		Repeat   int64   `xml:"r,attr"`
+	}
+
+	mpdSegmentTemplate struct {
+		Media          string             `xml:"media,attr"`
+		Initialization string             `xml:"initialization,attr"`
+		StartNumber    *uint64            `xml:"startNumber,attr"`
+		Timescale      *uint64            `xml:"timescale,attr"`
+		Duration       *uint64            `xml:"duration,attr"`
+		Timeline       []mpdTimelineEntry `xml:"SegmentTimeline>S"`
+	}
+)
+
+// Matches $Identifier$ and $Identifier%0Nd$ template substitutions
+var mpdTemplateIdentifier = regexp.MustCompile(`\$(RepresentationID|Number|Bandwidth|Time)(?:%0(\d+)d)?\$`)
+
+// Matches ISO 8601 durations as used by MPD duration attributes
+var mpdDurationPattern = regexp.MustCompile(
+	`^P(?:(\d+(?:\.\d+)?)Y)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseMPDDuration parses an ISO 8601 duration(ex. PT1H2M3.5S)
+func parseMPDDuration(duration string) (time.Duration, error) {
+	parts := mpdDurationPattern.FindStringSubmatch(duration)
+	if parts == nil || duration == "P" || duration == "PT" {
+		return 0, fmt.Errorf("invalid duration %s", duration)
+	}
+
+	// Years and months are approximated as the MPD spec does not fix their length
+	units := []time.Duration{365 * 24 * time.Hour, 30 * 24 * time.Hour, 24 * time.Hour,
+		time.Hour, time.Minute, time.Second}
+	total := time.Duration(0)
+	for i, unit := range units {
+		if parts[i+1] == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(parts[i+1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %s: %w", duration, err)
+		}
+		total += time.Duration(value * float64(unit))
+	}
+	return total, nil
+}
+
+// expandMPDTemplate substitutes SegmentTemplate identifiers with their values
+func expandMPDTemplate(template string, representation mpdRepresentation, number uint64, segmentTime uint64) string {
+	expanded := mpdTemplateIdentifier.ReplaceAllStringFunc(template, func(match string) string {
+		parts := mpdTemplateIdentifier.FindStringSubmatch(match)
+		var value interface{}
+		switch parts[1] {
+		case "RepresentationID":
+			return representation.ID
+		case "Number":
+			value = number
+		case "Bandwidth":
+			value = representation.Bandwidth
+		case "Time":
+			value = segmentTime
+		}
+		if parts[2] != "" {
+			return fmt.Sprintf("%0"+parts[2]+"d", value)
+		}
+		return fmt.Sprintf("%d", value)
+	})
+	return strings.ReplaceAll(expanded, "$$", "$")
+}
+
+// resolveMPDReference resolves 'ref' against 'base' the same way a browser resolves relative links
+func resolveMPDReference(base string, ref string) (string, error) {
+	if ref == "" {
+		return base, nil
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse base url %s: %w", base, err)
+	}
+	refURL, err := url.Parse(ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse reference url %s: %w", ref, err)
+	}
+
+	// Local file paths stay relative to the working directory
+	if !baseURL.IsAbs() && !refURL.IsAbs() && !path.IsAbs(ref) {
+		return path.Join(path.Dir(base), ref), nil
+	}
+	return baseURL.ResolveReference(refURL).String(), nil
+}
+
+// mergeSegmentTemplates layers a lower level SegmentTemplate over the inherited one
+func mergeSegmentTemplates(parent *mpdSegmentTemplate, child *mpdSegmentTemplate) *mpdSegmentTemplate {
+	if parent == nil {
+		return child
+	}
+	if child == nil {
+		return parent
+	}
+	merged := *parent
+	if child.Media != "" {
+		merged.Media = child.Media
+	}
+	if child.Initialization != "" {
+		merged.Initialization = child.Initialization
+	}
+	if child.StartNumber != nil {
+		merged.StartNumber = child.StartNumber
+	}
+	if child.Timescale != nil {
+		merged.Timescale = child.Timescale
+	}
+	if child.Duration != nil {
+		merged.Duration = child.Duration
+	}
+	if len(child.Timeline) > 0 {
+		merged.Timeline = child.Timeline
+	}
+	return &merged
+}
+
+// DASHPreprocessor implements DataPreprocessor for MPEG-DASH MPD Manifest Files
+type DASHPreprocessor struct {
+	outputDir    string
+	workers      int
+	retrieveFile func(string, io.Writer) error
+}
+
+/*
+NewDASHPreprocessor creates a new DASHPreprocessor where outputs are stored at workingDir.
+Segments are fetched with downloader, as many at once as its concurrency allows
+*/
+func NewDASHPreprocessor(workingDir string, downloader *Downloader) *DASHPreprocessor {
+	return &DASHPreprocessor{
+		outputDir:    workingDir,
+		workers:      downloader.Concurrency(),
+		retrieveFile: downloader.Download,
+	}
+}
+
+func (d *DASHPreprocessor) getManifest(manifestURL string) (*mpdManifest, error) {
+	buf := &bytes.Buffer{}
+	if err := d.retrieveFile(manifestURL, buf); err != nil {
+		return nil, fmt.Errorf("failed to download manifest at %s: %w", manifestURL, err)
+	}
+
+	manifest := &mpdManifest{}
+	if err := xml.Unmarshal(buf.Bytes(), manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse .mpd manifest %s: %w", manifestURL, err)
+	}
+	return manifest, nil
+}
+
+// templateSegments lists the segments described by a SegmentTemplate
+func (d *DASHPreprocessor) templateSegments(baseURL string, template *mpdSegmentTemplate,
+	representation mpdRepresentation, periodDuration time.Duration) ([]string, error) {
+	if template.Media == "" {
+		return nil, fmt.Errorf("segment template for representation %s has no media attribute", representation.ID)
+	}
+	startNumber := uint64(1)
+	if template.StartNumber != nil {
+		startNumber = *template.StartNumber
+	}
+	timescale := uint64(1)
+	if template.Timescale != nil && *template.Timescale > 0 {
+		timescale = *template.Timescale
+	}
+	periodEnd := uint64(periodDuration.Seconds() * float64(timescale))
+
+	segments := make([]string, 0)
+	if template.Initialization != "" {
+		initURL, err := resolveMPDReference(baseURL, expandMPDTemplate(template.Initialization, representation, 0, 0))
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, initURL)
+	}
+
+	addSegment := func(number uint64, segmentTime uint64) error {
+		segmentURL, err := resolveMPDReference(baseURL, expandMPDTemplate(template.Media, representation, number, segmentTime))
+		if err != nil {
+			return err
+		}
+		segments = append(segments, segmentURL)
+		return nil
+	}
+
+	number := startNumber
+	if len(template.Timeline) > 0 {
+		// Explicit timeline, repeat counts of -1 run until the end of the period
+		segmentTime := uint64(0)
+		for i, entry := range template.Timeline {
+			if entry.Time != nil {
+				segmentTime = *entry.Time
+			}
+			if entry.Duration == 0 {
+				return nil, fmt.Errorf("segment timeline entry %d has no duration", i)
+			}
+			repeat := entry.Repeat
+			if repeat < 0 {
+				end := periodEnd
+				if i+1 < len(template.Timeline) && template.Timeline[i+1].Time != nil {
+					end = *template.Timeline[i+1].Time
+				}
+				if end <= segmentTime {
+					return nil, fmt.Errorf("cannot resolve open ended segment timeline without a period duration")
+				}
+				repeat = int64((end-segmentTime+entry.Duration-1)/entry.Duration) - 1
+			}
+			for r := int64(0); r <= repeat; r++ {
+				if err := addSegment(number, segmentTime); err != nil {
+					return nil, err
+				}
+				number++
+				segmentTime += entry.Duration
+			}
+		}
+	} else {
+		// Fixed duration segments covering the whole period
+		if template.Duration == nil || *template.Duration == 0 {
+			return nil, fmt.Errorf("segment template for representation %s has no duration or timeline", representation.ID)
+		}
+		if periodDuration <= 0 {
+			return nil, fmt.Errorf("cannot count template segments without a period duration")
+		}
+		count := uint64(math.Ceil(float64(periodEnd) / float64(*template.Duration)))
+		for i := uint64(0); i < count; i++ {
+			if err := addSegment(number, i*(*template.Duration)); err != nil {
+				return nil, err
+			}
+			number++
+		}
+	}
+	return segments, nil
+}
+
+// listSegments lists the segments described by a SegmentList
+func (d *DASHPreprocessor) listSegments(baseURL string, list *mpdSegmentList) ([]string, error) {
+	segments := make([]string, 0, len(list.SegmentURLs)+1)
+	if list.Initialization != nil && list.Initialization.SourceURL != "" {
+		initURL, err := resolveMPDReference(baseURL, list.Initialization.SourceURL)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, initURL)
+	}
+	for _, segment := range list.SegmentURLs {
+		segmentURL, err := resolveMPDReference(baseURL, segment.Media)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segmentURL)
+	}
+	return segments, nil
+}
+
+/*
+baseSegments lists the segments of a single file representation. The whole file
+is fetched as one segment since byte ranged initialization data is contained in it
+*/
+func (d *DASHPreprocessor) baseSegments(baseURL string, base *mpdSegmentBase) ([]string, error) {
+	segments := make([]string, 0, 2)
+	if base != nil && base.Initialization != nil && base.Initialization.SourceURL != "" {
+		initURL, err := resolveMPDReference(baseURL, base.Initialization.SourceURL)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, initURL)
+	}
+	return append(segments, baseURL), nil
+}
+
+/*
+locateSegments lists the segments of a representation. Segment information is
+inherited from the adaptation set and period, with the lowest level taking precedence
+*/
+func (d *DASHPreprocessor) locateSegments(baseURL string, periodDuration time.Duration,
+	representation mpdRepresentation, adaptationSet mpdAdaptationSet, period mpdPeriod) ([]string, error) {
+	template := mergeSegmentTemplates(period.SegmentTemplate,
+		mergeSegmentTemplates(adaptationSet.SegmentTemplate, representation.SegmentTemplate))
+	levels := []struct {
+		list     *mpdSegmentList
+		template *mpdSegmentTemplate
+		base     *mpdSegmentBase
+	}{
+		{representation.SegmentList, representation.SegmentTemplate, representation.SegmentBase},
+		{adaptationSet.SegmentList, adaptationSet.SegmentTemplate, adaptationSet.SegmentBase},
+		{period.SegmentList, period.SegmentTemplate, period.SegmentBase},
+	}
+	for _, level := range levels {
+		switch {
+		case level.list != nil:
+			return d.listSegments(baseURL, level.list)
+		case level.template != nil:
+			return d.templateSegments(baseURL, template, representation, periodDuration)
+		case level.base != nil:
+			return d.baseSegments(baseURL, level.base)
+		}
+	}
+	return d.baseSegments(baseURL, nil)
+}
+
+// downloadStream fetches all segments of a representation into the working directory
+func (d *DASHPreprocessor) downloadStream(refs []string, observer ProgressObserver) (VODStream, error) {
+	segments, err := downloadSegments(refs, d.outputDir, d.workers, d.retrieveFile, observer)
+	if err != nil {
+		return VODStream{}, err
+	}
+	return VODStream{
+		FunctionalID: "",
+		Segments:     segments,
+	}, nil
+}
+
+/*
+Ingest fetches all data associated with manifestURL and creates an internal
+manifest object with one stream per representation in the MPD manifest
+*/
+func (d *DASHPreprocessor) IngestMedia(manifestURL string) (MediaIngest, error) {
+	return d.IngestMediaObserved(manifestURL, nopProgressObserver{})
+}
+
+// IngestMediaObserved is IngestMedia reporting download progress to observer
+func (d *DASHPreprocessor) IngestMediaObserved(manifestURL string, observer ProgressObserver) (MediaIngest, error) {
+	manifest, err := d.getManifest(manifestURL)
+	if err != nil {
+		return MediaIngest{}, fmt.Errorf("failed to download manifest %s: %w", manifestURL, err)
+	}
+	if len(manifest.Periods) == 0 {
+		return MediaIngest{}, fmt.Errorf("manifest %s contains no periods", manifestURL)
+	}
+
+	presentationDuration := time.Duration(0)
+	if manifest.MediaPresentationDuration != "" {
+		if presentationDuration, err = parseMPDDuration(manifest.MediaPresentationDuration); err != nil {
+			return MediaIngest{}, fmt.Errorf("failed to parse manifest %s: %w", manifestURL, err)
+		}
+	}
+	mpdBase, err := resolveMPDReference(manifestURL, manifest.BaseURL)
+	if err != nil {
+		return MediaIngest{}, fmt.Errorf("failed to resolve base url of %s: %w", manifestURL, err)
+	}
+
+	manifestResult := VODManifest{
+		URL:          manifestURL,
+		FunctionalID: "",
+		Streams:      make([]VODStream, 0),
+	}
+	ingestResult := MediaIngest{Type: VODMediaType, Result: manifestResult}
+	fail := func(err error) (MediaIngest, error) {
+		RemoveIngestArtifacts(ingestResult)
+		return MediaIngest{}, err
+	}
+
+	for p, period := range manifest.Periods {
+		// Single period presentations take their duration from the presentation
+		periodDuration := presentationDuration
+		if period.Duration != "" {
+			if periodDuration, err = parseMPDDuration(period.Duration); err != nil {
+				return fail(fmt.Errorf("failed to parse period %d of %s: %w", p, manifestURL, err))
+			}
+		} else if len(manifest.Periods) > 1 {
+			periodDuration = 0
+		}
+		periodBase, err := resolveMPDReference(mpdBase, period.BaseURL)
+		if err != nil {
+			return fail(fmt.Errorf("failed to resolve base url of period %d: %w", p, err))
+		}
+
+		for a, adaptationSet := range period.AdaptationSets {
+			adaptationBase, err := resolveMPDReference(periodBase, adaptationSet.BaseURL)
+			if err != nil {
+				return fail(fmt.Errorf("failed to resolve base url of adaptation set %d: %w", a, err))
+			}
+
+			for r, representation := range adaptationSet.Representations {
+				representationBase, err := resolveMPDReference(adaptationBase, representation.BaseURL)
+				if err != nil {
+					return fail(fmt.Errorf("failed to resolve base url of representation %s: %w", representation.ID, err))
+				}
+
+				refs, err := d.locateSegments(representationBase, periodDuration, representation, adaptationSet, period)
+				if err != nil {
+					return fail(fmt.Errorf("failed to locate segments of representation %s: %w", representation.ID, err))
+				}
+
+				stream, err := d.downloadStream(refs, observer)
+				if err != nil {
+					return fail(fmt.Errorf("failed to download representation %s: %w", representation.ID, err))
+				}
+
+				// Representation IDs are only unique within a period
+				representationID := representation.ID
+				if representationID == "" {
+					representationID = fmt.Sprintf("%d.%d", a, r)
+				}
+				stream.URL = fmt.Sprintf("%s#%d/%s", manifestURL, p, representationID)
+				manifestResult.Streams = append(manifestResult.Streams, stream)
+				ingestResult.Result = manifestResult
+			}
+		}
+	}
+
+	if len(manifestResult.Streams) == 0 {
+		return MediaIngest{}, fmt.Errorf("manifest %s contains no representations", manifestURL)
+	}
+	return ingestResult, nil
+}
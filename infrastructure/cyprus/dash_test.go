@@ -0,0 +1,85 @@
+package cyprus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMPDDuration(t *testing.T) {
+	duration, err := parseMPDDuration("PT1H2M3.5S")
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, time.Hour+2*time.Minute+3500*time.Millisecond, duration, "wrong duration")
+
+	duration, err = parseMPDDuration("P1DT12S")
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, 24*time.Hour+12*time.Second, duration, "wrong duration")
+
+	_, err = parseMPDDuration("PT")
+	assert.NotNil(t, err, "should fail on empty duration")
+	_, err = parseMPDDuration("12S")
+	assert.NotNil(t, err, "should fail on malformed duration")
+}
+
+func TestExpandMPDTemplate(t *testing.T) {
+	representation := mpdRepresentation{ID: "v1", Bandwidth: 5000}
+	assert.Equal(t, "v1/5000/seg_00042_900.m4s",
+		expandMPDTemplate("$RepresentationID$/$Bandwidth$/seg_$Number%05d$_$Time$.m4s", representation, 42, 900),
+		"wrong template expansion")
+	assert.Equal(t, "cost$_7.m4s", expandMPDTemplate("cost$$_$Number$.m4s", representation, 7, 0),
+		"wrong escaped template expansion")
+}
+
+func TestDASHPreprocessor(t *testing.T) {
+	preprocessor := &DASHPreprocessor{
+		outputDir:    "./test_resources/working",
+		retrieveFile: CopyFromDisk,
+	}
+
+	testFname := "./test_resources/dash/manifest.mpd"
+	ingest, err := preprocessor.IngestMedia(testFname)
+	if err != nil {
+		t.Fatalf("Failed to ingest media file %s: %v", testFname, err)
+	}
+	defer RemoveIngestArtifacts(ingest)
+
+	assert.Equal(t, VODMediaType, ingest.Type, "Ingest tag incorrect")
+	mediaManifest, ok := ingest.Result.(VODManifest)
+	if !ok {
+		t.Fatalf("Failed to return proper type manifest")
+	}
+	assert.Equal(t, testFname, mediaManifest.URL, "Wrong stored URL")
+
+	// One stream per representation with initialization segments first
+	expected := map[string][]string{
+		testFname + "#0/v1": {"video_v1_init.mp4", "video_v1_01.m4s", "video_v1_02.m4s"},
+		testFname + "#0/v2": {"video_v2_init.mp4", "video_v2_01.m4s", "video_v2_02.m4s"},
+		testFname + "#0/a1": {"audio_init.mp4", "audio_0.m4s", "audio_6000.m4s"},
+		testFname + "#0/t1": {"text_init.mp4", "text_1.m4s", "text_2.m4s"},
+		testFname + "#0/s1": {"single/full.mp4"},
+	}
+	assert.Equal(t, len(expected), len(mediaManifest.Streams), "Wrong number of parsed streams")
+	for _, stream := range mediaManifest.Streams {
+		segmentNames, ok := expected[stream.URL]
+		if !ok {
+			t.Fatalf("Unexpected stream %s", stream.URL)
+		}
+		assert.Equal(t, len(segmentNames), len(stream.Segments), "Wrong number of segments for %s", stream.URL)
+		for i, segment := range stream.Segments {
+			assert.Equal(t, i, segment.Index, "Wrong segment index")
+			assert.Equal(t, "test_resources/dash/"+segmentNames[i], segment.URL, "Wrong segment URL")
+			assert.FileExists(t, segment.File, "Segment was not downloaded")
+		}
+	}
+}
+
+func TestDASHPreprocessorMissingManifest(t *testing.T) {
+	preprocessor := &DASHPreprocessor{
+		outputDir:    "./test_resources/working",
+		retrieveFile: CopyFromDisk,
+	}
+
+	_, err := preprocessor.IngestMedia("./test_resources/dash/missing.mpd")
+	assert.NotNil(t, err, "should fail on missing manifest")
+}
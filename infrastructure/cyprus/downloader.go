@@ -0,0 +1,312 @@
+package cyprus
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults used for unset DownloaderConfig fields
+const (
+	DefaultDownloadConcurrency  = 4
+	DefaultDownloadTimeout      = time.Minute * 5
+	DefaultDownloadAttempts     = 3
+	DefaultDownloadRetryBackoff = time.Second
+)
+
+// DownloaderConfig configures the limits and retries of a Downloader
+type DownloaderConfig struct {
+	// Max number of requests in flight across all users of the downloader
+	Concurrency int
+
+	// Max duration of a single request including reading the body
+	Timeout time.Duration
+
+	/* Number of times a download is attempted, waiting RetryBackoff after
+	the first failure and doubling after every further one */
+	MaxAttempts  int
+	RetryBackoff time.Duration
+
+	// Max accepted size of a single download in bytes. 0 means unlimited
+	MaxSize int64
+}
+
+// errPermanentDownload marks download failures that retrying can't fix
+type errPermanentDownload struct {
+	err error
+}
+
+func (e *errPermanentDownload) Error() string { return e.err.Error() }
+func (e *errPermanentDownload) Unwrap() error { return e.err }
+
+/*
+Downloader fetches remote media over HTTP. Requests are bounded in number,
+time limited and rejected on non-2xx responses. Interrupted downloads are
+resumed with Range requests and bodies are validated against Content-Length.
+Requests to origins with an OriginProfile are made as the profile describes
+*/
+type Downloader struct {
+	client       *http.Client
+	slots        chan struct{}
+	maxAttempts  int
+	retryBackoff time.Duration
+	maxSize      int64
+	origins      []originProfile
+}
+
+// NewDownloader creates a Downloader, using defaults for any unset configuration
+func NewDownloader(conf DownloaderConfig) *Downloader {
+	if conf.Concurrency <= 0 {
+		conf.Concurrency = DefaultDownloadConcurrency
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = DefaultDownloadTimeout
+	}
+	if conf.MaxAttempts <= 0 {
+		conf.MaxAttempts = DefaultDownloadAttempts
+	}
+	if conf.RetryBackoff <= 0 {
+		conf.RetryBackoff = DefaultDownloadRetryBackoff
+	}
+	return &Downloader{
+		client:       &http.Client{Timeout: conf.Timeout},
+		slots:        make(chan struct{}, conf.Concurrency),
+		maxAttempts:  conf.MaxAttempts,
+		retryBackoff: conf.RetryBackoff,
+		maxSize:      conf.MaxSize,
+	}
+}
+
+// Concurrency returns the max number of requests the downloader runs at once
+func (d *Downloader) Concurrency() int {
+	return cap(d.slots)
+}
+
+// countingWriter tracks how many bytes have been written through it
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+}
+
+func (c *countingWriter) Write(data []byte) (int, error) {
+	n, err := c.writer.Write(data)
+	c.written += int64(n)
+	return n, err
+}
+
+// writeError marks failures of the destination writer so they aren't retried
+type writeError struct {
+	err error
+}
+
+func (e *writeError) Error() string { return e.err.Error() }
+
+// destinationWriter wraps errors of the writer a download goes to in writeError
+type destinationWriter struct {
+	writer io.Writer
+}
+
+func (w *destinationWriter) Write(data []byte) (int, error) {
+	n, err := w.writer.Write(data)
+	if err != nil {
+		return n, &writeError{err}
+	}
+	return n, nil
+}
+
+// contentRangeTotal parses the complete length from a 'bytes start-end/total' Content-Range header
+func contentRangeTotal(header string) (int64, bool) {
+	slash := strings.LastIndex(header, "/")
+	if !strings.HasPrefix(header, "bytes ") || slash < 0 {
+		return -1, false
+	}
+	total, err := strconv.ParseInt(header[slash+1:], 10, 64)
+	if err != nil {
+		return -1, false
+	}
+	return total, true
+}
+
+/*
+attempt makes one request for the length bytes of url starting at start,
+continuing from the bytes already written to out. A negative length requests
+everything after start. Returns the expected complete size of the download
+or -1 if it is unknown
+*/
+func (d *Downloader) attempt(url string, start int64, length int64, out *countingWriter) (int64, error) {
+	d.slots <- struct{}{}
+	defer func() { <-d.slots }()
+
+	req, client, err := d.newRequest(url)
+	if err != nil {
+		return -1, &errPermanentDownload{err}
+	}
+	position := start + out.written
+	if length >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", position, start+length-1))
+	} else if position > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", position))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+
+	// Determine where the body starts relative to start and how large the download is
+	offset := -start
+	total := int64(-1)
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && req.Header.Get("Range") != "":
+		offset = out.written
+		if rangeTotal, ok := contentRangeTotal(resp.Header.Get("Content-Range")); ok {
+			total = rangeTotal - start
+		}
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", position)) {
+			return -1, fmt.Errorf("server resumed %s at wrong offset: %s", url, resp.Header.Get("Content-Range"))
+		}
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299 && resp.StatusCode != http.StatusPartialContent:
+		if resp.ContentLength >= 0 {
+			total = resp.ContentLength - start
+		}
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return -1, fmt.Errorf("bad HTTP status downloading %s: %s", url, resp.Status)
+	default:
+		return -1, &errPermanentDownload{fmt.Errorf("bad HTTP status downloading %s: %s", url, resp.Status)}
+	}
+	if length >= 0 {
+		total = length
+	}
+	if d.maxSize > 0 && total > d.maxSize {
+		return -1, &errPermanentDownload{fmt.Errorf("%s is %d bytes, exceeding limit of %d", url, total, d.maxSize)}
+	}
+
+	// Servers ignoring the Range header restart from the beginning so skip what was already written
+	body := io.Reader(resp.Body)
+	if offset < out.written {
+		if _, err = io.CopyN(io.Discard, body, out.written-offset); err != nil {
+			return total, err
+		}
+	}
+	if length >= 0 {
+		body = io.LimitReader(body, length-out.written)
+	}
+	if d.maxSize > 0 {
+		body = io.LimitReader(body, d.maxSize-out.written+1)
+	}
+	if _, err = io.Copy(out, body); err != nil {
+		var writeErr *writeError
+		if errors.As(err, &writeErr) {
+			return total, &errPermanentDownload{writeErr.err}
+		}
+		return total, err
+	}
+	if d.maxSize > 0 && out.written > d.maxSize {
+		return total, &errPermanentDownload{fmt.Errorf("%s exceeds size limit of %d bytes", url, d.maxSize)}
+	}
+	return total, nil
+}
+
+/*
+Download writes the resource at url to out. Transient failures are retried
+with backoff and resume from where the previous attempt stopped
+*/
+func (d *Downloader) Download(url string, out io.Writer) error {
+	return d.download(url, 0, -1, out)
+}
+
+// DownloadRange is Download for the length bytes of the resource at url starting at offset
+func (d *Downloader) DownloadRange(url string, offset int64, length int64, out io.Writer) error {
+	if offset < 0 || length <= 0 {
+		return fmt.Errorf("invalid byte range %d@%d of %s", length, offset, url)
+	}
+	return d.download(url, offset, length, out)
+}
+
+// download writes the length bytes of the resource at url starting at start to out
+func (d *Downloader) download(url string, start int64, length int64, out io.Writer) error {
+	counter := &countingWriter{writer: &destinationWriter{out}}
+	var err error
+	for attempt := 1; attempt <= d.maxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(d.retryBackoff << (attempt - 2))
+		}
+
+		var total int64
+		total, err = d.attempt(url, start, length, counter)
+		if err == nil {
+			if total >= 0 && counter.written != total {
+				err = fmt.Errorf("downloaded %d bytes of %s, expected %d", counter.written, url, total)
+				continue
+			}
+			return nil
+		}
+
+		var permanent *errPermanentDownload
+		if errors.As(err, &permanent) {
+			return permanent.err
+		}
+	}
+	return fmt.Errorf("failed to download %s after %d attempts: %w", url, d.maxAttempts, err)
+}
+
+/*
+Peek returns the Content-Type the server declares for url along with up to
+length bytes from the start of the resource. A ranged request keeps servers
+supporting ranges from sending the rest, and servers that don't are cut off
+*/
+func (d *Downloader) Peek(url string, length int64) (string, []byte, error) {
+	var err error
+	for attempt := 1; attempt <= d.maxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(d.retryBackoff << (attempt - 2))
+		}
+
+		var contentType string
+		var head []byte
+		contentType, head, err = d.peekAttempt(url, length)
+		if err == nil {
+			return contentType, head, nil
+		}
+
+		var permanent *errPermanentDownload
+		if errors.As(err, &permanent) {
+			return "", nil, permanent.err
+		}
+	}
+	return "", nil, fmt.Errorf("failed to peek %s after %d attempts: %w", url, d.maxAttempts, err)
+}
+
+// peekAttempt makes one request for the start of the resource at url
+func (d *Downloader) peekAttempt(url string, length int64) (string, []byte, error) {
+	d.slots <- struct{}{}
+	defer func() { <-d.slots }()
+
+	req, client, err := d.newRequest(url)
+	if err != nil {
+		return "", nil, &errPermanentDownload{err}
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", length-1))
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return "", nil, fmt.Errorf("bad HTTP status peeking %s: %s", url, resp.Status)
+	default:
+		return "", nil, &errPermanentDownload{fmt.Errorf("bad HTTP status peeking %s: %s", url, resp.Status)}
+	}
+	head, err := io.ReadAll(io.LimitReader(resp.Body, length))
+	if err != nil {
+		return "", nil, err
+	}
+	return resp.Header.Get("Content-Type"), head, nil
+}
@@ -0,0 +1,233 @@
+package cyprus
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloaderRejectsBadStatus(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requests++
+		resp.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	downloader := NewDownloader(DownloaderConfig{MaxAttempts: 3, RetryBackoff: time.Millisecond})
+	buf := &bytes.Buffer{}
+	err := downloader.Download(server.URL, buf)
+	assert.NotNil(t, err, "expected 404 to be rejected")
+	assert.Equal(t, 1, requests, "client errors should not be retried")
+	assert.Zero(t, buf.Len(), "error body should not be written")
+}
+
+func TestDownloaderResume(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100))
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		ranges = append(ranges, req.Header.Get("Range"))
+
+		// First request is cut off half way through the body
+		if len(ranges) == 1 {
+			resp.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			resp.Write(content[:len(content)/2])
+			resp.(http.Flusher).Flush()
+			conn, _, _ := resp.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		http.ServeContent(resp, req, "media.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	downloader := NewDownloader(DownloaderConfig{MaxAttempts: 2, RetryBackoff: time.Millisecond})
+	buf := &bytes.Buffer{}
+	err := downloader.Download(server.URL, buf)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, content, buf.Bytes(), "resumed download is corrupted")
+	assert.Equal(t, []string{"", fmt.Sprintf("bytes=%d-", len(content)/2)}, ranges, "wrong range requests")
+}
+
+func TestDownloaderRange(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100))
+	ignoreRanges := false
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		ranges = append(ranges, req.Header.Get("Range"))
+		if ignoreRanges {
+			resp.Write(content)
+			return
+		}
+
+		// First request is cut off after 5 bytes of the range
+		if len(ranges) == 1 {
+			resp.Header().Set("Content-Range", fmt.Sprintf("bytes 100-149/%d", len(content)))
+			resp.Header().Set("Content-Length", "50")
+			resp.WriteHeader(http.StatusPartialContent)
+			resp.Write(content[100:105])
+			resp.(http.Flusher).Flush()
+			conn, _, _ := resp.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		http.ServeContent(resp, req, "media.ts", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	downloader := NewDownloader(DownloaderConfig{MaxAttempts: 2, RetryBackoff: time.Millisecond})
+	buf := &bytes.Buffer{}
+	assert.Nil(t, downloader.DownloadRange(server.URL, 100, 50, buf), "should not return error")
+	assert.Equal(t, content[100:150], buf.Bytes(), "resumed range download is corrupted")
+	assert.Equal(t, []string{"bytes=100-149", "bytes=105-149"}, ranges, "wrong range requests")
+
+	// Servers ignoring ranges are cut down to the range
+	ignoreRanges = true
+	buf.Reset()
+	assert.Nil(t, downloader.DownloadRange(server.URL, 20, 10, buf), "should not return error")
+	assert.Equal(t, content[20:30], buf.Bytes(), "wrong range of full response")
+
+	assert.NotNil(t, downloader.DownloadRange(server.URL, 0, 0, buf), "expected empty range to be rejected")
+}
+
+func TestDownloaderValidatesSize(t *testing.T) {
+	content := []byte(strings.Repeat("a", 100))
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/short" {
+			resp.Header().Set("Content-Length", strconv.Itoa(len(content)*2))
+			resp.Write(content)
+			return
+		}
+		resp.Write(content)
+	}))
+	defer server.Close()
+
+	// Bodies shorter than Content-Length fail once attempts run out
+	downloader := NewDownloader(DownloaderConfig{MaxAttempts: 1})
+	err := downloader.Download(server.URL+"/short", &bytes.Buffer{})
+	assert.NotNil(t, err, "expected truncated body to fail")
+
+	// Downloads over the size limit are rejected
+	downloader = NewDownloader(DownloaderConfig{MaxSize: int64(len(content) - 1)})
+	err = downloader.Download(server.URL, &bytes.Buffer{})
+	assert.NotNil(t, err, "expected oversized download to fail")
+
+	downloader = NewDownloader(DownloaderConfig{MaxSize: int64(len(content))})
+	buf := &bytes.Buffer{}
+	err = downloader.Download(server.URL, buf)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, content, buf.Bytes(), "wrong downloaded content")
+}
+
+func TestDownloaderConcurrency(t *testing.T) {
+	mutex := &sync.Mutex{}
+	active, maxActive := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mutex.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+		resp.Write([]byte(req.URL.Path))
+
+		mutex.Lock()
+		active--
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	downloader := NewDownloader(DownloaderConfig{Concurrency: 2})
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := &bytes.Buffer{}
+			err := downloader.Download(fmt.Sprintf("%s/%d", server.URL, i), buf)
+			assert.Nil(t, err, "should not return error")
+			assert.Equal(t, fmt.Sprintf("/%d", i), buf.String(), "wrong downloaded content")
+		}(i)
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, maxActive, 2, "too many concurrent requests")
+}
+
+func TestDownloadSegmentsOrder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte(req.URL.Path))
+	}))
+	defer server.Close()
+
+	workingDir := t.TempDir()
+	downloader := NewDownloader(DownloaderConfig{Concurrency: 3})
+	urls := make([]string, 10)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("%s/%d", server.URL, i)
+	}
+	segments, err := downloadSegments(urls, workingDir, downloader.Concurrency(), downloader.Download,
+		nopProgressObserver{})
+	assert.Nil(t, err, "should not return error")
+	assert.Len(t, segments, len(urls), "wrong number of segments")
+	for i, segment := range segments {
+		assert.Equal(t, i, segment.Index, "wrong segment index")
+		assert.Equal(t, urls[i], segment.URL, "wrong segment url")
+		assert.FileExists(t, segment.File, "segment not downloaded")
+	}
+
+	// A single failed segment removes every downloaded file
+	urls = append(urls, server.URL+"/missing")
+	failing := func(url string, out io.Writer) error {
+		if strings.HasSuffix(url, "/missing") {
+			return fmt.Errorf("not found")
+		}
+		return downloader.Download(url, out)
+	}
+	_, err = downloadSegments(urls, workingDir, 2, failing, nopProgressObserver{})
+	assert.NotNil(t, err, "expected failed segment to fail download")
+	remaining, _ := filepath.Glob(filepath.Join(workingDir, ingestFilePattern))
+	assert.Len(t, remaining, len(segments), "failed download left files behind")
+}
+
+func TestDownloaderPeek(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+		resp.Header().Set("Content-Type", "video/mp4")
+		if req.URL.Path == "/norange" {
+			resp.Write([]byte(content))
+			return
+		}
+		http.ServeContent(resp, req, "", time.Time{}, strings.NewReader(content))
+	}))
+	defer server.Close()
+
+	downloader := NewDownloader(DownloaderConfig{MaxAttempts: 2, RetryBackoff: time.Millisecond})
+	contentType, head, err := downloader.Peek(server.URL, 16)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, "video/mp4", contentType, "wrong content type")
+	assert.Equal(t, content[:16], string(head), "wrong head")
+
+	// Servers ignoring the range are cut off
+	_, head, err = downloader.Peek(server.URL+"/norange", 16)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, content[:16], string(head), "wrong head")
+
+	_, _, err = downloader.Peek(server.URL+"/missing", 16)
+	assert.NotNil(t, err, "expected 404 to be rejected")
+}
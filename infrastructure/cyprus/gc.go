@@ -0,0 +1,124 @@
+package cyprus
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/Apiara/ApiaraCDN/infrastructure/state"
+)
+
+/*
+StorageGCReport describes what a StorageGC pass found. Files are named by their
+place in the storage layout, e.g. /cryptdata/<fid>, and Missing maps content IDs
+to the resources state lists for them that don't exist
+*/
+type StorageGCReport struct {
+	Unreferenced []string
+	Deleted      []string
+	Missing      map[string][]string
+}
+
+/*
+StorageGC reconciles the storage dir of a FilesystemStorageManager with the
+resource lists in state. Files no content references are only collected once
+older than the grace period, which must exceed the longest running publish so
+files moved into place before their state entry is written are never collected
+*/
+type StorageGC struct {
+	storageDir   string
+	contentState state.ContentMetadataStateReader
+	gracePeriod  time.Duration
+}
+
+// NewStorageGC creates a new StorageGC for storageDir indexed by contentState
+func NewStorageGC(storageDir string, contentState state.ContentMetadataStateReader,
+	gracePeriod time.Duration) *StorageGC {
+	return &StorageGC{
+		storageDir:   storageDir,
+		contentState: contentState,
+		gracePeriod:  gracePeriod,
+	}
+}
+
+// referencedFiles returns the set of files referenced by state and records those that are missing in report
+func (g *StorageGC) referencedFiles(report *StorageGCReport) (map[string]bool, error) {
+	contentList, err := g.contentState.ContentList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list content: %w", err)
+	}
+
+	referenced := make(map[string]bool)
+	for _, cid := range contentList {
+		resources, err := g.contentState.GetContentResources(cid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read resource list for %s: %w", cid, err)
+		}
+		for _, resource := range resources {
+			name, ok := layoutName(resource)
+			if !ok {
+				continue
+			}
+			referenced[name] = true
+			if _, err = os.Stat(path.Join(g.storageDir, name)); os.IsNotExist(err) {
+				report.Missing[cid] = append(report.Missing[cid], name)
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to check resource %s of %s: %w", name, cid, err)
+			}
+		}
+	}
+	return referenced, nil
+}
+
+/*
+Collect finds files in the storage dirs that no content in state references and
+that are older than the grace period, deleting them if deleteUnreferenced is set,
+along with resources state references that are missing
+*/
+func (g *StorageGC) Collect(deleteUnreferenced bool) (StorageGCReport, error) {
+	report := StorageGCReport{
+		Unreferenced: make([]string, 0),
+		Deleted:      make([]string, 0),
+		Missing:      make(map[string][]string),
+	}
+	referenced, err := g.referencedFiles(&report)
+	if err != nil {
+		return report, err
+	}
+
+	cutoff := time.Now().Add(-g.gracePeriod)
+	for _, layoutDir := range storageLayoutDirs {
+		dir := path.Join(g.storageDir, layoutDir)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return report, fmt.Errorf("failed to list %s: %w", dir, err)
+		}
+
+		for _, entry := range entries {
+			name := path.Join(layoutDir, entry.Name())
+			if entry.IsDir() || referenced[name] {
+				continue
+			}
+			info, err := entry.Info()
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return report, fmt.Errorf("failed to stat %s: %w", name, err)
+			}
+			if info.ModTime().After(cutoff) {
+				continue
+			}
+
+			report.Unreferenced = append(report.Unreferenced, name)
+			if !deleteUnreferenced {
+				continue
+			}
+			if err = os.Remove(path.Join(g.storageDir, name)); err != nil && !os.IsNotExist(err) {
+				return report, fmt.Errorf("failed to delete unreferenced %s: %w", name, err)
+			}
+			report.Deleted = append(report.Deleted, name)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,78 @@
+package cyprus
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+	"github.com/Apiara/ApiaraCDN/infrastructure/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorageGC(t *testing.T) {
+	storageDir := t.TempDir()
+	contentState := state.NewMockMicroserviceState()
+	kek, _ := newKeyEncryptionKey(make([]byte, kekSize))
+	storage, err := NewFilesystemStorageManager(storageDir, contentState, kek)
+	assert.Nil(t, err, "should not return error")
+
+	// Publish referenced content, then age everything past the grace period
+	dataFile := filepath.Join(t.TempDir(), "digest_data")
+	os.WriteFile(dataFile, []byte("data"), 0644)
+	err = storage.Publish(MediaDigest{
+		Type:     RawMediaType,
+		CryptKey: []byte("0123456789abcdef"),
+		Result:   RawMedia{URL: "url", FunctionalID: "fid", File: dataFile},
+	})
+	assert.Nil(t, err, "should not return error")
+
+	old := time.Now().Add(-2 * time.Hour)
+	orphans := []string{
+		path.Join(infra.CryptDataStorageDir, "orphan"),
+		path.Join(infra.AESKeyStorageDir, "orphan"),
+		path.Join(infra.PartialMapDir, "orphan"),
+		path.Join(infra.CompleteMediaMapDir, "orphan"),
+	}
+	for _, name := range orphans {
+		os.WriteFile(filepath.Join(storageDir, name), []byte("orphan"), 0644)
+	}
+	for _, layoutDir := range storageLayoutDirs {
+		entries, _ := os.ReadDir(filepath.Join(storageDir, layoutDir))
+		for _, entry := range entries {
+			os.Chtimes(filepath.Join(storageDir, layoutDir, entry.Name()), old, old)
+		}
+	}
+	recent := path.Join(infra.CryptDataStorageDir, "recent")
+	os.WriteFile(filepath.Join(storageDir, recent), []byte("recent"), 0644)
+
+	missing := path.Join(infra.PartialMapDir, "fid")
+	os.Remove(filepath.Join(storageDir, missing))
+
+	// Reporting leaves files in place
+	gc := NewStorageGC(storageDir, contentState, time.Hour)
+	report, err := gc.Collect(false)
+	assert.Nil(t, err, "should not return error")
+	assert.ElementsMatch(t, orphans, report.Unreferenced, "wrong unreferenced files")
+	assert.Empty(t, report.Deleted, "expected nothing to be deleted")
+	assert.Equal(t, map[string][]string{"url": {missing}}, report.Missing, "wrong missing files")
+	for _, name := range orphans {
+		_, err = os.Stat(filepath.Join(storageDir, name))
+		assert.Nil(t, err, "expected %s to be kept", name)
+	}
+
+	// Deleting only removes unreferenced files past the grace period
+	report, err = gc.Collect(true)
+	assert.Nil(t, err, "should not return error")
+	assert.ElementsMatch(t, orphans, report.Deleted, "wrong deleted files")
+	for _, name := range orphans {
+		_, err = os.Stat(filepath.Join(storageDir, name))
+		assert.True(t, os.IsNotExist(err), "expected %s to be deleted", name)
+	}
+	for _, name := range []string{recent, path.Join(infra.CryptDataStorageDir, "fid")} {
+		_, err = os.Stat(filepath.Join(storageDir, name))
+		assert.Nil(t, err, "expected %s to be kept", name)
+	}
+}
@@ -0,0 +1,217 @@
+package cyprus
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// DefaultGCMChunkSize is the number of plaintext bytes sealed together by AESGCMDataProcessor
+const DefaultGCMChunkSize = 64 * 1024
+
+// Version of the chunked AES-GCM content format written by AESGCMDataProcessor
+const GCMFormatVersion byte = 1
+
+/*
+Encryption modes a deployment publishes content in. The mode is configured
+rather than read from content so readers can't be made to skip authentication
+*/
+const (
+	CTREncryptionMode = "ctr"
+	GCMEncryptionMode = "gcm"
+)
+
+/*
+Chunked AES-GCM content starts with a header of the format magic, version,
+plaintext chunk size and a random nonce prefix. Each chunk is sealed with a
+nonce made of the prefix, the chunk index and a flag marking the final chunk,
+with the header as additional data, so chunks can't be modified, reordered,
+dropped or truncated without failing authentication
+*/
+const (
+	gcmMagic           = "APGC"
+	gcmNoncePrefixSize = 7
+
+	// Bounds the memory a forged header can make a reader allocate
+	gcmMaxChunkSize = 16 * 1024 * 1024
+)
+
+// GCMHeaderSize is the length of the header preceding chunked AES-GCM content
+const GCMHeaderSize = len(gcmMagic) + 1 + 4 + gcmNoncePrefixSize
+
+// gcmHeader is the parsed header of chunked AES-GCM content
+type gcmHeader struct {
+	version     byte
+	chunkSize   uint32
+	noncePrefix []byte
+}
+
+func (h gcmHeader) encode() []byte {
+	header := make([]byte, 0, GCMHeaderSize)
+	header = append(header, gcmMagic...)
+	header = append(header, h.version)
+	header = binary.BigEndian.AppendUint32(header, h.chunkSize)
+	return append(header, h.noncePrefix...)
+}
+
+func decodeGCMHeader(header []byte) (gcmHeader, error) {
+	if !IsAESGCMContent(header) {
+		return gcmHeader{}, fmt.Errorf("missing chunked AES-GCM header")
+	}
+	parsed := gcmHeader{
+		version:     header[len(gcmMagic)],
+		chunkSize:   binary.BigEndian.Uint32(header[len(gcmMagic)+1:]),
+		noncePrefix: header[len(gcmMagic)+5 : GCMHeaderSize],
+	}
+	if parsed.version != GCMFormatVersion {
+		return gcmHeader{}, fmt.Errorf("unsupported chunked AES-GCM format version %d", parsed.version)
+	}
+	if parsed.chunkSize == 0 || parsed.chunkSize > gcmMaxChunkSize {
+		return gcmHeader{}, fmt.Errorf("invalid chunked AES-GCM chunk size %d", parsed.chunkSize)
+	}
+	return parsed, nil
+}
+
+// IsAESGCMContent returns whether data begins with a chunked AES-GCM header
+func IsAESGCMContent(data []byte) bool {
+	return len(data) >= GCMHeaderSize && bytes.Equal(data[:len(gcmMagic)], []byte(gcmMagic))
+}
+
+// gcmNonce returns the nonce of the chunk at index
+func gcmNonce(prefix []byte, index uint32, final bool) []byte {
+	nonce := make([]byte, 0, gcmNoncePrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, index)
+	if final {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+/*
+sealAESGCM writes plain to out as chunked AES-GCM content using chunkSize byte
+chunks and a nonce prefix read from nonces
+*/
+func sealAESGCM(block cipher.Block, chunkSize int, nonces io.Reader, plain io.Reader, out io.Writer) error {
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("failed to create GCM cipher: %w", err)
+	}
+	noncePrefix := make([]byte, gcmNoncePrefixSize)
+	if _, err = io.ReadFull(nonces, noncePrefix); err != nil {
+		return fmt.Errorf("failed to generate nonce prefix: %w", err)
+	}
+	header := gcmHeader{version: GCMFormatVersion, chunkSize: uint32(chunkSize), noncePrefix: noncePrefix}.encode()
+	if _, err = out.Write(header); err != nil {
+		return fmt.Errorf("failed to write content header: %w", err)
+	}
+
+	// Always seal at least one, possibly empty, final chunk so truncation is detectable
+	reader := bufio.NewReader(plain)
+	chunk := make([]byte, chunkSize)
+	sealed := make([]byte, 0, chunkSize+aead.Overhead())
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(reader, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("failed to read chunk %d: %w", index, err)
+		}
+		_, peekErr := reader.Peek(1)
+		final := peekErr == io.EOF
+		if peekErr != nil && !final {
+			return fmt.Errorf("failed to read chunk %d: %w", index+1, peekErr)
+		}
+		if index == ^uint32(0) && !final {
+			return fmt.Errorf("content exceeds max number of chunks")
+		}
+
+		sealed = aead.Seal(sealed[:0], gcmNonce(noncePrefix, index, final), chunk[:n], header)
+		if _, err = out.Write(sealed); err != nil {
+			return fmt.Errorf("failed to write encrypted chunk %d: %w", index, err)
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+/*
+DecryptAESGCM authenticates and decrypts chunked AES-GCM content from in with
+key, writing the plaintext to out. Every chunk is authenticated before it is
+written so tampering is detected at the first modified chunk
+*/
+func DecryptAESGCM(key []byte, in io.Reader, out io.Writer) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("failed to create block cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("failed to create GCM cipher: %w", err)
+	}
+
+	header := make([]byte, GCMHeaderSize)
+	if _, err = io.ReadFull(in, header); err != nil {
+		return fmt.Errorf("failed to read content header: %w", err)
+	}
+	parsed, err := decodeGCMHeader(header)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(in)
+	sealed := make([]byte, int(parsed.chunkSize)+aead.Overhead())
+	plain := make([]byte, 0, parsed.chunkSize)
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(reader, sealed)
+		if err == io.EOF {
+			return fmt.Errorf("content truncated before final chunk")
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("failed to read chunk %d: %w", index, err)
+		}
+		_, peekErr := reader.Peek(1)
+		final := peekErr == io.EOF
+		if peekErr != nil && !final {
+			return fmt.Errorf("failed to read chunk %d: %w", index+1, peekErr)
+		}
+
+		plain, err = aead.Open(plain[:0], gcmNonce(parsed.noncePrefix, index, final), sealed[:n], header)
+		if err != nil {
+			return fmt.Errorf("chunk %d failed authentication: %w", index, err)
+		}
+		if _, err = out.Write(plain); err != nil {
+			return fmt.Errorf("failed to write decrypted chunk %d: %w", index, err)
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+/*
+AESGCMDataProcessor implements DataProcessor like AESDataProcessor, but seals
+media with chunked AES-GCM so clients can detect modified ciphertext
+*/
+type AESGCMDataProcessor struct {
+	*AESDataProcessor
+}
+
+// NewAESGCMDataProcessor creates a new AESGCMDataProcessor sealing chunkSize bytes of media per chunk
+func NewAESGCMDataProcessor(keySize int, chunkSize int, workingDir string) (*AESGCMDataProcessor, error) {
+	if chunkSize <= 0 || chunkSize > gcmMaxChunkSize {
+		return nil, fmt.Errorf("failed to create AESGCMDataProcessor. invalid chunk size %d", chunkSize)
+	}
+	processor, err := NewAESDataProcessor(keySize, workingDir)
+	if err != nil {
+		return nil, err
+	}
+	processor.seal = func(block cipher.Block, nonces io.Reader, plain io.Reader, out io.Writer) error {
+		return sealAESGCM(block, chunkSize, nonces, plain, out)
+	}
+	processor.sealMode = fmt.Sprintf("gcm-%d", chunkSize)
+	return &AESGCMDataProcessor{processor}, nil
+}
@@ -0,0 +1,89 @@
+package cyprus
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sealTestContent(t *testing.T, key []byte, chunkSize int, plain []byte) []byte {
+	block, err := aes.NewCipher(key)
+	assert.Nil(t, err, "should not return error")
+	sealed := &bytes.Buffer{}
+	assert.Nil(t, sealAESGCM(block, chunkSize, rand.Reader, bytes.NewReader(plain), sealed), "should not return error")
+	return sealed.Bytes()
+}
+
+func TestAESGCMRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x01}, 32)
+	for _, size := range []int{0, 1, 15, 16, 17, 64} {
+		plain := bytes.Repeat([]byte("p"), size)
+		sealed := sealTestContent(t, key, 16, plain)
+		assert.True(t, IsAESGCMContent(sealed), "sealed content should have header")
+
+		decrypted := &bytes.Buffer{}
+		assert.Nil(t, DecryptAESGCM(key, bytes.NewReader(sealed), decrypted), "should not return error for %d bytes", size)
+		assert.Equal(t, string(plain), decrypted.String(), "wrong plaintext for %d bytes", size)
+	}
+}
+
+func TestAESGCMTampering(t *testing.T) {
+	key := bytes.Repeat([]byte{0x01}, 32)
+	plain := bytes.Repeat([]byte("p"), 40)
+	sealed := sealTestContent(t, key, 16, plain)
+	chunk := 16 + 16
+
+	tests := map[string][]byte{
+		"flipped bit":     append([]byte{}, sealed...),
+		"truncated":       sealed[:GCMHeaderSize+chunk],
+		"header only":     sealed[:GCMHeaderSize],
+		"reordered":       append(append(append([]byte{}, sealed[:GCMHeaderSize]...), sealed[GCMHeaderSize+chunk:GCMHeaderSize+2*chunk]...), sealed[GCMHeaderSize:GCMHeaderSize+chunk]...),
+		"altered header":  append([]byte{}, sealed...),
+		"unknown version": append([]byte{}, sealed...),
+	}
+	tests["flipped bit"][GCMHeaderSize+3] ^= 0x01
+	tests["altered header"][GCMHeaderSize-1] ^= 0x01
+	tests["unknown version"][len(gcmMagic)] = GCMFormatVersion + 1
+	tests["reordered"] = append(tests["reordered"], sealed[GCMHeaderSize+2*chunk:]...)
+
+	for name, content := range tests {
+		err := DecryptAESGCM(key, bytes.NewReader(content), &bytes.Buffer{})
+		assert.NotNil(t, err, "expected %s content to fail", name)
+	}
+
+	wrongKey := bytes.Repeat([]byte{0x02}, 32)
+	assert.NotNil(t, DecryptAESGCM(wrongKey, bytes.NewReader(sealed), &bytes.Buffer{}), "expected wrong key to fail")
+}
+
+func TestAESGCMDataProcessor(t *testing.T) {
+	workingDir := t.TempDir()
+	plain := bytes.Repeat([]byte("media"), 1000)
+	ingestFile, err := os.CreateTemp(workingDir, ingestFilePattern)
+	assert.Nil(t, err, "should not return error")
+	ingestFile.Write(plain)
+	ingestFile.Close()
+
+	processor, err := NewAESGCMDataProcessor(DefaultAESKeySize, 1024, workingDir)
+	assert.Nil(t, err, "should not return error")
+	digest, err := processor.DigestMedia(MediaIngest{
+		Type:   RawMediaType,
+		Result: RawMedia{URL: "media.mp4", File: ingestFile.Name()},
+	})
+	assert.Nil(t, err, "should not return error")
+	media := digest.Result.(RawMedia)
+	defer RemoveIngestArtifacts(MediaIngest{Type: digest.Type, Result: media})
+
+	sealed, err := os.ReadFile(media.File)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, int64(len(sealed)), digest.ByteSize, "wrong digest size")
+	decrypted := &bytes.Buffer{}
+	assert.Nil(t, DecryptAESGCM(digest.CryptKey, bytes.NewReader(sealed), decrypted), "should not return error")
+	assert.Equal(t, plain, decrypted.Bytes(), "wrong plaintext")
+
+	_, err = NewAESGCMDataProcessor(DefaultAESKeySize, 0, workingDir)
+	assert.NotNil(t, err, "expected invalid chunk size to fail")
+}
@@ -1,6 +1,7 @@
 package cyprus
 
 import (
+	"fmt"
 	"io"
 	"net/http"
 	"os"
@@ -11,24 +12,80 @@ const (
 )
 
 type (
+	// VODManifest is an ingested manifest. Live ones are still being extended and sliding ones expire old segments.
+	// Media lists the alternate renditions the variants refer to by group, for formats declaring them
 	VODManifest struct {
 		URL          string      `json:"url"`
 		FunctionalID string      `json:"fid"`
+		Format       string      `json:"format,omitempty"`
+		Live         bool        `json:"live,omitempty"`
+		Sliding      bool        `json:"sliding,omitempty"`
 		Streams      []VODStream `json:"streams"`
+		Media        []VODMedia  `json:"media,omitempty"`
 	}
 
+	// VODStream is a single rendition of a manifest. Variant attributes are only known for formats declaring them.
+	// Rendition streams are only played as alternate renditions of the variants, which refer to them by group.
+	// The sequence numbers count the segments and discontinuities that expired out of sliding manifests
 	VODStream struct {
-		URL          string       `json:"url"`
-		FunctionalID string       `json:"fid"`
-		Segments     []VODSegment `json:"segments"`
+		URL                   string       `json:"url"`
+		FunctionalID          string       `json:"fid"`
+		Rendition             bool         `json:"rendition,omitempty"`
+		Bandwidth             int          `json:"bandwidth,omitempty"`
+		AverageBandwidth      int          `json:"average_bandwidth,omitempty"`
+		Resolution            string       `json:"resolution,omitempty"`
+		Codecs                string       `json:"codecs,omitempty"`
+		FrameRate             float64      `json:"frame_rate,omitempty"`
+		Video                 string       `json:"video,omitempty"`
+		Audio                 string       `json:"audio,omitempty"`
+		Subtitles             string       `json:"subtitles,omitempty"`
+		ClosedCaptions        string       `json:"closed_captions,omitempty"`
+		TargetDuration        int          `json:"target_duration,omitempty"`
+		MediaSequence         int          `json:"media_sequence,omitempty"`
+		DiscontinuitySequence int          `json:"discontinuity_sequence,omitempty"`
+		Segments              []VODSegment `json:"segments"`
 	}
 
+	// VODMedia is an alternate rendition in a group of a manifest. Those with a playlist of their own are played
+	// from the stream at Stream, the others are carried in the variants referring to their group
+	VODMedia struct {
+		Type            string `json:"type"`
+		GroupID         string `json:"group_id"`
+		Name            string `json:"name"`
+		Language        string `json:"language,omitempty"`
+		AssocLanguage   string `json:"assoc_language,omitempty"`
+		Default         bool   `json:"default,omitempty"`
+		AutoSelect      bool   `json:"autoselect,omitempty"`
+		Forced          bool   `json:"forced,omitempty"`
+		InStreamID      string `json:"instream_id,omitempty"`
+		Characteristics string `json:"characteristics,omitempty"`
+		Channels        string `json:"channels,omitempty"`
+		Stream          string `json:"stream,omitempty"`
+	}
+
+	// VODSegment is a single fetchable piece of a stream, optionally limited to a byte range of the resource at URL.
+	// Init segments hold the initialization data of the media segments following them. The fingerprint is a hash
+	// of the plaintext keyed by the content key, used to find unchanged segments, and size is the digested size
 	VODSegment struct {
-		Index        int    `json:"index"`
-		URL          string `json:"url"`
-		FunctionalID string `json:"fid"`
-		Checksum     string `json:"checksum"`
-		File         string `json:"-"`
+		Index         int           `json:"index"`
+		URL           string        `json:"url"`
+		FunctionalID  string        `json:"fid"`
+		Checksum      string        `json:"checksum"`
+		MerkleRoot    string        `json:"merkle_root,omitempty"`
+		WrappedKey    string        `json:"wrapped_key,omitempty"`
+		Fingerprint   string        `json:"fingerprint,omitempty"`
+		Size          int64         `json:"size,omitempty"`
+		Duration      float64       `json:"duration,omitempty"`
+		Init          bool          `json:"init,omitempty"`
+		Discontinuity bool          `json:"discontinuity,omitempty"`
+		ByteRange     *VODByteRange `json:"byte_range,omitempty"`
+		File          string        `json:"-"`
+		ProofFile     string        `json:"-"`
+	}
+
+	VODByteRange struct {
+		Offset int64 `json:"offset"`
+		Length int64 `json:"length"`
 	}
 )
 
@@ -41,6 +98,8 @@ type (
 	PartialVODSegment struct {
 		FunctionalID string `json:"fid"`
 		Checksum     string `json:"checksum"`
+		MerkleRoot   string `json:"merkle_root,omitempty"`
+		WrappedKey   string `json:"wrapped_key,omitempty"`
 	}
 )
 
@@ -55,6 +114,8 @@ func completeToPartialManifest(mediaMap VODManifest) PartialVODManifest {
 			pMediaMap.Segments = append(pMediaMap.Segments, PartialVODSegment{
 				FunctionalID: mediaSegment.FunctionalID,
 				Checksum:     mediaSegment.Checksum,
+				MerkleRoot:   mediaSegment.MerkleRoot,
+				WrappedKey:   mediaSegment.WrappedKey,
 			})
 		}
 	}
@@ -65,18 +126,22 @@ type RawMedia struct {
 	URL          string `json:"url"`
 	FunctionalID string `json:"fid"`
 	Checksum     string `json:"checksum"`
+	MerkleRoot   string `json:"merkle_root,omitempty"`
 	File         string `json:"-"`
+	ProofFile    string `json:"-"`
 }
 
 type PartialRawMedia struct {
 	FunctionalID string `json:"fid"`
 	Checksum     string `json:"checksum"`
+	MerkleRoot   string `json:"merkle_root,omitempty"`
 }
 
 func completeToPartialRawMedia(media RawMedia) PartialRawMedia {
 	return PartialRawMedia{
 		FunctionalID: media.FunctionalID,
 		Checksum:     media.Checksum,
+		MerkleRoot:   media.MerkleRoot,
 	}
 }
 
@@ -87,6 +152,9 @@ func DownloadFile(url string, outFile io.Writer) error {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("bad HTTP status downloading %s: %s", url, resp.Status)
+	}
 
 	_, err = io.Copy(outFile, resp.Body)
 	return err
@@ -104,3 +172,17 @@ func CopyFromDisk(fname string, outFile io.Writer) error {
 	}
 	return nil
 }
+
+// Testing replacement function for Downloader.DownloadRange
+func CopyRangeFromDisk(fname string, offset int64, length int64, outFile io.Writer) error {
+	inFile, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	if _, err = io.Copy(outFile, io.NewSectionReader(inFile, offset, length)); err != nil {
+		return err
+	}
+	return nil
+}
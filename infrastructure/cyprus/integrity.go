@@ -0,0 +1,192 @@
+package cyprus
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DefaultIntegrityBlockSize is the number of encrypted bytes covered by each leaf of an IntegrityProof
+const DefaultIntegrityBlockSize = 64 * 1024
+
+const (
+	proofFilePattern = "proof_*"
+
+	// Domain separation prefixes so leaves can't be passed off as interior nodes
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+/*
+IntegrityProof holds the hash of every fixed size block of an encrypted object.
+The blocks are the leaves of a Merkle tree whose root is published in the partial
+manifest, so a client can check the proof against the root once and then verify
+each block as it arrives from an untrusted peer. The checksum of the whole object
+is kept with it so the object can be identified without being read
+*/
+type IntegrityProof struct {
+	BlockSize int      `json:"block_size"`
+	Size      int64    `json:"size"`
+	Checksum  string   `json:"checksum,omitempty"`
+	Blocks    []string `json:"blocks"`
+}
+
+func merkleLeaf(data []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{merkleLeafPrefix})
+	hash.Write(data)
+	return hash.Sum(nil)
+}
+
+func merkleNode(left, right []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{merkleNodePrefix})
+	hash.Write(left)
+	hash.Write(right)
+	return hash.Sum(nil)
+}
+
+// merkleRoot reduces leaves to a single root, promoting the odd node of a level unchanged
+func merkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return merkleLeaf(nil)
+	}
+	level := leaves
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// NewIntegrityProof hashes the contents of reader in blocks of blockSize bytes
+func NewIntegrityProof(reader io.Reader, blockSize int) (IntegrityProof, error) {
+	if blockSize <= 0 {
+		return IntegrityProof{}, fmt.Errorf("invalid integrity block size %d", blockSize)
+	}
+	proof := IntegrityProof{BlockSize: blockSize, Blocks: make([]string, 0)}
+	checksum := sha256.New()
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(reader, block)
+		if n > 0 {
+			checksum.Write(block[:n])
+			proof.Size += int64(n)
+			proof.Blocks = append(proof.Blocks, base64.StdEncoding.EncodeToString(merkleLeaf(block[:n])))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			proof.Checksum = base64.StdEncoding.EncodeToString(checksum.Sum(nil))
+			return proof, nil
+		}
+		if err != nil {
+			return IntegrityProof{}, fmt.Errorf("failed to read block %d: %w", len(proof.Blocks), err)
+		}
+	}
+}
+
+// leaves decodes the block hashes of the proof
+func (p IntegrityProof) leaves() ([][]byte, error) {
+	leaves := make([][]byte, len(p.Blocks))
+	for i, block := range p.Blocks {
+		leaf, err := base64.StdEncoding.DecodeString(block)
+		if err != nil || len(leaf) != sha256.Size {
+			return nil, fmt.Errorf("malformed hash for block %d", i)
+		}
+		leaves[i] = leaf
+	}
+	return leaves, nil
+}
+
+// Root returns the base64 encoded Merkle root of the proof
+func (p IntegrityProof) Root() (string, error) {
+	leaves, err := p.leaves()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(merkleRoot(leaves)), nil
+}
+
+/*
+Verify checks the proof against the Merkle root published in a partial manifest.
+A proof must be verified before its blocks are trusted by VerifyBlock
+*/
+func (p IntegrityProof) Verify(root string) error {
+	if p.BlockSize <= 0 {
+		return fmt.Errorf("invalid integrity block size %d", p.BlockSize)
+	}
+	if expected := (p.Size + int64(p.BlockSize) - 1) / int64(p.BlockSize); int64(len(p.Blocks)) != expected {
+		return fmt.Errorf("proof has %d blocks, expected %d for %d bytes", len(p.Blocks), expected, p.Size)
+	}
+	proofRoot, err := p.Root()
+	if err != nil {
+		return err
+	}
+	if proofRoot != root {
+		return fmt.Errorf("proof root %s does not match published root %s", proofRoot, root)
+	}
+	return nil
+}
+
+// VerifyBlock checks that data is the block at index of the object the proof was created for
+func (p IntegrityProof) VerifyBlock(index int, data []byte) error {
+	if index < 0 || index >= len(p.Blocks) {
+		return fmt.Errorf("block %d out of range of %d blocks", index, len(p.Blocks))
+	}
+	expectedSize := int64(p.BlockSize)
+	if remaining := p.Size - int64(index)*int64(p.BlockSize); remaining < expectedSize {
+		expectedSize = remaining
+	}
+	if int64(len(data)) != expectedSize {
+		return fmt.Errorf("block %d is %d bytes, expected %d", index, len(data), expectedSize)
+	}
+	if base64.StdEncoding.EncodeToString(merkleLeaf(data)) != p.Blocks[index] {
+		return fmt.Errorf("block %d failed integrity check", index)
+	}
+	return nil
+}
+
+/*
+writeIntegrityProof creates the proof for the file fname and writes it to a
+new file in outputDir. Returns the proof file name and base64 Merkle root
+*/
+func writeIntegrityProof(fname string, blockSize int, outputDir string) (string, string, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	proof, err := NewIntegrityProof(file, blockSize)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create integrity proof for %s: %w", fname, err)
+	}
+	root, err := proof.Root()
+	if err != nil {
+		return "", "", err
+	}
+	serialProof, err := json.Marshal(proof)
+	if err != nil {
+		return "", "", err
+	}
+
+	proofFile, err := os.CreateTemp(outputDir, proofFilePattern)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create proof file: %w", err)
+	}
+	defer proofFile.Close()
+	if _, err = proofFile.Write(serialProof); err != nil {
+		os.Remove(proofFile.Name())
+		return "", "", fmt.Errorf("failed to write proof file: %w", err)
+	}
+	return proofFile.Name(), root, nil
+}
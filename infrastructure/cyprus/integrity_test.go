@@ -0,0 +1,80 @@
+package cyprus
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntegrityProof(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 5)
+	proof, err := NewIntegrityProof(bytes.NewReader(data), 16)
+	assert.Nil(t, err, "should not return error")
+	assert.Len(t, proof.Blocks, 4, "wrong number of blocks")
+	assert.Equal(t, int64(len(data)), proof.Size, "wrong proof size")
+
+	root, err := proof.Root()
+	assert.Nil(t, err, "should not return error")
+	assert.Nil(t, proof.Verify(root), "proof should match its own root")
+
+	// Blocks verify individually, including the short final block
+	for i := 0; i < len(proof.Blocks); i++ {
+		end := (i + 1) * 16
+		if end > len(data) {
+			end = len(data)
+		}
+		assert.Nil(t, proof.VerifyBlock(i, data[i*16:end]), "block %d should verify", i)
+	}
+
+	// Tampered blocks are rejected
+	tampered := append([]byte{}, data[:16]...)
+	tampered[0] ^= 0xff
+	assert.NotNil(t, proof.VerifyBlock(0, tampered), "expected tampered block to fail")
+	assert.NotNil(t, proof.VerifyBlock(3, data[48:49]), "expected truncated block to fail")
+	assert.NotNil(t, proof.VerifyBlock(4, data[:16]), "expected out of range block to fail")
+
+	// Tampered proofs don't match the published root
+	forged := proof
+	forged.Blocks = append([]string{}, proof.Blocks...)
+	forged.Blocks[1], forged.Blocks[2] = forged.Blocks[2], forged.Blocks[1]
+	assert.NotNil(t, forged.Verify(root), "expected reordered proof to fail")
+	forged = proof
+	forged.Blocks = proof.Blocks[:3]
+	assert.NotNil(t, forged.Verify(root), "expected truncated proof to fail")
+}
+
+func TestDigestIntegrityProof(t *testing.T) {
+	workingDir := t.TempDir()
+	ingestFile, err := os.CreateTemp(workingDir, ingestFilePattern)
+	assert.Nil(t, err, "should not return error")
+	ingestFile.Write(bytes.Repeat([]byte("a"), DefaultIntegrityBlockSize+10))
+	ingestFile.Close()
+
+	processor, err := NewAESDataProcessor(DefaultAESKeySize, workingDir)
+	assert.Nil(t, err, "should not return error")
+	digest, err := processor.DigestMedia(MediaIngest{
+		Type:   RawMediaType,
+		Result: RawMedia{URL: "media.mp4", File: ingestFile.Name()},
+	})
+	assert.Nil(t, err, "should not return error")
+	media := digest.Result.(RawMedia)
+	defer RemoveIngestArtifacts(MediaIngest{Type: digest.Type, Result: media})
+
+	// The published root covers every block of the encrypted file
+	serialProof, err := os.ReadFile(media.ProofFile)
+	assert.Nil(t, err, "should not return error")
+	var proof IntegrityProof
+	assert.Nil(t, json.Unmarshal(serialProof, &proof), "should not return error")
+	assert.Nil(t, proof.Verify(completeToPartialRawMedia(media).MerkleRoot), "proof should match published root")
+
+	encrypted, err := os.ReadFile(media.File)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, int64(len(encrypted)), proof.Size, "proof should cover the encrypted file")
+	assert.Equal(t, media.Checksum, proof.Checksum, "proof should carry the published checksum")
+	assert.Len(t, proof.Blocks, 2, "wrong number of blocks")
+	assert.Nil(t, proof.VerifyBlock(0, encrypted[:DefaultIntegrityBlockSize]), "block should verify")
+	assert.Nil(t, proof.VerifyBlock(1, encrypted[DefaultIntegrityBlockSize:]), "block should verify")
+}
@@ -1,24 +1,63 @@
 package cyprus
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	infra "github.com/Apiara/ApiaraCDN/infrastructure"
 )
 
+const (
+	jobRecordExtension = ".json"
+	jobRecordPerms     = 0600
+)
+
+/*
+job is the record of a processing job. It is persisted as JSON, which for live
+jobs includes the content key wrapped by the KEK, hence the restrictive record permissions
+*/
 type job struct {
-	status infra.ProcessingStatus
-	result *infra.PostProcessingMetadata
+	ContentID string                        `json:"cid"`
+	Status    infra.ProcessingStatus        `json:"status"`
+	Result    *infra.PostProcessingMetadata `json:"result"`
+	Progress  infra.ProcessingProgress      `json:"progress"`
+	Error     string                        `json:"error"`
+	Attempts  int                           `json:"attempts"`
+	Completed time.Time                     `json:"completed"`
+	Callback  string                        `json:"callback"`
+	Notified  bool                          `json:"notified"`
+	Live      *liveState                    `json:"live,omitempty"`
+	Update    bool                          `json:"update,omitempty"`
+}
+
+// response creates the API representation of the job
+func (j *job) response() infra.StatusResponse {
+	response := infra.StatusResponse{Status: j.Status, Error: j.Error}
+	if j.Status == infra.RunningProcessing {
+		progress := j.Progress
+		response.Progress = &progress
+	}
+	// Live content is served while it is still being ingested
+	if j.Status == infra.FinishedProcessing || j.Live != nil {
+		response.Metadata = j.Result
+	}
+	return response
 }
 
 /*
 jobTracker is used by the service API to keep track
-of the status of processing jobs
+of the status of processing jobs. If a record directory
+is set every job is mirrored to disk so it survives restarts
 */
 type jobTracker struct {
-	jobs  map[string]*job
-	mutex *sync.RWMutex
+	jobs      map[string]*job
+	recordDir string
+	mutex     *sync.RWMutex
 }
 
 func newJobTracker() *jobTracker {
@@ -28,41 +67,250 @@ func newJobTracker() *jobTracker {
 	}
 }
 
-func (j *jobTracker) newJob(id string) {
+/*
+newPersistentJobTracker creates a jobTracker that stores job records in
+recordDir and loads any records left behind by a previous run
+*/
+func newPersistentJobTracker(recordDir string) (*jobTracker, error) {
+	if err := os.MkdirAll(recordDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create job record directory %s: %w", recordDir, err)
+	}
+	tracker := newJobTracker()
+	tracker.recordDir = recordDir
+
+	entries, err := os.ReadDir(recordDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list job records in %s: %w", recordDir, err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != jobRecordExtension {
+			continue
+		}
+		recordFile := filepath.Join(recordDir, entry.Name())
+		data, err := os.ReadFile(recordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read job record %s: %w", recordFile, err)
+		}
+		record := &job{}
+		if err = json.Unmarshal(data, record); err != nil {
+			return nil, fmt.Errorf("failed to parse job record %s: %w", recordFile, err)
+		}
+		tracker.jobs[record.ContentID] = record
+	}
+	return tracker, nil
+}
+
+// recordFile returns the record location for a job. Content IDs are URLs so they are escaped
+func (j *jobTracker) recordFile(id string) string {
+	name := strings.NewReplacer("%", "%25", "/", "%2F", ":", "%3A").Replace(id)
+	return filepath.Join(j.recordDir, name+jobRecordExtension)
+}
+
+// persist writes the job record to disk. Caller must hold mutex
+func (j *jobTracker) persist(record *job) error {
+	if j.recordDir == "" {
+		return nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode job record for %s: %w", record.ContentID, err)
+	}
+
+	// Write then rename so a crash never leaves a partial record
+	tmpFile, err := os.CreateTemp(j.recordDir, "record_*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create job record for %s: %w", record.ContentID, err)
+	}
+	if _, err = tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("failed to write job record for %s: %w", record.ContentID, err)
+	}
+	tmpFile.Close()
+	os.Chmod(tmpFile.Name(), jobRecordPerms)
+	if err = os.Rename(tmpFile.Name(), j.recordFile(record.ContentID)); err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("failed to store job record for %s: %w", record.ContentID, err)
+	}
+	return nil
+}
+
+/*
+newJob creates a running job for id that reports completion to callback.
+It returns false if a job for id is already running so duplicate submissions
+are ignored, only replacing the callback of the running job if one is passed
+*/
+func (j *jobTracker) newJob(id string, callback string) (bool, error) {
+	return j.createJob(id, callback, nil, false)
+}
+
+// newLiveJob is newJob for a live ingestion job
+func (j *jobTracker) newLiveJob(id string, callback string) (bool, error) {
+	return j.createJob(id, callback, &liveState{}, false)
+}
+
+// newUpdateJob is newJob for a job updating published content
+func (j *jobTracker) newUpdateJob(id string, callback string) (bool, error) {
+	return j.createJob(id, callback, nil, true)
+}
+
+// createJob implements newJob, creating a live job if live is not nil and an update job if update is set
+func (j *jobTracker) createJob(id string, callback string, live *liveState, update bool) (bool, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if existing, ok := j.jobs[id]; ok && existing.Status == infra.RunningProcessing {
+		if callback == "" || callback == existing.Callback {
+			return false, nil
+		}
+		existing.Callback = callback
+		return false, j.persist(existing)
+	}
+	record := &job{
+		ContentID: id,
+		Status:    infra.RunningProcessing,
+		Result:    nil,
+		Progress:  infra.ProcessingProgress{Phase: infra.IngestPhase},
+		Callback:  callback,
+		Live:      live,
+		Update:    update,
+	}
+	if err := j.persist(record); err != nil {
+		return false, err
+	}
+	j.jobs[id] = record
+	return true, nil
+}
+
+// update applies 'modify' to the job with id and persists the result
+func (j *jobTracker) update(id string, modify func(*job)) error {
 	j.mutex.Lock()
-	j.jobs[id] = &job{
-		status: infra.RunningProcessing,
-		result: nil,
+	defer j.mutex.Unlock()
+
+	foundJob, ok := j.jobs[id]
+	if !ok {
+		return fmt.Errorf("no job with id %s", id)
 	}
-	j.mutex.Unlock()
+	modify(foundJob)
+	return j.persist(foundJob)
 }
 
 func (j *jobTracker) updateStatus(id string, status infra.ProcessingStatus) error {
+	return j.update(id, func(foundJob *job) {
+		foundJob.Status = status
+		if status != infra.RunningProcessing {
+			foundJob.Completed = time.Now()
+		}
+	})
+}
+
+// fail marks the job with id as failed because of 'cause'
+func (j *jobTracker) fail(id string, cause error) error {
+	return j.update(id, func(foundJob *job) {
+		foundJob.Status = infra.FailedProcessing
+		foundJob.Error = cause.Error()
+		foundJob.Completed = time.Now()
+	})
+}
+
+/*
+startPhase moves a running job with id into 'phase' and resets its progress.
+Returns ErrJobCancelled if the job is no longer running
+*/
+func (j *jobTracker) startPhase(id string, phase infra.ProcessingPhase) error {
 	j.mutex.Lock()
 	defer j.mutex.Unlock()
 
-	if foundJob, ok := j.jobs[id]; ok {
-		foundJob.status = status
-		return nil
+	foundJob, ok := j.jobs[id]
+	if !ok {
+		return fmt.Errorf("no job with id %s", id)
 	}
-	return fmt.Errorf("no job with id %s", id)
+	if foundJob.Status != infra.RunningProcessing {
+		return ErrJobCancelled
+	}
+	foundJob.Progress = infra.ProcessingProgress{Phase: phase}
+	return j.persist(foundJob)
 }
 
-func (j *jobTracker) updateResult(id string, result *infra.PostProcessingMetadata) error {
+/*
+updateProgress applies 'modify' to the progress of a running job with id.
+Progress changes too often to be persisted. Returns ErrJobCancelled if the
+job is no longer running
+*/
+func (j *jobTracker) updateProgress(id string, modify func(*infra.ProcessingProgress)) error {
 	j.mutex.Lock()
 	defer j.mutex.Unlock()
 
-	if foundJob, ok := j.jobs[id]; ok {
-		foundJob.result = result
-		return nil
+	foundJob, ok := j.jobs[id]
+	if !ok {
+		return fmt.Errorf("no job with id %s", id)
 	}
-	return fmt.Errorf("no job with id %s", id)
+	if foundJob.Status != infra.RunningProcessing {
+		return ErrJobCancelled
+	}
+	modify(&foundJob.Progress)
+	return nil
 }
 
-func (j *jobTracker) free(id string) {
+/*
+cancel marks a running job with id as cancelled. Jobs that are already
+publishing can no longer be stopped
+*/
+func (j *jobTracker) cancel(id string) error {
 	j.mutex.Lock()
-	delete(j.jobs, id)
-	j.mutex.Unlock()
+	defer j.mutex.Unlock()
+
+	foundJob, ok := j.jobs[id]
+	if !ok {
+		return fmt.Errorf("no job with id %s", id)
+	}
+	if foundJob.Status != infra.RunningProcessing {
+		return fmt.Errorf("job %s is not running", id)
+	}
+	if foundJob.Progress.Phase == infra.PublishPhase {
+		return fmt.Errorf("job %s is already publishing", id)
+	}
+	foundJob.Status = infra.CancelledProcessing
+	foundJob.Completed = time.Now()
+	return j.persist(foundJob)
+}
+
+func (j *jobTracker) updateResult(id string, result *infra.PostProcessingMetadata) error {
+	return j.update(id, func(foundJob *job) { foundJob.Result = result })
+}
+
+// addAttempt increments and returns the number of attempts made at the job with id
+func (j *jobTracker) addAttempt(id string) (int, error) {
+	attempts := 0
+	err := j.update(id, func(foundJob *job) {
+		foundJob.Attempts++
+		attempts = foundJob.Attempts
+	})
+	return attempts, err
+}
+
+// live returns a copy of the ingestion state of the live job with id
+func (j *jobTracker) live(id string) (*liveState, error) {
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+
+	foundJob, ok := j.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("no job with id %s", id)
+	}
+	if foundJob.Live == nil {
+		return nil, fmt.Errorf("job %s is not live", id)
+	}
+	return foundJob.Live.clone(), nil
+}
+
+// updating returns whether the job for id is updating published content
+func (j *jobTracker) updating(id string) bool {
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+
+	foundJob, ok := j.jobs[id]
+	return ok && foundJob.Update
 }
 
 func (j *jobTracker) status(id string) (infra.ProcessingStatus, error) {
@@ -70,17 +318,87 @@ func (j *jobTracker) status(id string) (infra.ProcessingStatus, error) {
 	defer j.mutex.RUnlock()
 
 	if job, ok := j.jobs[id]; ok {
-		return job.status, nil
+		return job.Status, nil
 	}
 	return "", fmt.Errorf("no job with ID %s", id)
 }
 
-func (j *jobTracker) result(id string) (*infra.PostProcessingMetadata, error) {
+func (j *jobTracker) response(id string) (infra.StatusResponse, error) {
 	j.mutex.RLock()
 	defer j.mutex.RUnlock()
 
 	if job, ok := j.jobs[id]; ok {
-		return job.result, nil
+		return job.response(), nil
+	}
+	return infra.StatusResponse{}, fmt.Errorf("no job with ID %s", id)
+}
+
+// list returns the API representation of every tracked job
+func (j *jobTracker) list() []infra.JobResponse {
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+
+	jobs := make([]infra.JobResponse, 0, len(j.jobs))
+	for id, job := range j.jobs {
+		jobs = append(jobs, infra.JobResponse{ContentID: id, StatusResponse: job.response()})
+	}
+	return jobs
+}
+
+// prune frees all jobs that reached a terminal status more than 'retention' ago
+func (j *jobTracker) prune(retention time.Duration) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	for id, job := range j.jobs {
+		if job.Status != infra.RunningProcessing && time.Since(job.Completed) > retention {
+			delete(j.jobs, id)
+			if j.recordDir != "" {
+				os.Remove(j.recordFile(id))
+			}
+		}
+	}
+}
+
+/*
+pendingCallback returns the callback URL and final status of a completed
+job with id if its callback has not been delivered yet
+*/
+func (j *jobTracker) pendingCallback(id string) (string, infra.JobResponse, bool) {
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+
+	foundJob, ok := j.jobs[id]
+	if !ok || foundJob.Status == infra.RunningProcessing || foundJob.Callback == "" || foundJob.Notified {
+		return "", infra.JobResponse{}, false
+	}
+	return foundJob.Callback, infra.JobResponse{ContentID: id, StatusResponse: foundJob.response()}, true
+}
+
+// completed returns the IDs of all jobs that have reached a terminal status
+func (j *jobTracker) completed() []string {
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+
+	ids := make([]string, 0)
+	for id, job := range j.jobs {
+		if job.Status != infra.RunningProcessing {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// running returns the IDs of all jobs that have not reached a terminal status
+func (j *jobTracker) running() []string {
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+
+	ids := make([]string, 0)
+	for id, job := range j.jobs {
+		if job.Status == infra.RunningProcessing {
+			ids = append(ids, id)
+		}
 	}
-	return nil, fmt.Errorf("no job with ID %s", id)
+	return ids
 }
@@ -0,0 +1,245 @@
+package cyprus
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+)
+
+const (
+	// Version of the wrapped content key format
+	wrappedKeyVersion byte = 1
+
+	kekSize           = 32
+	kekIDSize         = 8
+	kekNonceSize      = 12
+	wrappedKeyPerms   = 0600
+	wrappedHeaderSize = 1 + kekIDSize + kekNonceSize
+)
+
+/*
+KeyEncryptionKey wraps content keys with AES-256-GCM so they are never stored in
+the clear. Wrapped keys record the ID of the KEK that wrapped them and are bound
+to the name they are stored under, so a wrapped key can't be moved to other content
+*/
+type KeyEncryptionKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+func newKeyEncryptionKey(key []byte) (*KeyEncryptionKey, error) {
+	if len(key) != kekSize {
+		return nil, fmt.Errorf("key encryption key must be %d bytes, got %d", kekSize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key encryption cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key encryption cipher: %w", err)
+	}
+	checksum := sha256.Sum256(key)
+	return &KeyEncryptionKey{id: checksum[:kekIDSize], aead: aead}, nil
+}
+
+// LoadKeyEncryptionKey reads a hex encoded 256-bit KEK from keyfile
+func LoadKeyEncryptionKey(keyfile string) (*KeyEncryptionKey, error) {
+	data, err := os.ReadFile(keyfile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyfile %s: %w", keyfile, err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode keyfile %s: %w", keyfile, err)
+	}
+	return newKeyEncryptionKey(key)
+}
+
+// GenerateKeyEncryptionKey writes a new random KEK to keyfile, failing if it already exists
+func GenerateKeyEncryptionKey(keyfile string) (*KeyEncryptionKey, error) {
+	key, err := generateRandomBytes(kekSize)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(keyfile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, wrappedKeyPerms)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create keyfile %s: %w", keyfile, err)
+	}
+	defer file.Close()
+	if _, err = file.WriteString(hex.EncodeToString(key) + "\n"); err != nil {
+		os.Remove(keyfile)
+		return nil, fmt.Errorf("failed to write keyfile %s: %w", keyfile, err)
+	}
+	return newKeyEncryptionKey(key)
+}
+
+// ID returns the hex encoded identifier recorded in keys wrapped by the KEK
+func (k *KeyEncryptionKey) ID() string {
+	return hex.EncodeToString(k.id)
+}
+
+func wrappedKeyAAD(header []byte, name string) []byte {
+	return append(append([]byte{}, header...), name...)
+}
+
+// Wrap encrypts a content key to be stored under name
+func (k *KeyEncryptionKey) Wrap(key []byte, name string) ([]byte, error) {
+	nonce, err := generateRandomBytes(kekNonceSize)
+	if err != nil {
+		return nil, err
+	}
+	header := append(append([]byte{wrappedKeyVersion}, k.id...), nonce...)
+	return k.aead.Seal(header, nonce, key, wrappedKeyAAD(header, name)), nil
+}
+
+// wrappedBy returns whether wrapped was created by this KEK
+func (k *KeyEncryptionKey) wrappedBy(wrapped []byte) bool {
+	return len(wrapped) >= wrappedHeaderSize && bytes.Equal(wrapped[1:1+kekIDSize], k.id)
+}
+
+// Unwrap decrypts a content key stored under name
+func (k *KeyEncryptionKey) Unwrap(wrapped []byte, name string) ([]byte, error) {
+	if len(wrapped) < wrappedHeaderSize || wrapped[0] != wrappedKeyVersion {
+		return nil, fmt.Errorf("malformed wrapped key %s", name)
+	}
+	if !k.wrappedBy(wrapped) {
+		return nil, fmt.Errorf("key %s was wrapped by KEK %s, not %s", name,
+			hex.EncodeToString(wrapped[1:1+kekIDSize]), k.ID())
+	}
+	header := wrapped[:wrappedHeaderSize]
+	key, err := k.aead.Open(nil, header[1+kekIDSize:], wrapped[wrappedHeaderSize:], wrappedKeyAAD(header, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap key %s: %w", name, err)
+	}
+	return key, nil
+}
+
+// writeWrappedKey atomically stores the wrapped form of key as fname
+func writeWrappedKey(kek *KeyEncryptionKey, key []byte, fname string) error {
+	wrapped, err := kek.Wrap(key, path.Base(fname))
+	if err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(path.Dir(fname), "."+path.Base(fname)+"_*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err = tmpFile.Write(wrapped); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Chmod(wrappedKeyPerms); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), fname)
+}
+
+// readWrappedKey reads and unwraps the key stored as fname
+func readWrappedKey(kek *KeyEncryptionKey, fname string) ([]byte, error) {
+	wrapped, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	return kek.Unwrap(wrapped, path.Base(fname))
+}
+
+// readStoredKey reads the stored form of the key named name from store
+func readStoredKey(store ObjectStore, name string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := store.ReadObject(name, buf); err != nil {
+		return nil, fmt.Errorf("failed to read key %s: %w", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// writeStoredKey wraps key with kek and stores it in store as name
+func writeStoredKey(store ObjectStore, kek *KeyEncryptionKey, key []byte, name string) error {
+	wrapped, err := kek.Wrap(key, path.Base(name))
+	if err != nil {
+		return fmt.Errorf("failed to wrap key %s: %w", name, err)
+	}
+	return store.WriteObject(name, bytes.NewReader(wrapped), int64(len(wrapped)))
+}
+
+/*
+RewrapKeys rewraps every content key in store from oldKEK to newKEK without
+touching the media they encrypt. Keys already wrapped by newKEK are skipped so
+an interrupted rotation can be rerun. Returns the number of rewrapped keys
+*/
+func RewrapKeys(store ListableObjectStore, oldKEK *KeyEncryptionKey, newKEK *KeyEncryptionKey) (int, error) {
+	names, err := store.ListObjects(infra.AESKeyStorageDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list keys: %w", err)
+	}
+
+	rewrapped := 0
+	for _, name := range names {
+		wrapped, err := readStoredKey(store, name)
+		if err != nil {
+			return rewrapped, err
+		}
+		if newKEK.wrappedBy(wrapped) {
+			continue
+		}
+
+		key, err := oldKEK.Unwrap(wrapped, path.Base(name))
+		if err != nil {
+			return rewrapped, err
+		}
+		if err = writeStoredKey(store, newKEK, key, name); err != nil {
+			return rewrapped, fmt.Errorf("failed to rewrap key %s: %w", name, err)
+		}
+		rewrapped++
+	}
+	return rewrapped, nil
+}
+
+/*
+WrapPlaintextKeys wraps with kek every content key in store that was published
+in the clear before keys were wrapped. Keys already wrapped by kek are skipped
+so the migration can be rerun, while keys wrapped by another KEK are an error
+and should be rotated instead. Returns the number of wrapped keys
+*/
+func WrapPlaintextKeys(store ListableObjectStore, kek *KeyEncryptionKey) (int, error) {
+	names, err := store.ListObjects(infra.AESKeyStorageDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list keys: %w", err)
+	}
+
+	wrapped := 0
+	for _, name := range names {
+		key, err := readStoredKey(store, name)
+		if err != nil {
+			return wrapped, err
+		}
+		if kek.wrappedBy(key) {
+			continue
+		}
+
+		// Plaintext keys are raw AES keys, which are shorter than any wrapped key
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return wrapped, fmt.Errorf("key %s is neither a plaintext key nor wrapped by KEK %s", name, kek.ID())
+		}
+		if err = writeStoredKey(store, kek, key, name); err != nil {
+			return wrapped, fmt.Errorf("failed to wrap key %s: %w", name, err)
+		}
+		wrapped++
+	}
+	return wrapped, nil
+}
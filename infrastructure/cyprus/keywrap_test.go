@@ -0,0 +1,126 @@
+package cyprus
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyEncryptionKey(t *testing.T) {
+	keyfile := filepath.Join(t.TempDir(), "kek")
+	kek, err := GenerateKeyEncryptionKey(keyfile)
+	assert.Nil(t, err, "should not return error")
+	_, err = GenerateKeyEncryptionKey(keyfile)
+	assert.NotNil(t, err, "expected existing keyfile not to be overwritten")
+
+	loaded, err := LoadKeyEncryptionKey(keyfile)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, kek.ID(), loaded.ID(), "loaded KEK differs from generated KEK")
+
+	key := []byte("content key")
+	wrapped, err := kek.Wrap(key, "content")
+	assert.Nil(t, err, "should not return error")
+	assert.NotContains(t, string(wrapped), string(key), "key stored in the clear")
+
+	unwrapped, err := loaded.Unwrap(wrapped, "content")
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, key, unwrapped, "wrong unwrapped key")
+
+	// Wrapped keys are bound to their name and KEK
+	_, err = kek.Unwrap(wrapped, "other")
+	assert.NotNil(t, err, "expected key moved to other content to fail")
+	other, err := newKeyEncryptionKey(make([]byte, kekSize))
+	assert.Nil(t, err, "should not return error")
+	_, err = other.Unwrap(wrapped, "content")
+	assert.NotNil(t, err, "expected other KEK to fail")
+}
+
+func TestRewrapKeys(t *testing.T) {
+	publishDir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(publishDir, infra.AESKeyStorageDir), 0755), "should not return error")
+	s3Store, _ := newTestS3ObjectStore(t)
+	stores := map[string]ListableObjectStore{
+		"filesystem": NewFilesystemObjectStore(publishDir),
+		"s3":         s3Store,
+	}
+
+	for backend, store := range stores {
+		oldKEK, _ := newKeyEncryptionKey(make([]byte, kekSize))
+		newKEK, _ := GenerateKeyEncryptionKey(filepath.Join(t.TempDir(), "kek"))
+
+		keys := map[string][]byte{
+			path.Join(infra.AESKeyStorageDir, "a"): []byte("key a"),
+			path.Join(infra.AESKeyStorageDir, "b"): []byte("key b"),
+		}
+		for name, key := range keys {
+			assert.Nil(t, writeStoredKey(store, oldKEK, key, name), "should not return error")
+		}
+
+		rewrapped, err := RewrapKeys(store, oldKEK, newKEK)
+		assert.Nil(t, err, "should not return error")
+		assert.Equal(t, len(keys), rewrapped, "wrong number of rewrapped keys on %s", backend)
+		for name, key := range keys {
+			wrapped, err := readStoredKey(store, name)
+			assert.Nil(t, err, "should not return error")
+			unwrapped, err := newKEK.Unwrap(wrapped, path.Base(name))
+			assert.Nil(t, err, "should not return error")
+			assert.Equal(t, key, unwrapped, "wrong rewrapped key on %s", backend)
+			_, err = oldKEK.Unwrap(wrapped, path.Base(name))
+			assert.NotNil(t, err, "expected old KEK to no longer unwrap keys on %s", backend)
+		}
+
+		// Rerunning a finished rotation is a no-op
+		rewrapped, err = RewrapKeys(store, oldKEK, newKEK)
+		assert.Nil(t, err, "should not return error")
+		assert.Zero(t, rewrapped, "expected already rewrapped keys to be skipped on %s", backend)
+	}
+
+	// Rewrapped keys on the filesystem stay readable only by their owner
+	info, err := os.Stat(filepath.Join(publishDir, infra.AESKeyStorageDir, "a"))
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, os.FileMode(wrappedKeyPerms), info.Mode().Perm(), "wrapped keys should not be world readable")
+}
+
+func TestWrapPlaintextKeys(t *testing.T) {
+	store, _ := newTestS3ObjectStore(t)
+	kek, _ := GenerateKeyEncryptionKey(filepath.Join(t.TempDir(), "kek"))
+	other, _ := newKeyEncryptionKey(make([]byte, kekSize))
+
+	// Keys published before wrapping are raw AES keys
+	plaintext := map[string][]byte{
+		path.Join(infra.AESKeyStorageDir, "a"): bytes.Repeat([]byte{1}, 16),
+		path.Join(infra.AESKeyStorageDir, "b"): bytes.Repeat([]byte{2}, 32),
+	}
+	for name, key := range plaintext {
+		assert.Nil(t, store.WriteObject(name, bytes.NewReader(key), int64(len(key))), "should not return error")
+	}
+	wrappedName := path.Join(infra.AESKeyStorageDir, "c")
+	assert.Nil(t, writeStoredKey(store, kek, []byte("key c"), wrappedName), "should not return error")
+
+	wrapped, err := WrapPlaintextKeys(store, kek)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, len(plaintext), wrapped, "wrong number of wrapped keys")
+	for name, key := range plaintext {
+		stored, err := readStoredKey(store, name)
+		assert.Nil(t, err, "should not return error")
+		assert.NotEqual(t, key, stored, "key left in the clear")
+		unwrapped, err := kek.Unwrap(stored, path.Base(name))
+		assert.Nil(t, err, "should not return error")
+		assert.Equal(t, key, unwrapped, "wrong wrapped key")
+	}
+
+	// Rerunning a finished migration is a no-op
+	wrapped, err = WrapPlaintextKeys(store, kek)
+	assert.Nil(t, err, "should not return error")
+	assert.Zero(t, wrapped, "expected already wrapped keys to be skipped")
+
+	// Keys wrapped by another KEK need a rotation instead
+	assert.Nil(t, writeStoredKey(store, other, []byte("key d"), path.Join(infra.AESKeyStorageDir, "d")), "should not return error")
+	_, err = WrapPlaintextKeys(store, kek)
+	assert.NotNil(t, err, "expected key wrapped by another KEK to be rejected")
+}
@@ -0,0 +1,566 @@
+package cyprus
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+)
+
+// DefaultLiveWindow is the number of media segments per stream kept published for sliding live content
+const DefaultLiveWindow = 10
+
+/*
+LiveDataProcessor is a DataProcessor that can digest additions to a manifest
+under the key its earlier segments were digested with
+*/
+type LiveDataProcessor interface {
+	DataProcessor
+	DigestManifestUpdate(cryptKey []byte, update VODManifest, observer ProgressObserver) (MediaDigest, error)
+}
+
+/*
+liveStream tracks the media playlist of a live stream. NextSequence is the
+media sequence number of the first segment not ingested yet and Init the origin
+init segment the last ingested segments use
+*/
+type liveStream struct {
+	PlaylistURL  string      `json:"playlist_url"`
+	NextSequence int         `json:"next_sequence"`
+	Init         *VODSegment `json:"init,omitempty"`
+	Polled       bool        `json:"polled"`
+	Sliding      bool        `json:"sliding"`
+	Ended        bool        `json:"ended"`
+}
+
+/*
+liveState is the progress of a live ingestion job. Manifest is what was last
+published, with one liveStream per manifest stream, and Sizes holds the digested
+size of its segments by functional ID. The content key is only kept in memory,
+job records hold it wrapped by the KEK
+*/
+type liveState struct {
+	CryptKey   []byte           `json:"-"`
+	WrappedKey []byte           `json:"wrapped_key,omitempty"`
+	Manifest   VODManifest      `json:"manifest"`
+	Streams    []liveStream     `json:"streams"`
+	Sizes      map[string]int64 `json:"sizes"`
+}
+
+// clone returns a copy of the state that can be modified without affecting it
+func (s *liveState) clone() *liveState {
+	clone := &liveState{
+		CryptKey:   s.CryptKey,
+		WrappedKey: s.WrappedKey,
+		Manifest:   s.Manifest,
+		Streams:    make([]liveStream, len(s.Streams)),
+		Sizes:      make(map[string]int64, len(s.Sizes)),
+	}
+	clone.Manifest.Streams = make([]VODStream, len(s.Manifest.Streams))
+	for i, stream := range s.Manifest.Streams {
+		stream.Segments = append([]VODSegment(nil), stream.Segments...)
+		clone.Manifest.Streams[i] = stream
+	}
+	copy(clone.Streams, s.Streams)
+	for fid, size := range s.Sizes {
+		clone.Sizes[fid] = size
+	}
+	return clone
+}
+
+// ended returns whether every stream has ended
+func (s *liveState) ended() bool {
+	for _, stream := range s.Streams {
+		if !stream.Ended {
+			return false
+		}
+	}
+	return true
+}
+
+// byteSize returns the digested size of the segments currently in the manifest
+func (s *liveState) byteSize() int64 {
+	size := int64(0)
+	counted := make(map[string]bool)
+	for _, stream := range s.Manifest.Streams {
+		for _, segment := range stream.Segments {
+			if !counted[segment.FunctionalID] {
+				counted[segment.FunctionalID] = true
+				size += s.Sizes[segment.FunctionalID]
+			}
+		}
+	}
+	return size
+}
+
+// pollInterval returns the shortest target duration of the streams still running
+func (s *liveState) pollInterval() int {
+	interval := 0
+	for i, stream := range s.Streams {
+		target := s.Manifest.Streams[i].TargetDuration
+		if !stream.Ended && target > 0 && (interval == 0 || target < interval) {
+			interval = target
+		}
+	}
+	return interval
+}
+
+/*
+merge appends the segments of a digested update to the manifest, renumbering
+them after the segments already in it. Sliding manifests are then trimmed to
+the last 'window' media segments of each stream, removing the digest files of
+new segments that fall out of the window right away
+*/
+func (s *liveState) merge(update VODManifest, window int) error {
+	s.Manifest.FunctionalID = update.FunctionalID
+	for i, updateStream := range update.Streams {
+		stream := &s.Manifest.Streams[i]
+		stream.FunctionalID = updateStream.FunctionalID
+		stream.TargetDuration = int(math.Max(float64(stream.TargetDuration), float64(updateStream.TargetDuration)))
+		stream.Bandwidth = int(math.Max(float64(stream.Bandwidth), float64(updateStream.Bandwidth)))
+		if len(stream.Segments) == 0 {
+			stream.MediaSequence = updateStream.MediaSequence
+			stream.DiscontinuitySequence = updateStream.DiscontinuitySequence
+		}
+
+		nextIndex := 0
+		if len(stream.Segments) > 0 {
+			nextIndex = stream.Segments[len(stream.Segments)-1].Index + 1
+		}
+		for _, segment := range updateStream.Segments {
+			info, err := os.Stat(segment.File)
+			if err != nil {
+				return fmt.Errorf("failed to size digested segment %s: %w", segment.URL, err)
+			}
+			s.Sizes[segment.FunctionalID] = info.Size()
+			segment.Index = nextIndex
+			nextIndex++
+			stream.Segments = append(stream.Segments, segment)
+		}
+
+		if s.Manifest.Sliding {
+			RemoveIngestArtifacts(MediaIngest{Type: VODMediaType, Result: VODManifest{
+				Streams: []VODStream{{Segments: trimLiveStream(stream, window)}},
+			}})
+		}
+	}
+
+	// Forget the sizes of segments no longer in the manifest
+	listed := make(map[string]bool)
+	for _, stream := range s.Manifest.Streams {
+		for _, segment := range stream.Segments {
+			listed[segment.FunctionalID] = true
+		}
+	}
+	for fid := range s.Sizes {
+		if !listed[fid] {
+			delete(s.Sizes, fid)
+		}
+	}
+	return nil
+}
+
+// settle drops the digest file references of published segments so they are kept by later publishes
+func (s *liveState) settle() {
+	for i := range s.Manifest.Streams {
+		for j := range s.Manifest.Streams[i].Segments {
+			s.Manifest.Streams[i].Segments[j].File = ""
+			s.Manifest.Streams[i].Segments[j].ProofFile = ""
+		}
+	}
+}
+
+/*
+trimLiveStream drops all but the last 'window' media segments of stream along
+with the init segments they no longer use, advancing the sequence numbers of
+the stream past what was dropped. The init segment used by the first kept media
+segment stays in front of it. Returns the dropped segments
+*/
+func trimLiveStream(stream *VODStream, window int) []VODSegment {
+	media := 0
+	for _, segment := range stream.Segments {
+		if !segment.Init {
+			media++
+		}
+	}
+	if media <= window {
+		return nil
+	}
+
+	// Find the first kept media segment and the init segment in effect for it
+	cut, init := 0, -1
+	for skipped := 0; ; cut++ {
+		if stream.Segments[cut].Init {
+			init = cut
+			continue
+		}
+		if skipped == media-window {
+			break
+		}
+		skipped++
+	}
+
+	dropped := make([]VODSegment, 0, cut)
+	kept := make([]VODSegment, 0, len(stream.Segments)-cut+1)
+	for i, segment := range stream.Segments[:cut] {
+		if i == init {
+			// A discontinuity in front of the playlist is counted as expired instead
+			if segment.Discontinuity {
+				stream.DiscontinuitySequence++
+				segment.Discontinuity = false
+			}
+			kept = append(kept, segment)
+			continue
+		}
+		if !segment.Init {
+			stream.MediaSequence++
+		}
+		if segment.Discontinuity {
+			stream.DiscontinuitySequence++
+		}
+		dropped = append(dropped, segment)
+	}
+	stream.Segments = append(kept, stream.Segments[cut:]...)
+	return dropped
+}
+
+/*
+resolveLiveStreams returns a manifest with one empty stream per variant of the
+live content at manifestURL, along with the media playlists to poll for them
+*/
+func (r *HLSPreprocessor) resolveLiveStreams(manifestURL string) (VODManifest, []liveStream, error) {
+	mediaMap := VODManifest{URL: manifestURL, Format: HLSManifestFormat, Live: true}
+	playlist, err := r.getManifest(manifestURL)
+	if err != nil {
+		return VODManifest{}, nil, fmt.Errorf("failed to download manifest %s: %w", manifestURL, err)
+	}
+	if !playlist.IsMaster() {
+		mediaMap.Streams = []VODStream{{URL: DefaultStreamName, Segments: []VODSegment{}}}
+		return mediaMap, []liveStream{{PlaylistURL: manifestURL}}, nil
+	}
+
+	streams := make([]liveStream, 0)
+	variantURLs := make([]string, 0)
+	for _, variant := range playlist.Playlists() {
+		if variant.IFrame {
+			continue
+		}
+		playlistURL, err := url.JoinPath(path.Dir(manifestURL), variant.URI)
+		if err != nil {
+			return VODManifest{}, nil, fmt.Errorf("failed to create sub manifest download URL: %w", err)
+		}
+		stream := VODStream{URL: playlistURL, Segments: []VODSegment{}}
+		setVariantAttributes(&stream, variant)
+		mediaMap.Streams = append(mediaMap.Streams, stream)
+		streams = append(streams, liveStream{PlaylistURL: playlistURL})
+		variantURLs = append(variantURLs, playlistURL)
+	}
+
+	// Alternate renditions with playlists of their own are polled like the variants
+	media, renditionURLs, err := alternateRenditions(manifestURL, playlist, variantURLs)
+	if err != nil {
+		return VODManifest{}, nil, err
+	}
+	mediaMap.Media = media
+	for _, playlistURL := range renditionURLs {
+		mediaMap.Streams = append(mediaMap.Streams, VODStream{URL: playlistURL, Rendition: true, Segments: []VODSegment{}})
+		streams = append(streams, liveStream{PlaylistURL: playlistURL})
+	}
+	return mediaMap, streams, nil
+}
+
+// sameSegment returns whether a and b refer to the same origin data
+func sameSegment(a *VODSegment, b *VODSegment) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.URL != b.URL || (a.ByteRange == nil) != (b.ByteRange == nil) {
+		return false
+	}
+	return a.ByteRange == nil || *a.ByteRange == *b.ByteRange
+}
+
+/*
+pollLiveStream fetches the media playlist of stream and downloads the segments
+listed from stream.NextSequence on, preceded by their init segment if it differs
+from the one used so far. Segments the origin expired before they were polled
+are skipped and marked by a discontinuity. The returned stream only carries the
+new segments and, on the first poll, the sequence numbers of the playlist
+*/
+func (r *HLSPreprocessor) pollLiveStream(stream *liveStream, observer ProgressObserver) (VODStream, error) {
+	playlist, err := r.getManifest(stream.PlaylistURL)
+	if err != nil {
+		return VODStream{}, err
+	}
+	refs, err := r.locateSegments(path.Dir(stream.PlaylistURL), playlist)
+	if err != nil {
+		return VODStream{}, err
+	}
+
+	update := VODStream{TargetDuration: playlist.Target, MediaSequence: playlist.Sequence}
+	if playlist.DiscontinuitySequence != nil {
+		update.DiscontinuitySequence = *playlist.DiscontinuitySequence
+	}
+	newRefs := make([]VODSegment, 0)
+	var init *VODSegment
+	sequence := playlist.Sequence
+	for i, ref := range refs {
+		if ref.Init {
+			init = &refs[i]
+			continue
+		}
+		if sequence >= stream.NextSequence {
+			if len(newRefs) == 0 && stream.Polled && sequence > stream.NextSequence {
+				log.Printf("Segments %d to %d of %s expired before being polled\n",
+					stream.NextSequence, sequence-1, stream.PlaylistURL)
+				ref.Discontinuity = true
+			}
+			if init == nil {
+				stream.Init = nil
+			} else if !sameSegment(init, stream.Init) {
+				initRef := *init
+				initRef.Discontinuity = initRef.Discontinuity || ref.Discontinuity
+				ref.Discontinuity = false
+				newRefs = append(newRefs, initRef)
+				stream.Init = init
+			}
+			newRefs = append(newRefs, ref)
+		}
+		sequence++
+	}
+
+	if update.Segments, err = downloadSegmentRefs(newRefs, r.outputDir, r.workers, r.retrieveSegment, observer); err != nil {
+		return VODStream{}, err
+	}
+	stream.NextSequence = int(math.Max(float64(stream.NextSequence), float64(sequence)))
+	stream.Polled = true
+	stream.Sliding = playlist.Type == nil
+	stream.Ended = !playlist.IsLive()
+	return update, nil
+}
+
+/*
+processLive runs the live ingestion job for cid until every stream ended, the
+job is cancelled or polling failed maxAttempts times in a row. Each cycle polls
+the media playlists, digests new segments under the content key and publishes
+the extended manifest. Jobs that stop before the content ended are published
+closed so players stop waiting for more segments
+*/
+func (q *ProcessingQueue) processLive(cid string) {
+	observer := &jobObserver{tracker: q.tracker, cid: cid}
+	failures := 0
+	for {
+		wait, err := q.liveCycle(cid, observer)
+		if errors.Is(err, ErrJobCancelled) {
+			log.Printf("Cancelled live job for %s\n", cid)
+			q.closeLive(cid)
+			return
+		}
+		if err != nil {
+			failures++
+			if failures >= q.maxAttempts {
+				q.closeLive(cid)
+				q.fail(cid, fmt.Errorf("failed to ingest live %s after %d attempts: %w", cid, failures, err))
+				return
+			}
+			backoff := q.retryBackoff << (failures - 1)
+			log.Printf("Live ingest attempt %d of %s failed, retrying in %s: %v\n", failures, cid, backoff, err)
+			time.Sleep(backoff)
+			continue
+		}
+		failures = 0
+
+		live, err := q.tracker.live(cid)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if live.ended() {
+			if err = q.tracker.updateStatus(cid, infra.FinishedProcessing); err != nil {
+				log.Println(err)
+			}
+			q.notify(cid)
+			return
+		}
+		time.Sleep(wait)
+	}
+}
+
+/*
+liveCycle polls, digests and publishes the live content cid once, returning
+how long to wait for the origin to add segments. The job record is only updated
+once the cycle succeeded, so failed cycles are repeated from the same state
+*/
+func (q *ProcessingQueue) liveCycle(cid string, observer *jobObserver) (time.Duration, error) {
+	if err := q.tracker.startPhase(cid, infra.IngestPhase); err != nil {
+		return 0, err
+	}
+	current, err := q.liveState(cid)
+	if err != nil {
+		return 0, err
+	}
+	live := current.clone()
+	if len(live.Streams) == 0 {
+		if live.Manifest, live.Streams, err = q.livePreprocessor.resolveLiveStreams(cid); err != nil {
+			return 0, err
+		}
+	}
+
+	// Poll every running stream for new segments
+	update := VODManifest{
+		URL:          live.Manifest.URL,
+		FunctionalID: live.Manifest.FunctionalID,
+		Format:       live.Manifest.Format,
+		Streams:      make([]VODStream, len(live.Streams)),
+	}
+	added := 0
+	for i := range live.Streams {
+		stream := live.Manifest.Streams[i]
+		update.Streams[i] = VODStream{URL: stream.URL, FunctionalID: stream.FunctionalID, Segments: []VODSegment{}}
+		if live.Streams[i].Ended {
+			continue
+		}
+		polled, err := q.livePreprocessor.pollLiveStream(&live.Streams[i], observer)
+		if err != nil {
+			RemoveIngestArtifacts(MediaIngest{Type: VODMediaType, Result: update})
+			return 0, fmt.Errorf("failed to poll %s: %w", live.Streams[i].PlaylistURL, err)
+		}
+		polled.URL, polled.FunctionalID = stream.URL, stream.FunctionalID
+
+		// A lone media playlist declares no bandwidth so estimate it from what was polled
+		if stream.URL == DefaultStreamName {
+			if polled.Bandwidth, err = estimateBandwidth(polled); err != nil {
+				RemoveIngestArtifacts(MediaIngest{Type: VODMediaType, Result: update})
+				return 0, err
+			}
+		}
+		update.Streams[i] = polled
+		added += len(polled.Segments)
+	}
+	wasLive := live.Manifest.Live
+	live.Manifest.Live = !live.ended()
+	for _, stream := range live.Streams {
+		live.Manifest.Sliding = live.Manifest.Sliding || stream.Sliding
+	}
+
+	// Publish new segments, and the closed manifest once the content ended
+	if added > 0 || (wasLive && !live.Manifest.Live && live.CryptKey != nil) {
+		if err = q.tracker.startPhase(cid, infra.DigestPhase); err != nil {
+			RemoveIngestArtifacts(MediaIngest{Type: VODMediaType, Result: update})
+			return 0, err
+		}
+		digest, err := q.liveProcessor.DigestManifestUpdate(live.CryptKey, update, observer)
+		if err != nil {
+			return 0, err
+		}
+		if live.WrappedKey == nil {
+			if live.WrappedKey, err = q.kek.Wrap(digest.CryptKey, infra.URLToSafeName(cid)); err != nil {
+				RemoveIngestArtifacts(MediaIngest{Type: VODMediaType, Result: digest.Result})
+				return 0, err
+			}
+		}
+		live.CryptKey = digest.CryptKey
+		if err = live.merge(digest.Result.(VODManifest), q.liveWindow); err != nil {
+			RemoveIngestArtifacts(MediaIngest{Type: VODMediaType, Result: live.Manifest})
+			return 0, err
+		}
+		if err = q.publishLive(cid, live); err != nil {
+			return 0, err
+		}
+	} else if live.CryptKey == nil && !live.Manifest.Live {
+		return 0, fmt.Errorf("live content %s ended without segments", cid)
+	}
+	live.settle()
+	if err = q.tracker.update(cid, func(foundJob *job) { foundJob.Live = live }); err != nil {
+		return 0, err
+	}
+
+	// Wait a full target duration after changes and half of one otherwise, like players do
+	wait := time.Duration(live.pollInterval()) * q.livePollUnit
+	if added == 0 {
+		wait /= 2
+	}
+	if wait <= 0 {
+		wait = q.livePollUnit
+	}
+
+	// Move back to ingest so the job can be cancelled while waiting
+	return wait, q.tracker.startPhase(cid, infra.IngestPhase)
+}
+
+/*
+liveState returns the ingestion state of the live job for cid, unwrapping its
+content key if the job was resumed from its record
+*/
+func (q *ProcessingQueue) liveState(cid string) (*liveState, error) {
+	live, err := q.tracker.live(cid)
+	if err != nil {
+		return nil, err
+	}
+	if live.CryptKey == nil && live.WrappedKey != nil {
+		if live.CryptKey, err = q.kek.Unwrap(live.WrappedKey, infra.URLToSafeName(cid)); err != nil {
+			return nil, fmt.Errorf("failed to unwrap content key of live job %s: %w", cid, err)
+		}
+	}
+	return live, nil
+}
+
+// publishLive publishes the manifest of live and records the result
+func (q *ProcessingQueue) publishLive(cid string, live *liveState) error {
+	if err := q.tracker.startPhase(cid, infra.PublishPhase); err != nil {
+		RemoveIngestArtifacts(MediaIngest{Type: VODMediaType, Result: live.Manifest})
+		return err
+	}
+	digest := MediaDigest{
+		Type:         VODMediaType,
+		CryptKey:     live.CryptKey,
+		FunctionalID: live.Manifest.FunctionalID,
+		ByteSize:     live.byteSize(),
+		Result:       live.Manifest,
+	}
+	segments, _ := ingestSize(MediaIngest{Type: digest.Type, Result: digest.Result})
+	q.tracker.updateProgress(cid, func(progress *infra.ProcessingProgress) {
+		progress.SegmentsTotal, progress.BytesTotal = segments, digest.ByteSize
+	})
+	if err := q.storage.Publish(digest); err != nil {
+		RemoveIngestArtifacts(MediaIngest{Type: VODMediaType, Result: live.Manifest})
+		return err
+	}
+	return q.tracker.updateResult(cid, &infra.PostProcessingMetadata{
+		FunctionalID: digest.FunctionalID,
+		ByteSize:     digest.ByteSize,
+	})
+}
+
+// closeLive republishes the content of a stopped live job as ended, if anything was published
+func (q *ProcessingQueue) closeLive(cid string) {
+	live, err := q.liveState(cid)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if live.CryptKey == nil || !live.Manifest.Live {
+		return
+	}
+	live.Manifest.Live = false
+	err = q.storage.Publish(MediaDigest{
+		Type:         VODMediaType,
+		CryptKey:     live.CryptKey,
+		FunctionalID: live.Manifest.FunctionalID,
+		ByteSize:     live.byteSize(),
+		Result:       live.Manifest,
+	})
+	if err != nil {
+		log.Printf("Failed to close live content %s: %v\n", cid, err)
+		return
+	}
+	if err = q.tracker.update(cid, func(foundJob *job) { foundJob.Live = live }); err != nil {
+		log.Println(err)
+	}
+}
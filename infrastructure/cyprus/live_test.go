@@ -0,0 +1,274 @@
+package cyprus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+	"github.com/Apiara/ApiaraCDN/infrastructure/state"
+	"github.com/etherlabsio/go-m3u8/m3u8"
+	"github.com/stretchr/testify/assert"
+)
+
+// liveOrigin serves resources from memory so tests can change them between polls
+type liveOrigin struct {
+	mutex     sync.Mutex
+	resources map[string]string
+}
+
+func (o *liveOrigin) set(url string, data string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.resources[url] = data
+}
+
+func (o *liveOrigin) retrieve(url string, out io.Writer) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	data, ok := o.resources[url]
+	if !ok {
+		return fmt.Errorf("no resource %s", url)
+	}
+	_, err := io.WriteString(out, data)
+	return err
+}
+
+// liveMediaPlaylist writes a media playlist of one second segments starting at sequence
+func liveMediaPlaylist(playlistType string, sequence int, ended bool, items ...string) string {
+	playlist := "#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:1\n"
+	playlist += fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", sequence)
+	if playlistType != "" {
+		playlist += "#EXT-X-PLAYLIST-TYPE:" + playlistType + "\n"
+	}
+	for _, item := range items {
+		if strings.HasPrefix(item, "init") {
+			playlist += fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", item)
+			continue
+		}
+		playlist += "#EXTINF:1.0,\n" + item + "\n"
+	}
+	if ended {
+		playlist += "#EXT-X-ENDLIST\n"
+	}
+	return playlist
+}
+
+func newLiveOrigin() *liveOrigin {
+	origin := &liveOrigin{resources: make(map[string]string)}
+	for _, name := range []string{"init.mp4", "init2.mp4", "seg0.mp4", "seg1.mp4", "seg2.mp4", "seg3.mp4", "seg4.mp4", "seg5.mp4"} {
+		origin.set("live/"+name, "data of "+name)
+	}
+	return origin
+}
+
+func TestTrimLiveStream(t *testing.T) {
+	segments := []VODSegment{
+		{Index: 0, FunctionalID: "init1", Init: true, Discontinuity: true},
+		{Index: 1, FunctionalID: "seg1"},
+		{Index: 2, FunctionalID: "seg2", Discontinuity: true},
+		{Index: 3, FunctionalID: "init2", Init: true},
+		{Index: 4, FunctionalID: "seg3"},
+		{Index: 5, FunctionalID: "seg4"},
+	}
+	fids := func(segments []VODSegment) []string {
+		names := make([]string, 0)
+		for _, segment := range segments {
+			names = append(names, segment.FunctionalID)
+		}
+		return names
+	}
+
+	// Init segments in front of the window are only kept while in use
+	stream := VODStream{MediaSequence: 5, Segments: append([]VODSegment(nil), segments...)}
+	dropped := trimLiveStream(&stream, 2)
+	assert.Equal(t, []string{"init1", "seg1", "seg2"}, fids(dropped), "wrong dropped segments")
+	assert.Equal(t, []string{"init2", "seg3", "seg4"}, fids(stream.Segments), "wrong kept segments")
+	assert.Equal(t, 7, stream.MediaSequence, "expected dropped media segments to advance the sequence")
+	assert.Equal(t, 2, stream.DiscontinuitySequence, "expected dropped discontinuities to advance the sequence")
+
+	stream = VODStream{Segments: append([]VODSegment(nil), segments...)}
+	dropped = trimLiveStream(&stream, 3)
+	assert.Equal(t, []string{"seg1"}, fids(dropped), "wrong dropped segments")
+	assert.Equal(t, []string{"init1", "seg2", "init2", "seg3", "seg4"}, fids(stream.Segments), "wrong kept segments")
+	assert.False(t, stream.Segments[0].Discontinuity, "expected leading discontinuity to expire")
+	assert.Equal(t, 1, stream.MediaSequence, "wrong media sequence")
+	assert.Equal(t, 1, stream.DiscontinuitySequence, "wrong discontinuity sequence")
+
+	// Streams within the window are left alone
+	stream = VODStream{Segments: append([]VODSegment(nil), segments...)}
+	assert.Nil(t, trimLiveStream(&stream, 4), "expected nothing to be dropped")
+	assert.Len(t, stream.Segments, len(segments), "expected all segments to be kept")
+}
+
+func TestPollLiveStream(t *testing.T) {
+	origin := newLiveOrigin()
+	preprocessor := &HLSPreprocessor{outputDir: t.TempDir(), retrieveFile: origin.retrieve}
+	stream := &liveStream{PlaylistURL: "live/media.m3u8"}
+	readSegments := func(segments []VODSegment) []string {
+		data := make([]string, 0)
+		for _, segment := range segments {
+			content, _ := os.ReadFile(segment.File)
+			os.Remove(segment.File)
+			data = append(data, string(content))
+		}
+		return data
+	}
+
+	// First poll takes everything listed along with the init segment
+	origin.set("live/media.m3u8", liveMediaPlaylist("", 3, false, "init.mp4", "seg0.mp4", "seg1.mp4"))
+	update, err := preprocessor.pollLiveStream(stream, nopProgressObserver{})
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, []string{"data of init.mp4", "data of seg0.mp4", "data of seg1.mp4"}, readSegments(update.Segments),
+		"wrong polled segments")
+	assert.True(t, update.Segments[0].Init, "expected init segment first")
+	assert.Equal(t, 3, update.MediaSequence, "expected sequence of the playlist on first poll")
+	assert.Equal(t, 5, stream.NextSequence, "wrong next sequence")
+	assert.True(t, stream.Sliding, "expected playlist without type to slide")
+	assert.False(t, stream.Ended, "expected stream to be running")
+
+	// Unchanged playlists have nothing new
+	update, err = preprocessor.pollLiveStream(stream, nopProgressObserver{})
+	assert.Nil(t, err, "should not return error")
+	assert.Empty(t, update.Segments, "expected no new segments")
+
+	// Segments expired before they were polled leave a discontinuity
+	origin.set("live/media.m3u8", liveMediaPlaylist("", 6, false, "init.mp4", "seg3.mp4", "seg4.mp4"))
+	update, err = preprocessor.pollLiveStream(stream, nopProgressObserver{})
+	assert.Nil(t, err, "should not return error")
+	assert.Len(t, update.Segments, 2, "expected init segment to be reused")
+	assert.True(t, update.Segments[0].Discontinuity, "expected discontinuity for skipped segments")
+	assert.Equal(t, []string{"data of seg3.mp4", "data of seg4.mp4"}, readSegments(update.Segments), "wrong polled segments")
+
+	// A new init segment precedes the segments using it
+	origin.set("live/media.m3u8", liveMediaPlaylist("", 7, true, "init.mp4", "seg4.mp4", "init2.mp4", "seg5.mp4"))
+	update, err = preprocessor.pollLiveStream(stream, nopProgressObserver{})
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, []string{"data of init2.mp4", "data of seg5.mp4"}, readSegments(update.Segments), "wrong polled segments")
+	assert.Equal(t, 9, stream.NextSequence, "wrong next sequence")
+	assert.True(t, stream.Ended, "expected stream to end with the playlist")
+}
+
+func TestProcessingQueueLive(t *testing.T) {
+	origin := newLiveOrigin()
+	workingDir := t.TempDir()
+	storageDir := t.TempDir()
+	preprocessor := &HLSPreprocessor{outputDir: workingDir, retrieveFile: origin.retrieve}
+	processor, err := NewAESDataProcessor(DefaultAESKeySize, workingDir)
+	assert.Nil(t, err, "should not return error")
+	kek, _ := newKeyEncryptionKey(make([]byte, kekSize))
+	storage, err := NewFilesystemStorageManager(storageDir, state.NewMockMicroserviceState(), kek)
+	assert.Nil(t, err, "should not return error")
+
+	conf := ProcessingQueueConfig{RecordDir: t.TempDir(), Workers: 1, MaxAttempts: 3,
+		RetryBackoff: time.Millisecond, Retention: time.Hour, LivePreprocessor: preprocessor, LiveWindow: 2}
+	queue, err := NewProcessingQueue(conf, preprocessor, processor, storage)
+	assert.NotNil(t, err, "expected live ingestion to require a KEK")
+	conf.KEK = kek
+	queue, err = NewProcessingQueue(conf, preprocessor, &mockQueueProcessor{}, storage)
+	assert.NotNil(t, err, "expected live ingestion to require a LiveDataProcessor")
+	queue, err = NewProcessingQueue(conf, preprocessor, processor, storage)
+	assert.Nil(t, err, "should not return error")
+	queue.livePollUnit = time.Millisecond
+
+	// readMediaPlaylist returns the published media playlist of the content once it has 'segments' segments
+	readMediaPlaylist := func(cid string, segments int) *m3u8.Playlist {
+		for i := 0; i < 100; i++ {
+			response, err := queue.Status(cid)
+			assert.Nil(t, err, "should not return error")
+			if response.Metadata != nil {
+				master, err := m3u8.ReadFile(filepath.Join(storageDir, infra.PlaylistDir, response.Metadata.FunctionalID))
+				assert.Nil(t, err, "should not return error")
+				playlistFile := filepath.Join(storageDir, infra.PlaylistDir, master.Playlists()[0].URI)
+				if media, err := m3u8.ReadFile(playlistFile); err == nil && media.SegmentSize() == segments {
+					return media
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("%s never published %d segments", cid, segments)
+		return nil
+	}
+	segmentURIs := func(playlist *m3u8.Playlist) []string {
+		uris := make([]string, 0)
+		for _, segment := range playlist.Segments() {
+			uris = append(uris, segment.Segment)
+		}
+		return uris
+	}
+
+	// Event content is extended until the playlist ends
+	origin.set("live/media.m3u8", liveMediaPlaylist(hlsPlaylistTypeEvent, 0, false, "init.mp4", "seg0.mp4", "seg1.mp4"))
+	created, err := queue.SubmitLive("live/media.m3u8", "")
+	assert.Nil(t, err, "should not return error")
+	assert.True(t, created, "expected job to be created")
+	playlist := readMediaPlaylist("live/media.m3u8", 2)
+	assert.True(t, playlist.IsLive(), "expected running content to stay open")
+	assert.Equal(t, hlsPlaylistTypeEvent, *playlist.Type, "wrong playlist type")
+	published := segmentURIs(playlist)
+
+	origin.set("live/media.m3u8", liveMediaPlaylist(hlsPlaylistTypeEvent, 0, true,
+		"init.mp4", "seg0.mp4", "seg1.mp4", "seg2.mp4"))
+	assert.Equal(t, infra.FinishedProcessing, waitForStatus(t, queue, "live/media.m3u8"), "expected job to finish")
+	playlist = readMediaPlaylist("live/media.m3u8", 3)
+	assert.False(t, playlist.IsLive(), "expected ended content to be closed")
+	assert.Equal(t, published, segmentURIs(playlist)[:2], "expected published segments to be kept")
+
+	// Job records only hold the content key wrapped by the KEK
+	cryptKey, err := readWrappedKey(kek, filepath.Join(storageDir, infra.AESKeyStorageDir,
+		infra.URLToSafeName("live/media.m3u8")))
+	assert.Nil(t, err, "should not return error")
+	records, _ := os.ReadDir(conf.RecordDir)
+	for _, record := range records {
+		var recorded job
+		data, _ := os.ReadFile(filepath.Join(conf.RecordDir, record.Name()))
+		assert.Nil(t, json.Unmarshal(data, &recorded), "should not return error")
+		if recorded.ContentID == "live/media.m3u8" {
+			assert.Nil(t, recorded.Live.CryptKey, "expected no plaintext key in job record")
+			unwrapped, err := kek.Unwrap(recorded.Live.WrappedKey, infra.URLToSafeName("live/media.m3u8"))
+			assert.Nil(t, err, "should not return error")
+			assert.Equal(t, cryptKey, unwrapped, "expected job record to hold the wrapped content key")
+		}
+	}
+
+	// Jobs resumed from their record unwrap the key
+	queue.tracker.update("live/media.m3u8", func(foundJob *job) { foundJob.Live.CryptKey = nil })
+	resumed, err := queue.liveState("live/media.m3u8")
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, cryptKey, resumed.CryptKey, "expected resumed job to unwrap the content key")
+
+	// Sliding content only keeps the window published
+	origin.set("live/sliding.m3u8", liveMediaPlaylist("", 0, false, "init.mp4", "seg0.mp4", "seg1.mp4", "seg2.mp4"))
+	_, err = queue.SubmitLive("live/sliding.m3u8", "")
+	assert.Nil(t, err, "should not return error")
+	playlist = readMediaPlaylist("live/sliding.m3u8", 2)
+	assert.Nil(t, playlist.Type, "expected sliding playlist to declare no type")
+	assert.Equal(t, 1, playlist.Sequence, "expected expired segment to advance the sequence")
+	published = segmentURIs(playlist)
+
+	origin.set("live/sliding.m3u8", liveMediaPlaylist("", 1, false, "init.mp4", "seg1.mp4", "seg2.mp4", "seg3.mp4"))
+	for i := 0; i < 100 && segmentURIs(playlist)[0] == published[0]; i++ {
+		time.Sleep(10 * time.Millisecond)
+		playlist = readMediaPlaylist("live/sliding.m3u8", 2)
+	}
+	assert.Equal(t, published[1], segmentURIs(playlist)[0], "expected window to slide")
+	assert.Equal(t, 2, playlist.Sequence, "wrong media sequence")
+	_, err = os.Stat(filepath.Join(storageDir, infra.CryptDataStorageDir, published[0]))
+	assert.True(t, os.IsNotExist(err), "expected expired segment to be purged")
+	_, err = os.Stat(filepath.Join(storageDir, infra.CryptDataStorageDir, published[1]))
+	assert.Nil(t, err, "expected segment in the window to be kept")
+
+	// Cancelled content is closed
+	assert.Nil(t, queue.Cancel("live/sliding.m3u8"), "should not return error")
+	for i := 0; i < 100 && playlist.IsLive(); i++ {
+		time.Sleep(10 * time.Millisecond)
+		playlist = readMediaPlaylist("live/sliding.m3u8", 2)
+	}
+	assert.False(t, playlist.IsLive(), "expected cancelled content to be closed")
+}
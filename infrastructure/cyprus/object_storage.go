@@ -0,0 +1,330 @@
+package cyprus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+	"github.com/Apiara/ApiaraCDN/infrastructure/state"
+)
+
+/*
+ObjectStorageManager implements StorageManager by publishing processed data to
+an ObjectStore using the same logical layout as FilesystemStorageManager, so
+the storage API and deus can read it back through the store. Resources are
+recorded in state by object name
+*/
+type ObjectStorageManager struct {
+	contentState state.ContentMetadataState
+	references   *resourceReferences
+	store        ObjectStore
+	kek          *KeyEncryptionKey
+}
+
+/*
+NewObjectStorageManager creates a new ObjectStorageManager publishing to store
+and indexing via state. Content keys are stored wrapped by kek
+*/
+func NewObjectStorageManager(store ObjectStore, contentState state.ContentMetadataState,
+	kek *KeyEncryptionKey) (*ObjectStorageManager, error) {
+	if kek == nil {
+		return nil, fmt.Errorf("storage manager requires a key encryption key")
+	}
+	return &ObjectStorageManager{
+		contentState: contentState,
+		references:   newResourceReferences(contentState),
+		store:        store,
+		kek:          kek,
+	}, nil
+}
+
+// putBytes stores data under name and appends it to resources
+func (s *ObjectStorageManager) putBytes(data []byte, name string, resources []string) ([]string, error) {
+	if err := s.store.WriteObject(name, bytes.NewReader(data), int64(len(data))); err != nil {
+		return resources, err
+	}
+	return append(resources, name), nil
+}
+
+// putFile uploads the local file fname under name and appends it to resources
+func (s *ObjectStorageManager) putFile(fname string, name string, resources []string) ([]string, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return resources, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return resources, err
+	}
+
+	if err = s.store.WriteObject(name, file, stat.Size()); err != nil {
+		return resources, err
+	}
+	return append(resources, name), nil
+}
+
+// storedObject is data stored under name in the object store
+type storedObject struct {
+	name string
+	data []byte
+}
+
+/*
+replaceObjects stores objects, which replace those of any earlier publish of
+the content, and appends them to resources. The previous objects are read first
+and restored should a write fail, so readers never see the index of a publish
+mixed with that of another
+*/
+func (s *ObjectStorageManager) replaceObjects(objects []storedObject, resources []string) ([]string, error) {
+	previous := make([]*bytes.Buffer, len(objects))
+	for i, object := range objects {
+		buf := &bytes.Buffer{}
+		err := s.store.ReadObject(object.name, buf)
+		if err == nil {
+			previous[i] = buf
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return resources, fmt.Errorf("failed to read previous object %s: %w", object.name, err)
+		}
+	}
+
+	for i, object := range objects {
+		if err := s.store.WriteObject(object.name, bytes.NewReader(object.data), int64(len(object.data))); err != nil {
+			s.restoreObjects(objects[:i+1], previous)
+			return resources, err
+		}
+	}
+	for _, object := range objects {
+		resources = append(resources, object.name)
+	}
+	return resources, nil
+}
+
+// restoreObjects stores the previous data of objects, deleting those that didn't exist before
+func (s *ObjectStorageManager) restoreObjects(objects []storedObject, previous []*bytes.Buffer) {
+	for i, object := range objects {
+		var err error
+		if previous[i] == nil {
+			err = s.store.DeleteObject(object.name)
+		} else {
+			err = s.store.WriteObject(object.name, previous[i], int64(previous[i].Len()))
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+publishIndex publishes the wrapped symmetric key and the complete and partial
+maps of content stored as urlFname. These overwrite those of an earlier publish
+so they are only published once all data of the content is
+*/
+func (s *ObjectStorageManager) publishIndex(key []byte, urlFname string, complete interface{},
+	partial interface{}, fid string, resources []string) ([]string, error) {
+	wrapped, err := s.kek.Wrap(key, urlFname)
+	if err != nil {
+		return resources, err
+	}
+	completeSerial, err := json.Marshal(complete)
+	if err != nil {
+		return resources, err
+	}
+	partialSerial, err := json.Marshal(partial)
+	if err != nil {
+		return resources, err
+	}
+	return s.replaceObjects([]storedObject{
+		{name: path.Join(infra.AESKeyStorageDir, urlFname), data: wrapped},
+		{name: path.Join(infra.CompleteMediaMapDir, urlFname), data: completeSerial},
+		{name: path.Join(infra.PartialMapDir, fid), data: partialSerial},
+	}, resources)
+}
+
+/*
+putShared uploads the local file fname under name, which other content may
+share, on behalf of cid. The reference is added before the upload, so a purge of
+other content that used the object either deletes it before it is referenced or
+keeps it, and name is appended to resources even on failure so the reference
+gets released
+*/
+func (s *ObjectStorageManager) putShared(fname string, name string, cid string, resources []string) ([]string, error) {
+	if err := s.references.add(cid, []string{name}); err != nil {
+		return resources, fmt.Errorf("failed to reference %s: %w", name, err)
+	}
+	_, err := s.putFile(fname, name, nil)
+	return append(resources, name), err
+}
+
+/*
+publishData uploads encrypted data and its integrity proof, if it was digested
+with one, under fid on behalf of cid
+*/
+func (s *ObjectStorageManager) publishData(dataFile string, proofFile string, fid string, cid string,
+	resources []string) ([]string, error) {
+	resources, err := s.putShared(dataFile, path.Join(infra.CryptDataStorageDir, fid), cid, resources)
+	if err != nil || proofFile == "" {
+		return resources, err
+	}
+	return s.putShared(proofFile, path.Join(infra.IntegrityProofDir, fid), cid, resources)
+}
+
+// publishManifest publishes digested manifest resources to the object store
+func (s *ObjectStorageManager) publishManifest(mediaMap VODManifest, key []byte) ([]string, error) {
+	var err error
+	resources := make([]string, 0)
+
+	/* Publish encrypted segments, uploading convergent segments repeated in the manifest
+	once and keeping those published by an earlier publish of the content */
+	published := make(map[string]bool)
+	for _, mediaStream := range mediaMap.Streams {
+		for _, mediaSegment := range mediaStream.Segments {
+			if published[mediaSegment.FunctionalID] {
+				continue
+			}
+			published[mediaSegment.FunctionalID] = true
+			if mediaSegment.File == "" {
+				resources = append(resources, path.Join(infra.CryptDataStorageDir, mediaSegment.FunctionalID))
+				if mediaSegment.MerkleRoot != "" {
+					resources = append(resources, path.Join(infra.IntegrityProofDir, mediaSegment.FunctionalID))
+				}
+				continue
+			}
+			resources, err = s.publishData(mediaSegment.File, mediaSegment.ProofFile, mediaSegment.FunctionalID,
+				mediaMap.URL, resources)
+			if err != nil {
+				return resources, err
+			}
+		}
+	}
+
+	if resources, err = s.publishPlaylists(mediaMap, resources); err != nil {
+		return resources, err
+	}
+
+	// Publish key, complete and partial maps
+	partialMap := completeToPartialManifest(mediaMap)
+	return s.publishIndex(key, infra.URLToSafeName(mediaMap.URL), mediaMap, partialMap, mediaMap.FunctionalID,
+		resources)
+}
+
+// publishPlaylists uploads the rewritten playlists of HLS manifests. Other formats are skipped
+func (s *ObjectStorageManager) publishPlaylists(mediaMap VODManifest, resources []string) ([]string, error) {
+	if mediaMap.Format != HLSManifestFormat {
+		return resources, nil
+	}
+	playlists, err := renderHLSPlaylists(mediaMap)
+	if err != nil {
+		return resources, err
+	}
+	for _, playlist := range playlists {
+		if resources, err = s.putBytes(playlist.Data, path.Join(infra.PlaylistDir, playlist.FunctionalID), resources); err != nil {
+			return resources, err
+		}
+	}
+	return resources, nil
+}
+
+// publishRawMedia publishes the digested media data to the object store
+func (s *ObjectStorageManager) publishRawMedia(media RawMedia, key []byte) ([]string, error) {
+	// Publish encrypted media file
+	resources, err := s.publishData(media.File, media.ProofFile, media.FunctionalID, media.URL, make([]string, 0))
+	if err != nil {
+		return resources, err
+	}
+
+	// Publish key, complete and partial media definitions
+	pMedia := completeToPartialRawMedia(media)
+	return s.publishIndex(key, infra.URLToSafeName(media.URL), media, pMedia, media.FunctionalID, resources)
+}
+
+// purgeObjects deletes all objects specified in 'resources'
+func (s *ObjectStorageManager) purgeObjects(resources []string) {
+	for _, resource := range resources {
+		if err := s.store.DeleteObject(resource); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+Publish publishes the output of a MediaDigest to the object store, replacing
+any earlier publish of the same content once all of its data is uploaded. The
+local digest files are removed once uploaded, like FilesystemStorageManager
+moves them
+*/
+func (s *ObjectStorageManager) Publish(digest MediaDigest) error {
+	var err error
+	var url string
+	var fid string
+	var resources []string
+	defer RemoveIngestArtifacts(MediaIngest{Type: digest.Type, Result: digest.Result})
+
+	// Publish digest based on MediaType
+	switch digest.Type {
+	case RawMediaType:
+		media := digest.Result.(RawMedia)
+		url = media.URL
+		fid = media.FunctionalID
+		resources, err = s.publishRawMedia(media, digest.CryptKey)
+	case VODMediaType:
+		mediaManifest := digest.Result.(VODManifest)
+		url = mediaManifest.URL
+		fid = mediaManifest.FunctionalID
+		resources, err = s.publishManifest(mediaManifest, digest.CryptKey)
+	default:
+		return fmt.Errorf("failed to publish. MediaType %d does not exist", digest.Type)
+	}
+
+	// Content published for the first time has no previous resources
+	previous, stateErr := s.contentState.GetContentResources(url)
+	if stateErr != nil {
+		previous = nil
+	}
+
+	// Purge all created resources no other content shares if anything failed
+	if err != nil {
+		s.references.release(url, unlistedResources(resources, previous), s.purgeObjects)
+		return err
+	}
+
+	// Publish state update to state index and purge objects an earlier publish no longer needs
+	if err = s.contentState.CreateContentEntry(url, fid, digest.ByteSize, resources); err != nil {
+		return err
+	}
+	s.references.release(url, unlistedResources(previous, resources), s.purgeObjects)
+	return nil
+}
+
+/*
+purge removes all objects created for a URL/FID as well
+as deletes all associated indexed information
+*/
+func (s *ObjectStorageManager) purge(url string) error {
+	resources, err := s.contentState.GetContentResources(url)
+	if err != nil {
+		return fmt.Errorf("failed to read resource list for URL %s: %w", url, err)
+	}
+	s.references.release(url, resources, s.purgeObjects)
+	return s.contentState.DeleteContentEntry(url)
+}
+
+// PurgeByURL allows purging by URL key
+func (s *ObjectStorageManager) PurgeByURL(url string) error {
+	return s.purge(url)
+}
+
+// PurgeByFunctionalID allows purging by functional ID
+func (s *ObjectStorageManager) PurgeByFunctionalID(fid string) error {
+	url, err := s.contentState.GetContentID(fid)
+	if err != nil {
+		return err
+	}
+	return s.purge(url)
+}
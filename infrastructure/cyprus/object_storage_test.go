@@ -0,0 +1,149 @@
+package cyprus
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+	"github.com/Apiara/ApiaraCDN/infrastructure/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObjectStorageManager(t *testing.T) {
+	store, fake := newTestS3ObjectStore(t)
+	contentState := state.NewMockMicroserviceState()
+	kek, _ := newKeyEncryptionKey(make([]byte, kekSize))
+	storage, err := NewObjectStorageManager(store, contentState, kek)
+	assert.Nil(t, err, "should not return error")
+
+	workingDir := t.TempDir()
+	dataFile := filepath.Join(workingDir, "digest_data")
+	proofFile := filepath.Join(workingDir, "proof_data")
+	os.WriteFile(dataFile, []byte("data"), 0644)
+	os.WriteFile(proofFile, []byte("proof"), 0644)
+
+	url := "http://www.randomsite.com/media.mp4"
+	urlFname := infra.URLToSafeName(url)
+	key := []byte("0123456789abcdef")
+	err = storage.Publish(MediaDigest{
+		Type:         RawMediaType,
+		CryptKey:     key,
+		FunctionalID: "fid",
+		ByteSize:     4,
+		Result:       RawMedia{URL: url, FunctionalID: "fid", File: dataFile, ProofFile: proofFile},
+	})
+	assert.Nil(t, err, "should not return error")
+
+	// Objects use the filesystem layout and local digest files are consumed
+	expected := []string{
+		path.Join(infra.CryptDataStorageDir, "fid"),
+		path.Join(infra.IntegrityProofDir, "fid"),
+		path.Join(infra.AESKeyStorageDir, urlFname),
+		path.Join(infra.CompleteMediaMapDir, urlFname),
+		path.Join(infra.PartialMapDir, "fid"),
+	}
+	resources, err := contentState.GetContentResources(url)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, expected, resources, "wrong resources recorded")
+	for _, name := range expected {
+		assert.Contains(t, fake.objects, "/bucket"+name, "missing object %s", name)
+	}
+	_, err = os.Stat(dataFile)
+	assert.True(t, os.IsNotExist(err), "expected data file to be removed")
+	_, err = os.Stat(proofFile)
+	assert.True(t, os.IsNotExist(err), "expected proof file to be removed")
+
+	// The storage API serves objects from the store and unwraps keys
+	server := httptest.NewServer(newStorageAPI(store, kek, StorageAccessPolicy{ServiceToken: "service"}))
+	defer server.Close()
+	get := func(resource string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+resource, nil)
+		req.Header.Set("Authorization", "Bearer service")
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err, "should not return error")
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	status, body := get(infra.CyprusStorageAPIKeyResource + "/" + urlFname)
+	assert.Equal(t, http.StatusOK, status, "expected key to be served")
+	assert.Equal(t, string(key), body, "expected key to be served unwrapped")
+	status, body = get(infra.CyprusStorageAPIDataResource + "/fid")
+	assert.Equal(t, http.StatusOK, status, "expected data to be served")
+	assert.Equal(t, "data", body, "wrong data")
+	status, _ = get(infra.CyprusStorageAPIDataResource + "/missing")
+	assert.Equal(t, http.StatusNotFound, status, "expected missing data to 404")
+
+	// Purging removes every object
+	assert.Nil(t, storage.PurgeByFunctionalID("fid"), "should not return error")
+	assert.Empty(t, fake.objects, "expected all objects to be purged")
+}
+
+// failingObjectStore is an ObjectStore failing writes of the object named fail
+type failingObjectStore struct {
+	ObjectStore
+	fail string
+}
+
+func (f *failingObjectStore) WriteObject(name string, data io.Reader, size int64) error {
+	if name == f.fail {
+		return fmt.Errorf("failed to write object %s", name)
+	}
+	return f.ObjectStore.WriteObject(name, data, size)
+}
+
+func TestObjectStorageManagerFailedRepublish(t *testing.T) {
+	s3Store, fake := newTestS3ObjectStore(t)
+	store := &failingObjectStore{ObjectStore: s3Store}
+	contentState := state.NewMockMicroserviceState()
+	kek, _ := newKeyEncryptionKey(make([]byte, kekSize))
+	storage, err := NewObjectStorageManager(store, contentState, kek)
+	assert.Nil(t, err, "should not return error")
+
+	url := "http://www.randomsite.com/media.mp4"
+	urlFname := infra.URLToSafeName(url)
+	workingDir := t.TempDir()
+	publish := func(fid string) error {
+		dataFile := filepath.Join(workingDir, fid)
+		os.WriteFile(dataFile, []byte(fid), 0644)
+		return storage.Publish(MediaDigest{
+			Type:         RawMediaType,
+			CryptKey:     []byte("0123456789abcdef"),
+			FunctionalID: fid,
+			ByteSize:     int64(len(fid)),
+			Result:       RawMedia{URL: url, FunctionalID: fid, File: dataFile},
+		})
+	}
+	assert.Nil(t, publish("fid"), "should not return error")
+	published := make(map[string][]byte)
+	for name, data := range fake.objects {
+		published[name] = data
+	}
+
+	// Failing to upload new data leaves the earlier publish untouched
+	store.fail = path.Join(infra.CryptDataStorageDir, "fid2")
+	assert.NotNil(t, publish("fid2"), "expected failed upload to fail publish")
+	assert.Equal(t, published, fake.objects, "expected earlier publish to be kept")
+
+	// Failing to replace its index restores the earlier one
+	store.fail = path.Join(infra.CompleteMediaMapDir, urlFname)
+	assert.NotNil(t, publish("fid2"), "expected failed index write to fail publish")
+	assert.Equal(t, published, fake.objects, "expected earlier publish to be restored")
+	resources, err := contentState.GetContentResources(url)
+	assert.Nil(t, err, "should not return error")
+	assert.Contains(t, resources, path.Join(infra.CryptDataStorageDir, "fid"), "expected earlier resources")
+
+	// Republishing replaces the earlier publish
+	store.fail = ""
+	assert.Nil(t, publish("fid2"), "should not return error")
+	assert.NotContains(t, fake.objects, "/bucket"+path.Join(infra.CryptDataStorageDir, "fid"),
+		"expected earlier data to be purged")
+	assert.NotEqual(t, published["/bucket"+path.Join(infra.CompleteMediaMapDir, urlFname)],
+		fake.objects["/bucket"+path.Join(infra.CompleteMediaMapDir, urlFname)], "expected complete map to be replaced")
+}
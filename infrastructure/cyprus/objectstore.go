@@ -0,0 +1,226 @@
+package cyprus
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+)
+
+/*
+StorageReader represents an object that can read published data by its logical
+name, the storage dir of its resource class joined with its file name, such as
+path.Join(infra.CryptDataStorageDir, fid). Reading a missing object returns an
+error wrapping fs.ErrNotExist
+*/
+type StorageReader interface {
+	ReadObject(name string, out io.Writer) error
+}
+
+/*
+ObjectInfo describes a stored object. Version changes whenever the object is
+written again, so it identifies the data without reading it, and is empty if
+the store can't tell
+*/
+type ObjectInfo struct {
+	Size    int64
+	Version string
+}
+
+/*
+ObjectRangeReader is a StorageReader that can also describe an object and read
+it from an offset, so parts of objects are served without reading them whole
+*/
+type ObjectRangeReader interface {
+	StorageReader
+	StatObject(name string) (ObjectInfo, error)
+	OpenObjectAt(name string, offset int64) (io.ReadCloser, error)
+}
+
+/*
+ObjectStore represents a flat store that published data can be written to
+and read from by logical name
+*/
+type ObjectStore interface {
+	StorageReader
+	WriteObject(name string, data io.Reader, size int64) error
+	DeleteObject(name string) error
+}
+
+/*
+ListableObjectStore is an ObjectStore that can also list the names of the
+objects stored under a storage dir, so maintenance can walk a resource class
+on any storage backend
+*/
+type ListableObjectStore interface {
+	ObjectStore
+	ListObjects(dir string) ([]string, error)
+}
+
+// cleanObjectName returns name rooted at the top of the storage layout
+func cleanObjectName(name string) string {
+	return path.Clean("/" + name)
+}
+
+// validObjectFname returns whether fname is a file name a client may request
+func validObjectFname(fname string) bool {
+	return fname != "" && !strings.ContainsAny(fname, "/\\") && !strings.HasPrefix(fname, ".")
+}
+
+/*
+FilesystemStorageReader implements StorageReader over the publishing dir
+written by FilesystemStorageManager
+*/
+type FilesystemStorageReader struct {
+	storageDir string
+}
+
+// NewFilesystemStorageReader creates a FilesystemStorageReader reading from storageDir
+func NewFilesystemStorageReader(storageDir string) *FilesystemStorageReader {
+	return &FilesystemStorageReader{storageDir: storageDir}
+}
+
+// openObject opens the regular file backing the object stored under name
+func (r *FilesystemStorageReader) openObject(name string) (*os.File, error) {
+	file, err := os.Open(path.Join(r.storageDir, cleanObjectName(name)))
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !stat.Mode().IsRegular() {
+		file.Close()
+		return nil, fmt.Errorf("object %s is not a file: %w", name, fs.ErrNotExist)
+	}
+	return file, nil
+}
+
+// ReadObject writes the object stored under name to out
+func (r *FilesystemStorageReader) ReadObject(name string, out io.Writer) error {
+	file, err := r.openObject(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err = io.Copy(out, file); err != nil {
+		return fmt.Errorf("failed to read object %s: %w", name, err)
+	}
+	return nil
+}
+
+/*
+StatObject describes the object stored under name. Objects are replaced rather
+than modified in place, so its modification time and size identify its data
+*/
+func (r *FilesystemStorageReader) StatObject(name string) (ObjectInfo, error) {
+	file, err := r.openObject(name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to stat object %s: %w", name, err)
+	}
+	return ObjectInfo{
+		Size:    stat.Size(),
+		Version: fmt.Sprintf("%x-%x", stat.ModTime().UnixNano(), stat.Size()),
+	}, nil
+}
+
+// OpenObjectAt opens the object stored under name for reading from offset
+func (r *FilesystemStorageReader) OpenObjectAt(name string, offset int64) (io.ReadCloser, error) {
+	file, err := r.openObject(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to seek object %s: %w", name, err)
+	}
+	return file, nil
+}
+
+/*
+FilesystemObjectStore implements ListableObjectStore over the publishing dir
+written by FilesystemStorageManager. Objects are replaced atomically, with
+keys written readable only by their owner like FilesystemStorageManager does
+*/
+type FilesystemObjectStore struct {
+	*FilesystemStorageReader
+}
+
+// NewFilesystemObjectStore creates a FilesystemObjectStore over storageDir
+func NewFilesystemObjectStore(storageDir string) *FilesystemObjectStore {
+	return &FilesystemObjectStore{NewFilesystemStorageReader(storageDir)}
+}
+
+// WriteObject stores size bytes of data under name, replacing any existing object
+func (s *FilesystemObjectStore) WriteObject(name string, data io.Reader, size int64) error {
+	fname := path.Join(s.storageDir, cleanObjectName(name))
+	tmpFile, err := os.CreateTemp(path.Dir(fname), "."+path.Base(fname)+"_*")
+	if err != nil {
+		return fmt.Errorf("failed to create object %s: %w", name, err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	perms := os.FileMode(publishedFilePerms)
+	if path.Dir(cleanObjectName(name)) == cleanObjectName(infra.AESKeyStorageDir) {
+		perms = wrappedKeyPerms
+	}
+	written, err := io.Copy(tmpFile, data)
+	if err == nil && written != size {
+		err = fmt.Errorf("wrote %d bytes, expected %d", written, size)
+	}
+	if err == nil {
+		err = tmpFile.Chmod(perms)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write object %s: %w", name, err)
+	}
+	if err = os.Rename(tmpFile.Name(), fname); err != nil {
+		return fmt.Errorf("failed to replace object %s: %w", name, err)
+	}
+	return nil
+}
+
+// DeleteObject removes the object stored under name. Deleting a missing object is not an error
+func (s *FilesystemObjectStore) DeleteObject(name string) error {
+	err := os.Remove(path.Join(s.storageDir, cleanObjectName(name)))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete object %s: %w", name, err)
+	}
+	return nil
+}
+
+// ListObjects returns the names of the objects stored under dir, skipping in progress writes
+func (s *FilesystemObjectStore) ListObjects(dir string) ([]string, error) {
+	entries, err := os.ReadDir(path.Join(s.storageDir, cleanObjectName(dir)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects in %s: %w", dir, err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, path.Join(dir, entry.Name()))
+		}
+	}
+	return names, nil
+}
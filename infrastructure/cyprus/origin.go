@@ -0,0 +1,211 @@
+package cyprus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+OriginProfile holds how requests to a customer origin are made. A profile
+applies to URLs whose host is one of Hosts or that fall under one of
+URLPrefixes, having the scheme and host of the prefix and a path starting
+with its path. The profile with the longest matching prefix is used, then
+the one matching the host
+*/
+type OriginProfile struct {
+	Hosts       []string
+	URLPrefixes []string
+
+	// Headers and cookies set on every request, e.g. signed cookies or API keys
+	Headers map[string]string
+	Cookies map[string]string
+
+	// Credentials sent as the Authorization header, a bearer token takes precedence
+	BearerToken   string
+	BasicUsername string
+	BasicPassword string
+
+	/* PEM files of the TLS client certificate and key presented to the origin,
+	and of CA certificates trusted for the origin on top of the system ones */
+	ClientCertFile string
+	ClientKeyFile  string
+	CAFile         string
+
+	// Max duration of a single request to the origin, overrides the downloader timeout if set
+	Timeout time.Duration
+}
+
+// maxOriginRedirects is the number of redirects followed per request, as net/http does by default
+const maxOriginRedirects = 10
+
+// originProfile is an OriginProfile along with its parsed URL prefixes and the client its requests are sent with
+type originProfile struct {
+	profile  OriginProfile
+	prefixes []*url.URL
+	client   *http.Client
+}
+
+/*
+stripProfileRedirect returns a CheckRedirect function that drops the headers and
+credentials of profile from redirects leaving the host of the original request,
+so they are only ever sent to the origin the profile was configured for
+*/
+func stripProfileRedirect(profile OriginProfile) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxOriginRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxOriginRedirects)
+		}
+		if strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+			return nil
+		}
+		for key := range profile.Headers {
+			req.Header.Del(key)
+		}
+		req.Header.Del("Authorization")
+		req.Header.Del("Cookie")
+		return nil
+	}
+}
+
+// newOriginClient creates the client for requests made under profile
+func newOriginClient(profile OriginProfile, fallback *http.Client) (*http.Client, error) {
+	client := &http.Client{
+		Timeout:       fallback.Timeout,
+		Transport:     fallback.Transport,
+		CheckRedirect: stripProfileRedirect(profile),
+	}
+	if profile.Timeout > 0 {
+		client.Timeout = profile.Timeout
+	}
+	if profile.ClientCertFile == "" && profile.CAFile == "" {
+		return client, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if profile.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(profile.ClientCertFile, profile.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS client certificate %s: %w", profile.ClientCertFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if profile.CAFile != "" {
+		pemCerts, err := os.ReadFile(profile.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file %s: %w", profile.CAFile, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("no CA certificates found in %s", profile.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client.Transport = transport
+	return client, nil
+}
+
+/*
+EnableOriginProfiles makes every request of the downloader to an origin
+matching one of profiles carry the headers and credentials of the profile,
+over a client with its TLS configuration and timeout
+*/
+func (d *Downloader) EnableOriginProfiles(profiles []OriginProfile) error {
+	origins := make([]originProfile, 0, len(profiles))
+	for i, profile := range profiles {
+		if len(profile.Hosts) == 0 && len(profile.URLPrefixes) == 0 {
+			return fmt.Errorf("origin profile %d matches no hosts or URL prefixes", i)
+		}
+		if (profile.ClientCertFile == "") != (profile.ClientKeyFile == "") {
+			return fmt.Errorf("origin profile %d needs both a TLS client certificate and key", i)
+		}
+		prefixes := make([]*url.URL, 0, len(profile.URLPrefixes))
+		for _, prefix := range profile.URLPrefixes {
+			parsed, err := url.Parse(prefix)
+			if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+				return fmt.Errorf("origin profile %d has invalid URL prefix %s", i, prefix)
+			}
+			prefixes = append(prefixes, parsed)
+		}
+		client, err := newOriginClient(profile, d.client)
+		if err != nil {
+			return fmt.Errorf("failed to create client for origin profile %d: %w", i, err)
+		}
+		origins = append(origins, originProfile{profile: profile, prefixes: prefixes, client: client})
+	}
+	d.origins = origins
+	return nil
+}
+
+// matchOrigin returns the profile requests for rawURL are made under, if any
+func (d *Downloader) matchOrigin(rawURL string) (originProfile, bool) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return originProfile{}, false
+	}
+
+	var match originProfile
+	matchLength := -1
+	for _, origin := range d.origins {
+		for _, prefix := range origin.prefixes {
+			if !strings.EqualFold(prefix.Scheme, parsed.Scheme) || !strings.EqualFold(prefix.Host, parsed.Host) {
+				continue
+			}
+			prefixPath := prefix.EscapedPath()
+			if strings.HasPrefix(parsed.EscapedPath(), prefixPath) && len(prefixPath) > matchLength {
+				match, matchLength = origin, len(prefixPath)
+			}
+		}
+	}
+	if matchLength >= 0 {
+		return match, true
+	}
+
+	for _, origin := range d.origins {
+		for _, host := range origin.profile.Hosts {
+			if strings.EqualFold(host, parsed.Host) || strings.EqualFold(host, parsed.Hostname()) {
+				return origin, true
+			}
+		}
+	}
+	return originProfile{}, false
+}
+
+/*
+newRequest creates a GET request for rawURL under the profile of its origin
+and returns it with the client it should be sent with
+*/
+func (d *Downloader) newRequest(rawURL string) (*http.Request, *http.Client, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create request for %s: %w", rawURL, err)
+	}
+	origin, ok := d.matchOrigin(rawURL)
+	if !ok {
+		return req, d.client, nil
+	}
+
+	profile := origin.profile
+	for key, value := range profile.Headers {
+		req.Header.Set(key, value)
+	}
+	for name, value := range profile.Cookies {
+		req.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	if profile.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+profile.BearerToken)
+	} else if profile.BasicUsername != "" {
+		req.SetBasicAuth(profile.BasicUsername, profile.BasicPassword)
+	}
+	return req, origin.client, nil
+}
@@ -0,0 +1,220 @@
+package cyprus
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloaderOriginProfiles(t *testing.T) {
+	var received *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+			return
+		}
+		received = req
+		resp.Write([]byte("media"))
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	downloader := NewDownloader(DownloaderConfig{MaxAttempts: 1})
+	err := downloader.EnableOriginProfiles([]OriginProfile{{Headers: map[string]string{"X-Key": "key"}}})
+	assert.NotNil(t, err, "expected profile matching nothing to be rejected")
+	err = downloader.EnableOriginProfiles([]OriginProfile{{Hosts: []string{"host"}, ClientCertFile: "cert"}})
+	assert.NotNil(t, err, "expected client certificate without key to be rejected")
+
+	err = downloader.EnableOriginProfiles([]OriginProfile{
+		{
+			Hosts:         []string{serverURL.Host},
+			Headers:       map[string]string{"X-Key": "host key"},
+			BasicUsername: "user",
+			BasicPassword: "password",
+		},
+		{
+			URLPrefixes: []string{server.URL + "/private/"},
+			Headers:     map[string]string{"X-Key": "private key"},
+			Cookies:     map[string]string{"Signature": "signed"},
+			BearerToken: "token",
+		},
+		{
+			URLPrefixes: []string{server.URL + "/slow"},
+			Timeout:     50 * time.Millisecond,
+		},
+	})
+	assert.Nil(t, err, "should not return error")
+
+	// Profiles matching the host apply to every request to it
+	assert.Nil(t, downloader.Download(server.URL+"/media.mp4", &bytes.Buffer{}), "should not return error")
+	assert.Equal(t, "host key", received.Header.Get("X-Key"), "expected profile header")
+	username, password, ok := received.BasicAuth()
+	assert.True(t, ok, "expected basic auth credentials")
+	assert.Equal(t, "user", username, "wrong basic auth username")
+	assert.Equal(t, "password", password, "wrong basic auth password")
+
+	// Profiles matching a URL prefix take precedence over the host
+	_, _, err = downloader.Peek(server.URL+"/private/vod.m3u8", 16)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, "private key", received.Header.Get("X-Key"), "expected prefix profile header")
+	assert.Equal(t, "Bearer token", received.Header.Get("Authorization"), "expected bearer token")
+	cookie, err := received.Cookie("Signature")
+	assert.Nil(t, err, "expected signed cookie")
+	assert.Equal(t, "signed", cookie.Value, "wrong signed cookie")
+
+	// Profiles can limit the time of requests to an origin
+	err = downloader.Download(server.URL+"/slow", &bytes.Buffer{})
+	assert.NotNil(t, err, "expected profile timeout to apply")
+
+	// Other origins are requested without any profile
+	other := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		received = req
+	}))
+	defer other.Close()
+	assert.Nil(t, downloader.Download(other.URL+"/media.mp4", &bytes.Buffer{}), "should not return error")
+	assert.Empty(t, received.Header.Get("X-Key"), "expected no profile header")
+	assert.Empty(t, received.Header.Get("Authorization"), "expected no credentials")
+}
+
+func TestDownloaderOriginClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+
+	// Create a self signed client certificate
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cyprus"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "should not return error")
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	clientCert, _ := x509.ParseCertificate(certDER)
+
+	// The origin requires the client certificate and serves a certificate only trusted through the CA file
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("media"))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+	downloader := NewDownloader(DownloaderConfig{MaxAttempts: 1})
+	assert.NotNil(t, downloader.Download(server.URL, &bytes.Buffer{}), "expected untrusted origin to be rejected")
+
+	serverURL, _ := url.Parse(server.URL)
+	err = downloader.EnableOriginProfiles([]OriginProfile{{Hosts: []string{serverURL.Hostname()}, CAFile: caFile}})
+	assert.Nil(t, err, "should not return error")
+	assert.NotNil(t, downloader.Download(server.URL, &bytes.Buffer{}), "expected missing client certificate to be rejected")
+
+	err = downloader.EnableOriginProfiles([]OriginProfile{{
+		Hosts:          []string{serverURL.Hostname()},
+		ClientCertFile: certFile,
+		ClientKeyFile:  keyFile,
+		CAFile:         caFile,
+	}})
+	assert.Nil(t, err, "should not return error")
+	buf := &bytes.Buffer{}
+	assert.Nil(t, downloader.Download(server.URL, buf), "should not return error")
+	assert.Equal(t, "media", buf.String(), "wrong data")
+}
+
+func TestDownloaderOriginPrefixMatch(t *testing.T) {
+	downloader := NewDownloader(DownloaderConfig{MaxAttempts: 1})
+	err := downloader.EnableOriginProfiles([]OriginProfile{{URLPrefixes: []string{"/relative"}}})
+	assert.NotNil(t, err, "expected prefix without scheme and host to be rejected")
+
+	err = downloader.EnableOriginProfiles([]OriginProfile{
+		{URLPrefixes: []string{"https://cdn.example.com"}, BearerToken: "host"},
+		{URLPrefixes: []string{"https://cdn.example.com/private/"}, BearerToken: "private"},
+	})
+	assert.Nil(t, err, "should not return error")
+
+	matches := map[string]string{
+		"https://cdn.example.com/vod.m3u8":         "host",
+		"https://CDN.example.com/vod.m3u8":         "host",
+		"https://cdn.example.com/private/vod.m3u8": "private",
+	}
+	for rawURL, token := range matches {
+		origin, ok := downloader.matchOrigin(rawURL)
+		assert.True(t, ok, "expected %s to match", rawURL)
+		assert.Equal(t, token, origin.profile.BearerToken, "wrong profile for %s", rawURL)
+	}
+
+	for _, rawURL := range []string{
+		"https://cdn.example.com.evil.net/vod.m3u8",
+		"https://cdn.example.com:8443/vod.m3u8",
+		"https://cdn.example.com@evil.net/vod.m3u8",
+		"http://cdn.example.com/vod.m3u8",
+	} {
+		_, ok := downloader.matchOrigin(rawURL)
+		assert.False(t, ok, "expected %s not to match", rawURL)
+	}
+}
+
+func TestDownloaderOriginRedirect(t *testing.T) {
+	var received *http.Request
+	other := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		received = req
+		resp.Write([]byte("media"))
+	}))
+	defer other.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/external":
+			http.Redirect(resp, req, other.URL+"/media.mp4", http.StatusFound)
+		case "/internal":
+			http.Redirect(resp, req, "/media.mp4", http.StatusFound)
+		default:
+			received = req
+			resp.Write([]byte("media"))
+		}
+	}))
+	defer origin.Close()
+
+	downloader := NewDownloader(DownloaderConfig{MaxAttempts: 1})
+	err := downloader.EnableOriginProfiles([]OriginProfile{{
+		URLPrefixes: []string{origin.URL},
+		Headers:     map[string]string{"X-Key": "key"},
+		Cookies:     map[string]string{"Signature": "signed"},
+		BearerToken: "token",
+	}})
+	assert.Nil(t, err, "should not return error")
+
+	// Redirects within the origin keep the profile
+	assert.Nil(t, downloader.Download(origin.URL+"/internal", &bytes.Buffer{}), "should not return error")
+	assert.Equal(t, "key", received.Header.Get("X-Key"), "expected profile header")
+	assert.Equal(t, "Bearer token", received.Header.Get("Authorization"), "expected bearer token")
+
+	// Redirects to another host drop it
+	received = nil
+	assert.Nil(t, downloader.Download(origin.URL+"/external", &bytes.Buffer{}), "should not return error")
+	assert.NotNil(t, received, "expected redirect to be followed")
+	assert.Empty(t, received.Header.Get("X-Key"), "expected profile header to be dropped")
+	assert.Empty(t, received.Header.Get("Authorization"), "expected credentials to be dropped")
+	assert.Empty(t, received.Header.Get("Cookie"), "expected cookies to be dropped")
+}
@@ -0,0 +1,197 @@
+package cyprus
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/etherlabsio/go-m3u8/m3u8"
+)
+
+const (
+	// EXT-X-MAP outside of I-frame playlists requires version 6
+	hlsPlaylistVersion   = 6
+	hlsPlaylistTypeVOD   = "VOD"
+	hlsPlaylistTypeEvent = "EVENT"
+
+	hlsPlaylistContentType = "application/vnd.apple.mpegurl"
+)
+
+// hlsPlaylist is a rewritten playlist, published under the functional ID of what it describes
+type hlsPlaylist struct {
+	FunctionalID string
+	Data         []byte
+}
+
+// resolutionFromString parses a WIDTHxHEIGHT resolution
+func resolutionFromString(resolution string) (*m3u8.Resolution, error) {
+	var width, height int
+	if _, err := fmt.Sscanf(resolution, "%dx%d", &width, &height); err != nil {
+		return nil, fmt.Errorf("invalid resolution %s: %w", resolution, err)
+	}
+	return &m3u8.Resolution{Width: width, Height: height}, nil
+}
+
+/*
+renderHLSMediaPlaylist renders the media playlist of a stream of mediaMap with
+segments referenced by functional ID. Live manifests are left open and sliding
+ones declare no playlist type since their segments expire
+*/
+func renderHLSMediaPlaylist(mediaMap VODManifest, stream VODStream) ([]byte, error) {
+	version := hlsPlaylistVersion
+	master := false
+	playlist := &m3u8.Playlist{
+		Version:  &version,
+		Target:   stream.TargetDuration,
+		Sequence: stream.MediaSequence,
+		Live:     mediaMap.Live,
+		Master:   &master,
+	}
+	if stream.DiscontinuitySequence > 0 {
+		discontinuitySequence := stream.DiscontinuitySequence
+		playlist.DiscontinuitySequence = &discontinuitySequence
+	}
+	if !mediaMap.Sliding {
+		playlistType := hlsPlaylistTypeVOD
+		if mediaMap.Live {
+			playlistType = hlsPlaylistTypeEvent
+		}
+		playlist.Type = &playlistType
+	}
+
+	for _, segment := range stream.Segments {
+		if segment.Discontinuity {
+			playlist.AppendItem(&m3u8.DiscontinuityItem{})
+		}
+		if segment.Init {
+			playlist.AppendItem(&m3u8.MapItem{URI: segment.FunctionalID})
+			continue
+		}
+
+		// The target duration must cover every segment once rounded
+		playlist.Target = int(math.Max(float64(playlist.Target), math.Round(segment.Duration)))
+		playlist.AppendItem(&m3u8.SegmentItem{Duration: segment.Duration, Segment: segment.FunctionalID})
+	}
+
+	serialPlaylist, err := m3u8.Write(playlist)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write media playlist of %s: %w", stream.URL, err)
+	}
+	return []byte(serialPlaylist), nil
+}
+
+// optionalAttribute returns an optional playlist attribute set to value, or nil if value is empty
+func optionalAttribute(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// optionalFlag returns an optional YES/NO playlist attribute, set only when enabled
+func optionalFlag(enabled bool) *bool {
+	if !enabled {
+		return nil
+	}
+	return &enabled
+}
+
+/*
+renderHLSMasterPlaylist renders the master playlist of mediaMap with its
+alternate renditions and variants referenced by functional ID. Rendition
+streams are only declared through the renditions playing them
+*/
+func renderHLSMasterPlaylist(mediaMap VODManifest) ([]byte, error) {
+	version := hlsPlaylistVersion
+	master := true
+	playlist := &m3u8.Playlist{Version: &version, Master: &master}
+
+	streamFIDs := make(map[string]string, len(mediaMap.Streams))
+	for _, stream := range mediaMap.Streams {
+		streamFIDs[stream.URL] = stream.FunctionalID
+	}
+	for _, media := range mediaMap.Media {
+		rendition := &m3u8.MediaItem{
+			Type:            media.Type,
+			GroupID:         media.GroupID,
+			Name:            media.Name,
+			Language:        optionalAttribute(media.Language),
+			AssocLanguage:   optionalAttribute(media.AssocLanguage),
+			AutoSelect:      optionalFlag(media.AutoSelect),
+			Default:         optionalFlag(media.Default),
+			Forced:          optionalFlag(media.Forced),
+			InStreamID:      optionalAttribute(media.InStreamID),
+			Characteristics: optionalAttribute(media.Characteristics),
+			Channels:        optionalAttribute(media.Channels),
+		}
+		if media.Stream != "" {
+			fid, ok := streamFIDs[media.Stream]
+			if !ok {
+				return nil, fmt.Errorf("failed to write rendition %s: no stream %s", media.Name, media.Stream)
+			}
+			rendition.URI = &fid
+		}
+		playlist.AppendItem(rendition)
+	}
+
+	for _, stream := range mediaMap.Streams {
+		if stream.Rendition {
+			continue
+		}
+		variant := &m3u8.PlaylistItem{Bandwidth: stream.Bandwidth, URI: stream.FunctionalID}
+		if stream.AverageBandwidth > 0 {
+			averageBandwidth := stream.AverageBandwidth
+			variant.AverageBandwidth = &averageBandwidth
+		}
+		if stream.Resolution != "" {
+			resolution, err := resolutionFromString(stream.Resolution)
+			if err != nil {
+				return nil, fmt.Errorf("failed to write variant %s: %w", stream.URL, err)
+			}
+			variant.Resolution = resolution
+		}
+		if stream.Codecs != "" {
+			codecs := stream.Codecs
+			variant.Codecs = &codecs
+		}
+		if stream.FrameRate > 0 {
+			frameRate := stream.FrameRate
+			variant.FrameRate = &frameRate
+		}
+		variant.Video = optionalAttribute(stream.Video)
+		variant.Audio = optionalAttribute(stream.Audio)
+		variant.Subtitles = optionalAttribute(stream.Subtitles)
+		variant.ClosedCaptions = optionalAttribute(stream.ClosedCaptions)
+		playlist.AppendItem(variant)
+	}
+
+	serialPlaylist, err := m3u8.Write(playlist)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write master playlist of %s: %w", mediaMap.URL, err)
+	}
+	return []byte(serialPlaylist), nil
+}
+
+/*
+renderHLSPlaylists rewrites the playlists of a digested HLS manifest so they
+reference functional IDs instead of origin URLs. The master playlist comes
+first and is named by the manifest functional ID, followed by one media
+playlist per stream named by the stream functional ID, so relative references
+resolve when all are served from the same place. Byte ranges are dropped since
+every range is digested into a segment of its own
+*/
+func renderHLSPlaylists(mediaMap VODManifest) ([]hlsPlaylist, error) {
+	masterPlaylist, err := renderHLSMasterPlaylist(mediaMap)
+	if err != nil {
+		return nil, err
+	}
+
+	playlists := []hlsPlaylist{{FunctionalID: mediaMap.FunctionalID, Data: masterPlaylist}}
+	for _, stream := range mediaMap.Streams {
+		mediaPlaylist, err := renderHLSMediaPlaylist(mediaMap, stream)
+		if err != nil {
+			return nil, err
+		}
+		playlists = append(playlists, hlsPlaylist{FunctionalID: stream.FunctionalID, Data: mediaPlaylist})
+	}
+	return playlists, nil
+}
@@ -0,0 +1,168 @@
+package cyprus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+	"github.com/Apiara/ApiaraCDN/infrastructure/state"
+	"github.com/etherlabsio/go-m3u8/m3u8"
+	"github.com/stretchr/testify/assert"
+)
+
+func testHLSManifest() VODManifest {
+	return VODManifest{
+		URL:          "http://origin.com/master.m3u8",
+		FunctionalID: "masterfid",
+		Format:       HLSManifestFormat,
+		Streams: []VODStream{
+			{
+				URL:          "http://origin.com/720.m3u8",
+				FunctionalID: "streamfid",
+				Bandwidth:    3956044,
+				Resolution:   "1280x720",
+				Codecs:       "avc1.640029,mp4a.40.2",
+				FrameRate:    29.97,
+				Segments: []VODSegment{
+					{Index: 0, URL: "http://origin.com/720.mp4", FunctionalID: "initfid", Init: true,
+						ByteRange: &VODByteRange{Offset: 0, Length: 16}},
+					{Index: 1, URL: "http://origin.com/720.mp4", FunctionalID: "segfid1", Duration: 6.006,
+						ByteRange: &VODByteRange{Offset: 16, Length: 32}},
+					{Index: 2, URL: "http://origin.com/ad.ts", FunctionalID: "segfid2", Duration: 5.372,
+						Discontinuity: true},
+				},
+			},
+		},
+	}
+}
+
+func TestRenderHLSPlaylists(t *testing.T) {
+	playlists, err := renderHLSPlaylists(testHLSManifest())
+	assert.Nil(t, err, "should not return error")
+	assert.Len(t, playlists, 2, "expected a master and a media playlist")
+
+	// Master playlist keeps variant attributes and references streams by functional ID
+	assert.Equal(t, "masterfid", playlists[0].FunctionalID, "wrong master playlist name")
+	master, err := m3u8.Read(strings.NewReader(string(playlists[0].Data)))
+	assert.Nil(t, err, "should not return error")
+	assert.True(t, master.IsMaster(), "expected master playlist")
+	variants := master.Playlists()
+	assert.Len(t, variants, 1, "wrong number of variants")
+	assert.Equal(t, "streamfid", variants[0].URI, "wrong variant reference")
+	assert.Equal(t, 3956044, variants[0].Bandwidth, "wrong variant bandwidth")
+	assert.Equal(t, "1280x720", variants[0].Resolution.String(), "wrong variant resolution")
+	assert.Equal(t, "avc1.640029,mp4a.40.2", *variants[0].Codecs, "wrong variant codecs")
+
+	// Media playlist references segments by functional ID without byte ranges
+	assert.Equal(t, "streamfid", playlists[1].FunctionalID, "wrong media playlist name")
+	media, err := m3u8.Read(strings.NewReader(string(playlists[1].Data)))
+	assert.Nil(t, err, "should not return error")
+	assert.False(t, media.IsLive(), "expected VOD playlist")
+	assert.Equal(t, 6, media.Target, "wrong target duration")
+	assert.Len(t, media.Items, 4, "wrong number of playlist items")
+	initSegment, ok := media.Items[0].(*m3u8.MapItem)
+	assert.True(t, ok, "expected init segment first")
+	assert.Equal(t, "initfid", initSegment.URI, "wrong init segment reference")
+	assert.Nil(t, initSegment.ByteRange, "expected byte range to be dropped")
+	segment, ok := media.Items[1].(*m3u8.SegmentItem)
+	assert.True(t, ok, "expected media segment")
+	assert.Equal(t, "segfid1", segment.Segment, "wrong segment reference")
+	assert.Equal(t, 6.006, segment.Duration, "wrong segment duration")
+	assert.Nil(t, segment.ByteRange, "expected byte range to be dropped")
+	_, ok = media.Items[2].(*m3u8.DiscontinuityItem)
+	assert.True(t, ok, "expected discontinuity before segment")
+	segment, ok = media.Items[3].(*m3u8.SegmentItem)
+	assert.True(t, ok, "expected media segment")
+	assert.Equal(t, "segfid2", segment.Segment, "wrong segment reference")
+}
+
+func TestRenderHLSAlternateRenditions(t *testing.T) {
+	mediaMap := testHLSManifest()
+	mediaMap.Streams[0].Audio = "aud"
+	mediaMap.Streams[0].ClosedCaptions = "NONE"
+	mediaMap.Streams = append(mediaMap.Streams, VODStream{
+		URL:          "http://origin.com/audio_en.m3u8",
+		FunctionalID: "audiofid",
+		Rendition:    true,
+		Segments:     []VODSegment{{Index: 0, URL: "http://origin.com/audio_en.ts", FunctionalID: "audiosegfid", Duration: 6}},
+	})
+	mediaMap.Media = []VODMedia{
+		{Type: "AUDIO", GroupID: "aud", Name: "English", Language: "en", Default: true, AutoSelect: true,
+			Stream: "http://origin.com/audio_en.m3u8"},
+		{Type: "AUDIO", GroupID: "aud", Name: "Muxed"},
+	}
+
+	playlists, err := renderHLSPlaylists(mediaMap)
+	assert.Nil(t, err, "should not return error")
+	assert.Len(t, playlists, 3, "expected a master and a media playlist per stream")
+	assert.Equal(t, "audiofid", playlists[2].FunctionalID, "expected rendition media playlist")
+
+	// Renditions reference their streams by functional ID and are only declared once
+	master, err := m3u8.Read(strings.NewReader(string(playlists[0].Data)))
+	assert.Nil(t, err, "should not return error")
+	renditions := make([]*m3u8.MediaItem, 0)
+	for _, item := range master.Items {
+		if rendition, ok := item.(*m3u8.MediaItem); ok {
+			renditions = append(renditions, rendition)
+		}
+	}
+	assert.Len(t, renditions, 2, "wrong number of renditions")
+	assert.Equal(t, "aud", renditions[0].GroupID, "wrong rendition group")
+	assert.Equal(t, "audiofid", *renditions[0].URI, "wrong rendition reference")
+	assert.Equal(t, "en", *renditions[0].Language, "wrong rendition language")
+	assert.True(t, *renditions[0].Default, "expected default rendition")
+	assert.Nil(t, renditions[1].URI, "expected muxed rendition without reference")
+
+	variants := master.Playlists()
+	assert.Len(t, variants, 1, "expected rendition streams to not be variants")
+	assert.Equal(t, "aud", *variants[0].Audio, "wrong variant audio group")
+	assert.Equal(t, "NONE", *variants[0].ClosedCaptions, "wrong variant closed captions")
+
+	// Renditions must refer to a stream of the manifest
+	mediaMap.Media[0].Stream = "http://origin.com/missing.m3u8"
+	_, err = renderHLSPlaylists(mediaMap)
+	assert.NotNil(t, err, "expected rendition of missing stream to fail")
+}
+
+func TestPublishHLSPlaylists(t *testing.T) {
+	storageDir := t.TempDir()
+	workingDir := t.TempDir()
+	contentState := state.NewMockMicroserviceState()
+	kek, _ := newKeyEncryptionKey(make([]byte, kekSize))
+	storage, err := NewFilesystemStorageManager(storageDir, contentState, kek)
+	assert.Nil(t, err, "should not return error")
+
+	mediaMap := testHLSManifest()
+	for i := range mediaMap.Streams[0].Segments {
+		segmentFile := filepath.Join(workingDir, mediaMap.Streams[0].Segments[i].FunctionalID)
+		os.WriteFile(segmentFile, []byte("data"), 0644)
+		mediaMap.Streams[0].Segments[i].File = segmentFile
+	}
+	digest := MediaDigest{
+		Type:         VODMediaType,
+		CryptKey:     []byte("0123456789abcdef"),
+		FunctionalID: mediaMap.FunctionalID,
+		Result:       mediaMap,
+	}
+	assert.Nil(t, storage.Publish(digest), "should not return error")
+
+	// Playlists are served next to each other so relative references resolve
+	server := httptest.NewServer(newStorageAPI(NewFilesystemStorageReader(storageDir), kek, StorageAccessPolicy{}))
+	defer server.Close()
+	for _, fid := range []string{"masterfid", "streamfid"} {
+		resp, err := http.Get(server.URL + infra.CyprusStorageAPIPlaylistResource + "/" + fid)
+		assert.Nil(t, err, "should not return error")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "expected playlist %s to be served", fid)
+		assert.Equal(t, hlsPlaylistContentType, resp.Header.Get("Content-Type"), "wrong playlist content type")
+	}
+
+	// and are purged with the content
+	assert.Nil(t, storage.PurgeByURL(mediaMap.URL), "should not return error")
+	_, err = os.Stat(filepath.Join(storageDir, infra.PlaylistDir, "masterfid"))
+	assert.True(t, os.IsNotExist(err), "expected master playlist to be purged")
+}
@@ -3,11 +3,13 @@ package cyprus
 import (
 	"fmt"
 	"io"
+	"math"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/etherlabsio/go-m3u8/m3u8"
 )
@@ -38,16 +40,156 @@ RemoveIngestArtifacts is a helper function for removing all
 local files referenced/created by a MediaIngest
 */
 func RemoveIngestArtifacts(ingest MediaIngest) {
-	switch mediaMap := ingest.Result.(type) {
-	case *VODManifest:
+	removeRawMedia := func(media RawMedia) {
+		os.Remove(media.File)
+		if media.ProofFile != "" {
+			os.Remove(media.ProofFile)
+		}
+	}
+	removeManifest := func(mediaMap VODManifest) {
 		for _, mediaStream := range mediaMap.Streams {
 			for _, mediaSegment := range mediaStream.Segments {
 				os.Remove(mediaSegment.File)
+				if mediaSegment.ProofFile != "" {
+					os.Remove(mediaSegment.ProofFile)
+				}
 			}
 		}
+	}
+
+	switch mediaMap := ingest.Result.(type) {
+	case VODManifest:
+		removeManifest(mediaMap)
+	case *VODManifest:
+		removeManifest(*mediaMap)
+	case RawMedia:
+		removeRawMedia(mediaMap)
 	case *RawMedia:
-		os.Remove(mediaMap.File)
+		removeRawMedia(*mediaMap)
+	}
+}
+
+/*
+RemoveProcessingArtifacts removes the ingest, digest and proof temp files left
+in processingDir by jobs interrupted by a crash. Interrupted jobs start over
+when resumed, so it must run before the processing queue is started. Returns
+the number of removed files
+*/
+func RemoveProcessingArtifacts(processingDir string) (int, error) {
+	removed := 0
+	for _, pattern := range []string{ingestFilePattern, digestFilePattern, proofFilePattern} {
+		fnames, err := filepath.Glob(filepath.Join(processingDir, pattern))
+		if err != nil {
+			return removed, fmt.Errorf("failed to list %s files in %s: %w", pattern, processingDir, err)
+		}
+		for _, fname := range fnames {
+			if err = os.Remove(fname); err != nil {
+				return removed, fmt.Errorf("failed to remove processing artifact %s: %w", fname, err)
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+/*
+downloadSegments downloads every URL in segmentURLs into its own ingest file
+in outputDir using up to 'workers' concurrent downloads. Segments are indexed
+in the order of segmentURLs. On failure every created ingest file is removed
+*/
+func downloadSegments(segmentURLs []string, outputDir string, workers int,
+	retrieveFile func(string, io.Writer) error, observer ProgressObserver) ([]VODSegment, error) {
+	refs := make([]VODSegment, len(segmentURLs))
+	for i, segmentURL := range segmentURLs {
+		refs[i] = VODSegment{URL: segmentURL}
+	}
+	retrieveSegment := func(segment VODSegment, out io.Writer) error {
+		return retrieveFile(segment.URL, out)
+	}
+	return downloadSegmentRefs(refs, outputDir, workers, retrieveSegment, observer)
+}
+
+/*
+downloadSegmentRefs is downloadSegments for segments described by more than a
+URL. Each of refs is fetched with retrieveSegment and returned with its index
+and ingest file set
+*/
+func downloadSegmentRefs(refs []VODSegment, outputDir string, workers int,
+	retrieveSegment func(VODSegment, io.Writer) error, observer ProgressObserver) ([]VODSegment, error) {
+	segments := make([]VODSegment, len(refs))
+	removeSegments := func() {
+		RemoveIngestArtifacts(MediaIngest{Type: VODMediaType, Result: VODManifest{
+			Streams: []VODStream{{Segments: segments}},
+		}})
+	}
+	if err := observer.AddTotal(len(refs), 0); err != nil {
+		return nil, err
+	}
+	if workers <= 0 {
+		workers = 1
+	}
+
+	// Hand out segments until the first failure
+	indexes := make(chan int)
+	errs := make(chan error, workers)
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				segmentFile, err := os.CreateTemp(outputDir, ingestFilePattern)
+				if err != nil {
+					errs <- fmt.Errorf("failed to create ingest file: %w", err)
+					return
+				}
+				segments[i] = refs[i]
+				segments[i].Index = i
+				segments[i].File = segmentFile.Name()
+
+				err = retrieveSegment(refs[i], &progressWriter{segmentFile, observer})
+				segmentFile.Close()
+				if err != nil {
+					errs <- fmt.Errorf("failed to download segment %s: %w", refs[i].URL, err)
+					return
+				}
+				if err = observer.SegmentDone(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var err error
+dispatch:
+	for i := range refs {
+		select {
+		case indexes <- i:
+		case err = <-errs:
+			break dispatch
+		case <-done:
+			break dispatch
+		}
+	}
+	close(indexes)
+	<-done
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+	if err != nil {
+		removeSegments()
+		return nil, err
 	}
+	return segments, nil
 }
 
 /*
@@ -72,10 +214,15 @@ func (m *MockDataPreprocessor) IngestMedia(fname string) (MediaIngest, error) {
 
 /*
 CompoundPreprocessor implements DataPreprocessor by checking URL extensions
-and routing to the media type specific preprocessor
+and routing to the media type specific preprocessor. With content sniffing
+enabled, media without a known extension is routed by its content type
 */
 type CompoundPreprocessor struct {
-	extensionMap map[string]DataPreprocessor
+	extensionMap   map[string]DataPreprocessor
+	contentTypeMap map[string]DataPreprocessor
+
+	// sniff returns the declared content type and first bytes of media, nil when sniffing is disabled
+	sniff func(url string) (string, []byte, error)
 }
 
 /*
@@ -83,19 +230,70 @@ NewCompoundPreprocessor creates a new CompoundPreprocessor with the
 provided extension to DataPreprocessor mapping
 */
 func NewCompoundPreprocessor(extensionMap map[string]DataPreprocessor) *CompoundPreprocessor {
+	extensions := make(map[string]DataPreprocessor, len(extensionMap))
+	for ext, preprocessor := range extensionMap {
+		extensions[strings.ToLower(ext)] = preprocessor
+	}
 	return &CompoundPreprocessor{
-		extensionMap: extensionMap,
+		extensionMap: extensions,
+	}
+}
+
+/*
+EnableContentSniffing routes media whose URL has no known extension with the
+provided content type to DataPreprocessor mapping. The start of the media is
+fetched with downloader, and the content type the origin declares is used if
+mapped, falling back to the one its magic bytes identify
+*/
+func (c *CompoundPreprocessor) EnableContentSniffing(contentTypeMap map[string]DataPreprocessor, downloader *Downloader) {
+	c.contentTypeMap = make(map[string]DataPreprocessor, len(contentTypeMap))
+	for contentType, preprocessor := range contentTypeMap {
+		c.contentTypeMap[normalizeContentType(contentType)] = preprocessor
+	}
+	c.sniff = func(url string) (string, []byte, error) {
+		return downloader.Peek(url, sniffLength)
+	}
+}
+
+// route returns the preprocessor for the media at mediaURL
+func (c *CompoundPreprocessor) route(mediaURL string) (DataPreprocessor, error) {
+	// Query strings and fragments of signed URLs are not part of the extension
+	mediaPath := strings.TrimSpace(mediaURL)
+	if parsed, err := url.Parse(mediaPath); err == nil {
+		mediaPath = parsed.Path
+	}
+	if preprocessor, ok := c.extensionMap[strings.ToLower(path.Ext(mediaPath))]; ok {
+		return preprocessor, nil
 	}
+	if c.sniff == nil {
+		return nil, fmt.Errorf("failed to find proper preprocessor for %s", mediaURL)
+	}
+
+	declaredType, head, err := c.sniff(mediaURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sniff content type of %s: %w", mediaURL, err)
+	}
+	if preprocessor, ok := c.contentTypeMap[normalizeContentType(declaredType)]; ok {
+		return preprocessor, nil
+	}
+	if preprocessor, ok := c.contentTypeMap[sniffContentType(head)]; ok {
+		return preprocessor, nil
+	}
+	return nil, fmt.Errorf("failed to find proper preprocessor for %s with content type %q", mediaURL, declaredType)
 }
 
 // IngestMedia routes to the correct preprocessor and delegates the IngestMedia call
 func (c *CompoundPreprocessor) IngestMedia(url string) (MediaIngest, error) {
-	ext := filepath.Ext(strings.TrimSpace(url))
-	preprocessor, ok := c.extensionMap[ext]
-	if !ok {
-		return MediaIngest{}, fmt.Errorf("failed to find proper preprocessor for %s", url)
+	return c.IngestMediaObserved(url, nopProgressObserver{})
+}
+
+// IngestMediaObserved routes to the correct preprocessor, reporting progress when it supports it
+func (c *CompoundPreprocessor) IngestMediaObserved(url string, observer ProgressObserver) (MediaIngest, error) {
+	preprocessor, err := c.route(url)
+	if err != nil {
+		return MediaIngest{}, err
 	}
-	return preprocessor.IngestMedia(url)
+	return ingestObserved(preprocessor, url, observer)
 }
 
 // RawPreprocessor implements DataPreprocessor for raw media files(ex. mp4)
@@ -104,15 +302,25 @@ type RawPreprocessor struct {
 	retrieveFile func(string, io.Writer) error
 }
 
-func NewRawPreprocessor(workingPath string) *RawPreprocessor {
+// NewRawPreprocessor creates a new RawPreprocessor downloading to workingPath with downloader
+func NewRawPreprocessor(workingPath string, downloader *Downloader) *RawPreprocessor {
 	return &RawPreprocessor{
 		outputDir:    workingPath,
-		retrieveFile: DownloadFile,
+		retrieveFile: downloader.Download,
 	}
 }
 
 // IngestMedia returns the filepath of the downloaded raw media file
 func (r *RawPreprocessor) IngestMedia(fileURL string) (MediaIngest, error) {
+	return r.IngestMediaObserved(fileURL, nopProgressObserver{})
+}
+
+// IngestMediaObserved is IngestMedia reporting download progress to observer
+func (r *RawPreprocessor) IngestMediaObserved(fileURL string, observer ProgressObserver) (MediaIngest, error) {
+	if err := observer.AddTotal(1, 0); err != nil {
+		return MediaIngest{}, err
+	}
+
 	// Download single media file
 	outFile, err := os.CreateTemp(r.outputDir, ingestFilePattern)
 	if err != nil {
@@ -120,9 +328,14 @@ func (r *RawPreprocessor) IngestMedia(fileURL string) (MediaIngest, error) {
 	}
 	defer outFile.Close()
 
-	if err := r.retrieveFile(fileURL, outFile); err != nil {
+	if err := r.retrieveFile(fileURL, &progressWriter{outFile, observer}); err != nil {
+		os.Remove(outFile.Name())
 		return MediaIngest{}, fmt.Errorf("failed to download %s to %s: %w", fileURL, outFile.Name(), err)
 	}
+	if err := observer.SegmentDone(); err != nil {
+		os.Remove(outFile.Name())
+		return MediaIngest{}, err
+	}
 	return MediaIngest{
 		Type: RawMediaType,
 		Result: RawMedia{
@@ -132,53 +345,221 @@ func (r *RawPreprocessor) IngestMedia(fileURL string) (MediaIngest, error) {
 	}, nil
 }
 
+// HLSManifestFormat tags manifests ingested by HLSPreprocessor
+const HLSManifestFormat = "hls"
+
 // HLSPreprocessor implements DataPreprocessor for HLS Manifest Files
 type HLSPreprocessor struct {
-	outputDir    string
-	retrieveFile func(string, io.Writer) error
+	outputDir     string
+	workers       int
+	retrieveFile  func(string, io.Writer) error
+	retrieveRange func(string, int64, int64, io.Writer) error
 }
 
-// NewHLSPreprocessor creates a new HLSPreprocessor where outputs are stored at workingDir
-func NewHLSPreprocessor(workingDir string) *HLSPreprocessor {
+/*
+NewHLSPreprocessor creates a new HLSPreprocessor where outputs are stored at workingDir.
+Segments are fetched with downloader, as many at once as its concurrency allows
+*/
+func NewHLSPreprocessor(workingDir string, downloader *Downloader) *HLSPreprocessor {
 	return &HLSPreprocessor{
-		outputDir:    workingDir,
-		retrieveFile: DownloadFile,
+		outputDir:     workingDir,
+		workers:       downloader.Concurrency(),
+		retrieveFile:  downloader.Download,
+		retrieveRange: downloader.DownloadRange,
 	}
 }
 
-func (r *HLSPreprocessor) parseStreamPlaylist(basePath string, playlist *m3u8.Playlist) (VODStream, error) {
-	hlsSegments := playlist.Segments()
-	genericSegments := make([]VODSegment, 0, len(hlsSegments))
-	for i, hlsSegment := range hlsSegments {
-		segmentURL, err := url.JoinPath(basePath, hlsSegment.Segment)
-		if err != nil {
-			return VODStream{}, fmt.Errorf("failed to create segment download url: %w", err)
+/*
+locateSegments lists the segments of a media playlist in playback order. Init
+segments declared by EXT-X-MAP precede the media segments they apply to and
+byte ranges without an offset continue the previous range of their resource
+*/
+func (r *HLSPreprocessor) locateSegments(basePath string, playlist *m3u8.Playlist) ([]VODSegment, error) {
+	refs := make([]VODSegment, 0, len(playlist.Items))
+	rangeEnds := make(map[string]int64)
+	discontinuity := false
+	for _, item := range playlist.Items {
+		var ref VODSegment
+		var uri string
+		var byteRange *m3u8.ByteRange
+		switch hlsItem := item.(type) {
+		case *m3u8.DiscontinuityItem:
+			discontinuity = true
+			continue
+		case *m3u8.MapItem:
+			ref = VODSegment{Init: true}
+			uri, byteRange = hlsItem.URI, hlsItem.ByteRange
+		case *m3u8.SegmentItem:
+			ref = VODSegment{Duration: hlsItem.Duration}
+			uri, byteRange = hlsItem.Segment, hlsItem.ByteRange
+		default:
+			continue
 		}
-		segmentFile, err := os.CreateTemp(r.outputDir, ingestFilePattern)
+
+		segmentURL, err := url.JoinPath(basePath, uri)
 		if err != nil {
-			return VODStream{}, fmt.Errorf("failed to create ingest file: %w", err)
+			return nil, fmt.Errorf("failed to create segment download url: %w", err)
 		}
-
-		if err := r.retrieveFile(segmentURL, segmentFile); err != nil {
-			segmentFile.Close()
-			return VODStream{}, fmt.Errorf("failed to download segment %s: %w", segmentURL, err)
+		ref.URL = segmentURL
+		ref.Discontinuity = discontinuity
+		discontinuity = false
+
+		if byteRange != nil && byteRange.Length != nil {
+			offset, continued := rangeEnds[segmentURL]
+			if byteRange.Start != nil {
+				offset = int64(*byteRange.Start)
+			} else if !continued && !ref.Init {
+				return nil, fmt.Errorf("byte range of %s has no offset and follows no range of it", segmentURL)
+			}
+			ref.ByteRange = &VODByteRange{Offset: offset, Length: int64(*byteRange.Length)}
+			if !ref.Init {
+				rangeEnds[segmentURL] = offset + ref.ByteRange.Length
+			}
 		}
-		segmentFile.Close()
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
 
-		genericSegments = append(genericSegments, VODSegment{
-			Index:        i,
-			URL:          segmentURL,
-			FunctionalID: "",
-			File:         segmentFile.Name(),
-		})
+// retrieveSegment writes the resource or byte range segment refers to into out
+func (r *HLSPreprocessor) retrieveSegment(segment VODSegment, out io.Writer) error {
+	if segment.ByteRange == nil {
+		return r.retrieveFile(segment.URL, out)
+	}
+	return r.retrieveRange(segment.URL, segment.ByteRange.Offset, segment.ByteRange.Length, out)
+}
+
+// parseStreamPlaylist downloads the segments of a media playlist into a VODStream
+func (r *HLSPreprocessor) parseStreamPlaylist(basePath string, playlist *m3u8.Playlist,
+	observer ProgressObserver) (VODStream, error) {
+	refs, err := r.locateSegments(basePath, playlist)
+	if err != nil {
+		return VODStream{}, err
+	}
+
+	segments, err := downloadSegmentRefs(refs, r.outputDir, r.workers, r.retrieveSegment, observer)
+	if err != nil {
+		return VODStream{}, err
 	}
 
 	return VODStream{
-		FunctionalID: "",
-		Segments:     genericSegments,
+		FunctionalID:   "",
+		TargetDuration: playlist.Target,
+		Segments:       segments,
 	}, nil
 }
 
+// ingestStreamPlaylist retrieves the media playlist at playlistURL and downloads its segments into a VODStream
+func (r *HLSPreprocessor) ingestStreamPlaylist(playlistURL string, observer ProgressObserver) (VODStream, error) {
+	playlist, err := r.getManifest(playlistURL)
+	if err != nil {
+		return VODStream{}, fmt.Errorf("failed to retrieve sub manifest %s: %w", playlistURL, err)
+	}
+	mediaStream, err := r.parseStreamPlaylist(path.Dir(playlistURL), playlist, observer)
+	if err != nil {
+		return VODStream{}, fmt.Errorf("failed to parse sub manifest %s: %w", playlistURL, err)
+	}
+	mediaStream.URL = playlistURL
+	return mediaStream, nil
+}
+
+/*
+estimateBandwidth returns the peak bitrate of the downloaded media segments of
+stream in bits per second, which is how HLS defines the bandwidth of a variant
+*/
+func estimateBandwidth(stream VODStream) (int, error) {
+	peak := 0.0
+	for _, segment := range stream.Segments {
+		if segment.Init || segment.Duration <= 0 {
+			continue
+		}
+		stat, err := os.Stat(segment.File)
+		if err != nil {
+			return 0, fmt.Errorf("failed to size segment %s: %w", segment.URL, err)
+		}
+		peak = math.Max(peak, float64(stat.Size()*8)/segment.Duration)
+	}
+	return int(math.Ceil(peak)), nil
+}
+
+// setVariantAttributes copies the attributes master playlists declare for variant to stream
+func setVariantAttributes(stream *VODStream, variant *m3u8.PlaylistItem) {
+	stream.Bandwidth = variant.Bandwidth
+	if variant.AverageBandwidth != nil {
+		stream.AverageBandwidth = *variant.AverageBandwidth
+	}
+	if variant.Resolution != nil {
+		stream.Resolution = variant.Resolution.String()
+	}
+	if variant.Codecs != nil {
+		stream.Codecs = *variant.Codecs
+	}
+	if variant.FrameRate != nil {
+		stream.FrameRate = *variant.FrameRate
+	}
+	stream.Video = attributeValue(variant.Video)
+	stream.Audio = attributeValue(variant.Audio)
+	stream.Subtitles = attributeValue(variant.Subtitles)
+	stream.ClosedCaptions = attributeValue(variant.ClosedCaptions)
+}
+
+// attributeValue returns the value of an optional playlist attribute, empty if it isn't set
+func attributeValue(attribute *string) string {
+	if attribute == nil {
+		return ""
+	}
+	return *attribute
+}
+
+/*
+alternateRenditions returns the EXT-X-MEDIA renditions declared by the master
+playlist at manifestURL, along with the URLs of their playlists that aren't
+also variant playlists, which are ingested as rendition streams
+*/
+func alternateRenditions(manifestURL string, master *m3u8.Playlist, variantURLs []string) ([]VODMedia, []string, error) {
+	ingested := make(map[string]bool)
+	for _, variantURL := range variantURLs {
+		ingested[variantURL] = true
+	}
+
+	media := make([]VODMedia, 0)
+	playlists := make([]string, 0)
+	for _, item := range master.Items {
+		mediaItem, ok := item.(*m3u8.MediaItem)
+		if !ok {
+			continue
+		}
+		rendition := VODMedia{
+			Type:            mediaItem.Type,
+			GroupID:         mediaItem.GroupID,
+			Name:            mediaItem.Name,
+			Language:        attributeValue(mediaItem.Language),
+			AssocLanguage:   attributeValue(mediaItem.AssocLanguage),
+			Default:         mediaItem.Default != nil && *mediaItem.Default,
+			AutoSelect:      mediaItem.AutoSelect != nil && *mediaItem.AutoSelect,
+			Forced:          mediaItem.Forced != nil && *mediaItem.Forced,
+			InStreamID:      attributeValue(mediaItem.InStreamID),
+			Characteristics: attributeValue(mediaItem.Characteristics),
+			Channels:        attributeValue(mediaItem.Channels),
+		}
+
+		// Renditions sharing a playlist, with each other or a variant, share its stream
+		if mediaItem.URI != nil {
+			playlistURL, err := url.JoinPath(path.Dir(manifestURL), *mediaItem.URI)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to create rendition download URL: %w", err)
+			}
+			rendition.Stream = playlistURL
+			if !ingested[playlistURL] {
+				ingested[playlistURL] = true
+				playlists = append(playlists, playlistURL)
+			}
+		}
+		media = append(media, rendition)
+	}
+	return media, playlists, nil
+}
+
 func (r *HLSPreprocessor) getManifest(manifestURL string) (*m3u8.Playlist, error) {
 	// Download manifest file
 	outFile, err := os.CreateTemp("", "tmp_manifest_*.m3u8")
@@ -206,6 +587,11 @@ Ingest fetches all data associated with manifestURL and creates an internal
 manifest object to represent the VOD media map and point to appropriate system file locations
 */
 func (r *HLSPreprocessor) IngestMedia(manifestURL string) (MediaIngest, error) {
+	return r.IngestMediaObserved(manifestURL, nopProgressObserver{})
+}
+
+// IngestMediaObserved is IngestMedia reporting download progress to observer
+func (r *HLSPreprocessor) IngestMediaObserved(manifestURL string, observer ProgressObserver) (MediaIngest, error) {
 	// Fetch and parse master manifest
 	masterManifest, err := r.getManifest(manifestURL)
 	if err != nil {
@@ -214,32 +600,55 @@ func (r *HLSPreprocessor) IngestMedia(manifestURL string) (MediaIngest, error) {
 
 	baseURL := path.Dir(manifestURL)
 	streams := make([]VODStream, 0)
+	removeStreams := func() {
+		RemoveIngestArtifacts(MediaIngest{Type: VODMediaType, Result: VODManifest{Streams: streams}})
+	}
+	var media []VODMedia
 	if masterManifest.IsMaster() { // Handle case of master manifest with different stream sub manifests
 		playlists := masterManifest.Playlists()
+		variantURLs := make([]string, 0, len(playlists))
 		for _, playlist := range playlists {
-			// Retrieve and parse sub manifests
+			// I-frame renditions only index the segments of the regular ones
+			if playlist.IFrame {
+				continue
+			}
+
+			// Retrieve and parse sub manifests into internal 'stream' objects
 			subManifestURL, err := url.JoinPath(baseURL, playlist.URI)
 			if err != nil {
+				removeStreams()
 				return MediaIngest{}, fmt.Errorf("failed to create sub manifest download URL: %w", err)
 			}
-			subManifest, err := r.getManifest(subManifestURL)
+			mediaStream, err := r.ingestStreamPlaylist(subManifestURL, observer)
 			if err != nil {
-				return MediaIngest{}, fmt.Errorf("failed to retrieve sub manifest %s: %w", subManifestURL, err)
+				removeStreams()
+				return MediaIngest{}, err
 			}
 
-			// generate internal 'stream' object based on sub manifest
-			mediaStream, err := r.parseStreamPlaylist(path.Dir(subManifestURL), subManifest)
+			// store processed stream with its variant attributes
+			setVariantAttributes(&mediaStream, playlist)
+			streams = append(streams, mediaStream)
+			variantURLs = append(variantURLs, subManifestURL)
+		}
+
+		// Alternate renditions with playlists of their own, e.g. demuxed audio, are ingested as streams too
+		var renditionURLs []string
+		if media, renditionURLs, err = alternateRenditions(manifestURL, masterManifest, variantURLs); err != nil {
+			removeStreams()
+			return MediaIngest{}, err
+		}
+		for _, renditionURL := range renditionURLs {
+			mediaStream, err := r.ingestStreamPlaylist(renditionURL, observer)
 			if err != nil {
-				return MediaIngest{}, fmt.Errorf("failed to parse sub manifest %s: %w", subManifestURL, err)
+				removeStreams()
+				return MediaIngest{}, err
 			}
-
-			// complete and store processed stream
-			mediaStream.URL = subManifestURL
+			mediaStream.Rendition = true
 			streams = append(streams, mediaStream)
 		}
 	} else { // Handle case of single manifest with no sub streams
 		// generate internal 'stream' object for single manifest
-		mediaStream, err := r.parseStreamPlaylist(baseURL, masterManifest)
+		mediaStream, err := r.parseStreamPlaylist(baseURL, masterManifest, observer)
 		if err != nil {
 			return MediaIngest{}, fmt.Errorf("failed to parse manifest %s: %w", manifestURL, err)
 		}
@@ -247,6 +656,12 @@ func (r *HLSPreprocessor) IngestMedia(manifestURL string) (MediaIngest, error) {
 		// store stream under default URL name to indicate no sub manifests
 		mediaStream.URL = DefaultStreamName
 		streams = append(streams, mediaStream)
+
+		// a lone media playlist declares no bandwidth so estimate it for the rewritten master playlist
+		if streams[0].Bandwidth, err = estimateBandwidth(streams[0]); err != nil {
+			removeStreams()
+			return MediaIngest{}, err
+		}
 	}
 
 	// Create and return preprocess result
@@ -255,7 +670,9 @@ func (r *HLSPreprocessor) IngestMedia(manifestURL string) (MediaIngest, error) {
 		Result: VODManifest{
 			URL:          manifestURL,
 			FunctionalID: "",
+			Format:       HLSManifestFormat,
 			Streams:      streams,
+			Media:        media,
 		},
 	}, nil
 }
@@ -61,6 +61,17 @@ func TestHLSPreprocessor(t *testing.T) {
 
 	assert.Equal(t, mediaManifest.URL, testFname, "Wrong stored URL")
 	assert.Equal(t, len(mediaManifest.Streams), 2, "Wrong number of parsed streams")
+	assert.Equal(t, HLSManifestFormat, mediaManifest.Format, "Wrong manifest format")
+
+	// Variant attributes and segment durations are kept
+	stream := mediaManifest.Streams[1]
+	assert.Equal(t, 3956044, stream.Bandwidth, "Wrong stream bandwidth")
+	assert.Equal(t, 3736264, stream.AverageBandwidth, "Wrong stream average bandwidth")
+	assert.Equal(t, "1280x720", stream.Resolution, "Wrong stream resolution")
+	assert.Equal(t, "avc1.640029,mp4a.40.2", stream.Codecs, "Wrong stream codecs")
+	assert.Equal(t, 29.97, stream.FrameRate, "Wrong stream frame rate")
+	assert.Equal(t, 7, mediaManifest.Streams[0].TargetDuration, "Wrong stream target duration")
+	assert.Equal(t, 6.006, mediaManifest.Streams[0].Segments[0].Duration, "Wrong segment duration")
 
 	// Cleanup
 	for _, mediaStream := range mediaManifest.Streams {
@@ -69,3 +80,109 @@ func TestHLSPreprocessor(t *testing.T) {
 		}
 	}
 }
+
+func TestHLSPreprocessorByteRanges(t *testing.T) {
+	preprocessor := &HLSPreprocessor{
+		outputDir:     t.TempDir(),
+		retrieveFile:  CopyFromDisk,
+		retrieveRange: CopyRangeFromDisk,
+	}
+
+	ingest, err := preprocessor.IngestMedia("./test_resources/hls_fmp4/media.m3u8")
+	assert.Nil(t, err, "should not return error")
+	defer RemoveIngestArtifacts(ingest)
+	mediaManifest := ingest.Result.(VODManifest)
+	assert.Len(t, mediaManifest.Streams, 1, "Wrong number of parsed streams")
+	stream := mediaManifest.Streams[0]
+	assert.Equal(t, DefaultStreamName, stream.URL, "Wrong stream name")
+	assert.Equal(t, 4, stream.TargetDuration, "Wrong stream target duration")
+	assert.Len(t, stream.Segments, 4, "Wrong number of segments")
+
+	// Init segments and byte ranges are fetched on their own, continuing ranges without offsets
+	expected := []struct {
+		init          bool
+		discontinuity bool
+		duration      float64
+		byteRange     *VODByteRange
+		data          string
+	}{
+		{true, false, 0, &VODByteRange{Offset: 0, Length: 16}, strings.Repeat("I", 16)},
+		{false, false, 4, &VODByteRange{Offset: 16, Length: 32}, strings.Repeat("A", 32)},
+		{false, false, 3.5, &VODByteRange{Offset: 48, Length: 24}, strings.Repeat("B", 24)},
+		{false, true, 2, nil, "other segment"},
+	}
+	for i, segment := range stream.Segments {
+		assert.Equal(t, i, segment.Index, "Wrong segment index")
+		assert.Equal(t, expected[i].init, segment.Init, "Wrong init flag of segment %d", i)
+		assert.Equal(t, expected[i].discontinuity, segment.Discontinuity, "Wrong discontinuity of segment %d", i)
+		assert.Equal(t, expected[i].duration, segment.Duration, "Wrong duration of segment %d", i)
+		assert.Equal(t, expected[i].byteRange, segment.ByteRange, "Wrong byte range of segment %d", i)
+		data, _ := os.ReadFile(segment.File)
+		assert.Equal(t, expected[i].data, string(data), "Wrong data of segment %d", i)
+	}
+
+	// Lone media playlists get their peak bandwidth estimated
+	assert.Equal(t, 64, stream.Bandwidth, "Wrong estimated bandwidth")
+}
+
+func TestHLSPreprocessorAlternateRenditions(t *testing.T) {
+	preprocessor := &HLSPreprocessor{
+		outputDir:    t.TempDir(),
+		retrieveFile: CopyFromDisk,
+	}
+
+	ingest, err := preprocessor.IngestMedia("./test_resources/hls_alternate/master.m3u8")
+	assert.Nil(t, err, "should not return error")
+	defer RemoveIngestArtifacts(ingest)
+	mediaManifest := ingest.Result.(VODManifest)
+
+	// Variants keep the groups of the renditions they play with
+	assert.Len(t, mediaManifest.Streams, 3, "Wrong number of parsed streams")
+	variant := mediaManifest.Streams[0]
+	assert.False(t, variant.Rendition, "Expected variant stream first")
+	assert.Equal(t, "aud", variant.Audio, "Wrong variant audio group")
+	assert.Equal(t, "subs", variant.Subtitles, "Wrong variant subtitles group")
+	assert.Equal(t, "cc", variant.ClosedCaptions, "Wrong variant closed captions group")
+
+	// Rendition playlists are ingested once as streams of their own
+	audio, subtitles := mediaManifest.Streams[1], mediaManifest.Streams[2]
+	assert.True(t, audio.Rendition, "Expected audio rendition stream")
+	assert.True(t, strings.HasSuffix(audio.URL, "audio_en.m3u8"), "Wrong audio rendition URL")
+	assert.Len(t, audio.Segments, 1, "Wrong number of audio segments")
+	data, _ := os.ReadFile(audio.Segments[0].File)
+	assert.Equal(t, "audio_en data\n", string(data), "Wrong audio segment data")
+	assert.True(t, subtitles.Rendition, "Expected subtitles rendition stream")
+	assert.True(t, strings.HasSuffix(subtitles.URL, "subs_en.m3u8"), "Wrong subtitles rendition URL")
+
+	// Every rendition is kept, referring to the stream playing it if it has a playlist
+	assert.Equal(t, []VODMedia{
+		{Type: "AUDIO", GroupID: "aud", Name: "English", Language: "en", Default: true, AutoSelect: true,
+			Channels: "2", Stream: audio.URL},
+		{Type: "AUDIO", GroupID: "aud-hd", Name: "English", Language: "en", Default: true, AutoSelect: true,
+			Channels: "2", Stream: audio.URL},
+		{Type: "SUBTITLES", GroupID: "subs", Name: "English", Language: "en", AutoSelect: true,
+			Stream: subtitles.URL},
+		{Type: "CLOSED-CAPTIONS", GroupID: "cc", Name: "English", Language: "en", InStreamID: "CC1"},
+	}, mediaManifest.Media, "Wrong alternate renditions")
+}
+
+func TestRemoveProcessingArtifacts(t *testing.T) {
+	processingDir := t.TempDir()
+	artifacts := []string{"ingest_1", "digest_1", "proof_1"}
+	kept := []string{"record_1.tmp", "other"}
+	for _, fname := range append(append([]string{}, artifacts...), kept...) {
+		os.WriteFile(path.Join(processingDir, fname), []byte("data"), 0644)
+	}
+
+	removed, err := RemoveProcessingArtifacts(processingDir)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, len(artifacts), removed, "wrong number of removed artifacts")
+	for _, fname := range artifacts {
+		_, err = os.Stat(path.Join(processingDir, fname))
+		assert.True(t, os.IsNotExist(err), "expected %s to be removed", fname)
+	}
+	for _, fname := range kept {
+		_, err = os.Stat(path.Join(processingDir, fname))
+		assert.Nil(t, err, "expected %s to be kept", fname)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 )
@@ -45,6 +46,14 @@ and a combination of SHA256 + AES for creation of Functional media IDs
 type AESDataProcessor struct {
 	keySize   int
 	outputDir string
+
+	/* seal writes the encrypted form of a plaintext file, reading IVs and
+	nonces from nonces, and sealMode identifies its output format */
+	seal     func(block cipher.Block, nonces io.Reader, plain io.Reader, out io.Writer) error
+	sealMode string
+
+	// Keys convergent encryption of manifest segments, nil when disabled
+	convergenceSecret []byte
 }
 
 // NewAESDataProcessor creates a new AESDataProcessor with the specified key size
@@ -55,9 +64,39 @@ func NewAESDataProcessor(keySize int, workingDir string) (*AESDataProcessor, err
 	return &AESDataProcessor{
 		keySize:   keySize,
 		outputDir: workingDir,
+		seal:      sealAESCTR,
+		sealMode:  "ctr",
 	}, nil
 }
 
+/*
+ingestSize returns the number of files and bytes referenced by a MediaIngest.
+Manifest segments without a file are already digested and not counted
+*/
+func ingestSize(ingest MediaIngest) (int, int64) {
+	files := make([]string, 0)
+	switch media := ingest.Result.(type) {
+	case RawMedia:
+		files = append(files, media.File)
+	case VODManifest:
+		for _, mediaStream := range media.Streams {
+			for _, mediaSegment := range mediaStream.Segments {
+				if mediaSegment.File != "" {
+					files = append(files, mediaSegment.File)
+				}
+			}
+		}
+	}
+
+	size := int64(0)
+	for _, fname := range files {
+		if info, err := os.Stat(fname); err == nil {
+			size += info.Size()
+		}
+	}
+	return len(files), size
+}
+
 func generateRandomBytes(size int) ([]byte, error) {
 	key := make([]byte, size)
 	_, err := rand.Read(key)
@@ -90,72 +129,121 @@ func CalculateSHA256Checksum(fname string) ([]byte, error) {
 	return hash.Sum(nil), nil
 }
 
+// digestedFile describes the encrypted output of digestFile
+type digestedFile struct {
+	File        string
+	Checksum    string
+	MerkleRoot  string
+	ProofFile   string
+	Size        int64
+	Fingerprint string
+}
+
 /*
-digestFile creates a file with the first a.keySize bytes being the initialization
-vector and the remaining data being 'fname' files content encrypted in CTR mode. Returns
-output file name, file checksum, file size, and error
+sealAESCTR writes an initialization vector read from nonces followed by
+the contents of plain encrypted with block in CTR mode
 */
-func (a *AESDataProcessor) digestFile(block cipher.Block, fname string) (string, string, int64, error) {
+func sealAESCTR(block cipher.Block, nonces io.Reader, plain io.Reader, out io.Writer) error {
+	// Read initialization vector for media encryption
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(nonces, iv); err != nil {
+		return fmt.Errorf("failed to generate initialization vector: %w", err)
+	}
+	if _, err := out.Write(iv); err != nil {
+		return fmt.Errorf("failed to prepend initialization vector to digest: %w", err)
+	}
+
+	// Encrypt using block+iv in CTR mode
+	streamCipher := cipher.NewCTR(block, iv)
+	cryptWriter := &cipher.StreamWriter{S: streamCipher, W: out}
+	if _, err := io.Copy(cryptWriter, plain); err != nil {
+		return fmt.Errorf("failed to write encrypted data: %w", err)
+	}
+	return nil
+}
+
+/*
+digestFile creates a file containing the contents of 'fname' encrypted by the
+processors seal function using IVs and nonces from 'nonces'. Returns the output
+file along with its checksum, size and integrity proof, and the plaintext hashed
+by fingerprint if it isn't nil
+*/
+func (a *AESDataProcessor) digestFile(block cipher.Block, nonces io.Reader, fname string, fingerprint hash.Hash,
+	observer ProgressObserver) (digestedFile, error) {
 	/* Ensure digest always deletes ingest file. Prevents buildup
 	of data on disk due to failed digests */
 	defer os.Remove(fname)
 
-	// Generate initialization vector for media encryption
-	iv, err := generateRandomBytes(aes.BlockSize)
-	if err != nil {
-		return "", "", -1, err
-	}
-
-	// Create encrypted file, prepend initialization vector
+	// Create encrypted file
 	outFile, err := os.CreateTemp(a.outputDir, digestFilePattern)
 	if err != nil {
-		return "", "", -1, err
-	}
-
-	_, err = outFile.Write(iv)
-	if err != nil {
-		outFile.Close()
-		return "", "", -1, fmt.Errorf("failed to prepend initialization vector to digest: %w", err)
+		return digestedFile{}, err
 	}
 
-	// Encrypt segment using block+iv in CTR mode and write digest
-	streamCipher := cipher.NewCTR(block, iv)
-	cryptWriter := &cipher.StreamWriter{S: streamCipher, W: outFile}
-
 	plainFile, err := os.Open(fname)
 	if err != nil {
 		outFile.Close()
-		return "", "", -1, fmt.Errorf("failed to open ingest file %s: %w", fname, err)
+		os.Remove(outFile.Name())
+		return digestedFile{}, fmt.Errorf("failed to open ingest file %s: %w", fname, err)
 	}
 
-	if _, err = io.Copy(cryptWriter, plainFile); err != nil {
-		outFile.Close()
-		plainFile.Close()
-		return "", "", -1, fmt.Errorf("failed to write encrypted data: %w", err)
+	// Encrypt segment and write digest
+	var plainCopy io.Writer = io.Discard
+	if fingerprint != nil {
+		plainCopy = fingerprint
 	}
+	err = a.seal(block, nonces, io.TeeReader(plainFile, &progressWriter{plainCopy, observer}), outFile)
 	outFile.Close()
 	plainFile.Close()
+	if err != nil {
+		os.Remove(outFile.Name())
+		return digestedFile{}, err
+	}
 
 	// Calculate checksum
 	checksum, err := CalculateSHA256Checksum(outFile.Name())
 	if err != nil {
-		return "", "", -1, fmt.Errorf("failed to calculate checksum for file %s: %w", outFile.Name(), err)
+		os.Remove(outFile.Name())
+		return digestedFile{}, fmt.Errorf("failed to calculate checksum for file %s: %w", outFile.Name(), err)
 	}
 
 	// Get file size
 	info, err := os.Stat(outFile.Name())
 	if err != nil {
-		return "", "", -1, fmt.Errorf("failed to get size of file %s: %w", outFile.Name(), err)
+		os.Remove(outFile.Name())
+		return digestedFile{}, fmt.Errorf("failed to get size of file %s: %w", outFile.Name(), err)
 	}
 
-	return outFile.Name(), base64.StdEncoding.EncodeToString(checksum), info.Size(), nil
+	// Create per block integrity proof
+	proofFile, merkleRoot, err := writeIntegrityProof(outFile.Name(), DefaultIntegrityBlockSize, a.outputDir)
+	if err != nil {
+		os.Remove(outFile.Name())
+		return digestedFile{}, err
+	}
+	if err = observer.SegmentDone(); err != nil {
+		os.Remove(outFile.Name())
+		os.Remove(proofFile)
+		return digestedFile{}, err
+	}
+
+	digested := digestedFile{
+		File:       outFile.Name(),
+		Checksum:   base64.StdEncoding.EncodeToString(checksum),
+		MerkleRoot: merkleRoot,
+		ProofFile:  proofFile,
+		Size:       info.Size(),
+	}
+	if fingerprint != nil {
+		digested.Fingerprint = hex.EncodeToString(fingerprint.Sum(nil))
+	}
+	return digested, nil
 }
 
 /*
 digestRawMedia delegates to digestFile and returns a rawMedia
 instance and the processed media size
 */
-func (a *AESDataProcessor) digestRawMedia(block cipher.Block, media RawMedia) (RawMedia, int64, error) {
+func (a *AESDataProcessor) digestRawMedia(block cipher.Block, media RawMedia, observer ProgressObserver) (RawMedia, int64, error) {
 	// Create stream cipher for use in creating Functional ID
 	fidIV, err := generateRandomBytes(aes.BlockSize)
 	if err != nil {
@@ -164,19 +252,25 @@ func (a *AESDataProcessor) digestRawMedia(block cipher.Block, media RawMedia) (R
 	fidCipher := cipher.NewCTR(block, fidIV)
 
 	// Update rawMedia entry
-	var size int64
 	media.FunctionalID = generateFunctionalID(media.URL, fidCipher)
-	media.File, media.Checksum, size, err = a.digestFile(block, media.File)
-	return media, size, err
+	digested, err := a.digestFile(block, rand.Reader, media.File, nil, observer)
+	if err != nil {
+		return RawMedia{}, -1, err
+	}
+	media.File, media.Checksum = digested.File, digested.Checksum
+	media.MerkleRoot, media.ProofFile = digested.MerkleRoot, digested.ProofFile
+	return media, digested.Size, nil
 }
 
 /*
 digestManifest takes a manifest and generates Functional IDs for each member of
-the manifest. In addition to this, it encrypts all segment files in the passed in
+the manifest that has none. In addition to this, it encrypts all segment files in the passed in
 manifest and returns a manifest with the File pointers pointing to the encrypted
-data
+data. Segments without a file were digested before and are kept as they are.
+On failure all ingest and partially created digest files are removed
 */
-func (a *AESDataProcessor) digestManifest(block cipher.Block, mediaMap VODManifest) (VODManifest, int64, error) {
+func (a *AESDataProcessor) digestManifest(block cipher.Block, mediaMap VODManifest,
+	observer ProgressObserver) (VODManifest, int64, error) {
 	// Create stream cipher used to assist in creation of Functional IDs
 	fidIV, err := generateRandomBytes(aes.BlockSize)
 	if err != nil {
@@ -185,20 +279,33 @@ func (a *AESDataProcessor) digestManifest(block cipher.Block, mediaMap VODManife
 	fidCipher := cipher.NewCTR(block, fidIV)
 
 	// Modify manifest with generated functional IDs and new encrypted segment locations
-	fileSize := int64(0)
 	totalSize := int64(0)
-	mediaMap.FunctionalID = generateFunctionalID(mediaMap.URL, fidCipher)
+	if mediaMap.FunctionalID == "" {
+		mediaMap.FunctionalID = generateFunctionalID(mediaMap.URL, fidCipher)
+	}
 	completeStreams := make([]VODStream, 0)
 	for _, mediaStream := range mediaMap.Streams {
-		mediaStream.FunctionalID = generateFunctionalID(mediaStream.URL, fidCipher)
+		if mediaStream.FunctionalID == "" {
+			mediaStream.FunctionalID = generateFunctionalID(mediaStream.URL, fidCipher)
+		}
 		completeSegments := make([]VODSegment, 0)
 		for _, mediaSegment := range mediaStream.Segments {
-			mediaSegment.FunctionalID = generateFunctionalID(mediaSegment.URL, fidCipher)
-			mediaSegment.File, mediaSegment.Checksum, fileSize, err = a.digestFile(block, mediaSegment.File)
+			if mediaSegment.File == "" {
+				totalSize += mediaSegment.Size
+				completeSegments = append(completeSegments, mediaSegment)
+				continue
+			}
+			digested, err := a.digestSegment(block, fidCipher, &mediaSegment, observer)
 			if err != nil {
+				digested := append(completeStreams, VODStream{Segments: completeSegments})
+				RemoveIngestArtifacts(MediaIngest{Type: VODMediaType, Result: VODManifest{Streams: digested}})
+				RemoveIngestArtifacts(MediaIngest{Type: VODMediaType, Result: mediaMap})
 				return VODManifest{}, -1, err
 			}
-			totalSize += fileSize
+			mediaSegment.File, mediaSegment.Checksum = digested.File, digested.Checksum
+			mediaSegment.MerkleRoot, mediaSegment.ProofFile = digested.MerkleRoot, digested.ProofFile
+			mediaSegment.Fingerprint, mediaSegment.Size = digested.Fingerprint, digested.Size
+			totalSize += digested.Size
 			completeSegments = append(completeSegments, mediaSegment)
 		}
 		mediaStream.Segments = completeSegments
@@ -210,6 +317,16 @@ func (a *AESDataProcessor) digestManifest(block cipher.Block, mediaMap VODManife
 
 // DigestMedia takes a MediaIngest and encrypts the data using AES, returning a MediaDigest
 func (a *AESDataProcessor) DigestMedia(ingest MediaIngest) (MediaDigest, error) {
+	return a.DigestMediaObserved(ingest, nopProgressObserver{})
+}
+
+// DigestMediaObserved is DigestMedia reporting encryption progress to observer
+func (a *AESDataProcessor) DigestMediaObserved(ingest MediaIngest, observer ProgressObserver) (MediaDigest, error) {
+	if err := observer.AddTotal(ingestSize(ingest)); err != nil {
+		RemoveIngestArtifacts(ingest)
+		return MediaDigest{}, err
+	}
+
 	// Randomly generate cryptographically secure 256-bit key and initialization vector
 	aesKey, err := generateRandomBytes(a.keySize)
 	if err != nil {
@@ -226,7 +343,7 @@ func (a *AESDataProcessor) DigestMedia(ingest MediaIngest) (MediaDigest, error)
 	digest := MediaDigest{CryptKey: aesKey, Type: ingest.Type}
 	switch ingest.Type {
 	case RawMediaType:
-		media, size, err := a.digestRawMedia(block, ingest.Result.(RawMedia))
+		media, size, err := a.digestRawMedia(block, ingest.Result.(RawMedia), observer)
 		if err != nil {
 			return MediaDigest{}, fmt.Errorf("failed to digest raw media file: %w", err)
 		}
@@ -234,7 +351,7 @@ func (a *AESDataProcessor) DigestMedia(ingest MediaIngest) (MediaDigest, error)
 		digest.FunctionalID = media.FunctionalID
 		digest.ByteSize = size
 	case VODMediaType:
-		mediaMap, size, err := a.digestManifest(block, ingest.Result.(VODManifest))
+		mediaMap, size, err := a.digestManifest(block, ingest.Result.(VODManifest), observer)
 		if err != nil {
 			return MediaDigest{}, fmt.Errorf("failed to digest manifest: %w", err)
 		}
@@ -247,3 +364,43 @@ func (a *AESDataProcessor) DigestMedia(ingest MediaIngest) (MediaDigest, error)
 
 	return digest, nil
 }
+
+/*
+DigestManifestUpdate encrypts the segments of update, which are additions to a
+manifest published under cryptKey, with the same key. Functional IDs already set
+on the manifest and its streams are kept. A nil cryptKey generates a new key,
+for the first update of a manifest
+*/
+func (a *AESDataProcessor) DigestManifestUpdate(cryptKey []byte, update VODManifest,
+	observer ProgressObserver) (MediaDigest, error) {
+	ingest := MediaIngest{Type: VODMediaType, Result: update}
+	if err := observer.AddTotal(ingestSize(ingest)); err != nil {
+		RemoveIngestArtifacts(ingest)
+		return MediaDigest{}, err
+	}
+
+	if cryptKey == nil {
+		var err error
+		if cryptKey, err = generateRandomBytes(a.keySize); err != nil {
+			RemoveIngestArtifacts(ingest)
+			return MediaDigest{}, fmt.Errorf("failed to generate symmetric key of size %d: %w", a.keySize, err)
+		}
+	}
+	block, err := aes.NewCipher(cryptKey)
+	if err != nil {
+		RemoveIngestArtifacts(ingest)
+		return MediaDigest{}, fmt.Errorf("failed to generate cipher block: %w", err)
+	}
+
+	mediaMap, size, err := a.digestManifest(block, update, observer)
+	if err != nil {
+		return MediaDigest{}, fmt.Errorf("failed to digest manifest update: %w", err)
+	}
+	return MediaDigest{
+		Type:         VODMediaType,
+		CryptKey:     cryptKey,
+		FunctionalID: mediaMap.FunctionalID,
+		ByteSize:     size,
+		Result:       mediaMap,
+	}, nil
+}
@@ -0,0 +1,69 @@
+package cyprus
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrJobCancelled is returned by work that was aborted because its job was cancelled
+var ErrJobCancelled = errors.New("job cancelled")
+
+/*
+ProgressObserver is informed of the progress of preprocessing and processing
+work. Totals are added to as work is discovered. Returning an error from any
+call aborts the work in progress
+*/
+type ProgressObserver interface {
+	AddTotal(segments int, bytes int64) error
+	AddBytes(bytes int64) error
+	SegmentDone() error
+}
+
+// nopProgressObserver implements ProgressObserver by ignoring all progress
+type nopProgressObserver struct{}
+
+func (nopProgressObserver) AddTotal(int, int64) error { return nil }
+func (nopProgressObserver) AddBytes(int64) error      { return nil }
+func (nopProgressObserver) SegmentDone() error        { return nil }
+
+// ObservedDataPreprocessor is a DataPreprocessor that reports progress and can be aborted
+type ObservedDataPreprocessor interface {
+	DataPreprocessor
+	IngestMediaObserved(url string, observer ProgressObserver) (MediaIngest, error)
+}
+
+// ObservedDataProcessor is a DataProcessor that reports progress and can be aborted
+type ObservedDataProcessor interface {
+	DataProcessor
+	DigestMediaObserved(ingest MediaIngest, observer ProgressObserver) (MediaDigest, error)
+}
+
+// ingestObserved ingests through the observed path when the preprocessor supports it
+func ingestObserved(preprocessor DataPreprocessor, url string, observer ProgressObserver) (MediaIngest, error) {
+	if observed, ok := preprocessor.(ObservedDataPreprocessor); ok {
+		return observed.IngestMediaObserved(url, observer)
+	}
+	return preprocessor.IngestMedia(url)
+}
+
+// digestObserved digests through the observed path when the processor supports it
+func digestObserved(processor DataProcessor, ingest MediaIngest, observer ProgressObserver) (MediaDigest, error) {
+	if observed, ok := processor.(ObservedDataProcessor); ok {
+		return observed.DigestMediaObserved(ingest, observer)
+	}
+	return processor.DigestMedia(ingest)
+}
+
+// progressWriter reports every write to a ProgressObserver, failing the write if it aborts
+type progressWriter struct {
+	writer   io.Writer
+	observer ProgressObserver
+}
+
+func (p *progressWriter) Write(data []byte) (int, error) {
+	n, err := p.writer.Write(data)
+	if err != nil {
+		return n, err
+	}
+	return n, p.observer.AddBytes(int64(n))
+}
@@ -0,0 +1,400 @@
+package cyprus
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+)
+
+// ProcessingQueueConfig configures the workers and job records of a ProcessingQueue
+type ProcessingQueueConfig struct {
+	// Directory job records are persisted in
+	RecordDir string
+
+	// Number of jobs processed concurrently
+	Workers int
+
+	/* Number of times ingestion is attempted before a job fails, waiting
+	RetryBackoff after the first failure and doubling after every further one */
+	MaxAttempts  int
+	RetryBackoff time.Duration
+
+	// Time finished, failed and cancelled jobs are kept for status requests
+	Retention time.Duration
+
+	/* Secret used to sign completion callbacks and the number of times delivery
+	is attempted, waiting CallbackBackoff after the first failure and doubling after */
+	CallbackSecret   []byte
+	CallbackAttempts int
+	CallbackBackoff  time.Duration
+
+	/* Preprocessor polling the playlists of live content, which is only accepted
+	when set, and the number of media segments per stream kept published for
+	live content that expires segments, DefaultLiveWindow if not positive */
+	LivePreprocessor *HLSPreprocessor
+	LiveWindow       int
+
+	/* Published content, read by update jobs to find the segments that changed,
+	and the KEK its keys are wrapped by. Update jobs are only accepted when
+	Published is set. The KEK also wraps the keys kept in live job records */
+	Published StorageReader
+	KEK       *KeyEncryptionKey
+}
+
+/*
+ProcessingQueue runs preprocess, process, publish jobs on a fixed number of
+workers. Job records are persisted so jobs interrupted by a restart are resumed,
+and ingestion failures are retried with exponential backoff. Live jobs run on
+their own until the content ends
+*/
+type ProcessingQueue struct {
+	preprocessor DataPreprocessor
+	processor    DataProcessor
+	storage      StorageManager
+	tracker      *jobTracker
+	notifier     *callbackNotifier
+
+	maxAttempts  int
+	retryBackoff time.Duration
+	retention    time.Duration
+
+	livePreprocessor *HLSPreprocessor
+	liveProcessor    LiveDataProcessor
+	liveWindow       int
+	livePollUnit     time.Duration
+
+	published         StorageReader
+	kek               *KeyEncryptionKey
+	revisionProcessor RevisionDataProcessor
+
+	pending []string
+	cond    *sync.Cond
+}
+
+// NewProcessingQueue creates a ProcessingQueue and starts its workers
+func NewProcessingQueue(conf ProcessingQueueConfig, preprocessor DataPreprocessor,
+	processor DataProcessor, storage StorageManager) (*ProcessingQueue, error) {
+	if conf.Workers <= 0 {
+		return nil, fmt.Errorf("processing queue requires at least one worker, got %d", conf.Workers)
+	}
+	if conf.MaxAttempts <= 0 {
+		conf.MaxAttempts = 1
+	}
+	if conf.LiveWindow <= 0 {
+		conf.LiveWindow = DefaultLiveWindow
+	}
+	liveProcessor, ok := processor.(LiveDataProcessor)
+	if conf.LivePreprocessor != nil && (!ok || conf.KEK == nil) {
+		return nil, fmt.Errorf("processing queue requires a LiveDataProcessor and KEK for live ingestion")
+	}
+	revisionProcessor, ok := processor.(RevisionDataProcessor)
+	if conf.Published != nil && (!ok || conf.KEK == nil) {
+		return nil, fmt.Errorf("processing queue requires a RevisionDataProcessor and KEK for update ingestion")
+	}
+	tracker, err := newPersistentJobTracker(conf.RecordDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create processing queue: %w", err)
+	}
+
+	queue := &ProcessingQueue{
+		preprocessor: preprocessor,
+		processor:    processor,
+		storage:      storage,
+		tracker:      tracker,
+		notifier:     newCallbackNotifier(conf.CallbackSecret, conf.CallbackAttempts, conf.CallbackBackoff),
+		maxAttempts:  conf.MaxAttempts,
+		retryBackoff: conf.RetryBackoff,
+		retention:    conf.Retention,
+
+		livePreprocessor: conf.LivePreprocessor,
+		liveProcessor:    liveProcessor,
+		liveWindow:       conf.LiveWindow,
+		livePollUnit:     time.Second,
+
+		published:         conf.Published,
+		kek:               conf.KEK,
+		revisionProcessor: revisionProcessor,
+
+		pending: make([]string, 0),
+		cond:    sync.NewCond(&sync.Mutex{}),
+	}
+	liveJobs := make([]string, 0)
+	for _, cid := range tracker.running() {
+		if _, err := tracker.live(cid); err == nil {
+			liveJobs = append(liveJobs, cid)
+		} else {
+			queue.pending = append(queue.pending, cid)
+		}
+	}
+	if len(queue.pending)+len(liveJobs) > 0 {
+		log.Printf("Resuming %d processing jobs\n", len(queue.pending)+len(liveJobs))
+	}
+	for i := 0; i < conf.Workers; i++ {
+		go queue.startWorker()
+	}
+	for _, cid := range liveJobs {
+		queue.startLive(cid)
+	}
+
+	// Retry callbacks that were not delivered before a restart
+	for _, cid := range tracker.completed() {
+		queue.notify(cid)
+	}
+	return queue, nil
+}
+
+// enqueue schedules a job to be picked up by the next free worker
+func (q *ProcessingQueue) enqueue(cid string) {
+	q.cond.L.Lock()
+	q.pending = append(q.pending, cid)
+	q.cond.L.Unlock()
+	q.cond.Signal()
+}
+
+// notify starts delivery of the final status of the job for cid if it has a callback
+func (q *ProcessingQueue) notify(cid string) {
+	callbackURL, status, ok := q.tracker.pendingCallback(cid)
+	if !ok {
+		return
+	}
+	go q.notifier.notify(callbackURL, status, func() {
+		if err := q.tracker.update(cid, func(foundJob *job) { foundJob.Notified = true }); err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+/*
+Submit queues a processing job for cid. If callbackURL is not empty the final
+status of the job is POSTed to it. Submitting content that already has a running
+job is a no-op and returns false
+*/
+func (q *ProcessingQueue) Submit(cid string, callbackURL string) (bool, error) {
+	q.tracker.prune(q.retention)
+	created, err := q.tracker.newJob(cid, callbackURL)
+	if err != nil {
+		return false, fmt.Errorf("failed to submit job for %s: %w", cid, err)
+	}
+	if created {
+		q.enqueue(cid)
+	}
+	return created, nil
+}
+
+/*
+SubmitLive starts a live ingestion job for cid that keeps publishing the segments
+the origin adds until the content ends. Submitting content that already has a
+running job is a no-op and returns false
+*/
+func (q *ProcessingQueue) SubmitLive(cid string, callbackURL string) (bool, error) {
+	if q.livePreprocessor == nil {
+		return false, fmt.Errorf("failed to submit live job for %s: live ingestion is not enabled", cid)
+	}
+	q.tracker.prune(q.retention)
+	created, err := q.tracker.newLiveJob(cid, callbackURL)
+	if err != nil {
+		return false, fmt.Errorf("failed to submit live job for %s: %w", cid, err)
+	}
+	if created {
+		q.startLive(cid)
+	}
+	return created, nil
+}
+
+/*
+SubmitUpdate queues a job re-ingesting cid that only digests and publishes the
+manifest segments that changed since cid was last published. Unchanged segments,
+streams and the manifest keep their functional IDs and segments that were removed
+are purged. Submitting content that already has a running job is a no-op and
+returns false
+*/
+func (q *ProcessingQueue) SubmitUpdate(cid string, callbackURL string) (bool, error) {
+	if q.published == nil {
+		return false, fmt.Errorf("failed to submit update job for %s: update ingestion is not enabled", cid)
+	}
+	q.tracker.prune(q.retention)
+	created, err := q.tracker.newUpdateJob(cid, callbackURL)
+	if err != nil {
+		return false, fmt.Errorf("failed to submit update job for %s: %w", cid, err)
+	}
+	if created {
+		q.enqueue(cid)
+	}
+	return created, nil
+}
+
+// startLive runs the live job for cid, failing it if live ingestion is not enabled
+func (q *ProcessingQueue) startLive(cid string) {
+	if q.livePreprocessor == nil {
+		q.fail(cid, fmt.Errorf("failed to resume live job for %s: live ingestion is not enabled", cid))
+		return
+	}
+	go q.processLive(cid)
+}
+
+// Status returns the status, progress and results of the job for cid
+func (q *ProcessingQueue) Status(cid string) (infra.StatusResponse, error) {
+	q.tracker.prune(q.retention)
+	return q.tracker.response(cid)
+}
+
+// List returns the status of every job ordered by content ID
+func (q *ProcessingQueue) List() []infra.JobResponse {
+	q.tracker.prune(q.retention)
+	jobs := q.tracker.list()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ContentID < jobs[j].ContentID })
+	return jobs
+}
+
+/*
+Cancel stops the running job for cid. Work in progress is aborted and its
+temporary files are removed by the worker running it
+*/
+func (q *ProcessingQueue) Cancel(cid string) error {
+	if err := q.tracker.cancel(cid); err != nil {
+		return fmt.Errorf("failed to cancel job for %s: %w", cid, err)
+	}
+	q.notify(cid)
+	return nil
+}
+
+// jobObserver implements ProgressObserver by updating the progress of a tracked job
+type jobObserver struct {
+	tracker *jobTracker
+	cid     string
+}
+
+func (o *jobObserver) AddTotal(segments int, bytes int64) error {
+	return o.tracker.updateProgress(o.cid, func(progress *infra.ProcessingProgress) {
+		progress.SegmentsTotal += segments
+		progress.BytesTotal += bytes
+	})
+}
+
+func (o *jobObserver) AddBytes(bytes int64) error {
+	return o.tracker.updateProgress(o.cid, func(progress *infra.ProcessingProgress) {
+		progress.BytesDone += bytes
+	})
+}
+
+func (o *jobObserver) SegmentDone() error {
+	return o.tracker.updateProgress(o.cid, func(progress *infra.ProcessingProgress) {
+		progress.SegmentsDone++
+	})
+}
+
+func (q *ProcessingQueue) startWorker() {
+	for {
+		q.cond.L.Lock()
+		for len(q.pending) == 0 {
+			q.cond.Wait()
+		}
+		cid := q.pending[0]
+		q.pending = q.pending[1:]
+		q.cond.L.Unlock()
+
+		q.process(cid)
+	}
+}
+
+// fail marks the job for cid as failed
+func (q *ProcessingQueue) fail(cid string, err error) {
+	log.Println(err)
+	if err = q.tracker.fail(cid, err); err != nil {
+		log.Println(err)
+	}
+	q.notify(cid)
+}
+
+/*
+process goes through the preprocess, process, publish workflow
+while keeping track of progress and results via the jobTracker.
+Cancelled jobs stop at the next progress update
+*/
+func (q *ProcessingQueue) process(cid string) {
+	observer := &jobObserver{tracker: q.tracker, cid: cid}
+	if err := q.tracker.startPhase(cid, infra.IngestPhase); err != nil {
+		if !errors.Is(err, ErrJobCancelled) {
+			log.Println(err)
+		}
+		return
+	}
+	attempts, err := q.tracker.addAttempt(cid)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	ingest, err := ingestObserved(q.preprocessor, cid, observer)
+	if errors.Is(err, ErrJobCancelled) {
+		log.Printf("Cancelled job for %s during ingest\n", cid)
+		return
+	}
+	if err != nil {
+		if attempts < q.maxAttempts {
+			backoff := q.retryBackoff << (attempts - 1)
+			log.Printf("Ingest attempt %d of %s failed, retrying in %s: %v\n", attempts, cid, backoff, err)
+			time.AfterFunc(backoff, func() { q.enqueue(cid) })
+			return
+		}
+		q.fail(cid, fmt.Errorf("failed to ingest %s after %d attempts: %w", cid, attempts, err))
+		return
+	}
+
+	if err = q.tracker.startPhase(cid, infra.DigestPhase); err != nil {
+		RemoveIngestArtifacts(ingest)
+		if !errors.Is(err, ErrJobCancelled) {
+			q.fail(cid, err)
+		}
+		return
+	}
+	var digest MediaDigest
+	if q.tracker.updating(cid) {
+		digest, err = q.digestUpdate(cid, ingest, observer)
+	} else {
+		digest, err = digestObserved(q.processor, ingest, observer)
+	}
+	if errors.Is(err, ErrJobCancelled) {
+		log.Printf("Cancelled job for %s during digest\n", cid)
+		return
+	}
+	if err != nil {
+		q.fail(cid, err)
+		return
+	}
+	err = q.tracker.updateResult(cid, &infra.PostProcessingMetadata{
+		FunctionalID: digest.FunctionalID,
+		ByteSize:     digest.ByteSize,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+
+	// Jobs can no longer be cancelled once publishing starts
+	if err = q.tracker.startPhase(cid, infra.PublishPhase); err != nil {
+		RemoveIngestArtifacts(MediaIngest{Type: digest.Type, Result: digest.Result})
+		if !errors.Is(err, ErrJobCancelled) {
+			q.fail(cid, err)
+		}
+		return
+	}
+	segments, _ := ingestSize(MediaIngest{Type: digest.Type, Result: digest.Result})
+	observer.AddTotal(segments, digest.ByteSize)
+	if err = q.storage.Publish(digest); err != nil {
+		q.fail(cid, err)
+		return
+	}
+	q.tracker.updateProgress(cid, func(progress *infra.ProcessingProgress) {
+		progress.SegmentsDone = progress.SegmentsTotal
+		progress.BytesDone = progress.BytesTotal
+	})
+	if err = q.tracker.updateStatus(cid, infra.FinishedProcessing); err != nil {
+		log.Println(err)
+	}
+	q.notify(cid)
+}
@@ -0,0 +1,222 @@
+package cyprus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyPreprocessor fails the first 'failures' ingests of every URL
+type flakyPreprocessor struct {
+	failures int
+	block    chan struct{}
+	mutex    sync.Mutex
+	calls    map[string]int
+}
+
+func (f *flakyPreprocessor) IngestMedia(url string) (MediaIngest, error) {
+	if f.block != nil {
+		<-f.block
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls[url]++
+	if f.calls[url] <= f.failures {
+		return MediaIngest{}, fmt.Errorf("transient failure %d", f.calls[url])
+	}
+	return MediaIngest{Type: RawMediaType, Result: RawMedia{URL: url}}, nil
+}
+
+type mockQueueProcessor struct{}
+
+func (m *mockQueueProcessor) DigestMedia(ingest MediaIngest) (MediaDigest, error) {
+	return MediaDigest{Type: ingest.Type, FunctionalID: "fid", ByteSize: 10}, nil
+}
+
+type mockQueueStorage struct{}
+
+func (m *mockQueueStorage) Publish(MediaDigest) error        { return nil }
+func (m *mockQueueStorage) PurgeByURL(string) error          { return nil }
+func (m *mockQueueStorage) PurgeByFunctionalID(string) error { return nil }
+
+// waitForStatus polls the queue until the job for cid leaves the running state
+func waitForStatus(t *testing.T, queue *ProcessingQueue, cid string) infra.ProcessingStatus {
+	for i := 0; i < 100; i++ {
+		response, err := queue.Status(cid)
+		assert.Nil(t, err, "should not return error")
+		if response.Status != infra.RunningProcessing {
+			return response.Status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job for %s never finished", cid)
+	return ""
+}
+
+func TestProcessingQueueRetries(t *testing.T) {
+	recordDir := t.TempDir()
+	preprocessor := &flakyPreprocessor{failures: 2, calls: make(map[string]int)}
+
+	// Succeeds once retries outlast the transient failures
+	conf := ProcessingQueueConfig{RecordDir: recordDir, Workers: 2, MaxAttempts: 3,
+		RetryBackoff: time.Millisecond, Retention: time.Hour}
+	queue, err := NewProcessingQueue(conf, preprocessor, &mockQueueProcessor{}, &mockQueueStorage{})
+	assert.Nil(t, err, "should not return error")
+	created, err := queue.Submit("cid1", "")
+	assert.Nil(t, err, "should not return error")
+	assert.True(t, created, "expected job to be created")
+	assert.Equal(t, infra.FinishedProcessing, waitForStatus(t, queue, "cid1"), "expected job to finish")
+	response, _ := queue.Status("cid1")
+	assert.Equal(t, &infra.PostProcessingMetadata{FunctionalID: "fid", ByteSize: 10}, response.Metadata, "wrong result")
+	assert.Equal(t, 3, preprocessor.calls["cid1"], "wrong number of ingest attempts")
+
+	// Fails once attempts are exhausted
+	preprocessor.mutex.Lock()
+	preprocessor.failures = 10
+	preprocessor.mutex.Unlock()
+	_, err = queue.Submit("cid2", "")
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, infra.FailedProcessing, waitForStatus(t, queue, "cid2"), "expected job to fail")
+	assert.Equal(t, 3, preprocessor.calls["cid2"], "wrong number of ingest attempts")
+	response, _ = queue.Status("cid2")
+	assert.Contains(t, response.Error, "transient failure 3", "expected failure reason")
+
+	// Completed jobs are listed until they leave the retention window
+	jobs := queue.List()
+	assert.Equal(t, 2, len(jobs), "wrong number of listed jobs")
+	assert.Equal(t, "cid1", jobs[0].ContentID, "wrong job order")
+	assert.Equal(t, infra.FailedProcessing, jobs[1].Status, "wrong listed status")
+	queue.retention = 0
+	assert.Equal(t, 0, len(queue.List()), "expected completed jobs to be pruned")
+}
+
+func TestProcessingQueueDedupAndResume(t *testing.T) {
+	recordDir := t.TempDir()
+	preprocessor := &flakyPreprocessor{block: make(chan struct{}), calls: make(map[string]int)}
+
+	conf := ProcessingQueueConfig{RecordDir: recordDir, Workers: 1, MaxAttempts: 1, Retention: time.Hour}
+	queue, err := NewProcessingQueue(conf, preprocessor, &mockQueueProcessor{}, &mockQueueStorage{})
+	assert.Nil(t, err, "should not return error")
+	created, err := queue.Submit("cid1", "")
+	assert.Nil(t, err, "should not return error")
+	assert.True(t, created, "expected job to be created")
+	created, err = queue.Submit("cid1", "")
+	assert.Nil(t, err, "should not return error")
+	assert.False(t, created, "expected duplicate submission to be ignored")
+
+	// A new queue on the same records resumes the running job
+	resumed := &flakyPreprocessor{calls: make(map[string]int)}
+	restarted, err := NewProcessingQueue(conf, resumed, &mockQueueProcessor{}, &mockQueueStorage{})
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, infra.FinishedProcessing, waitForStatus(t, restarted, "cid1"), "expected resumed job to finish")
+	assert.Equal(t, 1, resumed.calls["cid1"], "expected resumed job to be ingested")
+
+	// Pruned jobs are removed from the records
+	restarted.retention = 0
+	restarted.List()
+	tracker, err := newPersistentJobTracker(recordDir)
+	assert.Nil(t, err, "should not return error")
+	_, err = tracker.status("cid1")
+	assert.NotNil(t, err, "expected pruned job record to be removed")
+}
+
+func TestProcessingQueueCancel(t *testing.T) {
+	workingDir := t.TempDir()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	preprocessor := &RawPreprocessor{
+		outputDir: workingDir,
+		retrieveFile: func(url string, out io.Writer) error {
+			if _, err := out.Write([]byte("partial")); err != nil {
+				return err
+			}
+			close(started)
+			<-release
+			_, err := out.Write([]byte("rest"))
+			return err
+		},
+	}
+
+	conf := ProcessingQueueConfig{RecordDir: t.TempDir(), Workers: 1, MaxAttempts: 3, Retention: time.Hour}
+	queue, err := NewProcessingQueue(conf, preprocessor, &mockQueueProcessor{}, &mockQueueStorage{})
+	assert.Nil(t, err, "should not return error")
+	_, err = queue.Submit("cid1", "")
+	assert.Nil(t, err, "should not return error")
+	<-started
+
+	// Progress of the in-flight download is reported
+	response, err := queue.Status("cid1")
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, &infra.ProcessingProgress{Phase: infra.IngestPhase, SegmentsTotal: 1, BytesDone: 7},
+		response.Progress, "wrong progress")
+
+	// Cancelling aborts the download and removes its ingest file
+	assert.Nil(t, queue.Cancel("cid1"), "should not return error")
+	assert.NotNil(t, queue.Cancel("cid1"), "should fail to cancel stopped job")
+	close(release)
+	assert.Equal(t, infra.CancelledProcessing, waitForStatus(t, queue, "cid1"), "expected job to be cancelled")
+	for i := 0; i < 100; i++ {
+		if files, _ := os.ReadDir(workingDir); len(files) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected ingest files to be removed")
+}
+
+func TestProcessingQueueCallback(t *testing.T) {
+	secret := []byte("secret")
+	received := make(chan infra.JobResponse, 1)
+	failures := 1
+	receiver := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		payload, _ := io.ReadAll(req.Body)
+		if !infra.VerifyTimestampedPayload(secret, payload, req.Header.Get(infra.PayloadTimestampHeader),
+			req.Header.Get(infra.PayloadSignatureHeader), time.Minute, time.Now()) {
+			t.Errorf("callback signature was invalid")
+		}
+
+		// Fail the first delivery to exercise retries
+		if failures > 0 {
+			failures--
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var status infra.JobResponse
+		json.Unmarshal(payload, &status)
+		received <- status
+	}))
+	defer receiver.Close()
+
+	conf := ProcessingQueueConfig{RecordDir: t.TempDir(), Workers: 1, MaxAttempts: 1, Retention: time.Hour,
+		CallbackSecret: secret, CallbackAttempts: 2, CallbackBackoff: time.Millisecond}
+	preprocessor := &flakyPreprocessor{calls: make(map[string]int)}
+	queue, err := NewProcessingQueue(conf, preprocessor, &mockQueueProcessor{}, &mockQueueStorage{})
+	assert.Nil(t, err, "should not return error")
+	_, err = queue.Submit("cid1", receiver.URL)
+	assert.Nil(t, err, "should not return error")
+
+	select {
+	case status := <-received:
+		assert.Equal(t, "cid1", status.ContentID, "wrong callback content id")
+		assert.Equal(t, infra.FinishedProcessing, status.Status, "wrong callback status")
+		assert.Equal(t, &infra.PostProcessingMetadata{FunctionalID: "fid", ByteSize: 10}, status.Metadata,
+			"wrong callback result")
+	case <-time.After(time.Second):
+		t.Fatalf("callback was never delivered")
+	}
+
+	// Delivery is recorded so the callback isn't repeated after a restart
+	assert.Eventually(t, func() bool {
+		_, _, pending := queue.tracker.pendingCallback("cid1")
+		return !pending
+	}, time.Second, time.Millisecond, "delivered callback was not recorded")
+}
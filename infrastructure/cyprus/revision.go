@@ -0,0 +1,215 @@
+package cyprus
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"reflect"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+)
+
+/*
+RevisionDataProcessor is a DataProcessor that can digest a new ingest of a
+published manifest, re-digesting only the segments that changed
+*/
+type RevisionDataProcessor interface {
+	DataProcessor
+	DigestManifestRevision(cryptKey []byte, previous VODManifest, revision VODManifest,
+		observer ProgressObserver) (MediaDigest, error)
+}
+
+/*
+newSegmentFingerprint creates the keyed hash segment plaintexts are fingerprinted
+with. The key is derived from the content cipher so fingerprints in published
+manifests can't be used to confirm a guessed plaintext without the content key
+*/
+func newSegmentFingerprint(block cipher.Block) hash.Hash {
+	key := make([]byte, 2*aes.BlockSize)
+	label := make([]byte, aes.BlockSize)
+	copy(label, "fingerprint")
+	block.Encrypt(key[:aes.BlockSize], label)
+	label[aes.BlockSize-1] = 1
+	block.Encrypt(key[aes.BlockSize:], label)
+	return hmac.New(sha256.New, key)
+}
+
+// fingerprintFile returns the fingerprint of the segment plaintext in fname
+func fingerprintFile(block cipher.Block, fname string) (string, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return "", fmt.Errorf("failed to open ingest file %s: %w", fname, err)
+	}
+	defer file.Close()
+
+	fingerprint := newSegmentFingerprint(block)
+	if _, err = io.Copy(fingerprint, file); err != nil {
+		return "", fmt.Errorf("failed to hash ingest file %s: %w", fname, err)
+	}
+	return hex.EncodeToString(fingerprint.Sum(nil)), nil
+}
+
+// segmentIdentity identifies a segment within its stream by the resource and range it is fetched from
+func segmentIdentity(segment VODSegment) string {
+	if segment.ByteRange == nil {
+		return segment.URL
+	}
+	return fmt.Sprintf("%s@%d-%d", segment.URL, segment.ByteRange.Offset, segment.ByteRange.Length)
+}
+
+/*
+DigestManifestRevision digests revision, a new ingest of the manifest previous
+was published from, under the same key. Segments fetched from the same resource
+and range as a published segment of the stream with the same URL, and with the
+same plaintext fingerprint, are kept as published without a file and only the
+rest are encrypted. Streams and the manifest keep their functional IDs only if
+nothing in them changed, since what is published under a functional ID is
+cached as never changing
+*/
+func (a *AESDataProcessor) DigestManifestRevision(cryptKey []byte, previous VODManifest, revision VODManifest,
+	observer ProgressObserver) (MediaDigest, error) {
+	block, err := aes.NewCipher(cryptKey)
+	if err != nil {
+		RemoveIngestArtifacts(MediaIngest{Type: VODMediaType, Result: revision})
+		return MediaDigest{}, fmt.Errorf("failed to generate cipher block: %w", err)
+	}
+
+	// Index published segments by stream, segments digested before fingerprinting can't be matched
+	publishedStreams := make(map[string]VODStream)
+	published := make(map[string]map[string]VODSegment)
+	for _, mediaStream := range previous.Streams {
+		publishedStreams[mediaStream.URL] = mediaStream
+		segments := make(map[string]VODSegment)
+		for _, mediaSegment := range mediaStream.Segments {
+			if mediaSegment.Fingerprint != "" {
+				segments[segmentIdentity(mediaSegment)] = mediaSegment
+			}
+		}
+		published[mediaStream.URL] = segments
+	}
+
+	// Keep unchanged segments, dropping their ingest files
+	streams := make([]VODStream, 0, len(revision.Streams))
+	unchanged := len(revision.Streams) == len(previous.Streams)
+	for _, mediaStream := range revision.Streams {
+		kept := 0
+		segments := make([]VODSegment, 0, len(mediaStream.Segments))
+		for _, mediaSegment := range mediaStream.Segments {
+			fingerprint, err := fingerprintFile(block, mediaSegment.File)
+			if err != nil {
+				RemoveIngestArtifacts(MediaIngest{Type: VODMediaType, Result: revision})
+				return MediaDigest{}, err
+			}
+			publishedSegment, ok := published[mediaStream.URL][segmentIdentity(mediaSegment)]
+			if ok && publishedSegment.Fingerprint == fingerprint {
+				os.Remove(mediaSegment.File)
+				mediaSegment.File = ""
+				mediaSegment.FunctionalID, mediaSegment.Checksum = publishedSegment.FunctionalID, publishedSegment.Checksum
+				mediaSegment.MerkleRoot, mediaSegment.WrappedKey = publishedSegment.MerkleRoot, publishedSegment.WrappedKey
+				mediaSegment.Fingerprint, mediaSegment.Size = publishedSegment.Fingerprint, publishedSegment.Size
+				kept++
+			}
+			segments = append(segments, mediaSegment)
+		}
+		mediaStream.Segments = segments
+
+		// Streams whose playlist changed are given a new functional ID by the digest
+		publishedStream := publishedStreams[mediaStream.URL]
+		mediaStream.FunctionalID = publishedStream.FunctionalID
+		if kept != len(segments) || !reflect.DeepEqual(mediaStream, publishedStream) {
+			mediaStream.FunctionalID = ""
+			unchanged = false
+		}
+		streams = append(streams, mediaStream)
+	}
+	revision.Streams = streams
+	revision.FunctionalID = previous.FunctionalID
+	if !unchanged || !reflect.DeepEqual(revision, previous) {
+		revision.FunctionalID = ""
+	}
+
+	ingest := MediaIngest{Type: VODMediaType, Result: revision}
+	if err = observer.AddTotal(ingestSize(ingest)); err != nil {
+		RemoveIngestArtifacts(ingest)
+		return MediaDigest{}, err
+	}
+	mediaMap, size, err := a.digestManifest(block, revision, observer)
+	if err != nil {
+		return MediaDigest{}, fmt.Errorf("failed to digest manifest revision: %w", err)
+	}
+	return MediaDigest{
+		Type:         VODMediaType,
+		CryptKey:     cryptKey,
+		FunctionalID: mediaMap.FunctionalID,
+		ByteSize:     size,
+		Result:       mediaMap,
+	}, nil
+}
+
+/*
+readPublishedManifest reads the complete manifest published for url and the
+content key it was digested with. Returns an error wrapping fs.ErrNotExist if
+no manifest was published for url
+*/
+func (q *ProcessingQueue) readPublishedManifest(url string) (VODManifest, []byte, error) {
+	name := infra.URLToSafeName(url)
+	var serialMediaMap bytes.Buffer
+	if err := q.published.ReadObject(path.Join(infra.CompleteMediaMapDir, name), &serialMediaMap); err != nil {
+		return VODManifest{}, nil, fmt.Errorf("failed to read published manifest of %s: %w", url, err)
+	}
+	var mediaMap VODManifest
+	if err := json.Unmarshal(serialMediaMap.Bytes(), &mediaMap); err != nil {
+		return VODManifest{}, nil, fmt.Errorf("failed to parse published manifest of %s: %w", url, err)
+	}
+
+	// Raw media definitions share the location but have no streams
+	if len(mediaMap.Streams) == 0 {
+		return VODManifest{}, nil, fmt.Errorf("content published for %s is not a manifest: %w", url, fs.ErrNotExist)
+	}
+
+	var wrapped bytes.Buffer
+	if err := q.published.ReadObject(path.Join(infra.AESKeyStorageDir, name), &wrapped); err != nil {
+		return VODManifest{}, nil, fmt.Errorf("failed to read published key of %s: %w", url, err)
+	}
+	key, err := q.kek.Unwrap(wrapped.Bytes(), name)
+	if err != nil {
+		return VODManifest{}, nil, err
+	}
+	return mediaMap, key, nil
+}
+
+/*
+digestUpdate digests the ingest of an update job for cid against the manifest
+published for it. Content that isn't a published manifest is digested in full
+*/
+func (q *ProcessingQueue) digestUpdate(cid string, ingest MediaIngest, observer ProgressObserver) (MediaDigest, error) {
+	revision, ok := ingest.Result.(VODManifest)
+	if !ok {
+		return digestObserved(q.processor, ingest, observer)
+	}
+	if q.published == nil {
+		RemoveIngestArtifacts(ingest)
+		return MediaDigest{}, fmt.Errorf("failed to digest update of %s: update ingestion is not enabled", cid)
+	}
+
+	previous, key, err := q.readPublishedManifest(revision.URL)
+	if errors.Is(err, fs.ErrNotExist) {
+		return digestObserved(q.processor, ingest, observer)
+	}
+	if err != nil {
+		RemoveIngestArtifacts(ingest)
+		return MediaDigest{}, fmt.Errorf("failed to digest update of %s: %w", cid, err)
+	}
+	return q.revisionProcessor.DigestManifestRevision(key, previous, revision, observer)
+}
@@ -0,0 +1,156 @@
+package cyprus
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+	"github.com/Apiara/ApiaraCDN/infrastructure/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDigestManifestRevision(t *testing.T) {
+	workingDir := t.TempDir()
+	processor, err := NewAESDataProcessor(DefaultAESKeySize, workingDir)
+	assert.Nil(t, err, "should not return error")
+
+	// ingestManifest creates a manifest with segment files holding the data by segment URL of every stream
+	ingestManifest := func(streams map[string][]string, data map[string]string) VODManifest {
+		mediaMap := VODManifest{URL: "master.m3u8", Format: HLSManifestFormat}
+		for _, streamURL := range []string{"a.m3u8", "b.m3u8"} {
+			mediaStream := VODStream{URL: streamURL, Bandwidth: 1000}
+			for i, segmentURL := range streams[streamURL] {
+				segmentFile := filepath.Join(workingDir, "ingest_"+streamURL+segmentURL)
+				os.WriteFile(segmentFile, []byte(data[segmentURL]), 0644)
+				mediaStream.Segments = append(mediaStream.Segments,
+					VODSegment{Index: i, URL: segmentURL, Duration: 1, File: segmentFile})
+			}
+			mediaMap.Streams = append(mediaMap.Streams, mediaStream)
+		}
+		return mediaMap
+	}
+	streams := map[string][]string{"a.m3u8": {"a0.ts", "a1.ts", "a2.ts"}, "b.m3u8": {"b0.ts"}}
+	data := map[string]string{"a0.ts": "a0", "a1.ts": "a1", "a2.ts": "a2", "a3.ts": "a3", "b0.ts": "b0"}
+	digest, err := processor.DigestMedia(MediaIngest{Type: VODMediaType, Result: ingestManifest(streams, data)})
+	assert.Nil(t, err, "should not return error")
+
+	// Revisions are diffed against the manifest as published
+	var previous VODManifest
+	serialMediaMap, _ := json.Marshal(digest.Result)
+	assert.Nil(t, json.Unmarshal(serialMediaMap, &previous), "should not return error")
+	for _, segment := range previous.Streams[0].Segments {
+		assert.NotEmpty(t, segment.Fingerprint, "expected segment to be fingerprinted")
+		assert.NotEqual(t, int64(0), segment.Size, "expected segment size")
+	}
+
+	// Identical content keeps every functional ID
+	revision := ingestManifest(streams, data)
+	unchanged, err := processor.DigestManifestRevision(digest.CryptKey, previous, revision, nopProgressObserver{})
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, previous.FunctionalID, unchanged.FunctionalID, "expected manifest functional ID to be kept")
+	assert.Equal(t, digest.ByteSize, unchanged.ByteSize, "wrong byte size")
+	for i, segment := range unchanged.Result.(VODManifest).Streams[0].Segments {
+		assert.Equal(t, previous.Streams[0].Segments[i].FunctionalID, segment.FunctionalID, "expected segment to be kept")
+		assert.Empty(t, segment.File, "expected kept segment to have no file")
+		_, err = os.Stat(revision.Streams[0].Segments[i].File)
+		assert.True(t, os.IsNotExist(err), "expected ingest file of kept segment to be removed")
+	}
+
+	// Changed and added segments are digested while removed ones are dropped
+	data["a1.ts"] = "a1 changed"
+	streams["a.m3u8"] = []string{"a0.ts", "a1.ts", "a3.ts"}
+	changed, err := processor.DigestManifestRevision(digest.CryptKey, previous, ingestManifest(streams, data),
+		nopProgressObserver{})
+	assert.Nil(t, err, "should not return error")
+	mediaMap := changed.Result.(VODManifest)
+	assert.NotEqual(t, previous.FunctionalID, mediaMap.FunctionalID, "expected changed manifest to get a new functional ID")
+	assert.NotEqual(t, previous.Streams[0].FunctionalID, mediaMap.Streams[0].FunctionalID,
+		"expected changed stream to get a new functional ID")
+	assert.Equal(t, previous.Streams[1].FunctionalID, mediaMap.Streams[1].FunctionalID,
+		"expected unchanged stream to keep its functional ID")
+	segments := mediaMap.Streams[0].Segments
+	assert.Equal(t, previous.Streams[0].Segments[0].FunctionalID, segments[0].FunctionalID, "expected segment to be kept")
+	assert.Empty(t, segments[0].File, "expected kept segment to have no file")
+	for _, segment := range segments[1:] {
+		assert.NotEmpty(t, segment.File, "expected segment to be digested")
+		for _, published := range previous.Streams[0].Segments {
+			assert.NotEqual(t, published.FunctionalID, segment.FunctionalID, "expected segment to get a new functional ID")
+		}
+	}
+	assert.Equal(t, segments[0].Size+segments[1].Size+segments[2].Size+mediaMap.Streams[1].Segments[0].Size,
+		changed.ByteSize, "wrong byte size")
+}
+
+func TestProcessingQueueUpdate(t *testing.T) {
+	origin := newLiveOrigin()
+	workingDir := t.TempDir()
+	storageDir := t.TempDir()
+	preprocessor := &HLSPreprocessor{outputDir: workingDir, retrieveFile: origin.retrieve}
+	processor, err := NewAESDataProcessor(DefaultAESKeySize, workingDir)
+	assert.Nil(t, err, "should not return error")
+	kek, _ := newKeyEncryptionKey(make([]byte, kekSize))
+	storage, err := NewFilesystemStorageManager(storageDir, state.NewMockMicroserviceState(), kek)
+	assert.Nil(t, err, "should not return error")
+
+	conf := ProcessingQueueConfig{RecordDir: t.TempDir(), Workers: 1, Retention: time.Hour}
+	queue, err := NewProcessingQueue(conf, preprocessor, processor, storage)
+	assert.Nil(t, err, "should not return error")
+	_, err = queue.SubmitUpdate("live/vod.m3u8", "")
+	assert.NotNil(t, err, "expected update ingestion to require published content")
+
+	conf.Published, conf.KEK = NewFilesystemStorageReader(storageDir), kek
+	_, err = NewProcessingQueue(conf, preprocessor, &mockQueueProcessor{}, storage)
+	assert.NotNil(t, err, "expected update ingestion to require a RevisionDataProcessor")
+	queue, err = NewProcessingQueue(conf, preprocessor, processor, storage)
+	assert.Nil(t, err, "should not return error")
+
+	// publishedSegments returns the functional IDs of the segments published for cid
+	publishedSegments := func(cid string) []string {
+		var mediaMap VODManifest
+		serialMediaMap, err := os.ReadFile(filepath.Join(storageDir, infra.CompleteMediaMapDir, infra.URLToSafeName(cid)))
+		assert.Nil(t, err, "should not return error")
+		assert.Nil(t, json.Unmarshal(serialMediaMap, &mediaMap), "should not return error")
+		fids := make([]string, 0)
+		for _, segment := range mediaMap.Streams[0].Segments {
+			fids = append(fids, segment.FunctionalID)
+		}
+		return fids
+	}
+	segmentPublished := func(fid string) bool {
+		_, err := os.Stat(filepath.Join(storageDir, infra.CryptDataStorageDir, fid))
+		return err == nil
+	}
+
+	// Content that was never published is digested in full
+	origin.set("live/vod.m3u8", liveMediaPlaylist(hlsPlaylistTypeVOD, 0, true, "seg0.mp4", "seg1.mp4", "seg2.mp4"))
+	created, err := queue.SubmitUpdate("live/vod.m3u8", "")
+	assert.Nil(t, err, "should not return error")
+	assert.True(t, created, "expected job to be created")
+	assert.Equal(t, infra.FinishedProcessing, waitForStatus(t, queue, "live/vod.m3u8"), "expected job to finish")
+	response, _ := queue.Status("live/vod.m3u8")
+	published := publishedSegments("live/vod.m3u8")
+	assert.Len(t, published, 3, "wrong number of published segments")
+
+	// Updates only republish what changed and purge what was removed
+	origin.set("live/seg1.mp4", "changed data of seg1.mp4")
+	origin.set("live/vod.m3u8", liveMediaPlaylist(hlsPlaylistTypeVOD, 0, true, "seg0.mp4", "seg1.mp4"))
+	_, err = queue.SubmitUpdate("live/vod.m3u8", "")
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, infra.FinishedProcessing, waitForStatus(t, queue, "live/vod.m3u8"), "expected job to finish")
+	updated, _ := queue.Status("live/vod.m3u8")
+	assert.NotEqual(t, response.Metadata.FunctionalID, updated.Metadata.FunctionalID,
+		"expected changed content to get a new functional ID")
+	revised := publishedSegments("live/vod.m3u8")
+	assert.Len(t, revised, 2, "wrong number of published segments")
+	assert.Equal(t, published[0], revised[0], "expected unchanged segment to keep its functional ID")
+	assert.NotEqual(t, published[1], revised[1], "expected changed segment to get a new functional ID")
+	assert.True(t, segmentPublished(revised[0]), "expected unchanged segment to stay published")
+	assert.True(t, segmentPublished(revised[1]), "expected changed segment to be published")
+	assert.False(t, segmentPublished(published[1]), "expected replaced segment to be purged")
+	assert.False(t, segmentPublished(published[2]), "expected removed segment to be purged")
+	_, err = os.Stat(filepath.Join(storageDir, infra.PartialMapDir, response.Metadata.FunctionalID))
+	assert.True(t, os.IsNotExist(err), "expected replaced manifest to be purged")
+}
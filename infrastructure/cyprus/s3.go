@@ -0,0 +1,401 @@
+package cyprus
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3Service         = "s3"
+	s3SigningAlgo     = "AWS4-HMAC-SHA256"
+	s3DateFormat      = "20060102T150405Z"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+	// sha256 of an empty payload
+	s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// Bounds how much of an error response is read into an error message
+	s3MaxErrorBody = 1024
+)
+
+/*
+S3Config configures an S3ObjectStore. Endpoint is the base URL of the S3
+compatible API, e.g. https://s3.us-east-1.amazonaws.com or a local MinIO,
+and objects are addressed path style under Bucket
+*/
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Timeout   time.Duration
+}
+
+/*
+S3ObjectStore implements ObjectStore on top of a bucket of an S3 compatible
+object storage API. Requests are signed with AWS Signature Version 4 and
+object keys are the logical names with the leading slash removed
+*/
+type S3ObjectStore struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	now       func() time.Time
+}
+
+// NewS3ObjectStore creates a new S3ObjectStore from conf
+func NewS3ObjectStore(conf S3Config) (*S3ObjectStore, error) {
+	endpoint, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse S3 endpoint %s: %w", conf.Endpoint, err)
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("S3 endpoint %s must be an absolute URL", conf.Endpoint)
+	}
+	if conf.Bucket == "" {
+		return nil, fmt.Errorf("S3 object store requires a bucket")
+	}
+	if conf.Region == "" {
+		conf.Region = "us-east-1"
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = time.Minute
+	}
+
+	return &S3ObjectStore{
+		endpoint:  endpoint,
+		bucket:    conf.Bucket,
+		region:    conf.Region,
+		accessKey: conf.AccessKey,
+		secretKey: conf.SecretKey,
+		client:    &http.Client{Timeout: conf.Timeout},
+		now:       time.Now,
+	}, nil
+}
+
+// s3Escape URI encodes s as required by Signature Version 4, leaving '/' alone unless encodeSlash is set
+func s3Escape(s string, encodeSlash bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			escaped.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+// objectURL returns the path style URL of the object stored under name
+func (s *S3ObjectStore) objectURL(name string) (*url.URL, error) {
+	key := strings.TrimPrefix(cleanObjectName(name), "/")
+	objectPath := strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + "/" +
+		s3Escape(s.bucket, true) + "/" + s3Escape(key, false)
+	return url.Parse(s.endpoint.Scheme + "://" + s.endpoint.Host + objectPath)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalS3Query returns the query of u in Signature Version 4 canonical form
+func canonicalS3Query(u *url.URL) string {
+	query := u.Query()
+	pairs := make([]string, 0, len(query))
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+/*
+signS3Request adds Signature Version 4 authentication for the credentials
+to req at time now. All headers already set on req are signed along with the host
+*/
+func signS3Request(req *http.Request, payloadHash string, region string, accessKey string,
+	secretKey string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(s3DateFormat)
+	shortDate := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Canonicalize headers
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// Create string to sign from canonical request
+	canonicalPath := req.URL.EscapedPath()
+	if canonicalPath == "" {
+		canonicalPath = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath,
+		canonicalS3Query(req.URL),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := strings.Join([]string{shortDate, region, s3Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{s3SigningAlgo, amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	// Derive scoped signing key and sign
+	signingKey := hmacSHA256([]byte("AWS4"+secretKey), shortDate)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, s3Service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SigningAlgo, accessKey, scope, signedHeaders, signature))
+}
+
+// do sends a signed request with the extra headers in header for the object stored under name
+func (s *S3ObjectStore) do(method string, name string, header http.Header, body io.Reader,
+	size int64) (*http.Response, error) {
+	objectURL, err := s.objectURL(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create URL for object %s: %w", name, err)
+	}
+
+	/* Empty bodies are sent as http.NoBody, otherwise a non nil reader with
+	a zero length makes the client fall back to chunked encoding S3 rejects */
+	if body != nil && size == 0 {
+		body = http.NoBody
+	}
+	req, err := http.NewRequest(method, objectURL.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s request for object %s: %w", method, name, err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	resp, err := s.send(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to %s object %s: %w", method, name, err)
+	}
+	return resp, nil
+}
+
+// send signs and sends req, whose body is streamed rather than hashed up front
+func (s *S3ObjectStore) send(req *http.Request) (*http.Response, error) {
+	payloadHash := s3EmptyPayloadHash
+	if req.Body != nil && req.Body != http.NoBody {
+		payloadHash = s3UnsignedPayload
+	}
+	signS3Request(req, payloadHash, s.region, s.accessKey, s.secretKey, s.now())
+	return s.client.Do(req)
+}
+
+// s3StatusError creates an error describing the failed response to a request for name
+func s3StatusError(method string, name string, resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("failed to %s object %s: %w", method, name, fs.ErrNotExist)
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, s3MaxErrorBody))
+	return fmt.Errorf("failed to %s object %s: bad HTTP status %s: %s", method, name, resp.Status,
+		strings.TrimSpace(string(body)))
+}
+
+// ReadObject writes the object stored under name to out
+func (s *S3ObjectStore) ReadObject(name string, out io.Writer) error {
+	resp, err := s.do(http.MethodGet, name, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3StatusError(http.MethodGet, name, resp)
+	}
+
+	if _, err = io.Copy(out, resp.Body); err != nil {
+		return fmt.Errorf("failed to read object %s: %w", name, err)
+	}
+	return nil
+}
+
+// StatObject describes the object stored under name, versioned by the entity tag the store assigned it
+func (s *S3ObjectStore) StatObject(name string) (ObjectInfo, error) {
+	resp, err := s.do(http.MethodHead, name, nil, nil, 0)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ObjectInfo{}, s3StatusError(http.MethodHead, name, resp)
+	}
+	if resp.ContentLength < 0 {
+		return ObjectInfo{}, fmt.Errorf("failed to HEAD object %s: missing content length", name)
+	}
+	version := strings.Trim(strings.TrimPrefix(resp.Header.Get("ETag"), "W/"), `"`)
+	return ObjectInfo{Size: resp.ContentLength, Version: version}, nil
+}
+
+/*
+OpenObjectAt opens the object stored under name for reading from offset. The
+rest of the object is requested as a single range and streamed as it is read
+*/
+func (s *S3ObjectStore) OpenObjectAt(name string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := s.do(http.MethodGet, name, header, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		return nil, s3StatusError(http.MethodGet, name, resp)
+	}
+
+	// Stores ignoring the range send the whole object
+	if offset > 0 && resp.StatusCode == http.StatusOK {
+		if _, err = io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to skip to offset %d of object %s: %w", offset, name, err)
+		}
+	}
+	return resp.Body, nil
+}
+
+// s3ListResult is the part of a ListObjectsV2 response used by ListObjects
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// ListObjects returns the names of the objects stored under dir, following every page of the listing
+func (s *S3ObjectStore) ListObjects(dir string) ([]string, error) {
+	bucketURL, err := s.objectURL("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create URL for bucket %s: %w", s.bucket, err)
+	}
+	bucketURL.Path = strings.TrimSuffix(bucketURL.Path, "/")
+	bucketURL.RawPath = strings.TrimSuffix(bucketURL.RawPath, "/")
+	prefix := strings.TrimPrefix(cleanObjectName(dir), "/") + "/"
+
+	names := make([]string, 0)
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		bucketURL.RawQuery = query.Encode()
+		req, err := http.NewRequest(http.MethodGet, bucketURL.String(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request listing %s: %w", dir, err)
+		}
+		resp, err := s.send(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects in %s: %w", dir, err)
+		}
+
+		var result s3ListResult
+		if resp.StatusCode != http.StatusOK {
+			err = s3StatusError("LIST", dir, resp)
+		} else if decodeErr := xml.NewDecoder(resp.Body).Decode(&result); decodeErr != nil {
+			err = fmt.Errorf("failed to parse listing of %s: %w", dir, decodeErr)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		// Only objects directly under dir belong to it
+		for _, object := range result.Contents {
+			fname := strings.TrimPrefix(object.Key, prefix)
+			if fname != "" && !strings.Contains(fname, "/") {
+				names = append(names, path.Join(dir, fname))
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return names, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// WriteObject stores size bytes of data under name, replacing any existing object
+func (s *S3ObjectStore) WriteObject(name string, data io.Reader, size int64) error {
+	resp, err := s.do(http.MethodPut, name, nil, data, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return s3StatusError(http.MethodPut, name, resp)
+	}
+	return nil
+}
+
+// DeleteObject removes the object stored under name. Deleting a missing object is not an error
+func (s *S3ObjectStore) DeleteObject(name string) error {
+	resp, err := s.do(http.MethodDelete, name, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return s3StatusError(http.MethodDelete, name, resp)
+	}
+	return nil
+}
@@ -8,83 +8,61 @@ import (
 	infra "github.com/Apiara/ApiaraCDN/infrastructure"
 )
 
-/*
-handleProcessRequest goes through the preprocess, process, publish
-workflow while keeping track of progress and results via the jobTracker
-*/
-func handleProcessRequest(cid string, preprocessor DataPreprocessor,
-	processor DataProcessor, storage StorageManager, tracker *jobTracker) {
-
-	tracker.newJob(cid)
-	ingest, err := preprocessor.IngestMedia(cid)
-	if err != nil {
-		log.Println(err)
-		tracker.updateStatus(cid, infra.FailedProcessing)
-		return
-	}
-
-	digest, err := processor.DigestMedia(ingest)
-	if err != nil {
-		log.Println(err)
-		tracker.updateStatus(cid, infra.FailedProcessing)
-		return
-	}
-	tracker.updateResult(cid, &infra.PostProcessingMetadata{
-		FunctionalID: digest.FunctionalID,
-		ByteSize:     digest.ByteSize,
-	})
-
-	if err = storage.Publish(digest); err != nil {
-		log.Println(err)
-		tracker.updateStatus(cid, infra.FailedProcessing)
-		return
-	}
-	tracker.updateStatus(cid, infra.FinishedProcessing)
-}
-
 /*
 StartDataProcessingAPI starts the API used for processing and
 publishing data for use on the network
 */
-func StartDataProcessingAPI(listenAddr string, preprocessor DataPreprocessor,
-	processor DataProcessor, storage StorageManager) {
-	tracker := newJobTracker()
+func StartDataProcessingAPI(listenAddr string, queue *ProcessingQueue, storage StorageManager) {
 	processingAPI := http.NewServeMux()
 
 	// Start a new processing job
 	processingAPI.HandleFunc(infra.CyprusServiceAPIProcessResource,
 		func(resp http.ResponseWriter, req *http.Request) {
 			cid := req.URL.Query().Get(infra.ContentIDParam)
-			go handleProcessRequest(cid, preprocessor, processor, storage, tracker)
+			callbackURL := req.URL.Query().Get(infra.ProcessingCallbackParam)
+			submit := queue.Submit
+			if req.URL.Query().Get(infra.LiveIngestParam) == "true" {
+				submit = queue.SubmitLive
+			} else if req.URL.Query().Get(infra.UpdateIngestParam) == "true" {
+				submit = queue.SubmitUpdate
+			}
+			if _, err := submit(cid, callbackURL); err != nil {
+				log.Println(err)
+				resp.WriteHeader(http.StatusInternalServerError)
+			}
 		})
 
-	// Check status of a processing job and retrieve results
+	// Check status and progress of a processing job and retrieve results
 	processingAPI.HandleFunc(infra.CyprusServiceAPIStatusResource,
 		func(resp http.ResponseWriter, req *http.Request) {
 			cid := req.URL.Query().Get(infra.ContentIDParam)
-			status, err := tracker.status(cid)
+			response, err := queue.Status(cid)
 			if err != nil {
 				log.Println(err)
 				resp.WriteHeader(http.StatusInternalServerError)
 				return
 			}
 
-			response := infra.StatusResponse{Status: status}
-			switch status {
-			case infra.FinishedProcessing:
-				metadata, err := tracker.result(cid)
-				if err != nil {
-					log.Println(err)
-					resp.WriteHeader(http.StatusInternalServerError)
-					return
-				}
-				response.Metadata = metadata
-				tracker.free(cid)
-			case infra.FailedProcessing:
-				tracker.free(cid)
+			if err = json.NewEncoder(resp).Encode(&response); err != nil {
+				log.Println(err)
+				resp.WriteHeader(http.StatusInternalServerError)
+			}
+		})
+
+	// List all running and recently completed processing jobs
+	processingAPI.HandleFunc(infra.CyprusServiceAPIJobsResource,
+		func(resp http.ResponseWriter, req *http.Request) {
+			if err := json.NewEncoder(resp).Encode(queue.List()); err != nil {
+				log.Println(err)
+				resp.WriteHeader(http.StatusInternalServerError)
 			}
+		})
 
-			if err = json.NewEncoder(resp).Encode(&response); err != nil {
+	// Stop a running processing job and remove its temporary files
+	processingAPI.HandleFunc(infra.CyprusServiceAPICancelResource,
+		func(resp http.ResponseWriter, req *http.Request) {
+			cid := req.URL.Query().Get(infra.ContentIDParam)
+			if err := queue.Cancel(cid); err != nil {
 				log.Println(err)
 				resp.WriteHeader(http.StatusInternalServerError)
 			}
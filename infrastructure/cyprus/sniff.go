@@ -0,0 +1,68 @@
+package cyprus
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+)
+
+// Number of bytes fetched from the start of media to recognize it by
+const sniffLength = 4096
+
+const (
+	dashContentType      = "application/dash+xml"
+	mp4ContentType       = "video/mp4"
+	quickTimeContentType = "video/quicktime"
+)
+
+// Names content types are mapped to preprocessors by in configuration
+const (
+	RawPreprocessorName  = "raw"
+	HLSPreprocessorName  = "hls"
+	DASHPreprocessorName = "dash"
+)
+
+/*
+DefaultContentTypes maps the content types of supported media to the names of
+the preprocessors handling them, for routing media without a known extension
+*/
+var DefaultContentTypes = map[string]string{
+	hlsPlaylistContentType:  HLSPreprocessorName,
+	"application/x-mpegurl": HLSPreprocessorName,
+	"audio/mpegurl":         HLSPreprocessorName,
+	"audio/x-mpegurl":       HLSPreprocessorName,
+	dashContentType:         DASHPreprocessorName,
+	mp4ContentType:          RawPreprocessorName,
+	quickTimeContentType:    RawPreprocessorName,
+}
+
+// normalizeContentType strips the parameters of contentType and lowercases it
+func normalizeContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return mediaType
+}
+
+/*
+sniffContentType identifies media by the magic bytes at the start of head,
+returning an empty string if it isn't recognized. HLS playlists start with their
+header tag, DASH manifests are XML with an MPD root and MP4 and QuickTime files
+start with an ftyp box
+*/
+func sniffContentType(head []byte) string {
+	text := bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")), " \t\r\n")
+	switch {
+	case bytes.HasPrefix(text, []byte("#EXTM3U")):
+		return hlsPlaylistContentType
+	case bytes.HasPrefix(text, []byte("<")) && bytes.Contains(text, []byte("<MPD")):
+		return dashContentType
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		if string(head[8:12]) == "qt  " {
+			return quickTimeContentType
+		}
+		return mp4ContentType
+	}
+	return ""
+}
@@ -0,0 +1,79 @@
+package cyprus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// routedPreprocessor identifies the preprocessor a CompoundPreprocessor routed to
+type routedPreprocessor string
+
+func (r routedPreprocessor) IngestMedia(url string) (MediaIngest, error) {
+	return MediaIngest{Result: string(r)}, nil
+}
+
+func TestSniffContentType(t *testing.T) {
+	assert.Equal(t, hlsPlaylistContentType, sniffContentType([]byte("\xef\xbb\xbf#EXTM3U\n#EXT-X-VERSION:3\n")),
+		"expected HLS playlist")
+	assert.Equal(t, dashContentType, sniffContentType([]byte("<?xml version=\"1.0\"?>\n<MPD xmlns=\"urn:mpeg:dash\">")),
+		"expected DASH manifest")
+	assert.Equal(t, mp4ContentType, sniffContentType([]byte("\x00\x00\x00\x20ftypisom\x00\x00\x02\x00")), "expected MP4")
+	assert.Equal(t, quickTimeContentType, sniffContentType([]byte("\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00")),
+		"expected QuickTime")
+	assert.Equal(t, "", sniffContentType([]byte("<html><body>not media</body></html>")), "expected unknown content")
+	assert.Equal(t, "", sniffContentType(nil), "expected unknown content")
+}
+
+func TestCompoundPreprocessorRouting(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/live":
+			resp.Header().Set("Content-Type", "application/x-mpegURL; charset=utf-8")
+			resp.Write([]byte("#EXTM3U\n"))
+		case "/manifest":
+			resp.Header().Set("Content-Type", "application/octet-stream")
+			resp.Write([]byte("<?xml version=\"1.0\"?><MPD></MPD>"))
+		case "/video":
+			resp.Header().Set("Content-Type", "application/octet-stream")
+			resp.Write([]byte("\x00\x00\x00\x20ftypmp42\x00\x00\x00\x00"))
+		case "/page":
+			resp.Header().Set("Content-Type", "text/html")
+			resp.Write([]byte("<html></html>"))
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	preprocessor := NewCompoundPreprocessor(map[string]DataPreprocessor{
+		".m3u8": routedPreprocessor("hls"),
+		".MP4":  routedPreprocessor("raw"),
+	})
+	route := func(url string) string {
+		ingest, err := preprocessor.IngestMedia(url)
+		if err != nil {
+			return err.Error()
+		}
+		return ingest.Result.(string)
+	}
+
+	// Extensions are matched without query strings and case
+	assert.Equal(t, "hls", route("https://cdn.com/title/master.m3u8?Expires=1700000000&Signature=abc"), "wrong route")
+	assert.Equal(t, "raw", route("https://cdn.com/title/video.mp4#t=10"), "wrong route")
+	assert.Contains(t, route(server.URL+"/live"), "failed to find proper preprocessor", "expected sniffing to be disabled")
+
+	// Media without a known extension is routed by declared content type, then by magic bytes
+	preprocessor.EnableContentSniffing(map[string]DataPreprocessor{
+		"application/x-mpegurl": routedPreprocessor("hls"),
+		dashContentType:         routedPreprocessor("dash"),
+		mp4ContentType:          routedPreprocessor("raw"),
+	}, NewDownloader(DownloaderConfig{MaxAttempts: 1}))
+	assert.Equal(t, "hls", route(server.URL+"/live"), "expected declared content type to be used")
+	assert.Equal(t, "dash", route(server.URL+"/manifest?token=abc"), "expected magic bytes to be used")
+	assert.Equal(t, "raw", route(server.URL+"/video"), "expected magic bytes to be used")
+	assert.Contains(t, route(server.URL+"/page"), "text/html", "expected unknown content to be rejected")
+	assert.Contains(t, route(server.URL+"/missing"), "failed to sniff", "expected unreachable content to be rejected")
+}
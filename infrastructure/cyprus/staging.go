@@ -0,0 +1,115 @@
+package cyprus
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+)
+
+const (
+	stagingDirName    = ".staging"
+	stagingDirPattern = "publish_*"
+	commitRecordName  = "commit.json"
+)
+
+/*
+publishCommit is the record written once every resource of a publish is staged.
+Names are the resource paths relative to the storage dir, in the order they are
+moved into place
+*/
+type publishCommit struct {
+	URL          string   `json:"url"`
+	FunctionalID string   `json:"fid"`
+	ByteSize     int64    `json:"bytes"`
+	Names        []string `json:"names"`
+}
+
+// stagedPublish is a staging directory mirroring the storage layout for a single publish
+type stagedPublish struct {
+	dir    string
+	names  []string
+	staged map[string]bool
+}
+
+// newStagedPublish creates a new staging directory in stagingRoot
+func newStagedPublish(stagingRoot string) (*stagedPublish, error) {
+	dir, err := os.MkdirTemp(stagingRoot, stagingDirPattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging dir: %w", err)
+	}
+	for _, subdir := range storageLayoutDirs {
+		if err = os.MkdirAll(path.Join(dir, subdir), 0755); err != nil {
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("failed to create staging dir: %w", err)
+		}
+	}
+	return &stagedPublish{dir: dir, names: make([]string, 0), staged: make(map[string]bool)}, nil
+}
+
+/*
+stage records name as part of the publish and returns the path it should be
+staged at. Staging a name twice, as convergent segments repeated in a manifest
+do, records it once
+*/
+func (p *stagedPublish) stage(name string) string {
+	if !p.staged[name] {
+		p.staged[name] = true
+		p.names = append(p.names, name)
+	}
+	return path.Join(p.dir, name)
+}
+
+/*
+keep records name as part of the publish without staging it, for resources an
+earlier publish of the same content already moved into place
+*/
+func (p *stagedPublish) keep(name string) {
+	p.stage(name)
+}
+
+// commit atomically writes the commit record, after which the publish is completed even across a crash
+func (p *stagedPublish) commit(commit publishCommit) error {
+	serialCommit, err := json.Marshal(commit)
+	if err != nil {
+		return fmt.Errorf("failed to serialize commit record: %w", err)
+	}
+	tmpFile, err := os.CreateTemp(p.dir, commitRecordName+"_*")
+	if err != nil {
+		return fmt.Errorf("failed to create commit record: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err = tmpFile.Write(serialCommit); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write commit record: %w", err)
+	}
+	if err = tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to sync commit record: %w", err)
+	}
+	if err = tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to write commit record: %w", err)
+	}
+	return os.Rename(tmpFile.Name(), path.Join(p.dir, commitRecordName))
+}
+
+// discard removes the staging directory and everything staged in it
+func (p *stagedPublish) discard() {
+	if err := os.RemoveAll(p.dir); err != nil {
+		log.Println(err)
+	}
+}
+
+// readPublishCommit reads the commit record of the staging directory dir
+func readPublishCommit(dir string) (publishCommit, error) {
+	var commit publishCommit
+	serialCommit, err := os.ReadFile(path.Join(dir, commitRecordName))
+	if err != nil {
+		return commit, err
+	}
+	if err = json.Unmarshal(serialCommit, &commit); err != nil {
+		return commit, fmt.Errorf("failed to parse commit record in %s: %w", dir, err)
+	}
+	return commit, nil
+}
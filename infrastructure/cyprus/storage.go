@@ -2,10 +2,14 @@ package cyprus
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"path"
+	"strings"
+	"sync"
 
 	infra "github.com/Apiara/ApiaraCDN/infrastructure"
 	"github.com/Apiara/ApiaraCDN/infrastructure/state"
@@ -15,9 +19,125 @@ const (
 	publishedFilePerms = 0644
 )
 
+// storageLayoutDirs are the subdirectories of the storage dir published resources are stored in
+var storageLayoutDirs = []string{
+	infra.AESKeyStorageDir,
+	infra.CryptDataStorageDir,
+	infra.PartialMapDir,
+	infra.CompleteMediaMapDir,
+	infra.IntegrityProofDir,
+	infra.PlaylistDir,
+}
+
+/*
+layoutName returns the name of a resource recorded in state relative to the
+storage dir it was published to, so resources match regardless of the path the
+storage dir was configured with
+*/
+func layoutName(resource string) (string, bool) {
+	dir := path.Dir(path.Clean(resource))
+	for _, layoutDir := range storageLayoutDirs {
+		if strings.HasSuffix(dir, strings.TrimSuffix(layoutDir, "/")) {
+			return path.Join(layoutDir, path.Base(resource)), true
+		}
+	}
+	return "", false
+}
+
+/*
+sharedResource returns whether resource may be shared between content, which
+is the case for encrypted data and its proofs once segments are convergent
+*/
+func sharedResource(resource string) bool {
+	name, ok := layoutName(resource)
+	return ok && (strings.HasPrefix(name, infra.CryptDataStorageDir) || strings.HasPrefix(name, infra.IntegrityProofDir))
+}
+
+/*
+resourceReferences reference counts resources shared between content in state.
+Adding references is serialized with releasing them and deleting the resources
+left unused, so a purge either deletes a resource before other content
+references it to publish it again, or sees that reference and keeps it
+*/
+type resourceReferences struct {
+	mutex        sync.Mutex
+	contentState state.ContentMetadataStateWriter
+}
+
+// newResourceReferences creates a resourceReferences counting references in contentState
+func newResourceReferences(contentState state.ContentMetadataStateWriter) *resourceReferences {
+	return &resourceReferences{contentState: contentState}
+}
+
+// add records cid as a user of every shared resource in resources
+func (r *resourceReferences) add(cid string, resources []string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, resource := range resources {
+		if !sharedResource(resource) {
+			continue
+		}
+		if _, err := r.contentState.AddResourceReference(resource, cid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unlistedResources returns the resources in previous that are not in current
+func unlistedResources(previous []string, current []string) []string {
+	listed := make(map[string]bool, len(current))
+	for _, resource := range current {
+		listed[resource] = true
+	}
+	unlisted := make([]string, 0)
+	for _, resource := range previous {
+		if !listed[resource] {
+			unlisted = append(unlisted, resource)
+		}
+	}
+	return unlisted
+}
+
+/*
+release drops the references cid holds on shared resources and deletes the
+resources no content uses anymore with purge. Shared resources whose reference
+can't be dropped are kept, since leaking a file is better than deleting one in use
+*/
+func (r *resourceReferences) release(cid string, resources []string, purge func([]string)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	unused := make([]string, 0, len(resources))
+	released := make(map[string]bool)
+	for _, resource := range resources {
+		if released[resource] {
+			continue
+		}
+		released[resource] = true
+		if !sharedResource(resource) {
+			unused = append(unused, resource)
+			continue
+		}
+
+		references, err := r.contentState.RemoveResourceReference(resource, cid)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if references == 0 {
+			unused = append(unused, resource)
+		}
+	}
+	purge(unused)
+}
+
 /*
 StorageManager represents an object that can publish the output of a MediaDigest
-to the data stores for use by client and endpoint resource retrieval APIs
+to the data stores for use by client and endpoint resource retrieval APIs.
+Publishing content again replaces what was published for it before, with
+manifest segments that have no File being kept as already published
 */
 type StorageManager interface {
 	Publish(digest MediaDigest) error
@@ -27,26 +147,41 @@ type StorageManager interface {
 
 /*
 FilesystemStorageManager implements StorageManager and uses filesystem
-directories to store the processed data
+directories to store the processed data. Each publish is staged in its own
+directory mirroring the storage layout and committed by atomically writing a
+commit record, so a crash never leaves content that is only partially published
 */
 type FilesystemStorageManager struct {
 	contentState   state.ContentMetadataState
+	references     *resourceReferences
+	storageDir     string
+	stagingDir     string
 	keyDir         string
 	dataDir        string
 	partialMapDir  string
 	completeMapDir string
+	proofDir       string
+	kek            *KeyEncryptionKey
 }
 
 /*
 NewFilesystemStorageManager creates a new FilesystemStorageManager where all
-data is stored in subdirectories of storageDir and indexed via state
+data is stored in subdirectories of storageDir and indexed via state. Content
+keys are stored wrapped by kek
 */
-func NewFilesystemStorageManager(storageDir string, contentState state.ContentMetadataState) (*FilesystemStorageManager, error) {
+func NewFilesystemStorageManager(storageDir string, contentState state.ContentMetadataState,
+	kek *KeyEncryptionKey) (*FilesystemStorageManager, error) {
+	if kek == nil {
+		return nil, fmt.Errorf("storage manager requires a key encryption key")
+	}
 	dirs := []string{
 		path.Join(storageDir, infra.AESKeyStorageDir),
 		path.Join(storageDir, infra.CryptDataStorageDir),
 		path.Join(storageDir, infra.PartialMapDir),
 		path.Join(storageDir, infra.CompleteMediaMapDir),
+		path.Join(storageDir, infra.IntegrityProofDir),
+		path.Join(storageDir, stagingDirName),
+		path.Join(storageDir, infra.PlaylistDir),
 	}
 	for _, dir := range dirs {
 		if err := os.MkdirAll(dir, 0755); err != nil {
@@ -56,108 +191,140 @@ func NewFilesystemStorageManager(storageDir string, contentState state.ContentMe
 
 	return &FilesystemStorageManager{
 		contentState:   contentState,
+		references:     newResourceReferences(contentState),
+		storageDir:     storageDir,
+		stagingDir:     dirs[5],
 		keyDir:         dirs[0],
 		dataDir:        dirs[1],
 		partialMapDir:  dirs[2],
 		completeMapDir: dirs[3],
+		proofDir:       dirs[4],
+		kek:            kek,
 	}, nil
 }
 
-// publishManifest publishes digested manifest resources to the appropriate data stores
-func (s *FilesystemStorageManager) publishManifest(mediaMap VODManifest, key []byte) ([]string, error) {
-	// Create list of all created resources
-	resources := make([]string, 0)
-
-	// Publish symmetric key
+// publishManifest stages digested manifest resources for publishing
+func (s *FilesystemStorageManager) publishManifest(staged *stagedPublish, mediaMap VODManifest, key []byte) error {
+	// Stage wrapped symmetric key
 	urlFname := infra.URLToSafeName(mediaMap.URL)
-	keyFname := path.Join(s.keyDir, urlFname)
-	if err := os.WriteFile(keyFname, key, publishedFilePerms); err != nil {
-		return resources, err
+	keyFname := staged.stage(path.Join(infra.AESKeyStorageDir, urlFname))
+	if err := writeWrappedKey(s.kek, key, keyFname); err != nil {
+		return err
 	}
-	resources = append(resources, keyFname)
 
-	// Publish encrypted segments
-	var err error
+	// Stage encrypted segments, keeping those published by an earlier publish of the content
 	for _, mediaStream := range mediaMap.Streams {
 		for _, mediaSegment := range mediaStream.Segments {
-			dataFname := path.Join(s.dataDir, mediaSegment.FunctionalID)
-			if err = os.Rename(mediaSegment.File, dataFname); err != nil {
-				return resources, err
+			if mediaSegment.File == "" {
+				keepSegment(staged, mediaSegment)
+				continue
+			}
+			dataFname := staged.stage(path.Join(infra.CryptDataStorageDir, mediaSegment.FunctionalID))
+			if err := os.Rename(mediaSegment.File, dataFname); err != nil {
+				return err
+			}
+			if err := s.publishProof(staged, mediaSegment.ProofFile, mediaSegment.FunctionalID); err != nil {
+				return err
 			}
-			resources = append(resources, dataFname)
 		}
 	}
 
-	// Publish complete map
-	completeMapFname := path.Join(s.completeMapDir, urlFname)
+	// Stage complete map
+	completeMapFname := staged.stage(path.Join(infra.CompleteMediaMapDir, urlFname))
 	serialCompleteMap, err := json.Marshal(mediaMap)
 	if err != nil {
-		return resources, err
+		return err
 	}
 	if err = os.WriteFile(completeMapFname, serialCompleteMap, publishedFilePerms); err != nil {
-		return resources, err
+		return err
 	}
-	resources = append(resources, completeMapFname)
 
-	// Publish partial map
-	partialMapFname := path.Join(s.partialMapDir, mediaMap.FunctionalID)
+	// Stage partial map
+	partialMapFname := staged.stage(path.Join(infra.PartialMapDir, mediaMap.FunctionalID))
 	partialMap := completeToPartialManifest(mediaMap)
 	serialPartialMap, err := json.Marshal(partialMap)
 	if err != nil {
-		return resources, err
+		return err
 	}
 	if err = os.WriteFile(partialMapFname, serialPartialMap, publishedFilePerms); err != nil {
-		return resources, err
+		return err
+	}
+	return s.publishPlaylists(staged, mediaMap)
+}
+
+// publishPlaylists stages the rewritten playlists of HLS manifests. Other formats are skipped
+func (s *FilesystemStorageManager) publishPlaylists(staged *stagedPublish, mediaMap VODManifest) error {
+	if mediaMap.Format != HLSManifestFormat {
+		return nil
+	}
+	playlists, err := renderHLSPlaylists(mediaMap)
+	if err != nil {
+		return err
 	}
-	resources = append(resources, partialMapFname)
+	for _, playlist := range playlists {
+		playlistFname := staged.stage(path.Join(infra.PlaylistDir, playlist.FunctionalID))
+		if err = os.WriteFile(playlistFname, playlist.Data, publishedFilePerms); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	return resources, nil
+// keepSegment records the already published data and proof of segment as part of the publish
+func keepSegment(staged *stagedPublish, segment VODSegment) {
+	staged.keep(path.Join(infra.CryptDataStorageDir, segment.FunctionalID))
+	if segment.MerkleRoot != "" {
+		staged.keep(path.Join(infra.IntegrityProofDir, segment.FunctionalID))
+	}
 }
 
-// publishRawMedia publishes the digested media data to the proper data stores
-func (s *FilesystemStorageManager) publishRawMedia(media RawMedia, key []byte) ([]string, error) {
-	// Create list of all created resources
-	resources := make([]string, 0)
+/*
+publishProof stages the integrity proof of the encrypted data stored under fid
+next to it. Data digested without a proof is skipped
+*/
+func (s *FilesystemStorageManager) publishProof(staged *stagedPublish, proofFile string, fid string) error {
+	if proofFile == "" {
+		return nil
+	}
+	return os.Rename(proofFile, staged.stage(path.Join(infra.IntegrityProofDir, fid)))
+}
 
-	// Publish symmetric key
+// publishRawMedia stages the digested media data for publishing
+func (s *FilesystemStorageManager) publishRawMedia(staged *stagedPublish, media RawMedia, key []byte) error {
+	// Stage wrapped symmetric key
 	urlFname := infra.URLToSafeName(media.URL)
-	keyFname := path.Join(s.keyDir, urlFname)
-	if err := os.WriteFile(keyFname, key, publishedFilePerms); err != nil {
-		return resources, err
+	keyFname := staged.stage(path.Join(infra.AESKeyStorageDir, urlFname))
+	if err := writeWrappedKey(s.kek, key, keyFname); err != nil {
+		return err
 	}
-	resources = append(resources, keyFname)
 
-	// Publish encrypted media file
-	dataFname := path.Join(s.dataDir, media.FunctionalID)
+	// Stage encrypted media file
+	dataFname := staged.stage(path.Join(infra.CryptDataStorageDir, media.FunctionalID))
 	if err := os.Rename(media.File, dataFname); err != nil {
-		return resources, err
+		return err
+	}
+	if err := s.publishProof(staged, media.ProofFile, media.FunctionalID); err != nil {
+		return err
 	}
-	resources = append(resources, dataFname)
 
-	// Publish complete media definition
-	mediaDefFname := path.Join(s.completeMapDir, urlFname)
+	// Stage complete media definition
+	mediaDefFname := staged.stage(path.Join(infra.CompleteMediaMapDir, urlFname))
 	serialMediaDef, err := json.Marshal(media)
 	if err != nil {
-		return resources, err
+		return err
 	}
 	if err = os.WriteFile(mediaDefFname, serialMediaDef, publishedFilePerms); err != nil {
-		return resources, err
+		return err
 	}
-	resources = append(resources, mediaDefFname)
 
-	// Publish partial media definition
+	// Stage partial media definition
 	pMedia := completeToPartialRawMedia(media)
-	pMediaDefFname := path.Join(s.partialMapDir, media.FunctionalID)
+	pMediaDefFname := staged.stage(path.Join(infra.PartialMapDir, media.FunctionalID))
 	serialPMedia, err := json.Marshal(pMedia)
 	if err != nil {
-		return resources, err
-	}
-	if err = os.WriteFile(pMediaDefFname, serialPMedia, publishedFilePerms); err != nil {
-		return resources, err
+		return err
 	}
-	resources = append(resources, pMediaDefFname)
-
-	return resources, nil
+	return os.WriteFile(pMediaDefFname, serialPMedia, publishedFilePerms)
 }
 
 // purgeFiles deletes all files specified in 'resources'
@@ -169,39 +336,117 @@ func (s *FilesystemStorageManager) purgeFiles(resources []string) {
 	}
 }
 
-// Publish publishes the output of a MediaDigest to the appropriate datastores
+/*
+applyCommit moves the files of a committed publish into place, records them in
+state and removes the staging directory. Shared files are referenced before they
+are moved, so a purge of other content that used them either deletes them before
+they are referenced or keeps them. Files already moved by an interrupted attempt are skipped, so a commit can be
+applied again until it succeeds. Files of an earlier publish of the same content
+that are no longer listed are purged
+*/
+func (s *FilesystemStorageManager) applyCommit(stagingDir string, commit publishCommit) error {
+	resources := make([]string, 0, len(commit.Names))
+	for _, name := range commit.Names {
+		resources = append(resources, path.Join(s.storageDir, name))
+	}
+	// Content published for the first time has no previous resources
+	previous, err := s.contentState.GetContentResources(commit.URL)
+	if err != nil {
+		previous = nil
+	}
+	if err := s.references.add(commit.URL, resources); err != nil {
+		return fmt.Errorf("failed to reference shared resources of %s: %w", commit.URL, err)
+	}
+
+	for i, name := range commit.Names {
+		err := os.Rename(path.Join(stagingDir, name), resources[i])
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to publish %s: %w", resources[i], err)
+		}
+	}
+
+	err = s.contentState.CreateContentEntry(commit.URL, commit.FunctionalID, commit.ByteSize, resources)
+	if err != nil {
+		return err
+	}
+	s.references.release(commit.URL, unlistedResources(previous, resources), s.purgeFiles)
+	return os.RemoveAll(stagingDir)
+}
+
+/*
+Publish publishes the output of a MediaDigest to the appropriate datastores,
+replacing any earlier publish of the same content. Nothing becomes visible until
+every resource is staged, and a failure after the publish is committed is
+completed by the next Recover
+*/
 func (s *FilesystemStorageManager) Publish(digest MediaDigest) error {
-	var err error
-	var url string
-	var fid string
-	var resources []string
+	staged, err := newStagedPublish(s.stagingDir)
+	if err != nil {
+		return err
+	}
 
-	// Publish digest based on MediaType
+	// Stage digest based on MediaType
+	commit := publishCommit{ByteSize: digest.ByteSize}
 	switch digest.Type {
 	case RawMediaType:
 		media := digest.Result.(RawMedia)
-		url = media.URL
-		fid = media.FunctionalID
-		resources, err = s.publishRawMedia(media, digest.CryptKey)
+		commit.URL = media.URL
+		commit.FunctionalID = media.FunctionalID
+		err = s.publishRawMedia(staged, media, digest.CryptKey)
 	case VODMediaType:
 		mediaManifest := digest.Result.(VODManifest)
-		url = mediaManifest.URL
-		fid = mediaManifest.FunctionalID
-		resources, err = s.publishManifest(mediaManifest, digest.CryptKey)
+		commit.URL = mediaManifest.URL
+		commit.FunctionalID = mediaManifest.FunctionalID
+		err = s.publishManifest(staged, mediaManifest, digest.CryptKey)
 	default:
-		return fmt.Errorf("failed to publish. MediaType %d does not exist", digest.Type)
+		err = fmt.Errorf("failed to publish. MediaType %d does not exist", digest.Type)
 	}
 
-	// Purge all created resources if anything failed
+	// Discard everything staged if anything failed
 	if err != nil {
-		s.purgeFiles(resources)
+		staged.discard()
 		return err
 	}
 
-	// Publish state update to state index
-	if err = s.contentState.CreateContentEntry(url, fid, digest.ByteSize, resources); err != nil {
+	// Commit, then move resources into place and publish state update to state index
+	commit.Names = staged.names
+	if err = staged.commit(commit); err != nil {
+		staged.discard()
 		return err
 	}
+	return s.applyCommit(staged.dir, commit)
+}
+
+/*
+Recover completes publishes that were committed before a crash and deletes the
+staging directories of any that weren't. It must run before anything is
+published, normally at startup
+*/
+func (s *FilesystemStorageManager) Recover() error {
+	entries, err := os.ReadDir(s.stagingDir)
+	if err != nil {
+		return fmt.Errorf("failed to list staged publishes in %s: %w", s.stagingDir, err)
+	}
+
+	for _, entry := range entries {
+		stagingDir := path.Join(s.stagingDir, entry.Name())
+		commit, err := readPublishCommit(stagingDir)
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Discarding uncommitted publish %s\n", stagingDir)
+			if err = os.RemoveAll(stagingDir); err != nil {
+				return fmt.Errorf("failed to discard uncommitted publish %s: %w", stagingDir, err)
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Completing committed publish of %s\n", commit.URL)
+		if err = s.applyCommit(stagingDir, commit); err != nil {
+			return fmt.Errorf("failed to complete publish of %s: %w", commit.URL, err)
+		}
+	}
 	return nil
 }
 
@@ -210,12 +455,12 @@ purge removes all filesystem resources created for a URL/FID
 as well as deletes all associated indexed information
 */
 func (s *FilesystemStorageManager) purge(url string) error {
-	// Purge resource files
+	// Purge resource files no other content shares
 	resources, err := s.contentState.GetContentResources(url)
 	if err != nil {
 		return fmt.Errorf("failed to read resource list for URL %s: %w", url, err)
 	}
-	s.purgeFiles(resources)
+	s.references.release(url, resources, s.purgeFiles)
 	return s.contentState.DeleteContentEntry(url)
 }
 
@@ -1,66 +1,435 @@
 package cyprus
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	infra "github.com/Apiara/ApiaraCDN/infrastructure"
 )
 
-type nonListableFileSystem struct {
-	fs http.FileSystem
+/*
+StorageAccessPolicy decides which storage API resources require an access token.
+Tokens are issued with infra.IssueAccessToken using Secret, while internal
+services can present the long lived ServiceToken instead. The key resource is
+always restricted
+*/
+type StorageAccessPolicy struct {
+	Secret       []byte
+	ServiceToken string
+	Restricted   []string
 }
 
-func (n *nonListableFileSystem) Open(path string) (http.File, error) {
-	file, err := n.fs.Open(path)
+// tokenGate only passes requests with a valid access token for their path to next
+type tokenGate struct {
+	secret       []byte
+	serviceToken string
+	next         http.Handler
+}
+
+// requestClientIP returns the address of the client making req
+func requestClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func (g *tokenGate) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	token := req.URL.Query().Get(infra.AccessTokenParam)
+	if authorization := req.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		token = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	if token == "" {
+		resp.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if g.serviceToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(g.serviceToken)) == 1 {
+		g.next.ServeHTTP(resp, req)
+		return
+	}
+	if len(g.secret) == 0 {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	err := infra.VerifyAccessToken(g.secret, req.URL.EscapedPath(), token, requestClientIP(req), time.Now())
 	if err != nil {
-		return nil, err
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	g.next.ServeHTTP(resp, req)
+}
+
+// keyHandler serves content keys unwrapped from their stored form
+type keyHandler struct {
+	reader StorageReader
+	kek    *KeyEncryptionKey
+}
+
+func (k *keyHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(req.URL.Path, "/")
+	if !validObjectFname(name) {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var wrapped bytes.Buffer
+	err := k.reader.ReadObject(path.Join(infra.AESKeyStorageDir, name), &wrapped)
+	if errors.Is(err, fs.ErrNotExist) {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	key, err := k.kek.Unwrap(wrapped.Bytes(), name)
+	if err != nil {
+		log.Println(err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Write(key)
+}
+
+// Cache-Control directives of served objects, shared caches may only store unrestricted objects
+const (
+	immutableCacheControl  = "max-age=31536000, immutable"
+	revalidateCacheControl = "no-cache"
+	publicCacheControl     = "public, "
+	privateCacheControl    = "private, "
+)
+
+// dataDescriptionCacheSize bounds the number of crypdata descriptions kept by a dataDescriber
+const dataDescriptionCacheSize = 4096
+
+/*
+objectReadSeeker reads an object from a store that supports reading from an
+offset. The object is only opened once read, and reopened if a seek moves the
+read position, so http.ServeContent can serve ranges without reading it whole
+*/
+type objectReadSeeker struct {
+	reader     ObjectRangeReader
+	name       string
+	size       int64
+	offset     int64
+	body       io.ReadCloser
+	bodyOffset int64
+}
+
+func (o *objectReadSeeker) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body != nil && o.bodyOffset != o.offset {
+		o.body.Close()
+		o.body = nil
+	}
+	if o.body == nil {
+		body, err := o.reader.OpenObjectAt(o.name, o.offset)
+		if err != nil {
+			return 0, err
+		}
+		o.body, o.bodyOffset = body, o.offset
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	o.bodyOffset += int64(n)
+	return n, err
+}
+
+func (o *objectReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d in object %s", offset, o.name)
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *objectReadSeeker) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	return o.body.Close()
+}
+
+// nopReadSeekCloser adds a no-op Close to an io.ReadSeeker
+type nopReadSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopReadSeekCloser) Close() error { return nil }
+
+/*
+dataDescription holds what is served alongside a crypdata object: the entity tag
+derived from its published checksum and where the IV and ciphertext begin
+*/
+type dataDescription struct {
+	etag       string
+	ivOffset   int
+	ivLength   int
+	dataOffset int
+}
+
+/*
+dataDescriber describes crypdata objects. Functional IDs are never reused for
+other data, so descriptions are cached by functional ID
+*/
+type dataDescriber struct {
+	reader       StorageReader
+	mutex        sync.Mutex
+	descriptions map[string]dataDescription
+}
+
+func newDataDescriber(reader StorageReader) *dataDescriber {
+	return &dataDescriber{reader: reader, descriptions: make(map[string]dataDescription)}
+}
+
+/*
+describe returns the description of the crypdata object published under fid, read
+from content if not cached. Objects without a usable published checksum have no entity tag
+*/
+func (d *dataDescriber) describe(fid string, content io.ReadSeeker) (dataDescription, error) {
+	d.mutex.Lock()
+	description, ok := d.descriptions[fid]
+	d.mutex.Unlock()
+	if ok {
+		return description, nil
+	}
+
+	var serialProof bytes.Buffer
+	err := d.reader.ReadObject(path.Join(infra.IntegrityProofDir, fid), &serialProof)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return dataDescription{}, err
+	}
+	if err == nil {
+		// The data itself is still served if its proof is unusable
+		var proof IntegrityProof
+		if err = json.Unmarshal(serialProof.Bytes(), &proof); err != nil {
+			log.Printf("failed to parse integrity proof of %s: %v\n", fid, err)
+		}
+		if proof.Checksum != "" {
+			description.etag = `"` + proof.Checksum + `"`
+		}
+	}
+
+	// CTR content starts with its IV, chunked GCM content with a header holding the nonce prefix
+	head := make([]byte, GCMHeaderSize)
+	n, err := io.ReadFull(content, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return dataDescription{}, fmt.Errorf("failed to read head of crypdata %s: %w", fid, err)
+	}
+	if _, err = content.Seek(0, io.SeekStart); err != nil {
+		return dataDescription{}, fmt.Errorf("failed to rewind crypdata %s: %w", fid, err)
+	}
+	if IsAESGCMContent(head[:n]) {
+		description.ivOffset, description.ivLength = len(gcmMagic)+5, gcmNoncePrefixSize
+		description.dataOffset = GCMHeaderSize
+	} else {
+		description.ivLength, description.dataOffset = aes.BlockSize, aes.BlockSize
 	}
 
-	stat, err := file.Stat()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.descriptions) >= dataDescriptionCacheSize {
+		d.descriptions = make(map[string]dataDescription)
+	}
+	d.descriptions[fid] = description
+	return description, nil
+}
+
+/*
+objectHandler serves the objects of a single resource class stored under dir,
+as contentType if set and with the Cache-Control directive cacheControl. Objects
+are served with http.ServeContent so range and conditional requests work,
+without reading them whole from stores that can read from an offset. Crypdata
+is described by describer, other objects are tagged with their version in the store
+*/
+type objectHandler struct {
+	reader       StorageReader
+	dir          string
+	contentType  string
+	cacheControl string
+	describer    *dataDescriber
+}
+
+/*
+openObject opens the object stored under name for serving, along with its
+version if the store can tell it without reading the object
+*/
+func (o *objectHandler) openObject(name string) (io.ReadSeekCloser, string, error) {
+	if rangeReader, ok := o.reader.(ObjectRangeReader); ok {
+		info, err := rangeReader.StatObject(name)
+		if err != nil {
+			return nil, "", err
+		}
+		return &objectReadSeeker{reader: rangeReader, name: name, size: info.Size}, info.Version, nil
+	}
+
+	var data bytes.Buffer
+	if err := o.reader.ReadObject(name, &data); err != nil {
+		return nil, "", err
+	}
+	return nopReadSeekCloser{bytes.NewReader(data.Bytes())}, "", nil
+}
+
+// objectETag returns an entity tag for content derived from the checksum of its data
+func objectETag(content io.ReadSeeker) (string, error) {
+	checksum := sha256.New()
+	if _, err := io.Copy(checksum, content); err != nil {
+		return "", fmt.Errorf("failed to hash object: %w", err)
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to rewind object: %w", err)
+	}
+	return `"` + base64.StdEncoding.EncodeToString(checksum.Sum(nil)) + `"`, nil
+}
+
+func (o *objectHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	fname := strings.TrimPrefix(req.URL.Path, "/")
+	if !validObjectFname(fname) {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+	content, version, err := o.openObject(path.Join(o.dir, fname))
+	if errors.Is(err, fs.ErrNotExist) {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		return nil, err
+		log.Println(err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	// Tag the object so caches can revalidate it and clients can resume downloads
+	header := resp.Header()
+	if o.describer != nil {
+		description, err := o.describer.describe(fname, content)
+		if err != nil {
+			log.Println(err)
+			resp.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if description.etag != "" {
+			header.Set("ETag", description.etag)
+		}
+		header.Set(infra.CryptIVOffsetHeader, strconv.Itoa(description.ivOffset))
+		header.Set(infra.CryptIVLengthHeader, strconv.Itoa(description.ivLength))
+		header.Set(infra.CryptDataOffsetHeader, strconv.Itoa(description.dataOffset))
+	} else if version != "" {
+		header.Set("ETag", `"`+version+`"`)
+	} else {
+		// Stores that can't version objects read them whole anyway, so hashing them costs little more
+		etag, err := objectETag(content)
+		if err != nil {
+			log.Println(err)
+			resp.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		header.Set("ETag", etag)
 	}
 
-	if stat.IsDir() {
-		return nil, fmt.Errorf("directory listing not allowed")
+	contentType := o.contentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
 	}
-	return file, nil
+	header.Set("Content-Type", contentType)
+	header.Set("Cache-Control", o.cacheControl)
+	http.ServeContent(resp, req, fname, time.Time{}, content)
 }
 
-// StartStorageAPI starts the API used for accessing the processed data
-func StartStorageAPI(listenAddr, storageDir string) {
-	// Create file directory paths
-	keyDir := path.Join(storageDir, infra.AESKeyStorageDir)
-	dataDir := path.Join(storageDir, infra.CryptDataStorageDir)
-	partialMapDir := path.Join(storageDir, infra.PartialMapDir)
-	completeMapDir := path.Join(storageDir, infra.CompleteMediaMapDir)
+// newStorageAPI creates the handler serving the processed data read from reader under policy
+func newStorageAPI(reader StorageReader, kek *KeyEncryptionKey, policy StorageAccessPolicy) http.Handler {
+	restricted := map[string]bool{infra.CyprusStorageAPIKeyResource: true}
+	for _, resource := range policy.Restricted {
+		restricted[resource] = true
+	}
+
+	// cacheControl returns the directive for resource, data published under a functional ID never changes
+	cacheControl := func(resource string, immutable bool) string {
+		directive := revalidateCacheControl
+		if immutable {
+			directive = immutableCacheControl
+		}
+		if restricted[resource] {
+			return privateCacheControl + directive
+		}
+		return publicCacheControl + directive
+	}
 
-	// Create file servers
-	keyServer := http.FileServer(&nonListableFileSystem{http.Dir(keyDir)})
-	cryptDataServer := http.FileServer(&nonListableFileSystem{http.Dir(dataDir)})
-	partialMapServer := http.FileServer(&nonListableFileSystem{http.Dir(partialMapDir)})
-	completeMapServer := http.FileServer(&nonListableFileSystem{http.Dir(completeMapDir)})
+	// Create object servers
+	servers := map[string]http.Handler{
+		infra.CyprusStorageAPIKeyResource: &keyHandler{reader: reader, kek: kek},
+		infra.CyprusStorageAPIDataResource: &objectHandler{reader: reader, dir: infra.CryptDataStorageDir,
+			cacheControl: cacheControl(infra.CyprusStorageAPIDataResource, true), describer: newDataDescriber(reader)},
+		infra.CyprusStorageAPIPartialMetadataResource: &objectHandler{reader: reader, dir: infra.PartialMapDir,
+			cacheControl: cacheControl(infra.CyprusStorageAPIPartialMetadataResource, false)},
+		infra.CyprusStorageAPICompleteMetadataResource: &objectHandler{reader: reader, dir: infra.CompleteMediaMapDir,
+			cacheControl: cacheControl(infra.CyprusStorageAPICompleteMetadataResource, false)},
+		infra.CyprusStorageAPIProofResource: &objectHandler{reader: reader, dir: infra.IntegrityProofDir,
+			cacheControl: cacheControl(infra.CyprusStorageAPIProofResource, true)},
+		infra.CyprusStorageAPIPlaylistResource: &objectHandler{reader: reader, dir: infra.PlaylistDir,
+			contentType: hlsPlaylistContentType, cacheControl: cacheControl(infra.CyprusStorageAPIPlaylistResource, false)},
+	}
 
-	// Create and start API
+	// Gate restricted resource classes behind access tokens
 	storageAPI := http.NewServeMux()
-	storageAPI.Handle(
-		infra.CyprusStorageAPIKeyResource,
-		http.StripPrefix(infra.CyprusStorageAPIKeyResource, keyServer),
-	)
-	storageAPI.Handle(
-		infra.CyprusStorageAPIDataResource,
-		http.StripPrefix(infra.CyprusStorageAPIDataResource, cryptDataServer),
-	)
-	storageAPI.Handle(
-		infra.CyprusStorageAPIPartialMetadataResource,
-		http.StripPrefix(infra.CyprusStorageAPIPartialMetadataResource, partialMapServer),
-	)
-	storageAPI.Handle(
-		infra.CyprusStorageAPICompleteMetadataResource,
-		http.StripPrefix(infra.CyprusStorageAPICompleteMetadataResource, completeMapServer),
-	)
-	log.Fatal(http.ListenAndServe(listenAddr, storageAPI))
+	for resource, server := range servers {
+		handler := http.StripPrefix(resource, server)
+		if restricted[resource] {
+			handler = &tokenGate{secret: policy.Secret, serviceToken: policy.ServiceToken, next: handler}
+		}
+		storageAPI.Handle(resource+"/", handler)
+	}
+	return storageAPI
+}
+
+/*
+StartStorageAPI starts the API used for accessing the processed data read from
+reader. Content keys are unwrapped with kek and, like any other resource
+restricted by policy, only served to requests presenting a valid access token.
+Other objects are served with entity tags and Cache-Control directives so HTTP
+caches can sit in front of the API, and with range support so downloads resume
+*/
+func StartStorageAPI(listenAddr string, reader StorageReader, kek *KeyEncryptionKey, policy StorageAccessPolicy) {
+	log.Fatal(http.ListenAndServe(listenAddr, newStorageAPI(reader, kek, policy)))
 }
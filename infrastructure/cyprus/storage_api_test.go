@@ -0,0 +1,219 @@
+package cyprus
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorageAPIAccess(t *testing.T) {
+	storageDir := t.TempDir()
+	kek, _ := newKeyEncryptionKey(make([]byte, kekSize))
+	for _, dir := range []string{infra.AESKeyStorageDir, infra.CryptDataStorageDir, infra.CompleteMediaMapDir} {
+		assert.Nil(t, os.MkdirAll(path.Join(storageDir, dir), 0755), "should not return error")
+	}
+	assert.Nil(t, writeWrappedKey(kek, []byte("key"), path.Join(storageDir, infra.AESKeyStorageDir, "content")),
+		"should not return error")
+	os.WriteFile(path.Join(storageDir, infra.CryptDataStorageDir, "fid"), []byte("data"), 0644)
+	os.WriteFile(path.Join(storageDir, infra.CompleteMediaMapDir, "content"), []byte("map"), 0644)
+
+	secret := []byte("secret")
+	server := httptest.NewServer(newStorageAPI(NewFilesystemStorageReader(storageDir), kek, StorageAccessPolicy{
+		Secret:       secret,
+		ServiceToken: "service",
+		Restricted:   []string{infra.CyprusStorageAPICompleteMetadataResource},
+	}))
+	defer server.Close()
+
+	get := func(resource string, token string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+resource, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err, "should not return error")
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	keyPath := infra.CyprusStorageAPIKeyResource + "/content"
+	expiry := time.Now().Add(time.Minute)
+
+	// Keys are always restricted and served unwrapped
+	status, _ := get(keyPath, "")
+	assert.Equal(t, http.StatusUnauthorized, status, "expected missing token to be rejected")
+	status, body := get(keyPath, infra.IssueAccessToken(secret, keyPath, expiry, ""))
+	assert.Equal(t, http.StatusOK, status, "expected valid token to be accepted")
+	assert.Equal(t, "key", body, "expected key to be served unwrapped")
+	status, body = get(keyPath, "service")
+	assert.Equal(t, http.StatusOK, status, "expected service token to be accepted")
+	assert.Equal(t, "key", body, "expected key to be served unwrapped")
+
+	// Tokens are scoped to a path, an expiry and optionally a client IP
+	status, _ = get(keyPath, infra.IssueAccessToken(secret, infra.CyprusStorageAPIKeyResource+"/other", expiry, ""))
+	assert.Equal(t, http.StatusForbidden, status, "expected token for other path to be rejected")
+	status, _ = get(keyPath, infra.IssueAccessToken(secret, keyPath, time.Now().Add(-time.Minute), ""))
+	assert.Equal(t, http.StatusForbidden, status, "expected expired token to be rejected")
+	status, _ = get(keyPath, infra.IssueAccessToken([]byte("forged"), keyPath, expiry, ""))
+	assert.Equal(t, http.StatusForbidden, status, "expected forged token to be rejected")
+	status, _ = get(keyPath, infra.IssueAccessToken(secret, keyPath, expiry, "10.0.0.1"))
+	assert.Equal(t, http.StatusForbidden, status, "expected token bound to other client to be rejected")
+	status, _ = get(keyPath, infra.IssueAccessToken(secret, keyPath, expiry, "127.0.0.1"))
+	assert.Equal(t, http.StatusOK, status, "expected token bound to client to be accepted")
+
+	// Tokens can be passed in the query of a signed URL
+	signedURL, err := infra.NewAccessTokenIssuer(secret, time.Minute).SignURL(server.URL+keyPath, "")
+	assert.Nil(t, err, "should not return error")
+	resp, err := http.Get(signedURL)
+	assert.Nil(t, err, "should not return error")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "expected signed URL to be accepted")
+
+	// Other resource classes follow the policy
+	status, body = get(infra.CyprusStorageAPIDataResource+"/fid", "")
+	assert.Equal(t, http.StatusOK, status, "expected public crypdata to be served")
+	assert.Equal(t, "data", body, "wrong crypdata")
+	status, _ = get(infra.CyprusStorageAPICompleteMetadataResource+"/content", "")
+	assert.Equal(t, http.StatusUnauthorized, status, "expected restricted complete map to require token")
+	status, _ = get(infra.CyprusStorageAPICompleteMetadataResource+"/content", "service")
+	assert.Equal(t, http.StatusOK, status, "expected service token to be accepted")
+
+	status, _ = get(infra.CyprusStorageAPIKeyResource+"/missing", "service")
+	assert.Equal(t, http.StatusNotFound, status, "expected missing key to 404")
+}
+
+func TestStorageAPICaching(t *testing.T) {
+	storageDir := t.TempDir()
+	s3Store, _ := newTestS3ObjectStore(t)
+	readers := map[string]StorageReader{"filesystem": NewFilesystemStorageReader(storageDir), "s3": s3Store}
+	writers := map[string]func(string, []byte) error{
+		"filesystem": func(name string, data []byte) error { return os.WriteFile(path.Join(storageDir, name), data, 0644) },
+		"s3": func(name string, data []byte) error {
+			return s3Store.WriteObject(name, bytes.NewReader(data), int64(len(data)))
+		},
+	}
+
+	// Publish CTR and chunked GCM crypdata with their proofs to both stores
+	ctrData := append(bytes.Repeat([]byte{1}, 16), []byte("ctr ciphertext")...)
+	gcmHeader := gcmHeader{version: GCMFormatVersion, chunkSize: 64, noncePrefix: []byte("noncepf")}
+	gcmData := append(gcmHeader.encode(), []byte("gcm ciphertext")...)
+	objects := map[string][]byte{
+		path.Join(infra.CryptDataStorageDir, "ctr"):      ctrData,
+		path.Join(infra.CryptDataStorageDir, "gcm"):      gcmData,
+		path.Join(infra.CryptDataStorageDir, "unproven"): ctrData,
+		path.Join(infra.CompleteMediaMapDir, "content"):  []byte("map"),
+	}
+	checksums := make(map[string]string)
+	for fid, data := range map[string][]byte{"ctr": ctrData, "gcm": gcmData} {
+		proof, err := NewIntegrityProof(bytes.NewReader(data), DefaultIntegrityBlockSize)
+		assert.Nil(t, err, "should not return error")
+		serialProof, _ := json.Marshal(proof)
+		objects[path.Join(infra.IntegrityProofDir, fid)] = serialProof
+		checksums[fid] = proof.Checksum
+	}
+	for name, data := range objects {
+		assert.Nil(t, os.MkdirAll(path.Join(storageDir, path.Dir(name)), 0755), "should not return error")
+		assert.Nil(t, os.WriteFile(path.Join(storageDir, name), data, 0644), "should not return error")
+		assert.Nil(t, s3Store.WriteObject(name, bytes.NewReader(data), int64(len(data))), "should not return error")
+	}
+
+	for store, reader := range readers {
+		kek, _ := newKeyEncryptionKey(make([]byte, kekSize))
+		server := httptest.NewServer(newStorageAPI(reader, kek, StorageAccessPolicy{
+			ServiceToken: "service",
+			Restricted:   []string{infra.CyprusStorageAPICompleteMetadataResource},
+		}))
+		defer server.Close()
+
+		get := func(resource string, header map[string]string) (*http.Response, string) {
+			req, _ := http.NewRequest(http.MethodGet, server.URL+resource, nil)
+			for key, value := range header {
+				req.Header.Set(key, value)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			assert.Nil(t, err, "should not return error")
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			return resp, string(body)
+		}
+
+		// Crypdata is tagged with its published checksum and cached as immutable
+		resp, body := get(infra.CyprusStorageAPIDataResource+"/ctr", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "wrong status from %s", store)
+		assert.Equal(t, string(ctrData), body, "wrong crypdata from %s", store)
+		etag := resp.Header.Get("ETag")
+		assert.Equal(t, `"`+checksums["ctr"]+`"`, etag, "expected published checksum as ETag from %s", store)
+		assert.Contains(t, resp.Header.Get("Cache-Control"), "immutable", "expected immutable crypdata from %s", store)
+		assert.True(t, strings.HasPrefix(resp.Header.Get("Cache-Control"), "public"),
+			"expected public crypdata from %s", store)
+		resp, body = get(infra.CyprusStorageAPIDataResource+"/ctr", map[string]string{"If-None-Match": etag})
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode, "expected matching ETag to revalidate on %s", store)
+		assert.Empty(t, body, "expected no body when not modified from %s", store)
+		resp, _ = get(infra.CyprusStorageAPIDataResource+"/unproven", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "wrong status from %s", store)
+		assert.Empty(t, resp.Header.Get("ETag"), "expected crypdata without checksum to be untagged on %s", store)
+
+		// Ranges expose where the IV and ciphertext begin
+		resp, body = get(infra.CyprusStorageAPIDataResource+"/ctr", map[string]string{"Range": "bytes=16-"})
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode, "expected partial content from %s", store)
+		assert.Equal(t, "ctr ciphertext", body, "wrong range from %s", store)
+		assert.Equal(t, "0", resp.Header.Get(infra.CryptIVOffsetHeader), "wrong CTR IV offset from %s", store)
+		assert.Equal(t, "16", resp.Header.Get(infra.CryptIVLengthHeader), "wrong CTR IV length from %s", store)
+		assert.Equal(t, "16", resp.Header.Get(infra.CryptDataOffsetHeader), "wrong CTR data offset from %s", store)
+		resp, body = get(infra.CyprusStorageAPIDataResource+"/gcm", map[string]string{"Range": "bytes=9-15"})
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode, "expected partial content from %s", store)
+		assert.Equal(t, "noncepf", body, "expected range to hold the nonce prefix from %s", store)
+		assert.Equal(t, "9", resp.Header.Get(infra.CryptIVOffsetHeader), "wrong GCM IV offset from %s", store)
+		assert.Equal(t, "7", resp.Header.Get(infra.CryptIVLengthHeader), "wrong GCM IV length from %s", store)
+		assert.Equal(t, "16", resp.Header.Get(infra.CryptDataOffsetHeader), "wrong GCM data offset from %s", store)
+
+		// Downloads resume only while the object is unchanged
+		resp, body = get(infra.CyprusStorageAPIDataResource+"/gcm", map[string]string{"Range": "bytes=16-",
+			"If-Range": `"` + checksums["gcm"] + `"`})
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode, "expected resumed download from %s", store)
+		assert.Equal(t, "gcm ciphertext", body, "wrong resumed range from %s", store)
+		resp, body = get(infra.CyprusStorageAPIDataResource+"/gcm", map[string]string{"Range": "bytes=16-",
+			"If-Range": `"stale"`})
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "expected stale download to restart from %s", store)
+		assert.Equal(t, string(gcmData), body, "wrong restarted download from %s", store)
+
+		// Other objects are tagged with their version in the store and revalidated
+		name := path.Join(infra.CompleteMediaMapDir, "content")
+		info, err := reader.(ObjectRangeReader).StatObject(name)
+		assert.Nil(t, err, "should not return error")
+		assert.NotEmpty(t, info.Version, "expected object version from %s", store)
+		resp, _ = get(infra.CyprusStorageAPIProofResource+"/ctr", nil)
+		assert.Contains(t, resp.Header.Get("Cache-Control"), "immutable", "expected immutable proof from %s", store)
+		resp, body = get(infra.CyprusStorageAPICompleteMetadataResource+"/content",
+			map[string]string{"Authorization": "Bearer service"})
+		assert.Equal(t, "map", body, "wrong complete map from %s", store)
+		assert.Equal(t, "private, no-cache", resp.Header.Get("Cache-Control"),
+			"expected restricted map to be private from %s", store)
+		resp, _ = get(infra.CyprusStorageAPICompleteMetadataResource+"/content",
+			map[string]string{"Authorization": "Bearer service", "If-None-Match": resp.Header.Get("ETag")})
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode, "expected matching ETag to revalidate on %s", store)
+		versionTag := `"` + info.Version + `"`
+		assert.Equal(t, versionTag, resp.Header.Get("ETag"), "expected object version as ETag from %s", store)
+
+		// Rewritten objects get a new tag
+		assert.Nil(t, writers[store](name, []byte("new map")), "should not return error")
+		resp, body = get(infra.CyprusStorageAPICompleteMetadataResource+"/content",
+			map[string]string{"Authorization": "Bearer service", "If-None-Match": versionTag})
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "expected rewritten object to be served from %s", store)
+		assert.Equal(t, "new map", body, "wrong rewritten complete map from %s", store)
+		assert.NotEqual(t, versionTag, resp.Header.Get("ETag"), "expected rewritten object to be tagged anew from %s", store)
+
+		resp, _ = get(infra.CyprusStorageAPIDataResource+"/missing", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, "expected missing crypdata to 404 on %s", store)
+	}
+}
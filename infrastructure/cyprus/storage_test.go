@@ -2,9 +2,14 @@ package cyprus
 
 import (
 	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
 	"github.com/Apiara/ApiaraCDN/infrastructure/state"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestFilesystemStorageManager(t *testing.T) {
@@ -23,7 +28,11 @@ func TestFilesystemStorageManager(t *testing.T) {
 
 	// Test
 	state := state.NewMockMicroserviceState()
-	storage, err := NewFilesystemStorageManager(storageDir, state)
+	kek, err := newKeyEncryptionKey(make([]byte, kekSize))
+	if err != nil {
+		t.Fatalf("Failed to create key encryption key: %v", err)
+	}
+	storage, err := NewFilesystemStorageManager(storageDir, state, kek)
 	if err != nil {
 		t.Fatalf("Failed to create redis storage manager: %v", err)
 	}
@@ -86,3 +95,157 @@ func TestFilesystemStorageManager(t *testing.T) {
 		t.Fatalf("Failed to purge by fid: %v", err)
 	}
 }
+
+func TestFilesystemStorageManagerStaging(t *testing.T) {
+	storageDir := t.TempDir()
+	workingDir := t.TempDir()
+	contentState := state.NewMockMicroserviceState()
+	kek, _ := newKeyEncryptionKey(make([]byte, kekSize))
+	storage, err := NewFilesystemStorageManager(storageDir, contentState, kek)
+	assert.Nil(t, err, "should not return error")
+
+	newDigest := func(url string, fid string) MediaDigest {
+		dataFile := filepath.Join(workingDir, "digest_"+fid)
+		os.WriteFile(dataFile, []byte("data"), 0644)
+		return MediaDigest{
+			Type:         RawMediaType,
+			CryptKey:     []byte("0123456789abcdef"),
+			FunctionalID: fid,
+			ByteSize:     4,
+			Result:       RawMedia{URL: url, FunctionalID: fid, File: dataFile},
+		}
+	}
+	published := func(fid string) bool {
+		_, err := os.Stat(filepath.Join(storageDir, infra.CryptDataStorageDir, fid))
+		return err == nil
+	}
+	staged := func() int {
+		entries, _ := os.ReadDir(filepath.Join(storageDir, stagingDirName))
+		return len(entries)
+	}
+
+	// Successful publishes leave nothing staged
+	assert.Nil(t, storage.Publish(newDigest("url1", "fid1")), "should not return error")
+	assert.True(t, published("fid1"), "expected data to be published")
+	assert.Equal(t, 0, staged(), "expected staging dir to be removed")
+	resources, err := contentState.GetContentResources("url1")
+	assert.Nil(t, err, "should not return error")
+	assert.Len(t, resources, 4, "wrong number of resources recorded")
+
+	// Failed publishes make nothing visible
+	failed := newDigest("url2", "fid2")
+	os.Remove(failed.Result.(RawMedia).File)
+	assert.NotNil(t, storage.Publish(failed), "expected publish of missing data to fail")
+	_, err = os.Stat(filepath.Join(storageDir, infra.AESKeyStorageDir, infra.URLToSafeName("url2")))
+	assert.True(t, os.IsNotExist(err), "expected key of failed publish to not be visible")
+	assert.Equal(t, 0, staged(), "expected staging dir to be removed")
+
+	// Recovery discards uncommitted publishes
+	uncommitted, err := newStagedPublish(storage.stagingDir)
+	assert.Nil(t, err, "should not return error")
+	digest := newDigest("url3", "fid3")
+	assert.Nil(t, storage.publishRawMedia(uncommitted, digest.Result.(RawMedia), digest.CryptKey), "should not return error")
+
+	// and completes committed ones
+	committed, err := newStagedPublish(storage.stagingDir)
+	assert.Nil(t, err, "should not return error")
+	digest = newDigest("url4", "fid4")
+	assert.Nil(t, storage.publishRawMedia(committed, digest.Result.(RawMedia), digest.CryptKey), "should not return error")
+	assert.Nil(t, committed.commit(publishCommit{URL: "url4", FunctionalID: "fid4", ByteSize: 4, Names: committed.names}),
+		"should not return error")
+
+	assert.Nil(t, storage.Recover(), "should not return error")
+	assert.Equal(t, 0, staged(), "expected staging dirs to be removed")
+	assert.False(t, published("fid3"), "expected uncommitted publish to be discarded")
+	assert.True(t, published("fid4"), "expected committed publish to be completed")
+	fid, err := contentState.GetContentFunctionalID("url4")
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, "fid4", fid, "expected completed publish to be recorded")
+	key, err := readWrappedKey(kek, filepath.Join(storageDir, infra.AESKeyStorageDir, infra.URLToSafeName("url4")))
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, digest.CryptKey, key, "wrong recovered key")
+}
+
+func TestFilesystemStorageManagerSharedData(t *testing.T) {
+	storageDir := t.TempDir()
+	workingDir := t.TempDir()
+	contentState := state.NewMockMicroserviceState()
+	kek, _ := newKeyEncryptionKey(make([]byte, kekSize))
+	storage, err := NewFilesystemStorageManager(storageDir, contentState, kek)
+	assert.Nil(t, err, "should not return error")
+
+	publish := func(url string) {
+		dataFile := filepath.Join(workingDir, "digest_"+url)
+		os.WriteFile(dataFile, []byte("data"), 0644)
+		err := storage.Publish(MediaDigest{
+			Type:         RawMediaType,
+			CryptKey:     []byte("0123456789abcdef"),
+			FunctionalID: "shared",
+			ByteSize:     4,
+			Result:       RawMedia{URL: url, FunctionalID: "shared", File: dataFile},
+		})
+		assert.Nil(t, err, "should not return error")
+	}
+	sharedFile := filepath.Join(storageDir, infra.CryptDataStorageDir, "shared")
+	keyFile := func(url string) string {
+		return filepath.Join(storageDir, infra.AESKeyStorageDir, infra.URLToSafeName(url))
+	}
+
+	// Data shared by two contents survives purging one of them
+	publish("url1")
+	publish("url2")
+	assert.Nil(t, storage.PurgeByURL("url1"), "should not return error")
+	_, err = os.Stat(sharedFile)
+	assert.Nil(t, err, "expected shared data to be kept")
+	_, err = os.Stat(keyFile("url1"))
+	assert.True(t, os.IsNotExist(err), "expected key of purged content to be removed")
+
+	// and is deleted with the last content referencing it
+	assert.Nil(t, storage.PurgeByURL("url2"), "should not return error")
+	_, err = os.Stat(sharedFile)
+	assert.True(t, os.IsNotExist(err), "expected unreferenced data to be removed")
+}
+
+// blockingReferenceState is a ContentMetadataState blocking once a reference is removed until unblocked
+type blockingReferenceState struct {
+	*state.MockMicroserviceState
+	removed chan struct{}
+	unblock chan struct{}
+}
+
+func (b *blockingReferenceState) RemoveResourceReference(resource string, cid string) (int64, error) {
+	count, err := b.MockMicroserviceState.RemoveResourceReference(resource, cid)
+	close(b.removed)
+	<-b.unblock
+	return count, err
+}
+
+func TestResourceReferencesSerialized(t *testing.T) {
+	contentState := &blockingReferenceState{
+		MockMicroserviceState: state.NewMockMicroserviceState(),
+		removed:               make(chan struct{}),
+		unblock:               make(chan struct{}),
+	}
+	references := newResourceReferences(contentState)
+	resource := filepath.Join("/storage", infra.CryptDataStorageDir, "fid")
+	assert.Nil(t, references.add("cid1", []string{resource}), "should not return error")
+
+	// Content referencing a resource waits for a purge releasing its last reference to finish
+	var purged, added int32
+	go references.release("cid1", []string{resource}, func(unused []string) {
+		assert.Equal(t, []string{resource}, unused, "expected unreferenced resource to be purged")
+		atomic.StoreInt32(&purged, 1)
+	})
+	<-contentState.removed
+	go func() {
+		assert.Nil(t, references.add("cid2", []string{resource}), "should not return error")
+		atomic.StoreInt32(&added, atomic.LoadInt32(&purged)+1)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Zero(t, atomic.LoadInt32(&added), "expected reference to wait for purge")
+
+	close(contentState.unblock)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&added) != 0 }, time.Second, 10*time.Millisecond,
+		"expected reference to be added")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&added), "expected reference to be added after the purge")
+}
@@ -0,0 +1 @@
+audio_en data
@@ -0,0 +1 @@
+video data
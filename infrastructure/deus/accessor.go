@@ -1,16 +1,20 @@
 package deus
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"os"
+	"time"
 
 	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+	"github.com/Apiara/ApiaraCDN/infrastructure/cyprus"
 )
 
 /*
@@ -32,7 +36,45 @@ type aesInternalDataAccessor struct {
 	metadataBaseURL string
 	keyBaseURL      string
 	contentBaseURL  string
+	authenticated   bool
 	retrieveFile    func(string, io.Writer) error
+	retrieveKey     func(string, io.Writer) error
+}
+
+// isAuthenticatedMode returns whether content is published in the authenticated cyprus encryption mode
+func isAuthenticatedMode(encryptionMode string) (bool, error) {
+	switch encryptionMode {
+	case "", cyprus.CTREncryptionMode:
+		return false, nil
+	case cyprus.GCMEncryptionMode:
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown encryption mode %s", encryptionMode)
+}
+
+/*
+newAuthorizedRetriever returns a download function presenting token to
+the cyprus key serving path, which is the only place keys are unwrapped
+*/
+func newAuthorizedRetriever(token string) func(string, io.Writer) error {
+	client := &http.Client{Timeout: time.Minute}
+	return func(url string, out io.Writer) error {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("bad HTTP status: %s", resp.Status)
+		}
+		_, err = io.Copy(out, resp.Body)
+		return err
+	}
 }
 
 /*
@@ -66,13 +108,18 @@ func (d *aesInternalDataAccessor) GetKey(cid string) ([]byte, error) {
 	}
 
 	var cryptKey bytes.Buffer
-	if err = d.retrieveFile(keyURL, &cryptKey); err != nil {
+	if err = d.retrieveKey(keyURL, &cryptKey); err != nil {
 		return nil, fmt.Errorf("failed to download %s key: %w", cid, err)
 	}
 	return cryptKey.Bytes(), nil
 }
 
-// GetContent writes the internal content at 'url' decrypted with 'key' to 'out'
+/*
+GetContent writes the internal content at 'url' decrypted with 'key' to 'out'.
+Content is decrypted in the configured mode, chunked AES-GCM content being
+authenticated while it is decrypted. Content whose header doesn't match the
+mode is rejected so a rewritten header can't downgrade it to AES-CTR
+*/
 func (d *aesInternalDataAccessor) GetContent(url string, key []byte, out io.Writer) error {
 	// Download content
 	file, err := os.CreateTemp(os.TempDir(), "")
@@ -93,6 +140,23 @@ func (d *aesInternalDataAccessor) GetContent(url string, key []byte, out io.Writ
 	}
 	defer file.Close()
 
+	// Check the content format against the configured mode
+	content := bufio.NewReader(file)
+	header, _ := content.Peek(cyprus.GCMHeaderSize)
+	sealed := cyprus.IsAESGCMContent(header)
+	if d.authenticated {
+		if !sealed {
+			return fmt.Errorf("%s is not chunked AES-GCM content", url)
+		}
+		if err = cyprus.DecryptAESGCM(key, content, out); err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", url, err)
+		}
+		return nil
+	}
+	if sealed {
+		return fmt.Errorf("%s is chunked AES-GCM content but AES-CTR is configured", url)
+	}
+
 	cipherBlock, err := aes.NewCipher(key)
 	if err != nil {
 		return fmt.Errorf("failed to create block cipher from %s key: %w", url, err)
@@ -100,7 +164,7 @@ func (d *aesInternalDataAccessor) GetContent(url string, key []byte, out io.Writ
 
 	// Retrieve initialization vector
 	iv := make([]byte, aes.BlockSize)
-	_, err = file.Read(iv)
+	_, err = io.ReadFull(content, iv)
 	if err != nil {
 		return fmt.Errorf("failed to extract IV from %s: %w", url, err)
 	}
@@ -108,7 +172,7 @@ func (d *aesInternalDataAccessor) GetContent(url string, key []byte, out io.Writ
 	// Decrypt data
 	streamCipher := cipher.NewCTR(cipherBlock, iv)
 	cryptWriter := &cipher.StreamWriter{S: streamCipher, W: out}
-	if _, err = io.Copy(cryptWriter, file); err != nil {
+	if _, err = io.Copy(cryptWriter, content); err != nil {
 		return fmt.Errorf("failed to decrypt %s: %w", url, err)
 	}
 	return nil
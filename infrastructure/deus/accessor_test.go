@@ -2,8 +2,13 @@ package deus
 
 import (
 	"bytes"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
 
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
 	"github.com/Apiara/ApiaraCDN/infrastructure/cyprus"
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
@@ -15,6 +20,7 @@ func TestAESInternalDataAccessor(t *testing.T) {
 		keyBaseURL:      "./test_resources/keys",
 		contentBaseURL:  "./test_resources/content",
 		retrieveFile:    cyprus.CopyFromDisk,
+		retrieveKey:     cyprus.CopyFromDisk,
 	}
 
 	// Test GetMetadata
@@ -70,3 +76,92 @@ func TestAESInternalDataAccessor(t *testing.T) {
 	}
 	assert.Equal(t, "secret", buf.String(), "Got wrong key")
 }
+
+func TestAESInternalDataAccessorGCM(t *testing.T) {
+	accessor := &aesInternalDataAccessor{authenticated: true, retrieveFile: cyprus.CopyFromDisk}
+
+	// Seal content with the authenticated processor
+	workingDir := t.TempDir()
+	ingestFile := filepath.Join(workingDir, "ingest")
+	if err := os.WriteFile(ingestFile, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	processor, err := cyprus.NewAESGCMDataProcessor(cyprus.DefaultAESKeySize, cyprus.DefaultGCMChunkSize, workingDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := processor.DigestMedia(cyprus.MediaIngest{
+		Type:   cyprus.RawMediaType,
+		Result: cyprus.RawMedia{URL: "content", File: ingestFile},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contentFile := digest.Result.(cyprus.RawMedia).File
+
+	var buf bytes.Buffer
+	if err = accessor.GetContent(contentFile, digest.CryptKey, &buf); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "secret", buf.String(), "Got wrong content")
+
+	// Content not matching the configured mode is rejected
+	ctrAccessor := &aesInternalDataAccessor{retrieveFile: cyprus.CopyFromDisk}
+	assert.NotNil(t, ctrAccessor.GetContent(contentFile, digest.CryptKey, &bytes.Buffer{}),
+		"expected AES-GCM content to be rejected in AES-CTR mode")
+	sealed, err := os.ReadFile(contentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped := filepath.Join(workingDir, "stripped")
+	if err = os.WriteFile(stripped, sealed[cyprus.GCMHeaderSize:], 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, accessor.GetContent(stripped, digest.CryptKey, &bytes.Buffer{}),
+		"expected content without AES-GCM header to be rejected in AES-GCM mode")
+
+	// Modified ciphertext is rejected
+	sealed[len(sealed)-1] ^= 0x01
+	if err = os.WriteFile(contentFile, sealed, 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, accessor.GetContent(contentFile, digest.CryptKey, &bytes.Buffer{}), "expected tampered content to fail")
+}
+
+func TestStorageDataAccessor(t *testing.T) {
+	// Lay out published data like cyprus does
+	storageDir := t.TempDir()
+	for _, dir := range []string{infra.CompleteMediaMapDir, infra.CryptDataStorageDir} {
+		if err := os.MkdirAll(filepath.Join(storageDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mediaDef, _ := json.Marshal(cyprus.RawMedia{URL: "content", FunctionalID: "fid"})
+	os.WriteFile(filepath.Join(storageDir, infra.CompleteMediaMapDir, infra.URLToSafeName("content")), mediaDef, 0644)
+	crypt, err := os.ReadFile("./test_resources/content/test_content_crypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(storageDir, infra.CryptDataStorageDir, "fid"), crypt, 0644)
+
+	validator, err := NewStorageChecksumDataValidator(cyprus.NewFilesystemStorageReader(storageDir),
+		"http://localhost", "token", cyprus.CTREncryptionMode, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Metadata and content are read through the storage reader
+	var media cyprus.RawMedia
+	if err = validator.accessor.GetMetadata("content", &media); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "fid", media.FunctionalID, "Metadata read was not correct")
+
+	cryptKey := bytes.Repeat([]byte{0xde, 0xad, 0xbe, 0xef}, 8)
+	contentURL, _ := url.JoinPath(validator.contentBaseURL, media.FunctionalID)
+	var buf bytes.Buffer
+	if err = validator.accessor.GetContent(contentURL, cryptKey, &buf); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "secret", buf.String(), "Got wrong content")
+}
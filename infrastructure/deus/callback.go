@@ -0,0 +1,120 @@
+package deus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+)
+
+// Max age of a processing callback before it is rejected as a possible replay
+var ProcessCallbackMaxAge = time.Minute * 5
+
+/*
+ProcessingCallbackReceiver implements http.Handler by accepting signed completion
+callbacks from cyprus and handing them to whoever is waiting on the content ID.
+Callbacks sent longer than ProcessCallbackMaxAge ago are rejected
+*/
+type ProcessingCallbackReceiver struct {
+	secret  []byte
+	now     func() time.Time
+	mutex   *sync.Mutex
+	waiters map[string][]chan infra.StatusResponse
+}
+
+// NewProcessingCallbackReceiver creates a receiver accepting callbacks signed with secret
+func NewProcessingCallbackReceiver(secret []byte) *ProcessingCallbackReceiver {
+	return &ProcessingCallbackReceiver{
+		secret:  secret,
+		now:     time.Now,
+		mutex:   &sync.Mutex{},
+		waiters: make(map[string][]chan infra.StatusResponse),
+	}
+}
+
+/*
+Expect registers interest in the final status of the job for cid. It
+must be called before the job is submitted so no callback is missed
+*/
+func (r *ProcessingCallbackReceiver) Expect(cid string) <-chan infra.StatusResponse {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	waiter := make(chan infra.StatusResponse, 1)
+	r.waiters[cid] = append(r.waiters[cid], waiter)
+	return waiter
+}
+
+// Forget stops waiting on a channel returned by Expect
+func (r *ProcessingCallbackReceiver) Forget(cid string, waiter <-chan infra.StatusResponse) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	remaining := make([]chan infra.StatusResponse, 0, len(r.waiters[cid]))
+	for _, existing := range r.waiters[cid] {
+		if existing != waiter {
+			remaining = append(remaining, existing)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(r.waiters, cid)
+		return
+	}
+	r.waiters[cid] = remaining
+}
+
+// Wait blocks until the final status of the job for cid arrives on waiter or timeout passes
+func (r *ProcessingCallbackReceiver) Wait(cid string, waiter <-chan infra.StatusResponse,
+	timeout time.Duration) (infra.StatusResponse, error) {
+	defer r.Forget(cid, waiter)
+	select {
+	case status := <-waiter:
+		return status, nil
+	case <-time.After(timeout):
+		return infra.StatusResponse{}, fmt.Errorf("timed out waiting on processing callback for %s", cid)
+	}
+}
+
+// deliver hands 'status' to everyone waiting on the job for cid
+func (r *ProcessingCallbackReceiver) deliver(cid string, status infra.StatusResponse) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, waiter := range r.waiters[cid] {
+		waiter <- status
+	}
+	delete(r.waiters, cid)
+}
+
+// ServeHTTP verifies and accepts a completion callback
+func (r *ProcessingCallbackReceiver) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	payload, err := io.ReadAll(req.Body)
+	if err != nil {
+		log.Println(err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !infra.VerifyTimestampedPayload(r.secret, payload, req.Header.Get(infra.PayloadTimestampHeader),
+		req.Header.Get(infra.PayloadSignatureHeader), ProcessCallbackMaxAge, r.now()) {
+		log.Println("Rejected processing callback with invalid or stale signature")
+		resp.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var status infra.JobResponse
+	if err = json.Unmarshal(payload, &status); err != nil {
+		log.Println(err)
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.deliver(status.ContentID, status.StatusResponse)
+}
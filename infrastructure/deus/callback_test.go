@@ -0,0 +1,197 @@
+package deus
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+	"github.com/Apiara/ApiaraCDN/infrastructure/state"
+	"github.com/stretchr/testify/assert"
+)
+
+// postCallback sends a completion callback signed with secret
+func postCallback(addr string, secret []byte, status infra.JobResponse) (*http.Response, error) {
+	return postCallbackAt(addr, secret, status, time.Now())
+}
+
+// postCallbackAt sends a completion callback signed with secret as if sent at sentAt
+func postCallbackAt(addr string, secret []byte, status infra.JobResponse, sentAt time.Time) (*http.Response, error) {
+	payload, _ := json.Marshal(status)
+	req, _ := http.NewRequest(http.MethodPost, addr, bytes.NewReader(payload))
+	timestamp, signature := infra.SignTimestampedPayload(secret, payload, sentAt)
+	req.Header.Set(infra.PayloadTimestampHeader, timestamp)
+	req.Header.Set(infra.PayloadSignatureHeader, signature)
+	return http.DefaultClient.Do(req)
+}
+
+func TestProcessingCallbackReceiver(t *testing.T) {
+	secret := []byte("secret")
+	receiver := NewProcessingCallbackReceiver(secret)
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	waiter := receiver.Expect("cid")
+	finished := infra.JobResponse{ContentID: "cid", StatusResponse: infra.StatusResponse{
+		Status:   infra.FinishedProcessing,
+		Metadata: &infra.PostProcessingMetadata{FunctionalID: "fid", ByteSize: 10},
+	}}
+
+	// Payloads signed with the wrong secret are rejected
+	resp, err := postCallback(server.URL, []byte("wrong"), finished)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "expected forged callback to be rejected")
+	_, err = receiver.Wait("cid", waiter, 10*time.Millisecond)
+	assert.NotNil(t, err, "expected wait to time out")
+
+	// Valid payloads are delivered to waiters
+	waiter = receiver.Expect("cid")
+	resp, err = postCallback(server.URL, secret, finished)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "expected callback to be accepted")
+	status, err := receiver.Wait("cid", waiter, time.Second)
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, finished.StatusResponse, status, "wrong delivered status")
+}
+
+func TestProcessingCallbackReceiverReplay(t *testing.T) {
+	secret := []byte("secret")
+	receiver := NewProcessingCallbackReceiver(secret)
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	finished := infra.JobResponse{ContentID: "cid", StatusResponse: infra.StatusResponse{Status: infra.FinishedProcessing}}
+
+	// Callbacks signed too long ago are rejected
+	resp, err := postCallbackAt(server.URL, secret, finished, time.Now().Add(-2*ProcessCallbackMaxAge))
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "expected stale callback to be rejected")
+
+	// Captured callbacks can't be replayed once stale, even with a new timestamp
+	payload, _ := json.Marshal(finished)
+	timestamp, signature := infra.SignTimestampedPayload(secret, payload, time.Now())
+	replay := func(timestamp string) int {
+		req, _ := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader(payload))
+		req.Header.Set(infra.PayloadTimestampHeader, timestamp)
+		req.Header.Set(infra.PayloadSignatureHeader, signature)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err, "should not return error")
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, replay(timestamp), "expected fresh callback to be accepted")
+	receiver.now = func() time.Time { return time.Now().Add(2 * ProcessCallbackMaxAge) }
+	assert.Equal(t, http.StatusUnauthorized, replay(timestamp), "expected replayed callback to be rejected")
+	fresh := strconv.FormatInt(receiver.now().Unix(), 10)
+	assert.Equal(t, http.StatusUnauthorized, replay(fresh), "expected re-timestamped callback to be rejected")
+	assert.Equal(t, http.StatusUnauthorized, replay(""), "expected callback without timestamp to be rejected")
+}
+
+func TestMasterContentManagerCallbacks(t *testing.T) {
+	secret := []byte("secret")
+	receiver := NewProcessingCallbackReceiver(secret)
+
+	// The receiver is mounted at its resource path on the deus service API
+	deusAPI := http.NewServeMux()
+	deusAPI.Handle(infra.DeusServiceAPIProcessCallbackResource, receiver)
+	deusServer := httptest.NewServer(deusAPI)
+	defer deusServer.Close()
+
+	// Mock cyprus completes jobs by calling back
+	cyprusAPI := http.NewServeMux()
+	cyprusAPI.HandleFunc(infra.CyprusServiceAPIProcessResource, func(resp http.ResponseWriter, req *http.Request) {
+		cid := req.URL.Query().Get(infra.ContentIDParam)
+		callback := req.URL.Query().Get(infra.ProcessingCallbackParam)
+		go postCallback(callback, secret, infra.JobResponse{ContentID: cid, StatusResponse: infra.StatusResponse{
+			Status:   infra.FinishedProcessing,
+			Metadata: &infra.PostProcessingMetadata{FunctionalID: "fid-" + cid, ByteSize: 10},
+		}})
+	})
+	cyprusAPI.HandleFunc(infra.CyprusServiceAPIStatusResource, func(resp http.ResponseWriter, req *http.Request) {
+		t.Errorf("status should not be polled when callbacks are enabled")
+	})
+	cyprusServer := httptest.NewServer(cyprusAPI)
+	defer cyprusServer.Close()
+
+	manager, err := NewMasterContentManager(state.NewMockMicroserviceState(), cyprusServer.URL,
+		cyprusServer.URL, deusServer.URL, receiver)
+	assert.Nil(t, err, "should not return error")
+	manager.Lock()
+	defer manager.Unlock()
+	fid, size, submitted, err := manager.processContent("cid", false)
+	assert.Nil(t, err, "should not return error")
+	assert.True(t, submitted, "expected job to be submitted")
+	assert.Equal(t, "fid-cid", fid, "wrong functional id")
+	assert.Equal(t, int64(10), size, "wrong size")
+}
+
+func TestMasterContentManagerProcessUnlocked(t *testing.T) {
+	secret := []byte("secret")
+	receiver := NewProcessingCallbackReceiver(secret)
+
+	// Mock cyprus only completes the job once told to
+	var submissions int32
+	complete := make(chan struct{})
+	mockAPI := http.NewServeMux()
+	mockAPI.Handle(infra.DeusServiceAPIProcessCallbackResource, receiver)
+	mockAPI.HandleFunc(infra.CyprusServiceAPIProcessResource, func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&submissions, 1)
+		cid := req.URL.Query().Get(infra.ContentIDParam)
+		callback := req.URL.Query().Get(infra.ProcessingCallbackParam)
+		go func() {
+			<-complete
+			postCallback(callback, secret, infra.JobResponse{ContentID: cid, StatusResponse: infra.StatusResponse{
+				Status:   infra.FinishedProcessing,
+				Metadata: &infra.PostProcessingMetadata{FunctionalID: "fid-" + cid, ByteSize: 10},
+			}})
+		}()
+	})
+	server := httptest.NewServer(mockAPI)
+	defer server.Close()
+
+	manager, err := NewMasterContentManager(state.NewMockMicroserviceState(), server.URL,
+		server.URL, server.URL, receiver)
+	assert.Nil(t, err, "should not return error")
+
+	// Concurrent processing of the same content shares a single job
+	type result struct {
+		fid       string
+		submitted bool
+		err       error
+	}
+	results := make(chan result, 2)
+	started := 0
+	for i := 0; i < 2; i++ {
+		go func() {
+			manager.Lock()
+			defer manager.Unlock()
+			started++
+			fid, _, submitted, err := manager.processContent("cid", false)
+			results <- result{fid, submitted, err}
+		}()
+	}
+
+	// The manager stays usable while both calls wait on the job
+	assert.Eventually(t, func() bool {
+		manager.Lock()
+		defer manager.Unlock()
+		return started == 2 && len(manager.inflight) == 1 && atomic.LoadInt32(&submissions) == 1
+	}, time.Second, time.Millisecond, "expected lock to be released while processing")
+	close(complete)
+
+	submitted := 0
+	for i := 0; i < 2; i++ {
+		res := <-results
+		assert.Nil(t, res.err, "should not return error")
+		assert.Equal(t, "fid-cid", res.fid, "wrong functional id")
+		if res.submitted {
+			submitted++
+		}
+	}
+	assert.Equal(t, 1, submitted, "expected a single call to submit the job")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&submissions), "expected a single processing job")
+	assert.Empty(t, manager.inflight, "expected no jobs in flight")
+}
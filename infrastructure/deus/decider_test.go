@@ -10,7 +10,7 @@ import (
 
 func TestThresholdPullDecider(t *testing.T) {
 	validator := &mockContentValidator{}
-	manager := &mockContentManager{&sync.Mutex{}, make(map[string]bool)}
+	manager := &mockContentManager{mutex: &sync.Mutex{}, serving: make(map[string]bool)}
 	state := state.NewMockMicroserviceState()
 	threshold := 10
 	interval := time.Second
@@ -14,7 +14,7 @@ import (
 )
 
 var (
-	// How often the status of a data processing job is checked
+	// How often the status of a data processing job is checked when callbacks are disabled
 	ProcessStatusPollFrequency = time.Second
 
 	// Max time allocated to a data processing job before it is discarded
@@ -25,14 +25,16 @@ var (
 type ContentManager interface {
 	Serve(cid string, regionID string, dynamic bool) error
 	Remove(cid string, regionID string, dynamic bool) error
+	Refresh(cid string) error
 	Lock()
 	Unlock()
 }
 
 // mockContentManager is a mock implementation for testing
 type mockContentManager struct {
-	mutex   *sync.Mutex
-	serving map[string]bool
+	mutex     *sync.Mutex
+	serving   map[string]bool
+	refreshed []string
 }
 
 func (m *mockContentManager) Serve(cid string, server string, dyn bool) error {
@@ -45,12 +47,30 @@ func (m *mockContentManager) Remove(cid string, server string, dyn bool) error {
 	return nil
 }
 
+func (m *mockContentManager) Refresh(cid string) error {
+	m.refreshed = append(m.refreshed, cid)
+	return nil
+}
+
 func (m *mockContentManager) Lock()   { m.mutex.Lock() }
 func (m *mockContentManager) Unlock() { m.mutex.Unlock() }
 
-// MasterContentManager implements ContentManager
+// processCall is a processing job submitted by the manager, along with its results once done
+type processCall struct {
+	done         chan struct{}
+	functionalID string
+	size         int64
+	err          error
+}
+
+/*
+MasterContentManager implements ContentManager. Serve, Remove and Refresh must
+be called with the manager locked, though the lock is released while waiting
+on processing jobs so other content can be managed meanwhile
+*/
 type MasterContentManager struct {
 	mutex                *sync.Mutex
+	inflight             map[string]*processCall
 	state                ManagerMicroserviceState
 	httpClient           *http.Client
 	processDataAPIAddr   string
@@ -58,14 +78,18 @@ type MasterContentManager struct {
 	deleteDataAPIAddr    string
 	publishDataAPIAddr   string
 	unpublishDataAPIAddr string
+	callbackAddr         string
+	callbackReceiver     *ProcessingCallbackReceiver
 }
 
 /*
 NewMasterContentManager returns a new instances of MasterContentManager
-that uses the processAPI and coordinateAPI to delegate tasks
+that uses the processAPI and coordinateAPI to delegate tasks. If receiver
+is not nil, processing completion is received as a callback at callbackAPI
+instead of polling processAPI
 */
-func NewMasterContentManager(state ManagerMicroserviceState, processAPI string,
-	coordinateAPI string) (*MasterContentManager, error) {
+func NewMasterContentManager(state ManagerMicroserviceState, processAPI string, coordinateAPI string,
+	callbackAPI string, receiver *ProcessingCallbackReceiver) (*MasterContentManager, error) {
 	// Prepare API resources
 	processDataAPIAddr, err := url.JoinPath(processAPI, infra.CyprusServiceAPIProcessResource)
 	if err != nil {
@@ -87,9 +111,16 @@ func NewMasterContentManager(state ManagerMicroserviceState, processAPI string,
 	if err != nil {
 		return nil, err
 	}
+	callbackAddr := ""
+	if receiver != nil {
+		if callbackAddr, err = url.JoinPath(callbackAPI, infra.DeusServiceAPIProcessCallbackResource); err != nil {
+			return nil, err
+		}
+	}
 
 	return &MasterContentManager{
 		mutex:                &sync.Mutex{},
+		inflight:             make(map[string]*processCall),
 		state:                state,
 		httpClient:           http.DefaultClient,
 		processDataAPIAddr:   processDataAPIAddr,
@@ -97,6 +128,8 @@ func NewMasterContentManager(state ManagerMicroserviceState, processAPI string,
 		deleteDataAPIAddr:    deleteDataAPIAddr,
 		publishDataAPIAddr:   publishDataAPIAddr,
 		unpublishDataAPIAddr: unpublishDataAPIAddr,
+		callbackAddr:         callbackAddr,
+		callbackReceiver:     receiver,
 	}, nil
 }
 
@@ -118,12 +151,82 @@ func (m *MasterContentManager) sendHTTPMessage(addr string, query string) error
 	return nil
 }
 
-// Commands Cyprus data processing service to ingest+digest 'cid'
-func (m *MasterContentManager) processContent(cid string) (string, int64, error) {
-	// Create data process request
+// processResult converts the final status of a processing job into its results
+func processResult(cid string, status infra.StatusResponse) (string, int64, error) {
+	switch status.Status {
+	case infra.FailedProcessing:
+		return "", -1, fmt.Errorf("process request for %s failed: %s", cid, status.Error)
+	case infra.CancelledProcessing:
+		return "", -1, fmt.Errorf("process request for %s was cancelled", cid)
+	case infra.FinishedProcessing:
+		if status.Metadata == nil {
+			return "", -1, fmt.Errorf("process request for %s finished without results", cid)
+		}
+		return status.Metadata.FunctionalID, status.Metadata.ByteSize, nil
+	}
+	return "", -1, fmt.Errorf("process request for %s ended with unknown status %s", cid, status.Status)
+}
+
+// processQuery creates the query of a process request for 'cid', updating published content if 'update' is set
+func processQuery(cid string, update bool) url.Values {
 	query := url.Values{}
 	query.Add(infra.ContentIDParam, cid)
-	err := m.sendHTTPMessage(m.processDataAPIAddr, query.Encode())
+	if update {
+		query.Add(infra.UpdateIngestParam, "true")
+	}
+	return query
+}
+
+/*
+Commands Cyprus data processing service to ingest+digest 'cid'. If 'update' is set
+only what changed since 'cid' was last processed is digested and published again.
+The manager lock must be held, it is released while the job runs. If a job for 'cid'
+is already in flight its results are waited on instead of submitting another one.
+Returns whether this call submitted the job
+*/
+func (m *MasterContentManager) processContent(cid string, update bool) (string, int64, bool, error) {
+	if call, ok := m.inflight[cid]; ok {
+		m.mutex.Unlock()
+		<-call.done
+		m.mutex.Lock()
+		return call.functionalID, call.size, false, call.err
+	}
+
+	call := &processCall{done: make(chan struct{})}
+	m.inflight[cid] = call
+	m.mutex.Unlock()
+	if m.callbackReceiver == nil {
+		call.functionalID, call.size, call.err = m.processContentPolling(cid, update)
+	} else {
+		call.functionalID, call.size, call.err = m.processContentCallback(cid, update)
+	}
+	m.mutex.Lock()
+	delete(m.inflight, cid)
+	close(call.done)
+	return call.functionalID, call.size, true, call.err
+}
+
+// Commands Cyprus data processing service to ingest+digest 'cid' and waits for its completion callback
+func (m *MasterContentManager) processContentCallback(cid string, update bool) (string, int64, error) {
+	// Wait for the completion callback, registering first so it can't be missed
+	query := processQuery(cid, update)
+	query.Add(infra.ProcessingCallbackParam, m.callbackAddr)
+	waiter := m.callbackReceiver.Expect(cid)
+	if err := m.sendHTTPMessage(m.processDataAPIAddr, query.Encode()); err != nil {
+		m.callbackReceiver.Forget(cid, waiter)
+		return "", -1, err
+	}
+	status, err := m.callbackReceiver.Wait(cid, waiter, ProcessStatusTimeout)
+	if err != nil {
+		return "", -1, err
+	}
+	return processResult(cid, status)
+}
+
+// Commands Cyprus data processing service to ingest+digest 'cid' and polls until it completes
+func (m *MasterContentManager) processContentPolling(cid string, update bool) (string, int64, error) {
+	// Create data process request
+	err := m.sendHTTPMessage(m.processDataAPIAddr, processQuery(cid, update).Encode())
 	if err != nil {
 		return "", -1, err
 	}
@@ -133,7 +236,7 @@ func (m *MasterContentManager) processContent(cid string) (string, int64, error)
 	if err != nil {
 		return "", -1, err
 	}
-	statusReq.URL.RawQuery = query.Encode()
+	statusReq.URL.RawQuery = processQuery(cid, false).Encode()
 
 	status := infra.StatusResponse{}
 	startTime := time.Now()
@@ -154,13 +257,8 @@ func (m *MasterContentManager) processContent(cid string) (string, int64, error)
 		}
 
 		// Check state
-		switch status.Status {
-		case infra.RunningProcessing:
-			continue
-		case infra.FailedProcessing:
-			return "", -1, fmt.Errorf("process request for %s failed", cid)
-		case infra.FinishedProcessing:
-			return status.Metadata.FunctionalID, status.Metadata.ByteSize, nil
+		if status.Status != infra.RunningProcessing {
+			return processResult(cid, status)
 		}
 	}
 
@@ -246,33 +344,37 @@ func (m *MasterContentManager) Serve(cid string, regionID string, dynamic bool)
 	operation in case rollback needs to be performed */
 	rollbackOperations := make([]func() error, 0)
 
-	// Check if content has been processed yet
-	processed, err := m.state.IsContentBeingServed(cid)
-	if err != nil {
-		return err
-	}
-
-	// Get functional id and processed content size. Process if not processed
+	/* Get functional id and processed content size. Process if not processed,
+	checking again if another call processed it while the lock was released */
 	var functionalID string
 	var size int64
-	if !processed {
-		// Attempt content processing, update rollback operations
-		functionalID, size, err = m.processContent(cid)
+	for {
+		processed, err := m.state.IsContentBeingServed(cid)
 		if err != nil {
 			return err
 		}
-		rollbackOperations = append(rollbackOperations, func() error {
-			return m.deleteProcessedContent(cid)
-		})
-	} else {
-		functionalID, err = m.state.GetContentFunctionalID(cid)
-		if err != nil {
-			return err
+		if processed {
+			if functionalID, err = m.state.GetContentFunctionalID(cid); err != nil {
+				return err
+			}
+			if size, err = m.state.GetContentSize(cid); err != nil {
+				return err
+			}
+			break
 		}
-		size, err = m.state.GetContentSize(cid)
+
+		// Attempt content processing, update rollback operations
+		var submitted bool
+		functionalID, size, submitted, err = m.processContent(cid, false)
 		if err != nil {
 			return err
 		}
+		if submitted {
+			rollbackOperations = append(rollbackOperations, func() error {
+				return m.deleteProcessedContent(cid)
+			})
+			break
+		}
 	}
 
 	// Publish content to coordination infrastructure
@@ -381,6 +483,81 @@ func (m *MasterContentManager) Remove(cid string, regionID string, dynamic bool)
 	return nil
 }
 
+/*
+swapFunctionalID moves 'regionID' from serving 'oldFID' to serving 'newFID'. The
+new functional ID is served before the old one is retired so the region is never
+left without the content
+*/
+func (m *MasterContentManager) swapFunctionalID(regionID string, oldFID string, newFID string, size int64) error {
+	rollbackOperations := make([]func() error, 0)
+	serverAddr, err := m.state.GetServerPrivateAddress(regionID)
+	if err != nil {
+		return err
+	}
+
+	// Serve new functional ID, update rollback operations
+	if err = m.publishContentToAllocator(regionID, newFID, size); err != nil {
+		return err
+	}
+	rollbackOperations = append(rollbackOperations, func() error {
+		return m.unpublishContentFromAllocator(regionID, newFID)
+	})
+	if err = m.startServingAtEdge(serverAddr, newFID); err != nil {
+		performRollback(rollbackOperations)
+		return err
+	}
+
+	// The old functional ID is no longer published, failing to retire it only leaves unused entries
+	if err = m.stopServingAtEdge(serverAddr, oldFID); err != nil {
+		log.Printf("failed to stop serving %s at %s: %s\n", oldFID, regionID, err.Error())
+	}
+	if err = m.unpublishContentFromAllocator(regionID, oldFID); err != nil {
+		log.Printf("failed to unpublish %s from allocator in %s: %s\n", oldFID, regionID, err.Error())
+	}
+	return nil
+}
+
+/*
+Refresh re-processes 'cid' in place, only digesting and publishing the parts of it
+that changed. Unchanged parts keep their functional IDs, as does the content if
+nothing in it changed. Otherwise every region serving it is moved over to its new
+functional ID, and regions that can't be are dropped. Returns an error without
+changing anything if 'cid' couldn't be re-processed
+*/
+func (m *MasterContentManager) Refresh(cid string) error {
+	oldFID, err := m.state.GetContentFunctionalID(cid)
+	if err != nil {
+		return err
+	}
+
+	functionalID, size, _, err := m.processContent(cid, true)
+	if err != nil {
+		return err
+	}
+	if functionalID == oldFID {
+		return nil
+	}
+
+	// Regions may have changed while the lock was released
+	regions, err := m.state.ContentServerList(cid)
+	if err != nil {
+		return err
+	}
+
+	for _, regionID := range regions {
+		if err = m.swapFunctionalID(regionID, oldFID, functionalID, size); err != nil {
+			log.Printf("failed to move %s to %s in %s, no longer serving it there: %s\n",
+				cid, functionalID, regionID, err.Error())
+			if serverAddr, err := m.state.GetServerPrivateAddress(regionID); err == nil {
+				m.stopServingAtEdge(serverAddr, oldFID)
+			}
+			m.unpublishContentFromAllocator(regionID, oldFID)
+			m.state.DeleteContentLocationEntry(cid, regionID)
+		}
+	}
+	return nil
+}
+
 /*
 Use Lock every time Set, Remove, or any combination of MasterContentManager calls are
 made that are supposed to be a single unit(ie. a transaction)
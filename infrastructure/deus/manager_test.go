@@ -3,10 +3,13 @@ package deus
 import (
 	"encoding/json"
 	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 
 	infra "github.com/Apiara/ApiaraCDN/infrastructure"
 	"github.com/Apiara/ApiaraCDN/infrastructure/state"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestMasterContentManager(t *testing.T) {
@@ -36,12 +39,15 @@ func TestMasterContentManager(t *testing.T) {
 	serverID := "server_id"
 	serverAddr := mockAPIAddr
 	microserviceState := state.NewMockMicroserviceState()
-	manager, err := NewMasterContentManager(microserviceState, mockAPIAddr, mockAPIAddr)
+	manager, err := NewMasterContentManager(microserviceState, mockAPIAddr, mockAPIAddr, "", nil)
 	if err != nil {
 		t.Fatalf("Failed to create manager: %v", err)
 	}
 
 	microserviceState.CreateServerEntry(serverID, serverAddr, serverAddr)
+	manager.Lock()
+	defer manager.Unlock()
+
 	// Do Serve test
 	if err := manager.Serve(cid, serverID, true); err != nil {
 		t.Fatalf("Failed to start serving data: %v", err)
@@ -63,3 +69,76 @@ func TestMasterContentManager(t *testing.T) {
 		t.Fatalf("Failed propogate serve removal to content state")
 	}
 }
+
+// regionMicroserviceState is a mock state that reports content as served in fixed regions
+type regionMicroserviceState struct {
+	*state.MockMicroserviceState
+	regions []string
+}
+
+func (r *regionMicroserviceState) ContentServerList(cid string) ([]string, error) {
+	return r.regions, nil
+}
+
+func TestMasterContentManagerRefresh(t *testing.T) {
+	secret := []byte("secret")
+	receiver := NewProcessingCallbackReceiver(secret)
+
+	// Mock cyprus, crow and damocles record the requests they receive
+	var mutex sync.Mutex
+	requests := make([]string, 0)
+	updatedFID := "fid-2"
+	record := func(resp http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests = append(requests, req.URL.Path+" "+req.URL.Query().Get(infra.ContentFunctionalIDParam))
+	}
+	microserviceState := &regionMicroserviceState{state.NewMockMicroserviceState(), []string{"region"}}
+	mockAPI := http.NewServeMux()
+	mockAPI.Handle(infra.DeusServiceAPIProcessCallbackResource, receiver)
+	mockAPI.HandleFunc(infra.CyprusServiceAPIProcessResource, func(resp http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "true", req.URL.Query().Get(infra.UpdateIngestParam), "expected update job")
+		cid := req.URL.Query().Get(infra.ContentIDParam)
+
+		// Publishing replaces the content entry like cyprus storage does
+		microserviceState.CreateContentEntry(cid, updatedFID, 20, []string{})
+		callback := req.URL.Query().Get(infra.ProcessingCallbackParam)
+		go postCallback(callback, secret, infra.JobResponse{ContentID: cid, StatusResponse: infra.StatusResponse{
+			Status:   infra.FinishedProcessing,
+			Metadata: &infra.PostProcessingMetadata{FunctionalID: updatedFID, ByteSize: 20},
+		}})
+	})
+	mockAPI.HandleFunc(infra.CrowServiceAPIPublishResource, record)
+	mockAPI.HandleFunc(infra.CrowServiceAPIPurgeResource, record)
+	mockAPI.HandleFunc(infra.DamoclesServiceAPIAddResource, record)
+	mockAPI.HandleFunc(infra.DamoclesServiceAPIDelResource, record)
+	server := httptest.NewServer(mockAPI)
+	defer server.Close()
+
+	microserviceState.CreateServerEntry("region", server.URL, server.URL)
+	microserviceState.CreateContentEntry("cid", "fid-1", 10, []string{})
+	manager, err := NewMasterContentManager(microserviceState, server.URL, server.URL, server.URL, receiver)
+	assert.Nil(t, err, "should not return error")
+
+	// Regions are moved over to the new functional ID before the old one is retired
+	manager.Lock()
+	defer manager.Unlock()
+	assert.Nil(t, manager.Refresh("cid"), "should not return error")
+	assert.Equal(t, []string{
+		infra.CrowServiceAPIPublishResource + " fid-2",
+		infra.DamoclesServiceAPIAddResource + " fid-2",
+		infra.DamoclesServiceAPIDelResource + " fid-1",
+		infra.CrowServiceAPIPurgeResource + " fid-1",
+	}, requests, "wrong requests")
+	_, err = microserviceState.GetContentID("fid-1")
+	assert.NotNil(t, err, "expected old functional ID to no longer resolve")
+	foundCid, err := microserviceState.GetContentID("fid-2")
+	assert.Nil(t, err, "should not return error")
+	assert.Equal(t, "cid", foundCid, "expected new functional ID to resolve")
+
+	// Content that kept its functional ID stays as it is
+	requests = requests[:0]
+	microserviceState.CreateContentEntry("cid", "fid-2", 20, []string{})
+	assert.Nil(t, manager.Refresh("cid"), "should not return error")
+	assert.Empty(t, requests, "expected no requests")
+}
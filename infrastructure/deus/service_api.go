@@ -28,9 +28,15 @@ func handleStaleReport(cid string, checker DataValidator,
 		return
 	}
 
-	// Remove stale data
+	// Update stale data in place, only republishing what changed
 	manager.Lock()
 	defer manager.Unlock()
+	if err = manager.Refresh(cid); err == nil {
+		return
+	}
+	log.Printf("Failed to refresh %s, re-processing it instead: %v\n", cid, err)
+
+	// Remove stale data
 	for _, serverID := range serverList {
 		dynamic[serverID], err = state.WasContentPulled(cid, serverID)
 		if err != nil {
@@ -49,11 +55,19 @@ func handleStaleReport(cid string, checker DataValidator,
 	}
 }
 
-// StartServiceAPI starts the API used for changing of network state during runtime
+/*
+StartServiceAPI starts the API used for changing of network state during runtime.
+If receiver is not nil it is served as the cyprus processing callback endpoint
+*/
 func StartServiceAPI(listenAddr string, checker DataValidator, state ManagerMicroserviceState,
-	decider PullDecider, manager ContentManager) {
+	decider PullDecider, manager ContentManager, receiver *ProcessingCallbackReceiver) {
 	serviceAPI := http.NewServeMux()
 
+	// Receive completion callbacks of processing jobs started by the manager
+	if receiver != nil {
+		serviceAPI.Handle(infra.DeusServiceAPIProcessCallbackResource, receiver)
+	}
+
 	// Push allows manually pushing of data onto the network
 	serviceAPI.HandleFunc(infra.DeusServiceAPIPushResource,
 		func(resp http.ResponseWriter, req *http.Request) {
@@ -0,0 +1,24 @@
+package deus
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/Apiara/ApiaraCDN/infrastructure/state"
+	"github.com/stretchr/testify/assert"
+)
+
+// staleDataValidator reports all content as stale
+type staleDataValidator struct{}
+
+func (s *staleDataValidator) IsStale(string) (bool, error) { return true, nil }
+
+func TestHandleStaleReport(t *testing.T) {
+	manager := &mockContentManager{mutex: &sync.Mutex{}, serving: map[string]bool{"cidserver": true}}
+	microserviceState := state.NewMockMicroserviceState()
+
+	// Stale content is refreshed in place instead of being removed
+	handleStaleReport("cid", &staleDataValidator{}, microserviceState, manager)
+	assert.Equal(t, []string{"cid"}, manager.refreshed, "expected content to be refreshed")
+	assert.True(t, manager.serving["cidserver"], "expected content to keep being served")
+}
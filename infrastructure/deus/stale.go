@@ -36,10 +36,12 @@ type ChecksumDataValidator struct {
 /*
 NewChecksumDataValidator creates a new ChecksumDataValidator with the provided
 preprocessor and dataIndex, retrieving internal copies of data from the
-internalDataAddr base URL
+internalDataAddr base URL and content keys from the cyprus storage API at
+keyAPIAddr using keyToken. encryptionMode is the cyprus encryption mode
+internal copies are published in
 */
-func NewChecksumDataValidator(internalDataAddr string, preprocessor cyprus.DataPreprocessor,
-	dataIndex state.ContentMetadataStateReader) (*ChecksumDataValidator, error) {
+func NewChecksumDataValidator(internalDataAddr string, keyAPIAddr string, keyToken string, encryptionMode string,
+	preprocessor cyprus.DataPreprocessor, dataIndex state.ContentMetadataStateReader) (*ChecksumDataValidator, error) {
 
 	contentBaseURL, err := url.JoinPath(internalDataAddr, infra.CryptDataStorageDir)
 	if err != nil {
@@ -49,21 +51,53 @@ func NewChecksumDataValidator(internalDataAddr string, preprocessor cyprus.DataP
 	if err != nil {
 		return nil, fmt.Errorf("failed to create metadata download base URL: %w", err)
 	}
-	keyBaseURL, err := url.JoinPath(internalDataAddr, infra.AESKeyStorageDir)
+	return newChecksumDataValidator(&aesInternalDataAccessor{
+		metadataBaseURL: metadataBaseURL,
+		contentBaseURL:  contentBaseURL,
+		retrieveFile:    cyprus.DownloadFile,
+	}, keyAPIAddr, keyToken, encryptionMode, preprocessor, dataIndex)
+}
+
+/*
+NewStorageChecksumDataValidator creates a new ChecksumDataValidator like
+NewChecksumDataValidator, but reads internal copies of data straight from the
+store cyprus publishes to through reader. Keys are still retrieved from the
+cyprus storage API at keyAPIAddr since only it can unwrap them
+*/
+func NewStorageChecksumDataValidator(reader cyprus.StorageReader, keyAPIAddr string, keyToken string,
+	encryptionMode string, preprocessor cyprus.DataPreprocessor,
+	dataIndex state.ContentMetadataStateReader) (*ChecksumDataValidator, error) {
+	return newChecksumDataValidator(&aesInternalDataAccessor{
+		metadataBaseURL: infra.CompleteMediaMapDir,
+		contentBaseURL:  infra.CryptDataStorageDir,
+		retrieveFile:    reader.ReadObject,
+	}, keyAPIAddr, keyToken, encryptionMode, preprocessor, dataIndex)
+}
+
+/*
+newChecksumDataValidator completes accessor with key retrieval from keyAPIAddr
+and the decryption mode of encryptionMode and creates the validator
+*/
+func newChecksumDataValidator(accessor *aesInternalDataAccessor, keyAPIAddr string, keyToken string,
+	encryptionMode string, preprocessor cyprus.DataPreprocessor,
+	dataIndex state.ContentMetadataStateReader) (*ChecksumDataValidator, error) {
+	authenticated, err := isAuthenticatedMode(encryptionMode)
+	if err != nil {
+		return nil, err
+	}
+	accessor.authenticated = authenticated
+	keyBaseURL, err := url.JoinPath(keyAPIAddr, infra.CyprusStorageAPIKeyResource)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create key download base URL: %w", err)
 	}
+	accessor.keyBaseURL = keyBaseURL
+	accessor.retrieveKey = newAuthorizedRetriever(keyToken)
 
 	return &ChecksumDataValidator{
-		accessor: &aesInternalDataAccessor{
-			metadataBaseURL: metadataBaseURL,
-			keyBaseURL:      keyBaseURL,
-			contentBaseURL:  contentBaseURL,
-			retrieveFile:    cyprus.DownloadFile,
-		},
+		accessor:          accessor,
 		mediaPreprocessor: preprocessor,
 		dataIndex:         dataIndex,
-		contentBaseURL:    contentBaseURL,
+		contentBaseURL:    accessor.contentBaseURL,
 	}, nil
 }
 
@@ -106,22 +140,28 @@ func (c *ChecksumDataValidator) getVODMediaInternalChecksum(cid string) ([]byte,
 	}
 
 	// Get list of all functional IDs in increasing order for reproducability
+	wrappedKeys := make(map[string]string)
 	functionalIDs := make([]string, 0)
 	for _, stream := range mediaMap.Streams {
 		for _, segment := range stream.Segments {
 			functionalIDs = append(functionalIDs, segment.FunctionalID)
+			wrappedKeys[segment.FunctionalID] = segment.WrappedKey
 		}
 	}
 	sort.Strings(functionalIDs)
 
-	// Get content and calculate checksum
+	// Get content and calculate checksum, decrypting convergent segments with their own key
 	hasher := sha256.New()
 	for _, fid := range functionalIDs {
 		downloadURL, err := url.JoinPath(c.contentBaseURL, fid)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create %s download URL for %s checksum creation: %w", fid, cid, err)
 		}
-		if err = c.accessor.GetContent(downloadURL, cryptKey, hasher); err != nil {
+		segmentKey, err := cyprus.UnwrapSegmentKey(cryptKey, wrappedKeys[fid], fid)
+		if err != nil {
+			return nil, err
+		}
+		if err = c.accessor.GetContent(downloadURL, segmentKey, hasher); err != nil {
 			return nil, err
 		}
 	}
@@ -37,6 +37,7 @@ func TestChecksumDataValidator(t *testing.T) {
 			keyBaseURL:      "./test_resources/keys",
 			contentBaseURL:  "./test_resources/content",
 			retrieveFile:    cyprus.CopyFromDisk,
+			retrieveKey:     cyprus.CopyFromDisk,
 		},
 		mediaPreprocessor: preprocessor,
 		dataIndex:         dataIndex,
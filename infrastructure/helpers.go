@@ -2,13 +2,17 @@ package infrastructure
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 )
 
 /*
@@ -21,6 +25,56 @@ func URLToSafeName(url string) string {
 	return safe
 }
 
+// SignPayload returns the hex encoded HMAC-SHA256 of payload under secret
+func SignPayload(secret []byte, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyPayloadSignature checks in constant time that signature was created by SignPayload
+func VerifyPayloadSignature(secret []byte, payload []byte, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// timestampedPayload binds payload to the unix time it was signed at
+func timestampedPayload(timestamp string, payload []byte) []byte {
+	return append([]byte(timestamp+"."), payload...)
+}
+
+/*
+SignTimestampedPayload signs payload along with the time it is sent at, returning
+the unix timestamp and signature to send with it. Receivers verify both with
+VerifyTimestampedPayload so captured payloads can't be replayed later on
+*/
+func SignTimestampedPayload(secret []byte, payload []byte, sentAt time.Time) (string, string) {
+	timestamp := strconv.FormatInt(sentAt.Unix(), 10)
+	return timestamp, SignPayload(secret, timestampedPayload(timestamp, payload))
+}
+
+/*
+VerifyTimestampedPayload checks that signature was created by SignTimestampedPayload
+for payload sent at timestamp, and that timestamp is within maxAge of now
+*/
+func VerifyTimestampedPayload(secret []byte, payload []byte, timestamp string, signature string,
+	maxAge time.Duration, now time.Time) bool {
+	sentAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := now.Sub(time.Unix(sentAt, 0))
+	if age > maxAge || age < -maxAge {
+		return false
+	}
+	return VerifyPayloadSignature(secret, timestampedPayload(timestamp, payload), signature)
+}
+
 // RequestBodyDecoder represents a function that can decode a HTTP response body
 type RequestBodyDecoder func(io.Reader, interface{}) error
 
@@ -43,6 +97,11 @@ func GOBBodyDecoder(in io.Reader, result interface{}) error {
 	return nil
 }
 
+// JSONBodyDecoder decodes in as JSON into 'result'
+func JSONBodyDecoder(in io.Reader, result interface{}) error {
+	return json.NewDecoder(in).Decode(result)
+}
+
 // MakeHTTPRequest is a generic function for making an HTTP request and receiving/decoding a body response
 func MakeHTTPRequest(url string, query url.Values, body io.Reader,
 	client *http.Client, dec RequestBodyDecoder, result interface{}) error {
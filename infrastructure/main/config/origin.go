@@ -0,0 +1,61 @@
+package config
+
+import (
+	"time"
+
+	"github.com/Apiara/ApiaraCDN/infrastructure/cyprus"
+)
+
+/*
+OriginProfileConfig is the TOML form of a cyprus.OriginProfile, shared by
+every service that ingests from customer origins
+
+Config Format
+--------------
+[[origin_profiles]]
+hosts = [ "media.example.com", ... ]
+url_prefixes = [ "https://cdn.example.com/private/", ... ]
+headers = { "X-Api-Key" = string, ... }
+cookies = { "CloudFront-Signature" = string, ... }
+bearer_token = string
+basic_username = string
+basic_password = string
+client_cert_file = "../origin.crt"
+client_key_file = "../origin.key"
+ca_file = "../origin_ca.pem"
+timeout = time.Duration
+*/
+type OriginProfileConfig struct {
+	Hosts          []string          `toml:"hosts"`
+	URLPrefixes    []string          `toml:"url_prefixes"`
+	Headers        map[string]string `toml:"headers"`
+	Cookies        map[string]string `toml:"cookies"`
+	BearerToken    string            `toml:"bearer_token"`
+	BasicUsername  string            `toml:"basic_username"`
+	BasicPassword  string            `toml:"basic_password"`
+	ClientCertFile string            `toml:"client_cert_file"`
+	ClientKeyFile  string            `toml:"client_key_file"`
+	CAFile         string            `toml:"ca_file"`
+	Timeout        time.Duration     `toml:"timeout"`
+}
+
+// OriginProfiles converts confs to the profiles a cyprus.Downloader is enabled with
+func OriginProfiles(confs []OriginProfileConfig) []cyprus.OriginProfile {
+	profiles := make([]cyprus.OriginProfile, 0, len(confs))
+	for _, conf := range confs {
+		profiles = append(profiles, cyprus.OriginProfile{
+			Hosts:          conf.Hosts,
+			URLPrefixes:    conf.URLPrefixes,
+			Headers:        conf.Headers,
+			Cookies:        conf.Cookies,
+			BearerToken:    conf.BearerToken,
+			BasicUsername:  conf.BasicUsername,
+			BasicPassword:  conf.BasicPassword,
+			ClientCertFile: conf.ClientCertFile,
+			ClientKeyFile:  conf.ClientKeyFile,
+			CAFile:         conf.CAFile,
+			Timeout:        conf.Timeout,
+		})
+	}
+	return profiles
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
@@ -16,18 +17,43 @@ import (
 Config Format
 --------------
 size_classes = [int, int, ...]
+precompute_frequency = time.Duration
 service_listen_port = int
 allocator_listen_port = int
+reconcile_frequency = time.Duration
+coverage_window = time.Duration
+
+allocator_strategy = "precomputed" | "quality"
+target_bandwidth = int
+session_history_address = string
+session_history_window = time.Duration
+session_history_ttl = time.Duration (how long an endpoints history is reused, defaults to a minute)
 
 state_address = string
+storage_address = string
+descriptor_cache_ttl = time.Duration (how long download descriptors are reused, defaults to 10s)
 */
 
+const (
+	precomputedAllocatorStrategy = "precomputed"
+	qualityAllocatorStrategy     = "quality"
+)
+
 type crowConfig struct {
 	SizeClasses             []int64       `toml:"size_classes"`
 	ServicePort             int           `toml:"service_listen_port"`
 	AllocatorPort           int           `toml:"allocator_listen_port"`
 	StateServiceAddress     string        `toml:"state_address"`
+	StorageServiceAddress   string        `toml:"storage_address"`
+	DescriptorCacheTTL      time.Duration `toml:"descriptor_cache_ttl"`
 	AllocatorPrecomputeFreq time.Duration `toml:"precompute_frequency"`
+	ReconcileFrequency      time.Duration `toml:"reconcile_frequency"`
+	CoverageWindow          time.Duration `toml:"coverage_window"`
+	AllocatorStrategy       string        `toml:"allocator_strategy"`
+	TargetBandwidth         int64         `toml:"target_bandwidth"`
+	SessionHistoryAddress   string        `toml:"session_history_address"`
+	SessionHistoryWindow    time.Duration `toml:"session_history_window"`
+	SessionHistoryTTL       time.Duration `toml:"session_history_ttl"`
 }
 
 func main() {
@@ -54,21 +80,49 @@ func main() {
 		if err != nil {
 			return nil, err
 		}
-		alloc, err := crow.NewPrecomputedDataAllocator(edgeServerAddr, conf.AllocatorPrecomputeFreq, conf.SizeClasses)
-		if err != nil {
-			return nil, err
+		switch conf.AllocatorStrategy {
+		case qualityAllocatorStrategy:
+			return crow.NewQualityWeightedDataAllocator(edgeServerAddr, conf.AllocatorPrecomputeFreq)
+		case precomputedAllocatorStrategy, "":
+			return crow.NewPrecomputedDataAllocator(edgeServerAddr, conf.AllocatorPrecomputeFreq, conf.SizeClasses)
+		default:
+			return nil, fmt.Errorf("unknown allocator strategy %s", conf.AllocatorStrategy)
 		}
-		return alloc, nil
 	}
 	allocator := crow.NewCompoundLocationDataAllocator(conf.SizeClasses, allocatorConstructor)
 
+	// Create endpoint quality scorer, optionally cross-checked against session history
+	var history crow.EndpointHistory
+	if conf.SessionHistoryAddress != "" {
+		history, err = crow.NewDominiqueEndpointHistory(conf.SessionHistoryAddress)
+		if err != nil {
+			panic(err)
+		}
+	}
+	scorer := crow.NewReportedQualityScorer(conf.TargetBandwidth, history, conf.SessionHistoryWindow,
+		conf.SessionHistoryTTL)
+
+	// Create allocation download descriptor resolver
+	describer, err := crow.NewCyprusContentDescriber(conf.StorageServiceAddress, microserviceState,
+		conf.DescriptorCacheTTL)
+	if err != nil {
+		panic(err)
+	}
+
+	// Create regional coverage estimator
+	coverage := crow.NewCoverageEstimator(microserviceState, conf.CoverageWindow)
+
 	// Sync crow state with what network expects of it
-	if err = crow.LoadContent(microserviceState, allocator); err != nil {
+	reconciler := crow.NewContentReconciler(microserviceState, allocator)
+	if _, err = reconciler.Reconcile(); err != nil {
 		panic(err)
 	}
 
 	// Start service APIs
 	log.SetOutput(os.Stdout)
-	go crow.StartDataAllocatorAPI(allocatorAddr, allocator)
-	crow.StartServiceAPI(serviceAddr, allocator)
+	if conf.ReconcileFrequency > 0 {
+		go crow.StartContentReconciler(reconciler, conf.ReconcileFrequency)
+	}
+	go crow.StartDataAllocatorAPI(allocatorAddr, allocator, describer, scorer, coverage)
+	crow.StartServiceAPI(serviceAddr, allocator, coverage, reconciler)
 }
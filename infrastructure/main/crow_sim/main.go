@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
+	"github.com/Apiara/ApiaraCDN/infrastructure/crow"
+	"github.com/Apiara/ApiaraCDN/infrastructure/damocles"
+	"github.com/Apiara/ApiaraCDN/infrastructure/main/config"
+)
+
+/*
+Config Format
+--------------
+allocator = "even" | "precomputed" | "quality"
+size_classes = [int, int, ...]
+precompute_frequency = time.Duration
+tracker_collection_duration = time.Duration
+seed = int
+ticks = int
+tick_interval = time.Duration
+
+[endpoints]
+arrival_rate = float
+churn_rate = float
+recorded_file = string
+
+  [endpoints.available_space]
+  type = "constant" | "uniform" | "normal" | "exponential"
+  min = int
+  max = int
+  mean = float
+  stddev = float
+
+[catalogue]
+count = int
+popularity_skew = float
+requests_per_tick = int
+recorded_file = string
+
+  [catalogue.size]
+  type = "constant" | "uniform" | "normal" | "exponential"
+  min = int
+  max = int
+  mean = float
+  stddev = float
+*/
+
+const (
+	evenAllocatorName        = "even"
+	precomputedAllocatorName = "precomputed"
+	qualityAllocatorName     = "quality"
+)
+
+type (
+	crowSimConfig struct {
+		Allocator                 string          `toml:"allocator"`
+		SizeClasses               []int64         `toml:"size_classes"`
+		AllocatorPrecomputeFreq   time.Duration   `toml:"precompute_frequency"`
+		TrackerCollectionDuration time.Duration   `toml:"tracker_collection_duration"`
+		Seed                      int64           `toml:"seed"`
+		Ticks                     int             `toml:"ticks"`
+		TickInterval              time.Duration   `toml:"tick_interval"`
+		Endpoints                 endpointsConfig `toml:"endpoints"`
+		Catalogue                 catalogueConfig `toml:"catalogue"`
+	}
+
+	endpointsConfig struct {
+		ArrivalRate    float64            `toml:"arrival_rate"`
+		ChurnRate      float64            `toml:"churn_rate"`
+		RecordedFile   string             `toml:"recorded_file"`
+		AvailableSpace distributionConfig `toml:"available_space"`
+	}
+
+	catalogueConfig struct {
+		Count           int                `toml:"count"`
+		PopularitySkew  float64            `toml:"popularity_skew"`
+		RequestsPerTick int                `toml:"requests_per_tick"`
+		RecordedFile    string             `toml:"recorded_file"`
+		Size            distributionConfig `toml:"size"`
+	}
+)
+
+/*
+startPriorityServer serves the need tracker snapshot the same way a damocles
+service API does so allocators that pull priorities can be simulated
+*/
+func startPriorityServer(tracker damocles.NeedTracker) *httptest.Server {
+	api := http.NewServeMux()
+	api.HandleFunc(infra.DamoclesServiceAPIPriorityListResource,
+		func(resp http.ResponseWriter, req *http.Request) {
+			if err := gob.NewEncoder(resp).Encode(tracker.GetSnapshot()); err != nil {
+				resp.WriteHeader(http.StatusInternalServerError)
+			}
+		})
+	return httptest.NewServer(api)
+}
+
+// createAllocator builds the DataAllocator named in the configuration
+func createAllocator(conf crowSimConfig, priorityServerAddr string) (crow.DataAllocator, error) {
+	// Allocators sort size classes in place so always hand them a copy
+	sizeClasses := append([]int64{}, conf.SizeClasses...)
+
+	switch conf.Allocator {
+	case evenAllocatorName:
+		return crow.NewEvenDataAllocator(sizeClasses), nil
+	case precomputedAllocatorName:
+		return crow.NewPrecomputedDataAllocator(priorityServerAddr, conf.AllocatorPrecomputeFreq, sizeClasses)
+	case qualityAllocatorName:
+		return crow.NewQualityWeightedDataAllocator(priorityServerAddr, conf.AllocatorPrecomputeFreq)
+	default:
+		return nil, fmt.Errorf("unknown allocator %q", conf.Allocator)
+	}
+}
+
+func main() {
+	fnamePtr := flag.String("config", "", "TOML configuration file path")
+	jsonPtr := flag.Bool("json", false, "Output simulation report as JSON")
+	flag.Parse()
+
+	var conf crowSimConfig
+	if err := config.ReadTOMLConfig(*fnamePtr, &conf); err != nil {
+		panic(err)
+	}
+	rng := rand.New(rand.NewSource(conf.Seed))
+
+	// Create population and catalogue
+	catalogue, err := loadCatalogue(conf.Catalogue, rng)
+	if err != nil {
+		panic(err)
+	}
+	arrivals, err := loadArrivals(conf.Endpoints, conf.Ticks, rng)
+	if err != nil {
+		panic(err)
+	}
+
+	// Create allocator and demand source
+	tracker := damocles.NewDesperationTracker(conf.TrackerCollectionDuration)
+	priorityServer := startPriorityServer(tracker)
+	defer priorityServer.Close()
+
+	allocator, err := createAllocator(conf, priorityServer.URL)
+	if err != nil {
+		panic(err)
+	}
+	for _, content := range catalogue.items {
+		if err = tracker.CreateCategory(content.id); err != nil {
+			panic(err)
+		}
+		if err = allocator.NewEntry(content.id, content.size); err != nil {
+			panic(err)
+		}
+	}
+
+	// Give allocators that precompute solutions a chance to run once
+	if conf.Allocator == precomputedAllocatorName || conf.Allocator == qualityAllocatorName {
+		time.Sleep(conf.AllocatorPrecomputeFreq * 2)
+	}
+
+	// Run and report
+	sim := newSimulation(allocator, tracker, catalogue, conf, rng)
+	if err = sim.run(arrivals); err != nil {
+		panic(err)
+	}
+
+	report := sim.report()
+	if *jsonPtr {
+		err = report.writeJSON(os.Stdout)
+	} else {
+		err = report.writeText(os.Stdout)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
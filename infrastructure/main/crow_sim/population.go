@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+)
+
+const (
+	constantDistribution    = "constant"
+	uniformDistribution     = "uniform"
+	normalDistribution      = "normal"
+	exponentialDistribution = "exponential"
+)
+
+// distributionConfig describes a distribution of byte sizes clamped to [Min, Max]
+type distributionConfig struct {
+	Type   string  `toml:"type"`
+	Min    int64   `toml:"min"`
+	Max    int64   `toml:"max"`
+	Mean   float64 `toml:"mean"`
+	StdDev float64 `toml:"stddev"`
+}
+
+// sample draws a single value from the distribution
+func (d distributionConfig) sample(rng *rand.Rand) (int64, error) {
+	var value float64
+	switch d.Type {
+	case constantDistribution:
+		value = d.Mean
+	case uniformDistribution:
+		if d.Max <= d.Min {
+			return d.Min, nil
+		}
+		return d.Min + rng.Int63n(d.Max-d.Min+1), nil
+	case normalDistribution:
+		value = rng.NormFloat64()*d.StdDev + d.Mean
+	case exponentialDistribution:
+		value = rng.ExpFloat64() * d.Mean
+	default:
+		return -1, fmt.Errorf("unknown distribution type %q", d.Type)
+	}
+
+	// Clamp to configured bounds
+	size := int64(math.Round(value))
+	if size < d.Min {
+		size = d.Min
+	}
+	if d.Max > 0 && size > d.Max {
+		size = d.Max
+	}
+	return size, nil
+}
+
+// samplePoisson draws the number of events for a Poisson process with rate lambda
+func samplePoisson(rng *rand.Rand, lambda float64) int {
+	if lambda <= 0 {
+		return 0
+	}
+
+	// Normal approximation for large rates
+	if lambda > 30 {
+		n := int(math.Round(rng.NormFloat64()*math.Sqrt(lambda) + lambda))
+		if n < 0 {
+			return 0
+		}
+		return n
+	}
+
+	// Knuth's algorithm for small rates
+	limit := math.Exp(-lambda)
+	n := 0
+	p := rng.Float64()
+	for p > limit {
+		n++
+		p *= rng.Float64()
+	}
+	return n
+}
+
+// contentItem is a single entry in the simulated content catalogue
+type contentItem struct {
+	id     string
+	size   int64
+	weight float64
+}
+
+// contentCatalogue is a list of content with popularity weighted sampling
+type contentCatalogue struct {
+	items      []contentItem
+	cumulative []float64
+}
+
+func newContentCatalogue(items []contentItem) (*contentCatalogue, error) {
+	if len(items) == 0 {
+		return nil, fmt.Errorf("content catalogue is empty")
+	}
+
+	cumulative := make([]float64, len(items))
+	total := 0.0
+	for i, item := range items {
+		total += item.weight
+		cumulative[i] = total
+	}
+	if total <= 0 {
+		return nil, fmt.Errorf("content catalogue has no popularity weight")
+	}
+	return &contentCatalogue{items: items, cumulative: cumulative}, nil
+}
+
+// sampleContent picks a content index proportionally to its popularity weight
+func (c *contentCatalogue) sampleContent(rng *rand.Rand) int {
+	target := rng.Float64() * c.cumulative[len(c.cumulative)-1]
+	return sort.SearchFloat64s(c.cumulative, target)
+}
+
+// readCSV reads every record in fname, requiring at least minFields per record
+func readCSV(fname string, minFields int) ([][]string, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+
+	records := make([][]string, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", fname, err)
+		}
+		if len(record) < minFields {
+			return nil, fmt.Errorf("record %v in %s has fewer than %d fields", record, fname, minFields)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+/*
+loadCatalogue creates the simulated content catalogue. A recorded catalogue
+is a CSV of 'id,size,weight' records, otherwise conf.Count items are
+generated with Zipf-like popularity weights
+*/
+func loadCatalogue(conf catalogueConfig, rng *rand.Rand) (*contentCatalogue, error) {
+	items := make([]contentItem, 0)
+	if conf.RecordedFile != "" {
+		records, err := readCSV(conf.RecordedFile, 3)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load recorded catalogue: %w", err)
+		}
+		for _, record := range records {
+			size, err := strconv.ParseInt(record[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size for content %s: %w", record[0], err)
+			}
+			weight, err := strconv.ParseFloat(record[2], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid weight for content %s: %w", record[0], err)
+			}
+			items = append(items, contentItem{id: record[0], size: size, weight: weight})
+		}
+		return newContentCatalogue(items)
+	}
+
+	for rank := 1; rank <= conf.Count; rank++ {
+		size, err := conf.Size.sample(rng)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate catalogue: %w", err)
+		}
+		items = append(items, contentItem{
+			id:     "fid" + strconv.Itoa(rank),
+			size:   size,
+			weight: 1 / math.Pow(float64(rank), conf.PopularitySkew),
+		})
+	}
+	return newContentCatalogue(items)
+}
+
+// endpointArrival describes an endpoint joining the network. lifetime < 0 uses churn
+type endpointArrival struct {
+	tick           int
+	availableSpace int64
+	lifetime       int
+}
+
+/*
+loadArrivals creates the endpoint population. A recorded population is a CSV
+of 'arrival_tick,available_space[,lifetime_ticks]' records, otherwise
+arrivals are generated as a Poisson process over 'ticks'
+*/
+func loadArrivals(conf endpointsConfig, ticks int, rng *rand.Rand) ([]endpointArrival, error) {
+	arrivals := make([]endpointArrival, 0)
+	if conf.RecordedFile != "" {
+		records, err := readCSV(conf.RecordedFile, 2)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load recorded population: %w", err)
+		}
+		for _, record := range records {
+			arrival := endpointArrival{lifetime: -1}
+			if arrival.tick, err = strconv.Atoi(record[0]); err != nil {
+				return nil, fmt.Errorf("invalid arrival tick %s: %w", record[0], err)
+			}
+			if arrival.availableSpace, err = strconv.ParseInt(record[1], 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid available space %s: %w", record[1], err)
+			}
+			if len(record) > 2 {
+				if arrival.lifetime, err = strconv.Atoi(record[2]); err != nil {
+					return nil, fmt.Errorf("invalid lifetime %s: %w", record[2], err)
+				}
+			}
+			arrivals = append(arrivals, arrival)
+		}
+		sort.SliceStable(arrivals, func(i, j int) bool { return arrivals[i].tick < arrivals[j].tick })
+		return arrivals, nil
+	}
+
+	for tick := 0; tick < ticks; tick++ {
+		for n := samplePoisson(rng, conf.ArrivalRate); n > 0; n-- {
+			space, err := conf.AvailableSpace.sample(rng)
+			if err != nil {
+				return nil, fmt.Errorf("failed to generate population: %w", err)
+			}
+			arrivals = append(arrivals, endpointArrival{tick: tick, availableSpace: space, lifetime: -1})
+		}
+	}
+	return arrivals, nil
+}
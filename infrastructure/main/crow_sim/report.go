@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+type (
+	simulationReport struct {
+		Allocator                string              `json:"allocator"`
+		Endpoints                int                 `json:"endpoints"`
+		LiveEndpoints            int                 `json:"live_endpoints"`
+		Content                  int                 `json:"content"`
+		FillRatio                float64             `json:"fill_ratio"`
+		OvercommittedAllocations int                 `json:"overcommitted_allocations"`
+		EmptyAllocations         int                 `json:"empty_allocations"`
+		FailedAllocations        int                 `json:"failed_allocations"`
+		ReplicaDistribution      replicaDistribution `json:"replicas"`
+		AllocationGini           float64             `json:"allocation_gini"`
+		AllocationLatency        latencySummary      `json:"allocation_latency"`
+	}
+
+	// replica counts of every content item across live endpoints
+	replicaDistribution struct {
+		Min       int64           `json:"min"`
+		Max       int64           `json:"max"`
+		Mean      float64         `json:"mean"`
+		P50       int64           `json:"p50"`
+		P90       int64           `json:"p90"`
+		P99       int64           `json:"p99"`
+		Histogram map[int64]int64 `json:"histogram"`
+	}
+
+	latencySummary struct {
+		Mean time.Duration `json:"mean_ns"`
+		P50  time.Duration `json:"p50_ns"`
+		P90  time.Duration `json:"p90_ns"`
+		P99  time.Duration `json:"p99_ns"`
+		Max  time.Duration `json:"max_ns"`
+	}
+)
+
+// percentileIndex returns the index of percentile p in a sorted list of length n
+func percentileIndex(n int, p float64) int {
+	idx := int(p * float64(n-1))
+	if idx < 0 {
+		return 0
+	}
+	return idx
+}
+
+func summarizeReplicas(replicas []int64) replicaDistribution {
+	dist := replicaDistribution{Histogram: make(map[int64]int64)}
+	if len(replicas) == 0 {
+		return dist
+	}
+
+	sorted := append([]int64{}, replicas...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	total := int64(0)
+	for _, count := range sorted {
+		total += count
+		dist.Histogram[count]++
+	}
+	dist.Min = sorted[0]
+	dist.Max = sorted[len(sorted)-1]
+	dist.Mean = float64(total) / float64(len(sorted))
+	dist.P50 = sorted[percentileIndex(len(sorted), 0.5)]
+	dist.P90 = sorted[percentileIndex(len(sorted), 0.9)]
+	dist.P99 = sorted[percentileIndex(len(sorted), 0.99)]
+	return dist
+}
+
+func summarizeLatencies(latencies []time.Duration) latencySummary {
+	summary := latencySummary{}
+	if len(latencies) == 0 {
+		return summary
+	}
+
+	sorted := append([]time.Duration{}, latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	total := time.Duration(0)
+	for _, latency := range sorted {
+		total += latency
+	}
+	summary.Mean = total / time.Duration(len(sorted))
+	summary.P50 = sorted[percentileIndex(len(sorted), 0.5)]
+	summary.P90 = sorted[percentileIndex(len(sorted), 0.9)]
+	summary.P99 = sorted[percentileIndex(len(sorted), 0.99)]
+	summary.Max = sorted[len(sorted)-1]
+	return summary
+}
+
+/*
+giniCoefficient returns how unevenly 'values' are distributed, where 0
+means perfectly even and values approaching 1 mean maximally uneven
+*/
+func giniCoefficient(values []int64) float64 {
+	n := len(values)
+	if n == 0 {
+		return 0
+	}
+
+	sorted := append([]int64{}, values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	total := 0.0
+	weighted := 0.0
+	for i, value := range sorted {
+		total += float64(value)
+		weighted += float64(i+1) * float64(value)
+	}
+	if total == 0 {
+		return 0
+	}
+	return (2*weighted)/(float64(n)*total) - float64(n+1)/float64(n)
+}
+
+func (r simulationReport) writeJSON(out io.Writer) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func (r simulationReport) writeText(out io.Writer) error {
+	lines := []string{
+		fmt.Sprintf("allocator:                 %s", r.Allocator),
+		fmt.Sprintf("content items:             %d", r.Content),
+		fmt.Sprintf("endpoints (total/live):    %d/%d", r.Endpoints, r.LiveEndpoints),
+		fmt.Sprintf("fill ratio:                %.4f", r.FillRatio),
+		fmt.Sprintf("overcommitted allocations: %d", r.OvercommittedAllocations),
+		fmt.Sprintf("empty allocations:         %d", r.EmptyAllocations),
+		fmt.Sprintf("failed allocations:        %d", r.FailedAllocations),
+		fmt.Sprintf("allocation gini:           %.4f", r.AllocationGini),
+		fmt.Sprintf("replicas min/mean/max:     %d/%.2f/%d", r.ReplicaDistribution.Min,
+			r.ReplicaDistribution.Mean, r.ReplicaDistribution.Max),
+		fmt.Sprintf("replicas p50/p90/p99:      %d/%d/%d", r.ReplicaDistribution.P50,
+			r.ReplicaDistribution.P90, r.ReplicaDistribution.P99),
+		fmt.Sprintf("latency mean/p50/p90:      %s/%s/%s", r.AllocationLatency.Mean,
+			r.AllocationLatency.P50, r.AllocationLatency.P90),
+		fmt.Sprintf("latency p99/max:           %s/%s", r.AllocationLatency.P99, r.AllocationLatency.Max),
+		"replica histogram (replicas: content items):",
+	}
+
+	counts := make([]int64, 0, len(r.ReplicaDistribution.Histogram))
+	for count := range r.ReplicaDistribution.Histogram {
+		counts = append(counts, count)
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i] < counts[j] })
+	for _, count := range counts {
+		lines = append(lines, fmt.Sprintf("  %6d: %d", count, r.ReplicaDistribution.Histogram[count]))
+	}
+
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(out, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/Apiara/ApiaraCDN/infrastructure/crow"
+	"github.com/Apiara/ApiaraCDN/infrastructure/damocles"
+)
+
+// simEndpoint is an endpoint currently holding allocations
+type simEndpoint struct {
+	leaveTick int
+	holding   []int
+}
+
+// simulation replays endpoint arrivals and content demand against an allocator
+type simulation struct {
+	allocator crow.DataAllocator
+	tracker   damocles.NeedTracker
+	catalogue *contentCatalogue
+	conf      crowSimConfig
+	rng       *rand.Rand
+
+	contentIndex map[string]int
+	live         []*simEndpoint
+	replicas     []int64
+	allocations  []int64
+	latencies    []time.Duration
+
+	endpoints      int
+	requestedSpace int64
+	allocatedSpace int64
+	overcommitted  int
+	empty          int
+	failed         int
+}
+
+func newSimulation(allocator crow.DataAllocator, tracker damocles.NeedTracker,
+	catalogue *contentCatalogue, conf crowSimConfig, rng *rand.Rand) *simulation {
+	contentIndex := make(map[string]int)
+	for i, item := range catalogue.items {
+		contentIndex[item.id] = i
+	}
+
+	return &simulation{
+		allocator:    allocator,
+		tracker:      tracker,
+		catalogue:    catalogue,
+		conf:         conf,
+		rng:          rng,
+		contentIndex: contentIndex,
+		live:         make([]*simEndpoint, 0),
+		replicas:     make([]int64, len(catalogue.items)),
+		allocations:  make([]int64, len(catalogue.items)),
+		latencies:    make([]time.Duration, 0),
+	}
+}
+
+// churn removes endpoints that leave the network during 'tick'
+func (s *simulation) churn(tick int) {
+	remaining := s.live[:0]
+	for _, endpoint := range s.live {
+		leaving := endpoint.leaveTick == tick ||
+			(endpoint.leaveTick < 0 && s.rng.Float64() < s.conf.Endpoints.ChurnRate)
+		if !leaving {
+			remaining = append(remaining, endpoint)
+			continue
+		}
+		for _, idx := range endpoint.holding {
+			s.replicas[idx]--
+		}
+	}
+	s.live = remaining
+}
+
+// demand feeds client requests for popular content into the need tracker
+func (s *simulation) demand() {
+	for i := 0; i < s.conf.Catalogue.RequestsPerTick; i++ {
+		idx := s.catalogue.sampleContent(s.rng)
+		s.tracker.AddRequest(s.catalogue.items[idx].id)
+	}
+}
+
+// allocate requests an allocation for a newly arrived endpoint and records the result
+func (s *simulation) allocate(tick int, arrival endpointArrival) error {
+	s.endpoints++
+	s.requestedSpace += arrival.availableSpace
+
+	// Quality aware allocators see endpoints of uniformly distributed quality
+	var fids []string
+	var err error
+	start := time.Now()
+	if qualityAllocator, ok := s.allocator.(crow.QualityAwareDataAllocator); ok {
+		fids, err = qualityAllocator.AllocateSpaceByQuality(arrival.availableSpace, s.rng.Float64())
+	} else {
+		fids, err = s.allocator.AllocateSpace(arrival.availableSpace)
+	}
+	s.latencies = append(s.latencies, time.Since(start))
+	if err != nil {
+		s.failed++
+		return nil
+	}
+	if len(fids) == 0 {
+		s.empty++
+	}
+
+	endpoint := &simEndpoint{leaveTick: -1, holding: make([]int, 0, len(fids))}
+	if arrival.lifetime >= 0 {
+		endpoint.leaveTick = tick + arrival.lifetime
+	}
+
+	allocated := int64(0)
+	for _, fid := range fids {
+		idx, ok := s.contentIndex[fid]
+		if !ok {
+			return fmt.Errorf("allocator returned unknown content %s", fid)
+		}
+		allocated += s.catalogue.items[idx].size
+		s.replicas[idx]++
+		s.allocations[idx]++
+		endpoint.holding = append(endpoint.holding, idx)
+		s.tracker.AddAllocation(fid)
+	}
+	if allocated > arrival.availableSpace {
+		s.overcommitted++
+	}
+	s.allocatedSpace += allocated
+	s.live = append(s.live, endpoint)
+	return nil
+}
+
+// run steps through every tick until all arrivals have been replayed
+func (s *simulation) run(arrivals []endpointArrival) error {
+	ticks := s.conf.Ticks
+	if len(arrivals) > 0 && arrivals[len(arrivals)-1].tick >= ticks {
+		ticks = arrivals[len(arrivals)-1].tick + 1
+	}
+
+	next := 0
+	for tick := 0; tick < ticks; tick++ {
+		s.churn(tick)
+		s.demand()
+		for ; next < len(arrivals) && arrivals[next].tick == tick; next++ {
+			if err := s.allocate(tick, arrivals[next]); err != nil {
+				return err
+			}
+		}
+		time.Sleep(s.conf.TickInterval)
+	}
+	return nil
+}
+
+// report summarizes the simulation results
+func (s *simulation) report() simulationReport {
+	report := simulationReport{
+		Allocator:                s.conf.Allocator,
+		Endpoints:                s.endpoints,
+		LiveEndpoints:            len(s.live),
+		Content:                  len(s.catalogue.items),
+		OvercommittedAllocations: s.overcommitted,
+		EmptyAllocations:         s.empty,
+		FailedAllocations:        s.failed,
+		ReplicaDistribution:      summarizeReplicas(s.replicas),
+		AllocationGini:           giniCoefficient(s.allocations),
+		AllocationLatency:        summarizeLatencies(s.latencies),
+	}
+	if s.requestedSpace > 0 {
+		report.FillRatio = float64(s.allocatedSpace) / float64(s.requestedSpace)
+	}
+	return report
+}
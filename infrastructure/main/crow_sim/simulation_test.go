@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/Apiara/ApiaraCDN/infrastructure/crow"
+	"github.com/Apiara/ApiaraCDN/infrastructure/damocles"
+	"github.com/stretchr/testify/assert"
+)
+
+// runTestSimulation runs a seeded simulation against an even allocator
+func runTestSimulation(t *testing.T, seed int64) (*simulation, []endpointArrival) {
+	conf := crowSimConfig{
+		Allocator:                 evenAllocatorName,
+		SizeClasses:               []int64{1024, 4096, 16384},
+		TrackerCollectionDuration: time.Hour,
+		Seed:                      seed,
+		Ticks:                     50,
+		Endpoints: endpointsConfig{
+			ArrivalRate:    3,
+			ChurnRate:      0.05,
+			AvailableSpace: distributionConfig{Type: uniformDistribution, Min: 1024, Max: 32768},
+		},
+		Catalogue: catalogueConfig{
+			Count:           20,
+			PopularitySkew:  1,
+			RequestsPerTick: 10,
+			Size:            distributionConfig{Type: uniformDistribution, Min: 512, Max: 16384},
+		},
+	}
+	rng := rand.New(rand.NewSource(conf.Seed))
+
+	catalogue, err := loadCatalogue(conf.Catalogue, rng)
+	assert.Nil(t, err, "should not return error")
+	arrivals, err := loadArrivals(conf.Endpoints, conf.Ticks, rng)
+	assert.Nil(t, err, "should not return error")
+
+	tracker := damocles.NewDesperationTracker(conf.TrackerCollectionDuration)
+	allocator, err := createAllocator(conf, "")
+	assert.Nil(t, err, "should not return error")
+	for _, content := range catalogue.items {
+		assert.Nil(t, tracker.CreateCategory(content.id), "should not return error")
+		assert.Nil(t, allocator.NewEntry(content.id, content.size), "should not return error")
+	}
+
+	sim := newSimulation(allocator, tracker, catalogue, conf, rng)
+	assert.Nil(t, sim.run(arrivals), "should not return error")
+	return sim, arrivals
+}
+
+func TestSimulation(t *testing.T) {
+	sim, arrivals := runTestSimulation(t, 42)
+	report := sim.report()
+	assert.NotEmpty(t, arrivals, "expected generated arrivals")
+	assert.Equal(t, len(arrivals), report.Endpoints, "expected every arrival to request an allocation")
+	assert.Equal(t, 20, report.Content, "wrong content count")
+	assert.Zero(t, report.FailedAllocations, "allocations should not fail")
+	assert.Equal(t, len(sim.latencies), report.Endpoints, "expected latency per allocation")
+
+	// Replicas match what live endpoints hold
+	held := make([]int64, len(sim.replicas))
+	for _, endpoint := range sim.live {
+		for _, idx := range endpoint.holding {
+			held[idx]++
+		}
+	}
+	assert.Equal(t, held, sim.replicas, "replicas out of sync with live endpoints")
+
+	// The same seed replays the same simulation
+	replay, replayArrivals := runTestSimulation(t, 42)
+	assert.Equal(t, arrivals, replayArrivals, "expected same arrivals for same seed")
+	replayReport := replay.report()
+	report.AllocationLatency, replayReport.AllocationLatency = latencySummary{}, latencySummary{}
+	assert.Equal(t, report, replayReport, "expected same report for same seed")
+	assert.Equal(t, sim.allocations, replay.allocations, "expected same allocations for same seed")
+}
+
+func TestCreateAllocator(t *testing.T) {
+	conf := crowSimConfig{Allocator: evenAllocatorName, SizeClasses: []int64{4096, 1024}}
+	allocator, err := createAllocator(conf, "")
+	assert.Nil(t, err, "should not return error")
+	_, ok := allocator.(*crow.EvenDataAllocator)
+	assert.True(t, ok, "expected even allocator")
+	assert.Equal(t, []int64{4096, 1024}, conf.SizeClasses, "size classes should not be modified")
+
+	conf.Allocator = "unknown"
+	_, err = createAllocator(conf, "")
+	assert.NotNil(t, err, "expected unknown allocator to fail")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/Apiara/ApiaraCDN/infrastructure/cyprus"
+	"github.com/Apiara/ApiaraCDN/infrastructure/main/config"
+	"github.com/Apiara/ApiaraCDN/infrastructure/state"
+)
+
+/*
+Config Format
+--------------
+publishing_dir = "../publish/"
+state_address = addr
+grace_period = time.Duration
+
+Reports files under publishing_dir that no content in state references and
+that are older than grace_period, along with resources state references that
+are missing. Run with -delete to also delete the unreferenced files. The grace
+period must exceed the longest running cyprus publish
+*/
+
+type gcConfig struct {
+	PublishingDir       string        `toml:"publishing_dir"`
+	StateServiceAddress string        `toml:"state_address"`
+	GracePeriod         time.Duration `toml:"grace_period"`
+}
+
+func main() {
+	fnamePtr := flag.String("config", "", "TOML configuration file path")
+	deletePtr := flag.Bool("delete", false, "Delete unreferenced files instead of only reporting them")
+	flag.Parse()
+
+	var conf gcConfig
+	if err := config.ReadTOMLConfig(*fnamePtr, &conf); err != nil {
+		panic(err)
+	}
+	if conf.GracePeriod <= 0 {
+		panic(fmt.Errorf("grace_period must be positive, got %s", conf.GracePeriod))
+	}
+
+	// Collect
+	microserviceState, err := state.NewMicroserviceStateAPIClient(conf.StateServiceAddress)
+	if err != nil {
+		panic(err)
+	}
+	gc := cyprus.NewStorageGC(conf.PublishingDir, microserviceState, conf.GracePeriod)
+	report, err := gc.Collect(*deletePtr)
+	if err != nil {
+		panic(fmt.Errorf("collection stopped after deleting %d files: %w", len(report.Deleted), err))
+	}
+
+	// Report
+	for _, name := range report.Unreferenced {
+		fmt.Printf("unreferenced: %s\n", name)
+	}
+	for cid, names := range report.Missing {
+		for _, name := range names {
+			fmt.Printf("missing: %s (%s)\n", name, cid)
+		}
+	}
+	fmt.Printf("Found %d unreferenced files, deleted %d. %d content entries have missing files\n",
+		len(report.Unreferenced), len(report.Deleted), len(report.Missing))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/Apiara/ApiaraCDN/infrastructure/cyprus"
+	"github.com/Apiara/ApiaraCDN/infrastructure/main/config"
+)
+
+/*
+Config Format
+--------------
+storage_backend = "filesystem" | "s3"
+publishing_dir = "../publish/" (filesystem backend)
+s3_endpoint = "https://s3.us-east-1.amazonaws.com" (s3 backend)
+s3_bucket = string
+s3_region = string
+s3_access_key = string
+s3_secret_key = string
+old_kek_file = "../kek"
+new_kek_file = "../kek.new"
+
+Rewraps every content key in the cyprus storage from the old KEK to the new
+one without re-encrypting media. Run with -generate to create new_kek_file first.
+Once finished, point the cyprus kek_file at new_kek_file and restart it.
+
+Run with -migrate to instead wrap with new_kek_file the keys published in the
+clear before keys were wrapped, old_kek_file is then unused. Migrate before
+starting a cyprus that wraps keys, or existing content can't be decrypted
+*/
+
+type rotateConfig struct {
+	StorageBackend string `toml:"storage_backend"`
+	PublishingDir  string `toml:"publishing_dir"`
+	S3Endpoint     string `toml:"s3_endpoint"`
+	S3Bucket       string `toml:"s3_bucket"`
+	S3Region       string `toml:"s3_region"`
+	S3AccessKey    string `toml:"s3_access_key"`
+	S3SecretKey    string `toml:"s3_secret_key"`
+	OldKEKFile     string `toml:"old_kek_file"`
+	NewKEKFile     string `toml:"new_kek_file"`
+}
+
+func main() {
+	fnamePtr := flag.String("config", "", "TOML configuration file path")
+	generatePtr := flag.Bool("generate", false, "Generate a new KEK at new_kek_file before rotating")
+	migratePtr := flag.Bool("migrate", false, "Wrap plaintext keys with new_kek_file instead of rotating")
+	flag.Parse()
+
+	var conf rotateConfig
+	if err := config.ReadTOMLConfig(*fnamePtr, &conf); err != nil {
+		panic(err)
+	}
+
+	// Open key storage
+	var store cyprus.ListableObjectStore
+	switch conf.StorageBackend {
+	case "", "filesystem":
+		store = cyprus.NewFilesystemObjectStore(conf.PublishingDir)
+	case "s3":
+		s3Store, err := cyprus.NewS3ObjectStore(cyprus.S3Config{
+			Endpoint:  conf.S3Endpoint,
+			Bucket:    conf.S3Bucket,
+			Region:    conf.S3Region,
+			AccessKey: conf.S3AccessKey,
+			SecretKey: conf.S3SecretKey,
+		})
+		if err != nil {
+			panic(err)
+		}
+		store = s3Store
+	default:
+		panic(fmt.Errorf("unknown storage backend %s", conf.StorageBackend))
+	}
+
+	// Load key encryption keys
+	var newKEK *cyprus.KeyEncryptionKey
+	var err error
+	if *generatePtr {
+		newKEK, err = cyprus.GenerateKeyEncryptionKey(conf.NewKEKFile)
+	} else {
+		newKEK, err = cyprus.LoadKeyEncryptionKey(conf.NewKEKFile)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	// Migrate plaintext keys
+	if *migratePtr {
+		wrapped, err := cyprus.WrapPlaintextKeys(store, newKEK)
+		if err != nil {
+			panic(fmt.Errorf("migration stopped after wrapping %d keys, rerun to resume: %w", wrapped, err))
+		}
+		fmt.Printf("Wrapped %d plaintext keys with KEK %s\n", wrapped, newKEK.ID())
+		return
+	}
+
+	// Rewrap
+	oldKEK, err := cyprus.LoadKeyEncryptionKey(conf.OldKEKFile)
+	if err != nil {
+		panic(err)
+	}
+	rewrapped, err := cyprus.RewrapKeys(store, oldKEK, newKEK)
+	if err != nil {
+		panic(fmt.Errorf("rotation stopped after rewrapping %d keys, rerun to resume: %w", rewrapped, err))
+	}
+	fmt.Printf("Rewrapped %d keys from KEK %s to KEK %s\n", rewrapped, oldKEK.ID(), newKEK.ID())
+}
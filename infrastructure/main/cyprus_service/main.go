@@ -2,10 +2,13 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"time"
 
+	infra "github.com/Apiara/ApiaraCDN/infrastructure"
 	"github.com/Apiara/ApiaraCDN/infrastructure/cyprus"
 	"github.com/Apiara/ApiaraCDN/infrastructure/main/config"
 	"github.com/Apiara/ApiaraCDN/infrastructure/state"
@@ -15,22 +18,87 @@ import (
 Config Format
 --------------
 media_formats = [ ".mp4", ".mov", ...]
+content_types = { "video/mp4" = "raw" | "hls" | "dash", ... } (routes media without a known extension, defaults to common media types)
+raw_chunk_size = int
 processing_dir = "../workingdir/"
-publishing_dir = "../publish/"
+storage_backend = "filesystem" | "s3"
+publishing_dir = "../publish/" (filesystem backend)
+s3_endpoint = "https://s3.us-east-1.amazonaws.com" (s3 backend)
+s3_bucket = string
+s3_region = string
+s3_access_key = string
+s3_secret_key = string
 aes_key_size = 16 | 24 | 32
+encryption_mode = "ctr" | "gcm"
+gcm_chunk_size = int
+convergent_segments = bool
+convergence_secret = string (at least 16 bytes, shared by every cyprus publishing to the same storage)
 state_address = addr
+kek_file = "../kek" (keys published in the clear must first be wrapped with cyprus_rotate_kek -migrate)
+service_token = string
+access_token_secret = string
+restricted_resources = [ "/metadata/complete", ... ] (keys are always restricted)
+job_record_dir = "../jobs/"
+processing_workers = int
+ingest_attempts = int
+ingest_retry_backoff = time.Duration
+job_retention = time.Duration
+live_ingest = bool
+live_window = int
+callback_secret = string
+callback_attempts = int
+callback_retry_backoff = time.Duration
+download_concurrency = int
+download_timeout = time.Duration
+download_attempts = int
+download_retry_backoff = time.Duration
+download_max_size = int
+origin_profiles = [ OriginProfileConfig, ... ] (see main/config, authenticates requests to customer origins)
 processing_listen_port = int
 storage_listen_port = int
 */
 
 type cyprusConfig struct {
-	MediaFormats        []string `toml:"media_formats"`
-	ProcessingDir       string   `toml:"processing_dir"`
-	PublishingDir       string   `toml:"publishing_dir"`
-	AESKeySize          int      `toml:"aes_key_size"`
-	StateServiceAddress string   `toml:"state_address"`
-	ProcessingAPIPort   int      `toml:"processing_listen_port"`
-	StorageAPIPort      int      `toml:"storage_listen_port"`
+	MediaFormats        []string          `toml:"media_formats"`
+	ContentTypes        map[string]string `toml:"content_types"`
+	RawChunkSize        int64             `toml:"raw_chunk_size"`
+	ProcessingDir       string            `toml:"processing_dir"`
+	StorageBackend      string            `toml:"storage_backend"`
+	PublishingDir       string            `toml:"publishing_dir"`
+	S3Endpoint          string            `toml:"s3_endpoint"`
+	S3Bucket            string            `toml:"s3_bucket"`
+	S3Region            string            `toml:"s3_region"`
+	S3AccessKey         string            `toml:"s3_access_key"`
+	S3SecretKey         string            `toml:"s3_secret_key"`
+	AESKeySize          int               `toml:"aes_key_size"`
+	EncryptionMode      string            `toml:"encryption_mode"`
+	GCMChunkSize        int               `toml:"gcm_chunk_size"`
+	ConvergentSegments  bool              `toml:"convergent_segments"`
+	ConvergenceSecret   string            `toml:"convergence_secret"`
+	StateServiceAddress string            `toml:"state_address"`
+	KEKFile             string            `toml:"kek_file"`
+	ServiceToken        string            `toml:"service_token"`
+	AccessTokenSecret   string            `toml:"access_token_secret"`
+	RestrictedResources []string          `toml:"restricted_resources"`
+	JobRecordDir        string            `toml:"job_record_dir"`
+	ProcessingWorkers   int               `toml:"processing_workers"`
+	IngestAttempts      int               `toml:"ingest_attempts"`
+	IngestRetryBackoff  time.Duration     `toml:"ingest_retry_backoff"`
+	JobRetention        time.Duration     `toml:"job_retention"`
+	LiveIngest          bool              `toml:"live_ingest"`
+	LiveWindow          int               `toml:"live_window"`
+	CallbackSecret      string            `toml:"callback_secret"`
+	CallbackAttempts    int               `toml:"callback_attempts"`
+	CallbackBackoff     time.Duration     `toml:"callback_retry_backoff"`
+	DownloadConcurrency int               `toml:"download_concurrency"`
+	DownloadTimeout     time.Duration     `toml:"download_timeout"`
+	DownloadAttempts    int               `toml:"download_attempts"`
+	DownloadBackoff     time.Duration     `toml:"download_retry_backoff"`
+	DownloadMaxSize     int64             `toml:"download_max_size"`
+	ProcessingAPIPort   int               `toml:"processing_listen_port"`
+	StorageAPIPort      int               `toml:"storage_listen_port"`
+
+	OriginProfiles []config.OriginProfileConfig `toml:"origin_profiles"`
 }
 
 func main() {
@@ -41,37 +109,175 @@ func main() {
 	if err := config.ReadTOMLConfig(*fnamePtr, &conf); err != nil {
 		panic(err)
 	}
+	log.SetOutput(os.Stdout)
 	processingListenAddr := ":" + strconv.Itoa(conf.ProcessingAPIPort)
 	storageListenAddr := ":" + strconv.Itoa(conf.StorageAPIPort)
 
 	// Create preprocessor
-	rawPreprocessor := cyprus.NewRawPreprocessor(conf.ProcessingDir)
-	hlsPreprocessor := cyprus.NewHLSPreprocessor(conf.ProcessingDir)
+	downloader := cyprus.NewDownloader(cyprus.DownloaderConfig{
+		Concurrency:  conf.DownloadConcurrency,
+		Timeout:      conf.DownloadTimeout,
+		MaxAttempts:  conf.DownloadAttempts,
+		RetryBackoff: conf.DownloadBackoff,
+		MaxSize:      conf.DownloadMaxSize,
+	})
+	if err := downloader.EnableOriginProfiles(config.OriginProfiles(conf.OriginProfiles)); err != nil {
+		panic(err)
+	}
+	rawPreprocessor := cyprus.NewRawPreprocessor(conf.ProcessingDir, downloader)
+	hlsPreprocessor := cyprus.NewHLSPreprocessor(conf.ProcessingDir, downloader)
+	dashPreprocessor := cyprus.NewDASHPreprocessor(conf.ProcessingDir, downloader)
+	var mediaPreprocessor cyprus.DataPreprocessor = rawPreprocessor
+	if conf.RawChunkSize > 0 {
+		chunkingPreprocessor, err := cyprus.NewChunkingPreprocessor(rawPreprocessor, conf.RawChunkSize, conf.ProcessingDir)
+		if err != nil {
+			panic(err)
+		}
+		mediaPreprocessor = chunkingPreprocessor
+	}
 	preprocessorMap := make(map[string]cyprus.DataPreprocessor)
 	preprocessorMap[".m3u8"] = hlsPreprocessor
+	preprocessorMap[".mpd"] = dashPreprocessor
 	for _, ext := range conf.MediaFormats {
-		preprocessorMap[ext] = rawPreprocessor
+		preprocessorMap[ext] = mediaPreprocessor
 	}
 	preprocessor := cyprus.NewCompoundPreprocessor(preprocessorMap)
 
+	// Route media without a known extension by content type
+	contentTypes := conf.ContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = cyprus.DefaultContentTypes
+	}
+	namedPreprocessors := map[string]cyprus.DataPreprocessor{
+		cyprus.RawPreprocessorName:  mediaPreprocessor,
+		cyprus.HLSPreprocessorName:  hlsPreprocessor,
+		cyprus.DASHPreprocessorName: dashPreprocessor,
+	}
+	contentTypeMap := make(map[string]cyprus.DataPreprocessor)
+	for contentType, name := range contentTypes {
+		namedPreprocessor, ok := namedPreprocessors[name]
+		if !ok {
+			panic(fmt.Errorf("unknown preprocessor %s for content type %s", name, contentType))
+		}
+		contentTypeMap[contentType] = namedPreprocessor
+	}
+	preprocessor.EnableContentSniffing(contentTypeMap, downloader)
+
 	// Create processor
-	processor, err := cyprus.NewAESDataProcessor(conf.AESKeySize, conf.ProcessingDir)
-	if err != nil {
-		panic(err)
+	var processor cyprus.DataProcessor
+	var aesProcessor *cyprus.AESDataProcessor
+	switch conf.EncryptionMode {
+	case "", cyprus.CTREncryptionMode:
+		ctrProcessor, err := cyprus.NewAESDataProcessor(conf.AESKeySize, conf.ProcessingDir)
+		if err != nil {
+			panic(err)
+		}
+		processor = ctrProcessor
+		aesProcessor = ctrProcessor
+	case cyprus.GCMEncryptionMode:
+		if conf.GCMChunkSize == 0 {
+			conf.GCMChunkSize = cyprus.DefaultGCMChunkSize
+		}
+		gcmProcessor, err := cyprus.NewAESGCMDataProcessor(conf.AESKeySize, conf.GCMChunkSize, conf.ProcessingDir)
+		if err != nil {
+			panic(err)
+		}
+		processor = gcmProcessor
+		aesProcessor = gcmProcessor.AESDataProcessor
+	default:
+		panic(fmt.Errorf("unknown encryption mode %s", conf.EncryptionMode))
+	}
+	if conf.ConvergentSegments {
+		if err := aesProcessor.EnableConvergentSegments([]byte(conf.ConvergenceSecret)); err != nil {
+			panic(err)
+		}
 	}
 
 	// Create storage manager
+	kek, err := cyprus.LoadKeyEncryptionKey(conf.KEKFile)
+	if err != nil {
+		panic(err)
+	}
 	microserviceState, err := state.NewMicroserviceStateAPIClient(conf.StateServiceAddress)
 	if err != nil {
 		panic(err)
 	}
-	storage, err := cyprus.NewFilesystemStorageManager(conf.PublishingDir, microserviceState)
+	var storage cyprus.StorageManager
+	var storageReader cyprus.StorageReader
+	switch conf.StorageBackend {
+	case "", "filesystem":
+		fsStorage, err := cyprus.NewFilesystemStorageManager(conf.PublishingDir, microserviceState, kek)
+		if err != nil {
+			panic(err)
+		}
+		if err = fsStorage.Recover(); err != nil {
+			panic(err)
+		}
+		storage = fsStorage
+		storageReader = cyprus.NewFilesystemStorageReader(conf.PublishingDir)
+	case "s3":
+		store, err := cyprus.NewS3ObjectStore(cyprus.S3Config{
+			Endpoint:  conf.S3Endpoint,
+			Bucket:    conf.S3Bucket,
+			Region:    conf.S3Region,
+			AccessKey: conf.S3AccessKey,
+			SecretKey: conf.S3SecretKey,
+		})
+		if err != nil {
+			panic(err)
+		}
+		objectStorage, err := cyprus.NewObjectStorageManager(store, microserviceState, kek)
+		if err != nil {
+			panic(err)
+		}
+		storage = objectStorage
+		storageReader = store
+	default:
+		panic(fmt.Errorf("unknown storage backend %s", conf.StorageBackend))
+	}
+
+	// Create processing queue, clearing temp files of jobs interrupted by a crash first
+	removed, err := cyprus.RemoveProcessingArtifacts(conf.ProcessingDir)
+	if err != nil {
+		panic(err)
+	}
+	if removed > 0 {
+		log.Printf("Removed %d processing artifacts\n", removed)
+	}
+	var livePreprocessor *cyprus.HLSPreprocessor
+	if conf.LiveIngest {
+		livePreprocessor = hlsPreprocessor
+	}
+	queue, err := cyprus.NewProcessingQueue(cyprus.ProcessingQueueConfig{
+		RecordDir:    conf.JobRecordDir,
+		Workers:      conf.ProcessingWorkers,
+		MaxAttempts:  conf.IngestAttempts,
+		RetryBackoff: conf.IngestRetryBackoff,
+		Retention:    conf.JobRetention,
+
+		CallbackSecret:   []byte(conf.CallbackSecret),
+		CallbackAttempts: conf.CallbackAttempts,
+		CallbackBackoff:  conf.CallbackBackoff,
+
+		LivePreprocessor: livePreprocessor,
+		LiveWindow:       conf.LiveWindow,
+
+		Published: storageReader,
+		KEK:       kek,
+	}, preprocessor, processor, storage)
 	if err != nil {
 		panic(err)
 	}
 
 	// Run
-	log.SetOutput(os.Stdout)
-	go cyprus.StartDataProcessingAPI(processingListenAddr, preprocessor, processor, storage)
-	cyprus.StartStorageAPI(storageListenAddr, conf.PublishingDir)
+	go cyprus.StartDataProcessingAPI(processingListenAddr, queue, storage)
+	restricted := conf.RestrictedResources
+	if len(restricted) == 0 {
+		restricted = []string{infra.CyprusStorageAPICompleteMetadataResource}
+	}
+	cyprus.StartStorageAPI(storageListenAddr, storageReader, kek, cyprus.StorageAccessPolicy{
+		Secret:       []byte(conf.AccessTokenSecret),
+		ServiceToken: conf.ServiceToken,
+		Restricted:   restricted,
+	})
 }
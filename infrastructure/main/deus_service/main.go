@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
@@ -18,32 +19,61 @@ Configuration Format
 --------------------
 
 media_formats = [ ".mp4", ".mov" ]
+content_types = { "video/mp4" = "raw" | "hls" | "dash", ... } (routes media without a known extension, defaults to common media types)
+raw_chunk_size = int (must match cyprus)
 pull_frequency = time.Duration
 pull_request_threshold = int
 processing_dir = string
+storage_backend = "http" | "s3" (must match cyprus, "http" reads from internal_data_addr)
 internal_data_addr = string
+s3_endpoint = string
+s3_bucket = string
+s3_region = string
+s3_access_key = string
+s3_secret_key = string
+key_api = string
+key_api_token = string (cyprus service_token)
+encryption_mode = "ctr" | "gcm" (must match cyprus)
+origin_profiles = [ OriginProfileConfig, ... ] (see main/config, should match cyprus)
 
 service_listen_port = int
 
 validate_api = string
 process_api = string
 coordinate_api = string
+callback_api = string
+callback_secret = string
 
 state_address = string
 */
 
 type (
 	deusConfig struct {
-		MediaFormats         []string      `toml:"media_formats"`
-		PullFrequency        time.Duration `toml:"pull_frequency"`
-		PullRequestThreshold int           `toml:"pull_request_threshold"`
-		ServiceListenPort    int           `toml:"service_listen_port"`
-		InternalDataAddr     string        `toml:"internal_data_addr"`
-		ProcessingDir        string        `toml:"processing_dir"`
-		ValidateAPIAddress   string        `toml:"validate_api"`
-		ProcessAPIAddress    string        `toml:"process_api"`
-		CoordinateAPIAddress string        `toml:"coordinate_api"`
-		StateServiceAddress  string        `toml:"state_address"`
+		MediaFormats         []string          `toml:"media_formats"`
+		ContentTypes         map[string]string `toml:"content_types"`
+		RawChunkSize         int64             `toml:"raw_chunk_size"`
+		PullFrequency        time.Duration     `toml:"pull_frequency"`
+		PullRequestThreshold int               `toml:"pull_request_threshold"`
+		ServiceListenPort    int               `toml:"service_listen_port"`
+		StorageBackend       string            `toml:"storage_backend"`
+		InternalDataAddr     string            `toml:"internal_data_addr"`
+		S3Endpoint           string            `toml:"s3_endpoint"`
+		S3Bucket             string            `toml:"s3_bucket"`
+		S3Region             string            `toml:"s3_region"`
+		S3AccessKey          string            `toml:"s3_access_key"`
+		S3SecretKey          string            `toml:"s3_secret_key"`
+		KeyAPIAddress        string            `toml:"key_api"`
+		KeyAPIToken          string            `toml:"key_api_token"`
+		EncryptionMode       string            `toml:"encryption_mode"`
+		ProcessingDir        string            `toml:"processing_dir"`
+		ValidateAPIAddress   string            `toml:"validate_api"`
+		ProcessAPIAddress    string            `toml:"process_api"`
+		CoordinateAPIAddress string            `toml:"coordinate_api"`
+		CallbackAPIAddress   string            `toml:"callback_api"`
+		CallbackSecret       string            `toml:"callback_secret"`
+		StateServiceAddress  string            `toml:"state_address"`
+
+		OriginProfiles []config.OriginProfileConfig `toml:"origin_profiles"`
 	}
 )
 
@@ -69,8 +99,13 @@ func main() {
 		panic(err)
 	}
 
+	// Fall back to polling cyprus when no callback address is configured
+	var receiver *deus.ProcessingCallbackReceiver
+	if conf.CallbackAPIAddress != "" {
+		receiver = deus.NewProcessingCallbackReceiver([]byte(conf.CallbackSecret))
+	}
 	manager, err := deus.NewMasterContentManager(microserviceState, conf.ProcessAPIAddress,
-		conf.CoordinateAPIAddress)
+		conf.CoordinateAPIAddress, conf.CallbackAPIAddress, receiver)
 	if err != nil {
 		panic(err)
 	}
@@ -79,22 +114,76 @@ func main() {
 		conf.PullRequestThreshold, conf.PullFrequency)
 
 	// Create preprocessor
-	rawPreprocessor := cyprus.NewRawPreprocessor(conf.ProcessingDir)
-	hlsPreprocessor := cyprus.NewHLSPreprocessor(conf.ProcessingDir)
+	downloader := cyprus.NewDownloader(cyprus.DownloaderConfig{})
+	if err = downloader.EnableOriginProfiles(config.OriginProfiles(conf.OriginProfiles)); err != nil {
+		panic(err)
+	}
+	rawPreprocessor := cyprus.NewRawPreprocessor(conf.ProcessingDir, downloader)
+	hlsPreprocessor := cyprus.NewHLSPreprocessor(conf.ProcessingDir, downloader)
+	dashPreprocessor := cyprus.NewDASHPreprocessor(conf.ProcessingDir, downloader)
+	var mediaPreprocessor cyprus.DataPreprocessor = rawPreprocessor
+	if conf.RawChunkSize > 0 {
+		chunkingPreprocessor, err := cyprus.NewChunkingPreprocessor(rawPreprocessor, conf.RawChunkSize, conf.ProcessingDir)
+		if err != nil {
+			panic(err)
+		}
+		mediaPreprocessor = chunkingPreprocessor
+	}
 	preprocessorMap := make(map[string]cyprus.DataPreprocessor)
 	preprocessorMap[".m3u8"] = hlsPreprocessor
+	preprocessorMap[".mpd"] = dashPreprocessor
 	for _, ext := range conf.MediaFormats {
-		preprocessorMap[ext] = rawPreprocessor
+		preprocessorMap[ext] = mediaPreprocessor
 	}
 	preprocessor := cyprus.NewCompoundPreprocessor(preprocessorMap)
 
+	// Route media without a known extension by content type
+	contentTypes := conf.ContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = cyprus.DefaultContentTypes
+	}
+	namedPreprocessors := map[string]cyprus.DataPreprocessor{
+		cyprus.RawPreprocessorName:  mediaPreprocessor,
+		cyprus.HLSPreprocessorName:  hlsPreprocessor,
+		cyprus.DASHPreprocessorName: dashPreprocessor,
+	}
+	contentTypeMap := make(map[string]cyprus.DataPreprocessor)
+	for contentType, name := range contentTypes {
+		namedPreprocessor, ok := namedPreprocessors[name]
+		if !ok {
+			panic(fmt.Errorf("unknown preprocessor %s for content type %s", name, contentType))
+		}
+		contentTypeMap[contentType] = namedPreprocessor
+	}
+	preprocessor.EnableContentSniffing(contentTypeMap, downloader)
+
 	// Create stale data checker
-	staleChecker, err := deus.NewChecksumDataValidator(conf.InternalDataAddr, preprocessor, microserviceState)
+	var staleChecker *deus.ChecksumDataValidator
+	switch conf.StorageBackend {
+	case "", "http":
+		staleChecker, err = deus.NewChecksumDataValidator(conf.InternalDataAddr, conf.KeyAPIAddress,
+			conf.KeyAPIToken, conf.EncryptionMode, preprocessor, microserviceState)
+	case "s3":
+		store, storeErr := cyprus.NewS3ObjectStore(cyprus.S3Config{
+			Endpoint:  conf.S3Endpoint,
+			Bucket:    conf.S3Bucket,
+			Region:    conf.S3Region,
+			AccessKey: conf.S3AccessKey,
+			SecretKey: conf.S3SecretKey,
+		})
+		if storeErr != nil {
+			panic(storeErr)
+		}
+		staleChecker, err = deus.NewStorageChecksumDataValidator(store, conf.KeyAPIAddress,
+			conf.KeyAPIToken, conf.EncryptionMode, preprocessor, microserviceState)
+	default:
+		err = fmt.Errorf("unknown storage backend %s", conf.StorageBackend)
+	}
 	if err != nil {
 		panic(err)
 	}
 
 	// Start APIs
 	log.SetOutput(os.Stdout)
-	deus.StartServiceAPI(serviceListenAddr, staleChecker, microserviceState, pullDecider, manager)
+	deus.StartServiceAPI(serviceListenAddr, staleChecker, microserviceState, pullDecider, manager, receiver)
 }
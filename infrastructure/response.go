@@ -3,9 +3,26 @@ package infrastructure
 type StatusResponse struct {
 	Status   ProcessingStatus        `json:"Status"`
 	Metadata *PostProcessingMetadata `json:"metadata"`
+	Progress *ProcessingProgress     `json:"progress,omitempty"`
+	Error    string                  `json:"error,omitempty"`
 }
 
 type PostProcessingMetadata struct {
 	FunctionalID string `json:"FunctionalID"`
 	ByteSize     int64  `json:"bytes"`
 }
+
+// ProcessingProgress reports how far a job is within its current phase
+type ProcessingProgress struct {
+	Phase         ProcessingPhase `json:"phase"`
+	SegmentsDone  int             `json:"segments_done"`
+	SegmentsTotal int             `json:"segments_total"`
+	BytesDone     int64           `json:"bytes_done"`
+	BytesTotal    int64           `json:"bytes_total"`
+}
+
+// JobResponse is an entry of the cyprus job listing
+type JobResponse struct {
+	ContentID string `json:"cid"`
+	StatusResponse
+}
@@ -42,6 +42,9 @@ type MicroserviceStateAPIClient struct {
 	pullRuleExist              string
 	createPullRule             string
 	deletePullRule             string
+	getAllContent              string
+	addResourceReference       string
+	removeResourceReference    string
 }
 
 /*
@@ -61,7 +64,8 @@ func NewMicroserviceStateAPIClient(stateServiceAPI string) (*MicroserviceStateAP
 		infra.StateAPIGetContentServerListResource, infra.StateAPIGetServerContentListResource, infra.StateAPIIsContentActiveResource,
 		infra.StateAPIWasContentPulledResource, infra.StateAPICreateContentLocationEntryResource, infra.StateAPIDeleteContentLocationEntryResource,
 		infra.StateAPIGetContentPullRulesResource, infra.StateAPIDoesRuleExistResource, infra.StateAPICreateContentPullRuleResource,
-		infra.StateAPIDeleteContentPullRuleResource,
+		infra.StateAPIDeleteContentPullRuleResource, infra.StateAPIGetContentListResource,
+		infra.StateAPIAddResourceReferenceResource, infra.StateAPIRemoveResourceReferenceResource,
 	}
 
 	var err error
@@ -81,7 +85,8 @@ func NewMicroserviceStateAPIClient(stateServiceAPI string) (*MicroserviceStateAP
 		apiEndpoints[8], apiEndpoints[9], apiEndpoints[10], apiEndpoints[11],
 		apiEndpoints[12], apiEndpoints[13], apiEndpoints[14], apiEndpoints[15],
 		apiEndpoints[16], apiEndpoints[17], apiEndpoints[18], apiEndpoints[19],
-		apiEndpoints[20], apiEndpoints[21],
+		apiEndpoints[20], apiEndpoints[21], apiEndpoints[22], apiEndpoints[23],
+		apiEndpoints[24],
 	}, nil
 }
 
@@ -129,6 +134,14 @@ func (c *MicroserviceStateAPIClient) GetContentSize(cid string) (int64, error) {
 	return result, nil
 }
 
+func (c *MicroserviceStateAPIClient) ContentList() ([]string, error) {
+	var result []string
+	if err := infra.MakeHTTPRequest(c.getAllContent, nil, nil, c.client, infra.GOBBodyDecoder, &result); err != nil {
+		return nil, fmt.Errorf("failed to get all content: %w", err)
+	}
+	return result, nil
+}
+
 func (c *MicroserviceStateAPIClient) CreateContentEntry(cid string, fid string, size int64, resources []string) error {
 	// Create request body
 	errMsg := "failed to create content(%s) entry: %w"
@@ -160,6 +173,30 @@ func (c *MicroserviceStateAPIClient) DeleteContentEntry(cid string) error {
 	return nil
 }
 
+func (c *MicroserviceStateAPIClient) AddResourceReference(resource string, cid string) (int64, error) {
+	query := url.Values{}
+	query.Add(ResourceHeader, resource)
+	query.Add(ContentIDHeader, cid)
+
+	var result int64
+	if err := infra.MakeHTTPRequest(c.addResourceReference, query, nil, c.client, infra.GOBBodyDecoder, &result); err != nil {
+		return -1, fmt.Errorf("failed to add content(%s) reference to resource(%s): %w", cid, resource, err)
+	}
+	return result, nil
+}
+
+func (c *MicroserviceStateAPIClient) RemoveResourceReference(resource string, cid string) (int64, error) {
+	query := url.Values{}
+	query.Add(ResourceHeader, resource)
+	query.Add(ContentIDHeader, cid)
+
+	var result int64
+	if err := infra.MakeHTTPRequest(c.removeResourceReference, query, nil, c.client, infra.GOBBodyDecoder, &result); err != nil {
+		return -1, fmt.Errorf("failed to remove content(%s) reference to resource(%s): %w", cid, resource, err)
+	}
+	return result, nil
+}
+
 func (c *MicroserviceStateAPIClient) CreateServerEntry(sid string, publicAddr string, privateAddr string) error {
 	query := url.Values{}
 	query.Add(ServerHeader, sid)
@@ -3,6 +3,7 @@ package state
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
 var errMock error = errors.New("mock microservice state failed")
@@ -21,6 +22,8 @@ const (
 	mockSizeKey     = ":size"
 	mockResourceKey = ":resource"
 
+	mockReferencesKey = ":references"
+
 	mockPublicAddrKey  = ":public"
 	mockPrivateAddrKey = ":private"
 
@@ -58,6 +61,9 @@ func (m *MockMicroserviceState) GetServerPrivateAddress(sid string) (string, err
 }
 
 func (m *MockMicroserviceState) CreateContentEntry(cid string, fid string, size int64, resources []string) error {
+	if oldFID, ok := m.store[cid+mockFIDKey]; ok {
+		delete(m.store, oldFID.(string)+mockCIDKey)
+	}
 	m.store[cid+mockFIDKey] = fid
 	m.store[fid+mockCIDKey] = cid
 	m.store[cid+mockSizeKey] = size
@@ -103,6 +109,38 @@ func (m *MockMicroserviceState) GetContentSize(cid string) (int64, error) {
 	return -1, errMock
 }
 
+func (m *MockMicroserviceState) ContentList() ([]string, error) {
+	contentList := make([]string, 0)
+	for key, value := range m.store {
+		if strings.HasSuffix(key, mockCIDKey) {
+			contentList = append(contentList, value.(string))
+		}
+	}
+	return contentList, nil
+}
+
+func (m *MockMicroserviceState) AddResourceReference(resource string, cid string) (int64, error) {
+	references, ok := m.store[resource+mockReferencesKey].(map[string]bool)
+	if !ok {
+		references = make(map[string]bool)
+		m.store[resource+mockReferencesKey] = references
+	}
+	references[cid] = true
+	return int64(len(references)), nil
+}
+
+func (m *MockMicroserviceState) RemoveResourceReference(resource string, cid string) (int64, error) {
+	references, ok := m.store[resource+mockReferencesKey].(map[string]bool)
+	if !ok {
+		return 0, nil
+	}
+	delete(references, cid)
+	if len(references) == 0 {
+		delete(m.store, resource+mockReferencesKey)
+	}
+	return int64(len(references)), nil
+}
+
 func (m *MockMicroserviceState) CreateContentLocationEntry(cid string, serverID string, pulled bool) error {
 	m.store[cid+serverID] = true
 	return nil
@@ -40,11 +40,17 @@ type ContentMetadataStateReader interface {
 	GetContentID(fid string) (string, error)
 	GetContentResources(cid string) ([]string, error)
 	GetContentSize(cid string) (int64, error)
+	ContentList() ([]string, error)
 }
 
 type ContentMetadataStateWriter interface {
 	CreateContentEntry(cid string, fid string, size int64, resources []string) error
 	DeleteContentEntry(cid string) error
+
+	/* Resources shared between content are reference counted by the content
+	IDs using them. Both return the number of references left */
+	AddResourceReference(resource string, cid string) (int64, error)
+	RemoveResourceReference(resource string, cid string) (int64, error)
 }
 
 /*
@@ -121,6 +127,10 @@ const (
 	RedisContentMetadataReverseTable   = "content:reverse:"
 	RedisContentMetadataReverseCIDAttr = ":cid"
 
+	// Shared resource reference tables
+	RedisResourceReferenceTable = "resource:"
+	RedisResourceReferenceAttr  = ":references"
+
 	// Content location on edge network tables
 	RedisContentEdgeServerTable           = "edge:"
 	RedisContentEdgeServerServingAttr     = ":serving"
@@ -158,7 +168,7 @@ func NewRedisMicroserviceState(addr string) *RedisMicroserviceState {
 	}
 }
 
-// CreateContentEntry creates a metadata entry for a piece of content
+// CreateContentEntry creates a metadata entry for a piece of content, replacing any existing one
 func (r *RedisMicroserviceState) CreateContentEntry(cid string, fid string, size int64, resources []string) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
@@ -170,29 +180,45 @@ func (r *RedisMicroserviceState) CreateContentEntry(cid string, fid string, size
 	resourcesKey := RedisContentMetadataTable + safeCid + RedisContentMetadataResourcesAttr
 	cidKey := RedisContentMetadataReverseTable + fid + RedisContentMetadataReverseCIDAttr
 
-	// Write forward attributes
-	pipe := r.rdb.TxPipeline()
+	// Entries are replaced, dropping the reverse lookup of a replaced functional ID
 	errMsg := "failed to create content entry for %s: %w"
-	if err := pipe.Set(r.ctx, fidKey, fid, 0).Err(); err != nil {
-		return fmt.Errorf(errMsg, cid, err)
-	}
-	if err := pipe.Set(r.ctx, sizeKey, strconv.FormatInt(size, 10), 0).Err(); err != nil {
-		return fmt.Errorf(errMsg, cid, err)
-	}
-	for _, resource := range resources {
-		err := pipe.SAdd(r.ctx, resourcesKey, resource).Err()
-		if err != nil {
-			return fmt.Errorf(errMsg, cid, err)
+	create := func(tx *redis.Tx) error {
+		oldFID, err := tx.Get(r.ctx, fidKey).Result()
+		if err != nil && err != redis.Nil {
+			return err
 		}
-	}
 
-	// Write reverse attributes
-	if err := pipe.Set(r.ctx, cidKey, cid, 0).Err(); err != nil {
-		return fmt.Errorf(errMsg, cid, err)
+		_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			// Write forward attributes
+			if err := pipe.Set(r.ctx, fidKey, fid, 0).Err(); err != nil {
+				return err
+			}
+			if err := pipe.Set(r.ctx, sizeKey, strconv.FormatInt(size, 10), 0).Err(); err != nil {
+				return err
+			}
+			if err := pipe.Del(r.ctx, resourcesKey).Err(); err != nil {
+				return err
+			}
+			for _, resource := range resources {
+				if err := pipe.SAdd(r.ctx, resourcesKey, resource).Err(); err != nil {
+					return err
+				}
+			}
+
+			// Write reverse attributes
+			if oldFID != "" && oldFID != fid {
+				oldCidKey := RedisContentMetadataReverseTable + oldFID + RedisContentMetadataReverseCIDAttr
+				if err := pipe.Del(r.ctx, oldCidKey).Err(); err != nil {
+					return err
+				}
+			}
+			return pipe.Set(r.ctx, cidKey, cid, 0).Err()
+		})
+		return err
 	}
 
-	// Execute transaction
-	if _, err := pipe.Exec(r.ctx); err != nil {
+	// Execute transaction, failing if the entry changed since it was read
+	if err := r.rdb.Watch(r.ctx, create, fidKey); err != nil {
 		return fmt.Errorf(errMsg, cid, err)
 	}
 	return nil
@@ -326,6 +352,76 @@ func (r *RedisMicroserviceState) GetContentSize(cid string) (int64, error) {
 	return size, nil
 }
 
+// ContentList returns the content IDs of all content with a metadata entry
+func (r *RedisMicroserviceState) ContentList() ([]string, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	errMsg := "failed to get content list: %w"
+	cidKeys, err := r.rdb.Keys(r.ctx, RedisContentMetadataReverseTable+"*"+RedisContentMetadataReverseCIDAttr).Result()
+	if err != nil {
+		return nil, fmt.Errorf(errMsg, err)
+	}
+	if len(cidKeys) == 0 {
+		return []string{}, nil
+	}
+
+	cids, err := r.rdb.MGet(r.ctx, cidKeys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf(errMsg, err)
+	}
+	contentList := make([]string, 0, len(cids))
+	for _, cid := range cids {
+		// Entries deleted since the key listing are skipped
+		if cid, ok := cid.(string); ok {
+			contentList = append(contentList, cid)
+		}
+	}
+	return contentList, nil
+}
+
+/*
+AddResourceReference records that content ID cid uses resource. The reference
+is added and counted in one transaction, so the count is consistent across
+instances sharing the datastore
+*/
+func (r *RedisMicroserviceState) AddResourceReference(resource string, cid string) (int64, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	errMsg := "failed to add content(%s) reference to resource(%s): %w"
+	referencesKey := RedisResourceReferenceTable + infra.URLToSafeName(resource) + RedisResourceReferenceAttr
+	var count *redis.IntCmd
+	_, err := r.rdb.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(r.ctx, referencesKey, cid)
+		count = pipe.SCard(r.ctx, referencesKey)
+		return nil
+	})
+	if err != nil {
+		return -1, fmt.Errorf(errMsg, cid, resource, err)
+	}
+	return count.Val(), nil
+}
+
+// RemoveResourceReference records that content ID cid no longer uses resource, counting what's left in the same transaction
+func (r *RedisMicroserviceState) RemoveResourceReference(resource string, cid string) (int64, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	errMsg := "failed to remove content(%s) reference to resource(%s): %w"
+	referencesKey := RedisResourceReferenceTable + infra.URLToSafeName(resource) + RedisResourceReferenceAttr
+	var count *redis.IntCmd
+	_, err := r.rdb.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		pipe.SRem(r.ctx, referencesKey, cid)
+		count = pipe.SCard(r.ctx, referencesKey)
+		return nil
+	})
+	if err != nil {
+		return -1, fmt.Errorf(errMsg, cid, resource, err)
+	}
+	return count.Val(), nil
+}
+
 // CreateContentLocationEntry updates the datastore to indicate a content ID is being served by a server
 func (r *RedisMicroserviceState) CreateContentLocationEntry(cid string, serverID string, pulled bool) error {
 	r.mutex.Lock()
@@ -19,6 +19,7 @@ const (
 	ContentSizeHeader       = "size"
 	ContentWasPulledHeader  = "pulled"
 	RuleHeader              = "rule"
+	ResourceHeader          = "resource"
 )
 
 func sendViaGob(data interface{}, resp http.ResponseWriter) {
@@ -72,6 +73,40 @@ func setDataServiceContentMetadataResources(mux *http.ServeMux, manager Microser
 		sendViaGob(resources, resp)
 	})
 
+	mux.HandleFunc(infra.StateAPIGetContentListResource, func(resp http.ResponseWriter, req *http.Request) {
+		contentList, err := manager.ContentList()
+		if err != nil {
+			resp.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		sendViaGob(contentList, resp)
+	})
+
+	mux.HandleFunc(infra.StateAPIAddResourceReferenceResource, func(resp http.ResponseWriter, req *http.Request) {
+		resource := req.URL.Query().Get(ResourceHeader)
+		cid := req.URL.Query().Get(ContentIDHeader)
+		count, err := manager.AddResourceReference(resource, cid)
+		if err != nil {
+			resp.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		sendViaGob(count, resp)
+	})
+
+	mux.HandleFunc(infra.StateAPIRemoveResourceReferenceResource, func(resp http.ResponseWriter, req *http.Request) {
+		resource := req.URL.Query().Get(ResourceHeader)
+		cid := req.URL.Query().Get(ContentIDHeader)
+		count, err := manager.RemoveResourceReference(resource, cid)
+		if err != nil {
+			resp.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		sendViaGob(count, resp)
+	})
+
 	mux.HandleFunc(infra.StateAPIGetContentSizeResource, func(resp http.ResponseWriter, req *http.Request) {
 		cid := req.URL.Query().Get(ContentIDHeader)
 		size, err := manager.GetContentSize(cid)
@@ -58,6 +58,46 @@ func TestRedisMicroserviceState(t *testing.T) {
 	}
 	assert.Equal(t, foundCid, cid, "Content IDs not equal")
 
+	contentList, err := microserviceState.ContentList()
+	if err != nil {
+		t.Fatalf("Failed to get content list: %v", err)
+	}
+	assert.Contains(t, contentList, cid, "Content list missing content ID")
+
+	// Test re-creating an entry under a new functional ID replaces the old one
+	newFid := "newFunctionalID"
+	if err := microserviceState.CreateContentEntry(cid, newFid, size, resources); err != nil {
+		t.Fatalf("Failed to re-create entry: %v", err)
+	}
+	foundCid, err = microserviceState.GetContentID(newFid)
+	assert.Nil(t, err, "GetContentID error should be nil")
+	assert.Equal(t, cid, foundCid, "Content IDs not equal")
+	_, err = microserviceState.GetContentID(fid)
+	assert.NotNil(t, err, "Expected replaced functional ID to no longer resolve")
+	contentList, err = microserviceState.ContentList()
+	assert.Nil(t, err, "ContentList error should be nil")
+	occurrences := 0
+	for _, listed := range contentList {
+		if listed == cid {
+			occurrences++
+		}
+	}
+	assert.Equal(t, 1, occurrences, "Expected re-created content to be listed once")
+
+	// Test shared resource reference counting
+	count, err := microserviceState.AddResourceReference("shared", cid)
+	assert.Nil(t, err, "AddResourceReference error should be nil")
+	assert.Equal(t, int64(1), count, "Wrong reference count")
+	count, _ = microserviceState.AddResourceReference("shared", cid)
+	assert.Equal(t, int64(1), count, "Expected repeated reference to be counted once")
+	count, _ = microserviceState.AddResourceReference("shared", "other")
+	assert.Equal(t, int64(2), count, "Wrong reference count")
+	count, _ = microserviceState.RemoveResourceReference("shared", cid)
+	assert.Equal(t, int64(1), count, "Wrong reference count")
+	count, err = microserviceState.RemoveResourceReference("shared", "other")
+	assert.Nil(t, err, "RemoveResourceReference error should be nil")
+	assert.Equal(t, int64(0), count, "Wrong reference count")
+
 	foundSize, err := microserviceState.GetContentSize(cid)
 	if err != nil {
 		t.Fatalf("Failed to get content size: %v", err)
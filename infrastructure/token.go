@@ -0,0 +1,90 @@
+package infrastructure
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Access tokens grant time limited access to a single storage API path. A token
+has the form '<expiry unix seconds>.<ip bound 0|1>.<signature>' where the
+signature is an HMAC over the path, expiry and client IP if the token is bound
+to one. Tokens are passed in the AccessTokenParam query parameter or as a
+Bearer Authorization header
+*/
+
+// accessTokenPayload returns the signed portion of an access token
+func accessTokenPayload(path string, expiry int64, clientIP string) []byte {
+	return []byte(fmt.Sprintf("%s\n%d\n%s", path, expiry, clientIP))
+}
+
+// IssueAccessToken creates a token for path valid until expiry. An empty clientIP leaves the token unbound
+func IssueAccessToken(secret []byte, path string, expiry time.Time, clientIP string) string {
+	bound := "0"
+	if clientIP != "" {
+		bound = "1"
+	}
+	signature := SignPayload(secret, accessTokenPayload(path, expiry.Unix(), clientIP))
+	return fmt.Sprintf("%d.%s.%s", expiry.Unix(), bound, signature)
+}
+
+// VerifyAccessToken checks token grants a client at clientIP access to path at time now
+func VerifyAccessToken(secret []byte, path string, token string, clientIP string, now time.Time) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed access token")
+	}
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed access token expiry: %w", err)
+	}
+
+	switch parts[1] {
+	case "0":
+		clientIP = ""
+	case "1":
+	default:
+		return fmt.Errorf("malformed access token binding")
+	}
+	if !VerifyPayloadSignature(secret, accessTokenPayload(path, expiry, clientIP), parts[2]) {
+		return fmt.Errorf("invalid access token for %s", path)
+	}
+	if now.Unix() > expiry {
+		return fmt.Errorf("access token for %s expired at %s", path, time.Unix(expiry, 0))
+	}
+	return nil
+}
+
+/*
+AccessTokenIssuer hands out access tokens for storage API resources, for use
+by services like damocles or levi when matching clients to content
+*/
+type AccessTokenIssuer struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// NewAccessTokenIssuer creates an AccessTokenIssuer issuing tokens valid for ttl
+func NewAccessTokenIssuer(secret []byte, ttl time.Duration) *AccessTokenIssuer {
+	return &AccessTokenIssuer{secret: secret, ttl: ttl}
+}
+
+// Issue creates a token for path, bound to clientIP if it isn't empty
+func (i *AccessTokenIssuer) Issue(path string, clientIP string) string {
+	return IssueAccessToken(i.secret, path, time.Now().Add(i.ttl), clientIP)
+}
+
+// SignURL returns resourceURL with a token for its path added to the query
+func (i *AccessTokenIssuer) SignURL(resourceURL string, clientIP string) (string, error) {
+	parsed, err := url.Parse(resourceURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %s: %w", resourceURL, err)
+	}
+	query := parsed.Query()
+	query.Set(AccessTokenParam, i.Issue(parsed.EscapedPath(), clientIP))
+	parsed.RawQuery = query.Encode()
+	return parsed.String(), nil
+}